@@ -0,0 +1,331 @@
+// Package client is a Go client for the sixpaths-kv router's HTTP API.
+//
+// A Client numbers its writes itself, so retries of a write are recognized
+// by the cluster's dedup, and it keeps a read-your-writes token: every answer
+// carries the log index it reached on its node, the client merges those and
+// sends them along with each read, so a read never misses a write (or a
+// value) the client has already seen.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound       = errors.New("client: key not found")
+	ErrSessionExpired = errors.New("client: session expired")
+
+	errNoClientID = errors.New("client: no client ID, set Options.ClientID or call OpenSession")
+)
+
+// Error is a non-2xx answer from the router.
+type Error struct {
+	Status int
+	Msg    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("client: %d %s", e.Status, e.Msg)
+}
+
+type Options struct {
+	// ClientID names this client for dedup. If empty, the client must call
+	// OpenSession before writing.
+	ClientID string
+	// Consistency is sent with every Get ("" lets the node pick, see /get).
+	Consistency string
+	HTTPClient  *http.Client
+}
+
+type Client struct {
+	base string
+	http *http.Client
+	opts Options
+
+	mu       sync.Mutex
+	clientID string
+	seq      uint64
+	token    map[string]uint64 // node ID -> highest log index seen there
+}
+
+type WriteResult struct {
+	Success   bool   `json:"success"`
+	PrevValue string `json:"prevValue"`
+	LogIndex  uint64 `json:"logIndex"`
+	Token     string `json:"token"`
+}
+
+// New returns a client for the router at routerURL, e.g. "http://127.0.0.1:8080".
+func New(routerURL string, opts Options) *Client {
+	hc := opts.HTTPClient
+	if hc == nil {
+		hc = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Client{
+		base:     strings.TrimRight(routerURL, "/"),
+		http:     hc,
+		opts:     opts,
+		clientID: opts.ClientID,
+		token:    make(map[string]uint64),
+	}
+}
+
+// OpenSession registers a session on the cluster and uses it as the client ID
+// from now on. Sequence numbers restart with the new session.
+func (c *Client) OpenSession(ctx context.Context, ttl time.Duration) error {
+	var out struct {
+		Session string `json:"session"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/session", map[string]int64{"ttlMs": ttl.Milliseconds()}, &out); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.clientID = out.Session
+	c.seq = 0
+	c.mu.Unlock()
+	return nil
+}
+
+// KeepAlive refreshes the client's session.
+func (c *Client) KeepAlive(ctx context.Context) error {
+	c.mu.Lock()
+	sess := c.clientID
+	c.mu.Unlock()
+	return c.do(ctx, http.MethodPost, "/session/keepalive", map[string]string{"session": sess}, nil)
+}
+
+// ClientID returns the ID the client writes under.
+func (c *Client) ClientID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clientID
+}
+
+// SetSeq makes the next write use seq+1, for clients that persist their
+// sequence numbers across restarts.
+func (c *Client) SetSeq(seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq = seq
+}
+
+// Seq returns the sequence number of the last write.
+func (c *Client) Seq() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seq
+}
+
+func (c *Client) Put(ctx context.Context, key, value string) (WriteResult, error) {
+	return c.write(ctx, "/put", key, &value)
+}
+
+func (c *Client) Delete(ctx context.Context, key string) (WriteResult, error) {
+	return c.write(ctx, "/delete", key, nil)
+}
+
+func (c *Client) write(ctx context.Context, path, key string, value *string) (WriteResult, error) {
+	c.mu.Lock()
+	if c.clientID == "" {
+		c.mu.Unlock()
+		return WriteResult{}, errNoClientID
+	}
+	c.seq++
+	seq := c.seq
+	c.mu.Unlock()
+	return c.writeSeq(ctx, path, seq, key, value)
+}
+
+// PutSeq is Put with a seq the caller picked, for writers that number their
+// own writes, e.g. to send them again after a crash. Seq isn't changed.
+func (c *Client) PutSeq(ctx context.Context, seq uint64, key, value string) (WriteResult, error) {
+	return c.writeSeq(ctx, "/put", seq, key, &value)
+}
+
+func (c *Client) writeSeq(ctx context.Context, path string, seq uint64, key string, value *string) (WriteResult, error) {
+	c.mu.Lock()
+	if c.clientID == "" {
+		c.mu.Unlock()
+		return WriteResult{}, errNoClientID
+	}
+	body := map[string]any{"client": c.clientID, "seq": seq, "key": key}
+	c.mu.Unlock()
+	if value != nil {
+		body["value"] = *value
+	}
+
+	var res WriteResult
+	if err := c.do(ctx, http.MethodPost, path, body, &res); err != nil {
+		return WriteResult{}, err
+	}
+	c.observe(res.Token)
+	return res, nil
+}
+
+// PutStream uploads the value read from r to key in chunks, under the given
+// seq. Values too large for Put, or that aren't UTF-8, go this way; they can
+// only be read back as a stream.
+func (c *Client) PutStream(ctx context.Context, seq uint64, key string, r io.Reader) (WriteResult, error) {
+	c.mu.Lock()
+	id := c.clientID
+	c.mu.Unlock()
+	if id == "" {
+		return WriteResult{}, errNoClientID
+	}
+	q := url.Values{"client": {id}, "seq": {strconv.FormatUint(seq, 10)}, "key": {key}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.base+"/stream?"+q.Encode(), r)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	// an upload takes as long as it takes, ctx bounds it
+	hc := *c.http
+	hc.Timeout = 0
+	resp, err := hc.Do(req)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return WriteResult{}, respError(resp)
+	}
+	var res WriteResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return WriteResult{}, err
+	}
+	c.observe(res.Token)
+	return res, nil
+}
+
+// Get reads key, waiting until the owning node has caught up with the
+// client's token.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	q := url.Values{"key": {key}}
+	if c.opts.Consistency != "" {
+		q.Set("consistency", c.opts.Consistency)
+	}
+	c.mu.Lock()
+	if c.clientID != "" {
+		q.Set("client", c.clientID)
+	}
+	if tok := c.tokenLocked(); tok != "" {
+		q.Set("token", tok)
+	}
+	c.mu.Unlock()
+
+	var out struct {
+		Value string `json:"value"`
+		Token string `json:"token"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/get?"+q.Encode(), nil, &out); err != nil {
+		return "", err
+	}
+	c.observe(out.Token)
+	return out.Value, nil
+}
+
+// Token returns the client's read-your-writes token ("n1=12,n3=40").
+func (c *Client) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tokenLocked()
+}
+
+func (c *Client) tokenLocked() string {
+	ids := make([]string, 0, len(c.token))
+	for id := range c.token {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	parts := make([]string, 0, len(ids))
+	for _, id := range ids {
+		parts = append(parts, id+"="+strconv.FormatUint(c.token[id], 10))
+	}
+	return strings.Join(parts, ",")
+}
+
+// SetToken merges tok into the client's token, for clients that persist
+// their token across restarts.
+func (c *Client) SetToken(tok string) {
+	c.observe(tok)
+}
+
+// merges a token from an answer into the client's
+func (c *Client) observe(tok string) {
+	if tok == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, part := range strings.Split(tok, ",") {
+		id, v, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		idx, err := strconv.ParseUint(v, 10, 64)
+		if err == nil && idx > c.token[id] {
+			c.token[id] = idx
+		}
+	}
+}
+
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return respError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// turns a non-2xx answer into an error
+func respError(resp *http.Response) error {
+	var e struct {
+		Error string `json:"error"`
+	}
+	_ = json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&e)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusGone:
+		return ErrSessionExpired
+	}
+	return &Error{Status: resp.StatusCode, Msg: e.Error}
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientCarriesReadToken(t *testing.T) {
+	var lastToken string
+	var seqs []uint64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/put":
+			var body struct {
+				Seq uint64 `json:"seq"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			seqs = append(seqs, body.Seq)
+			_ = json.NewEncoder(w).Encode(map[string]any{"success": true, "logIndex": 7, "token": "n2=7"})
+		case "/get":
+			lastToken = r.URL.Query().Get("token")
+			if r.URL.Query().Get("key") == "missing" {
+				w.WriteHeader(http.StatusNotFound)
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": "not found"})
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"value": "v", "logIndex": 9, "token": "n4=9"})
+		}
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, Options{ClientID: "c1"})
+	ctx := context.Background()
+
+	if _, err := c.Put(ctx, "a", "1"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := c.Put(ctx, "b", "2"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if len(seqs) != 2 || seqs[0] != 1 || seqs[1] != 2 {
+		t.Fatalf("seqs = %v, want [1 2]", seqs)
+	}
+
+	if _, err := c.Get(ctx, "a"); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if lastToken != "n2=7" {
+		t.Fatalf("Get sent token %q, want n2=7", lastToken)
+	}
+	if c.Token() != "n2=7,n4=9" {
+		t.Fatalf("Token() = %q after a read", c.Token())
+	}
+
+	if _, err := c.Get(ctx, "missing"); err != ErrNotFound {
+		t.Fatalf("Get missing: err = %v, want ErrNotFound", err)
+	}
+}
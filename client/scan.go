@@ -0,0 +1,125 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ScanEntry is one key of a scan. Streamed values aren't returned inline,
+// only their size.
+type ScanEntry struct {
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+	Streamed bool   `json:"streamed,omitempty"`
+	Size     uint64 `json:"size"`
+}
+
+type ScanOptions struct {
+	Prefix string
+	After  string // the last key of the previous page
+	Limit  int    // 0 lets the router pick
+}
+
+type ScanPage struct {
+	Entries []ScanEntry `json:"entries"`
+	More    bool        `json:"more"` // call Scan again with After set to the last key
+	Token   string      `json:"token"`
+}
+
+// Scan returns the next page of keys in key order, across all nodes.
+func (c *Client) Scan(ctx context.Context, opts ScanOptions) (ScanPage, error) {
+	q := url.Values{}
+	if opts.Prefix != "" {
+		q.Set("prefix", opts.Prefix)
+	}
+	if opts.After != "" {
+		q.Set("after", opts.After)
+	}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if c.opts.Consistency != "" {
+		q.Set("consistency", c.opts.Consistency)
+	}
+	c.mu.Lock()
+	if c.clientID != "" {
+		q.Set("client", c.clientID)
+	}
+	if tok := c.tokenLocked(); tok != "" {
+		q.Set("token", tok)
+	}
+	c.mu.Unlock()
+
+	var page ScanPage
+	if err := c.do(ctx, http.MethodGet, "/scan?"+q.Encode(), nil, &page); err != nil {
+		return ScanPage{}, err
+	}
+	c.observe(page.Token)
+	return page, nil
+}
+
+// WatchEvent is one change to a watched key.
+type WatchEvent struct {
+	Node     string `json:"node"`
+	Index    uint64 `json:"index"`
+	Type     string `json:"type"` // "put" or "delete"
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+	Streamed bool   `json:"streamed,omitempty"`
+	Size     uint64 `json:"size,omitempty"`
+}
+
+// Watch calls fn for every change to keys starting with prefix, until ctx is
+// done (Watch then returns nil), fn returns an error, or the cluster ends
+// the watch. Changes made before the watch started aren't replayed.
+func (c *Client) Watch(ctx context.Context, prefix string, fn func(WatchEvent) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		c.base+"/watch?"+url.Values{"prefix": {prefix}}.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	// a watch runs for as long as the caller wants, the client's timeout doesn't apply
+	hc := *c.http
+	hc.Timeout = 0
+	resp, err := hc.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return respError(resp)
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64<<10), 4<<20)
+	for sc.Scan() {
+		var line struct {
+			WatchEvent
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			return err
+		}
+		if line.Error != "" {
+			return errors.New("client: " + line.Error)
+		}
+		if err := fn(line.WatchEvent); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return errors.New("client: watch ended")
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/O-Nicolinho/sixpaths_kv/client"
+	"github.com/O-Nicolinho/sixpaths_kv/internal/sixpaths_kvs"
+)
+
+// kvbench/main.go is a load generator for the router or a single node.
+// every worker is a client of its own (so its seqs never clash with another's)
+// that sends one request at a time, reads or writes picked by -read-ratio,
+// keys picked by -dist. latencies are kept per worker and merged at the end
+// for exact percentiles. -json writes the config and results, and -baseline
+// compares a run with one written earlier, e.g. by the previous build.
+
+type config struct {
+	Target      string        `json:"target"`
+	Dist        string        `json:"dist"`
+	Keys        int           `json:"keys"`
+	ZipfS       float64       `json:"zipfS,omitempty"`
+	ValueSize   int           `json:"valueSize"`
+	ValueMax    int           `json:"valueMax,omitempty"`
+	ReadRatio   float64       `json:"readRatio"`
+	Concurrency int           `json:"concurrency"`
+	Duration    time.Duration `json:"duration"`
+	Warmup      time.Duration `json:"warmup"`
+	Consistency string        `json:"consistency,omitempty"`
+}
+
+type opStats struct {
+	Count     int64   `json:"count"`
+	Errors    int64   `json:"errors"`
+	Misses    int64   `json:"misses,omitempty"` // reads of keys that weren't there
+	OpsPerSec float64 `json:"opsPerSec"`
+	MeanMs    float64 `json:"meanMs"`
+	P50Ms     float64 `json:"p50Ms"`
+	P90Ms     float64 `json:"p90Ms"`
+	P99Ms     float64 `json:"p99Ms"`
+	P999Ms    float64 `json:"p999Ms"`
+	MaxMs     float64 `json:"maxMs"`
+}
+
+type result struct {
+	Label     string    `json:"label,omitempty"`
+	Started   time.Time `json:"started"`
+	GoVersion string    `json:"goVersion"`
+	Config    config    `json:"config"`
+	Elapsed   float64   `json:"elapsedSec"`
+	Total     opStats   `json:"total"`
+	Read      opStats   `json:"read"`
+	Write     opStats   `json:"write"`
+}
+
+// what one worker measured
+type samples struct {
+	reads, writes             []time.Duration
+	readErrs, writeErrs, miss int64
+}
+
+func main() {
+	addr := flag.String("addr", "http://127.0.0.1:8080", "router URL")
+	node := flag.String("node", "", "drive this node (n1..n6) directly instead of the router")
+	host := flag.String("host", "127.0.0.1", "host of the nodes, with -node")
+	dist := flag.String("dist", "uniform", "key distribution: uniform, zipfian or sequential")
+	keys := flag.Int("keys", 10000, "number of distinct keys")
+	zipfS := flag.Float64("zipf-s", 1.1, "skew of the zipfian distribution, > 1")
+	valueSize := flag.Int("value-size", 128, "bytes per value written")
+	valueMax := flag.Int("value-max", 0, "if set, value sizes are uniform in [value-size, value-max]")
+	readRatio := flag.Float64("read-ratio", 0.9, "fraction of requests that are reads")
+	concurrency := flag.Int("concurrency", 16, "requests in flight at once")
+	duration := flag.Duration("duration", 10*time.Second, "how long to measure")
+	warmup := flag.Duration("warmup", 2*time.Second, "load run before measuring, not counted")
+	preload := flag.Bool("preload", true, "write every key once before the run, so reads find them")
+	consistency := flag.String("consistency", "", "read consistency: linearizable, sequential or stale")
+	timeout := flag.Duration("timeout", 5*time.Second, "timeout of each request")
+	label := flag.String("label", "", "name of this run in the results, e.g. the build")
+	jsonOut := flag.String("json", "", "write the results as JSON to this file (\"-\" for stdout)")
+	baseline := flag.String("baseline", "", "compare with the JSON results of an earlier run")
+	quiet := flag.Bool("quiet", false, "don't print progress while running")
+	flag.Parse()
+
+	cfg := config{
+		Target: strings.TrimRight(*addr, "/"), Dist: *dist, Keys: *keys, ValueSize: *valueSize, ValueMax: *valueMax,
+		ReadRatio: *readRatio, Concurrency: *concurrency, Duration: *duration, Warmup: *warmup, Consistency: *consistency,
+	}
+	if *dist == "zipfian" {
+		cfg.ZipfS = *zipfS
+	}
+	if *node != "" {
+		nc, _, err := sixpaths_kvs.ConfigForID(*node)
+		if err != nil {
+			fail(err)
+		}
+		cfg.Target = "http://" + *host + nc.ClientAddr
+	}
+	if err := cfg.validate(); err != nil {
+		fail(err)
+	}
+	if *consistency != "" {
+		if _, err := sixpaths_kvs.ParseReadConsistency(*consistency); err != nil {
+			fail(err)
+		}
+	}
+
+	hc := &http.Client{
+		Timeout:   *timeout,
+		Transport: &http.Transport{MaxIdleConns: cfg.Concurrency * 2, MaxIdleConnsPerHost: cfg.Concurrency * 2},
+	}
+	var run [8]byte
+	_, _ = rand.Read(run[:])
+	runID := hex.EncodeToString(run[:])
+	clients := make([]*client.Client, cfg.Concurrency)
+	for i := range clients {
+		clients[i] = client.New(cfg.Target, client.Options{
+			ClientID:    fmt.Sprintf("bench-%s-%d", runID, i),
+			Consistency: cfg.Consistency,
+			HTTPClient:  hc,
+		})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if *preload && cfg.ReadRatio > 0 {
+		if err := preloadKeys(ctx, clients, cfg); err != nil {
+			fail(err)
+		}
+	}
+
+	res := runBench(ctx, clients, cfg, *quiet)
+	res.Label = *label
+
+	if *jsonOut != "" {
+		if err := writeJSON(*jsonOut, res); err != nil {
+			fail(err)
+		}
+	}
+	if *jsonOut != "-" {
+		printResult(res)
+	}
+	if *baseline != "" {
+		base, err := readResult(*baseline)
+		if err != nil {
+			fail(err)
+		}
+		printComparison(base, res)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "kvbench:", err)
+	os.Exit(1)
+}
+
+func (c config) validate() error {
+	switch {
+	case c.Dist != "uniform" && c.Dist != "zipfian" && c.Dist != "sequential":
+		return fmt.Errorf("error: unknown distribution %q, want uniform, zipfian or sequential", c.Dist)
+	case c.Dist == "zipfian" && c.ZipfS <= 1:
+		return errors.New("error: -zipf-s must be > 1")
+	case c.Keys < 1:
+		return errors.New("error: -keys must be at least 1")
+	case c.ValueSize < 0 || (c.ValueMax != 0 && c.ValueMax < c.ValueSize):
+		return errors.New("error: bad value sizes, want 0 <= -value-size <= -value-max")
+	case c.ReadRatio < 0 || c.ReadRatio > 1:
+		return errors.New("error: -read-ratio must be in [0, 1]")
+	case c.Concurrency < 1:
+		return errors.New("error: -concurrency must be at least 1")
+	case c.Duration <= 0:
+		return errors.New("error: -duration must be positive")
+	}
+	return nil
+}
+
+func keyName(i int) string {
+	return fmt.Sprintf("bench/%08d", i)
+}
+
+// picks keys for one worker
+type keyGen struct {
+	dist string
+	keys int
+	rnd  *mrand.Rand
+	zipf *mrand.Zipf
+	seq  *atomic.Uint64 // shared by all workers, so sequential means sequential overall
+}
+
+func newKeyGen(cfg config, seed int64, seq *atomic.Uint64) *keyGen {
+	g := &keyGen{dist: cfg.Dist, keys: cfg.Keys, rnd: mrand.New(mrand.NewSource(seed)), seq: seq}
+	if cfg.Dist == "zipfian" {
+		// rank 0 is the hottest key; key names hash to nodes, so the hot keys
+		// still land on different shards
+		g.zipf = mrand.NewZipf(g.rnd, cfg.ZipfS, 1, uint64(cfg.Keys-1))
+	}
+	return g
+}
+
+func (g *keyGen) next() string {
+	switch g.dist {
+	case "zipfian":
+		return keyName(int(g.zipf.Uint64()))
+	case "sequential":
+		return keyName(int((g.seq.Add(1) - 1) % uint64(g.keys)))
+	}
+	return keyName(g.rnd.Intn(g.keys))
+}
+
+// a value of the configured size, its bytes don't matter
+func makeValue(cfg config, rnd *mrand.Rand, buf []byte) string {
+	n := cfg.ValueSize
+	if cfg.ValueMax > cfg.ValueSize {
+		n += rnd.Intn(cfg.ValueMax - cfg.ValueSize + 1)
+	}
+	return string(buf[:n])
+}
+
+func valueBuf(cfg config) []byte {
+	buf := make([]byte, max(cfg.ValueSize, cfg.ValueMax))
+	for i := range buf {
+		buf[i] = 'a' + byte(i%26)
+	}
+	return buf
+}
+
+// writes every key once, spread over the workers
+func preloadKeys(ctx context.Context, clients []*client.Client, cfg config) error {
+	fmt.Fprintf(os.Stderr, "preloading %d keys...\n", cfg.Keys)
+	buf := valueBuf(cfg)
+	var next atomic.Int64
+	errs := make([]error, len(clients))
+	var wg sync.WaitGroup
+	for w, c := range clients {
+		wg.Add(1)
+		go func(w int, c *client.Client) {
+			defer wg.Done()
+			rnd := mrand.New(mrand.NewSource(int64(w)))
+			for {
+				i := next.Add(1) - 1
+				if i >= int64(cfg.Keys) || ctx.Err() != nil {
+					return
+				}
+				if _, err := c.Put(ctx, keyName(int(i)), makeValue(cfg, rnd, buf)); err != nil {
+					errs[w] = fmt.Errorf("error: preloading %s: %w", keyName(int(i)), err)
+					return
+				}
+			}
+		}(w, c)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+func runBench(ctx context.Context, clients []*client.Client, cfg config, quiet bool) result {
+	res := result{Started: time.Now().UTC(), GoVersion: runtime.Version(), Config: cfg}
+
+	var measuring atomic.Bool
+	var done atomic.Int64 // requests finished while measuring, for progress
+	var seq atomic.Uint64
+	buf := valueBuf(cfg)
+	all := make([]samples, len(clients))
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	for w, c := range clients {
+		wg.Add(1)
+		go func(w int, c *client.Client) {
+			defer wg.Done()
+			g := newKeyGen(cfg, time.Now().UnixNano()+int64(w), &seq)
+			s := &all[w]
+			for runCtx.Err() == nil {
+				key := g.next()
+				read := g.rnd.Float64() < cfg.ReadRatio
+				t0 := time.Now()
+				var err error
+				if read {
+					_, err = c.Get(runCtx, key)
+				} else {
+					_, err = c.Put(runCtx, key, makeValue(cfg, g.rnd, buf))
+				}
+				dur := time.Since(t0)
+				// the request cut off by the end of the run doesn't count
+				if !measuring.Load() || runCtx.Err() != nil {
+					continue
+				}
+				done.Add(1)
+				switch {
+				case read && errors.Is(err, client.ErrNotFound):
+					s.miss++
+					s.reads = append(s.reads, dur)
+				case read && err != nil:
+					s.readErrs++
+				case read:
+					s.reads = append(s.reads, dur)
+				case err != nil:
+					s.writeErrs++
+				default:
+					s.writes = append(s.writes, dur)
+				}
+			}
+		}(w, c)
+	}
+
+	if cfg.Warmup > 0 {
+		fmt.Fprintf(os.Stderr, "warming up for %s...\n", cfg.Warmup)
+		select {
+		case <-time.After(cfg.Warmup):
+		case <-ctx.Done():
+		}
+	}
+	measuring.Store(true)
+	start := time.Now()
+
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	end := time.After(cfg.Duration)
+	last := int64(0)
+loop:
+	for {
+		select {
+		case <-tick.C:
+			if !quiet {
+				cur := done.Load()
+				fmt.Fprintf(os.Stderr, "%5.0fs  %8d ops/s\n", time.Since(start).Seconds(), cur-last)
+				last = cur
+			}
+		case <-end:
+			break loop
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	elapsed := time.Since(start)
+	cancel()
+	wg.Wait()
+
+	var reads, writes []time.Duration
+	var readErrs, writeErrs, misses int64
+	for _, s := range all {
+		reads = append(reads, s.reads...)
+		writes = append(writes, s.writes...)
+		readErrs += s.readErrs
+		writeErrs += s.writeErrs
+		misses += s.miss
+	}
+	res.Elapsed = elapsed.Seconds()
+	res.Read = summarize(reads, readErrs, elapsed)
+	res.Read.Misses = misses
+	res.Write = summarize(writes, writeErrs, elapsed)
+	res.Total = summarize(append(reads, writes...), readErrs+writeErrs, elapsed)
+	res.Total.Misses = misses
+	return res
+}
+
+// sorts lats in place
+func summarize(lats []time.Duration, errs int64, elapsed time.Duration) opStats {
+	st := opStats{Count: int64(len(lats)), Errors: errs}
+	if len(lats) == 0 {
+		return st
+	}
+	sort.Slice(lats, func(i, j int) bool { return lats[i] < lats[j] })
+	var sum time.Duration
+	for _, l := range lats {
+		sum += l
+	}
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	pct := func(p float64) float64 {
+		i := int(p * float64(len(lats)))
+		return ms(lats[min(i, len(lats)-1)])
+	}
+	st.OpsPerSec = float64(len(lats)) / elapsed.Seconds()
+	st.MeanMs = ms(sum / time.Duration(len(lats)))
+	st.P50Ms, st.P90Ms, st.P99Ms, st.P999Ms = pct(0.50), pct(0.90), pct(0.99), pct(0.999)
+	st.MaxMs = ms(lats[len(lats)-1])
+	return st
+}
+
+func printResult(res result) {
+	c := res.Config
+	fmt.Printf("target %s, %s keys (%d), %d%% reads, values %d", c.Target, c.Dist, c.Keys, int(c.ReadRatio*100+0.5), c.ValueSize)
+	if c.ValueMax > 0 {
+		fmt.Printf("-%d", c.ValueMax)
+	}
+	fmt.Printf(" bytes, %d workers, %.1fs\n\n", c.Concurrency, res.Elapsed)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "OP\tCOUNT\tERRORS\tOPS/S\tMEAN ms\tP50 ms\tP90 ms\tP99 ms\tP99.9 ms\tMAX ms\t")
+	for _, row := range []struct {
+		name string
+		st   opStats
+	}{{"read", res.Read}, {"write", res.Write}, {"total", res.Total}} {
+		st := row.st
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.0f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t\n",
+			row.name, st.Count, st.Errors, st.OpsPerSec, st.MeanMs, st.P50Ms, st.P90Ms, st.P99Ms, st.P999Ms, st.MaxMs)
+	}
+	_ = tw.Flush()
+	if res.Read.Misses > 0 {
+		fmt.Printf("\n%d reads found no value (counted in read latency, not as errors)\n", res.Read.Misses)
+	}
+}
+
+// prints how res differs from base, in percent
+func printComparison(base, res result) {
+	name := func(r result) string {
+		if r.Label != "" {
+			return r.Label
+		}
+		return r.Started.Format(time.RFC3339)
+	}
+	fmt.Printf("\ncompared with %s:\n", name(base))
+	if base.Config != res.Config {
+		fmt.Println("  (the runs were configured differently, see the JSON)")
+	}
+	delta := func(old, cur float64) string {
+		if old == 0 {
+			return "n/a"
+		}
+		return fmt.Sprintf("%+.1f%%", (cur-old)/old*100)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "OP\tOPS/S\tP50\tP99\tP99.9\t")
+	for _, row := range []struct {
+		name     string
+		old, cur opStats
+	}{{"read", base.Read, res.Read}, {"write", base.Write, res.Write}, {"total", base.Total, res.Total}} {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t\n", row.name, delta(row.old.OpsPerSec, row.cur.OpsPerSec),
+			delta(row.old.P50Ms, row.cur.P50Ms), delta(row.old.P99Ms, row.cur.P99Ms), delta(row.old.P999Ms, row.cur.P999Ms))
+	}
+	_ = tw.Flush()
+}
+
+func writeJSON(path string, res result) error {
+	b, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
+
+func readResult(path string) (result, error) {
+	var res result
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return res, err
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return res, fmt.Errorf("error: %s isn't kvbench JSON: %w", path, err)
+	}
+	return res, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/O-Nicolinho/sixpaths_kv/internal/sixpaths_kvs"
+)
+
+// backup.go has kvctl's backup and restore commands. a backup is taken from
+// one node over HTTP (GET /admin/backup), restore works on local files only
+// and builds a data dir for a node that isn't running, see backup.go in
+// sixpaths_kvs for what a backup holds.
+
+// backup DEST: DEST is a directory, a .tar file, or "-" for a tar on stdout
+func (k *ctl) backup(ctx context.Context, dest string) error {
+	if k.node == "" {
+		return errors.New("error: backup is taken from one node, pick it with -node")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.base+"/admin/backup", nil)
+	if err != nil {
+		return err
+	}
+	// the archive can take much longer than -timeout to come through
+	hc := *k.http
+	hc.Timeout = 0
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return fmt.Errorf("error: backup of %s failed: %s %s", k.node, resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	var info *sixpaths_kvs.BackupInfo
+	switch {
+	case dest == "-":
+		_, err = io.Copy(os.Stdout, resp.Body)
+		return err
+	case strings.HasSuffix(dest, ".tar"):
+		// we unpack a copy to check the archive is whole before keeping it
+		tmp, err := os.MkdirTemp("", "kvctl-backup-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		part := dest + ".part"
+		f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(part)
+		info, err = sixpaths_kvs.ExtractBackupTar(io.TeeReader(resp.Body, f), filepath.Join(tmp, "backup"))
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(part, dest); err != nil {
+			return err
+		}
+	default:
+		if info, err = sixpaths_kvs.ExtractBackupTar(resp.Body, dest); err != nil {
+			return err
+		}
+	}
+
+	if k.output == "json" {
+		k.printJSON(info)
+		return nil
+	}
+	k.table("NODE\tENGINE\tINDEXES\tSNAPSHOT\tRECORDS\tDEST", [][]string{{
+		info.Node, info.Engine, fmt.Sprintf("%d..%d", info.BaseIndex, info.LastIndex),
+		fmt.Sprint(info.Entries), fmt.Sprint(info.Records), dest,
+	}})
+	return nil
+}
+
+// restore [-to-index N] BACKUP DATADIR
+func (k *ctl) restore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	toIndex := fs.Uint64("to-index", 0, "restore up to and including this log index, 0 for all of the backup")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("usage: kvctl restore [-to-index N] BACKUP DATADIR")
+	}
+	src, dataDir := fs.Arg(0), fs.Arg(1)
+
+	if strings.HasSuffix(src, ".tar") {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		tmp, err := os.MkdirTemp("", "kvctl-restore-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		src = filepath.Join(tmp, "backup")
+		if _, err := sixpaths_kvs.ExtractBackupTar(f, src); err != nil {
+			return err
+		}
+	}
+
+	info, err := sixpaths_kvs.RestoreBackup(src, dataDir, sixpaths_kvs.RestoreOptions{ToIndex: *toIndex})
+	if err != nil {
+		return err
+	}
+	if k.output == "json" {
+		k.printJSON(info)
+		return nil
+	}
+	fmt.Fprintf(k.out, "restored %s (engine %s) into %s at index %d\n", info.Node, info.Engine, dataDir, info.LastIndex)
+	if info.Engine != sixpaths_kvs.DefaultEngine {
+		fmt.Fprintf(k.out, "start the node with -engine %s\n", info.Engine)
+	}
+	return nil
+}
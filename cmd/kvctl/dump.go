@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/O-Nicolinho/sixpaths_kv/client"
+	"github.com/O-Nicolinho/sixpaths_kv/internal/sixpaths_kvs"
+)
+
+// dump.go has kvctl's export and import commands, see dump.go in
+// sixpaths_kvs for the dump format.
+// an import writes under a client ID of its own, and entry i of the dump
+// always goes out with seq i+1. progress is saved after every batch, so an
+// import that was cut off picks up at the batch it was in, and the writes of
+// that batch that already made it are recognized by the nodes' dedup rather
+// than applied twice.
+
+// a batch must fit in the nodes' dedup window (64 results per client), or a
+// resent write could fall out of it
+const maxImportBatch = 64
+
+type exportSummary struct {
+	Dest     string                    `json:"dest"`
+	Format   string                    `json:"format"`
+	Entries  int64                     `json:"entries"`
+	Sections []sixpaths_kvs.DumpHeader `json:"sections"`
+}
+
+// export [-format jsonl|binary] [-prefix P] FILE
+func (k *ctl) export(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", sixpaths_kvs.DumpJSONL, "dump format: jsonl or binary")
+	prefix := fs.String("prefix", "", "only export keys starting with this")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: kvctl export [-format jsonl|binary] [-prefix P] FILE")
+	}
+	if _, err := sixpaths_kvs.ParseDumpFormat(*format); err != nil {
+		return err
+	}
+	dest := fs.Arg(0)
+
+	q := url.Values{"format": {*format}, "prefix": {*prefix}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.base+"/export?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	hc := *k.http
+	hc.Timeout = 0
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return fmt.Errorf("error: export failed: %s %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	// we read the dump back as it's written, to only keep one that's whole
+	var out io.Writer = os.Stdout
+	part := dest + ".part"
+	if dest != "-" {
+		f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(part)
+		defer f.Close()
+		out = f
+	}
+	sum := exportSummary{Dest: dest, Format: *format}
+	dr, err := sixpaths_kvs.NewDumpReader(io.TeeReader(resp.Body, out))
+	if err != nil {
+		return err
+	}
+	for {
+		_, err := dr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error: export was cut off after %d entries: %w", sum.Entries, err)
+		}
+		if h := dr.Header(); len(sum.Sections) == 0 || sum.Sections[len(sum.Sections)-1] != h {
+			sum.Sections = append(sum.Sections, h)
+		}
+		sum.Entries++
+	}
+	if dest != "-" {
+		f := out.(*os.File)
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		if err := os.Rename(part, dest); err != nil {
+			return err
+		}
+	}
+
+	if dest == "-" {
+		// stdout has the dump
+		return nil
+	}
+	if k.output == "json" {
+		k.printJSON(sum)
+		return nil
+	}
+	fmt.Fprintf(k.out, "exported %d entries to %s (%s)\n", sum.Entries, dest, sum.Format)
+	for _, h := range sum.Sections {
+		fmt.Fprintf(k.out, "  %s at index %d\n", h.Node, h.LogIndex)
+	}
+	return nil
+}
+
+// how far an import got, kept next to the dump
+type importProgress struct {
+	Dump     string `json:"dump"`
+	Size     int64  `json:"size"` // of the dump, to notice if it's not the same file anymore
+	ClientID string `json:"clientId"`
+	Done     int64  `json:"done"` // entries 0..Done-1 are written
+	Complete bool   `json:"complete,omitempty"`
+}
+
+// import [-batch N] [-progress FILE] DUMP
+func (k *ctl) importDump(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	batch := fs.Int("batch", 32, fmt.Sprintf("writes in flight at once, at most %d", maxImportBatch))
+	progressPath := fs.String("progress", "", "file that keeps the import's progress (default DUMP.progress)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: kvctl import [-batch N] [-progress FILE] DUMP")
+	}
+	if *batch < 1 || *batch > maxImportBatch {
+		return fmt.Errorf("error: -batch must be 1..%d", maxImportBatch)
+	}
+	path := fs.Arg(0)
+	if *progressPath == "" {
+		*progressPath = path + ".progress"
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	prog, err := loadImportProgress(*progressPath, path, st.Size())
+	if err != nil {
+		return err
+	}
+	if prog.Complete {
+		fmt.Fprintf(k.out, "%s was imported already (%d entries), remove %s to import it again\n", path, prog.Done, *progressPath)
+		return nil
+	}
+	if err := saveImportProgress(*progressPath, prog); err != nil {
+		return err
+	}
+
+	c := client.New(k.base, client.Options{ClientID: prog.ClientID, HTTPClient: k.http})
+	dr, err := sixpaths_kvs.NewDumpReader(f)
+	if err != nil {
+		return err
+	}
+
+	// we skip what an earlier run already wrote
+	var i int64
+	for ; i < prog.Done; i++ {
+		if _, err := dr.Next(); err != nil {
+			return fmt.Errorf("error: the dump has fewer entries than %s says were imported: %w", *progressPath, err)
+		}
+	}
+	resumed := prog.Done
+
+	for {
+		var entries []sixpaths_kvs.DumpEntry
+		var rerr error
+		for len(entries) < *batch {
+			e, err := dr.Next()
+			if err != nil {
+				rerr = err
+				break
+			}
+			entries = append(entries, e)
+		}
+		if err := importBatch(ctx, c, prog.Done, entries); err != nil {
+			return fmt.Errorf("error: import stopped after %d entries, run it again to resume: %w", prog.Done, err)
+		}
+		prog.Done += int64(len(entries))
+		if rerr == io.EOF {
+			prog.Complete = true
+		}
+		if err := saveImportProgress(*progressPath, prog); err != nil {
+			return err
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return fmt.Errorf("error: import stopped after %d entries: %w", prog.Done, rerr)
+		}
+	}
+
+	if k.output == "json" {
+		k.printJSON(prog)
+		return nil
+	}
+	fmt.Fprintf(k.out, "imported %d entries from %s as client %s", prog.Done, path, prog.ClientID)
+	if resumed > 0 {
+		fmt.Fprintf(k.out, " (resumed at entry %d)", resumed)
+	}
+	fmt.Fprintln(k.out)
+	return nil
+}
+
+// writes entries at once, the first one is entry first of the dump
+func importBatch(ctx context.Context, c *client.Client, first int64, entries []sixpaths_kvs.DumpEntry) error {
+	errs := make([]error, len(entries))
+	var wg sync.WaitGroup
+	for j, e := range entries {
+		wg.Add(1)
+		go func(j int, e sixpaths_kvs.DumpEntry) {
+			defer wg.Done()
+			seq := uint64(first) + uint64(j) + 1
+			// JSON can't carry a value that isn't UTF-8, so those are streamed too
+			if e.Streamed || !utf8.Valid(e.Value) {
+				_, errs[j] = c.PutStream(ctx, seq, e.Key, bytes.NewReader(e.Value))
+			} else {
+				_, errs[j] = c.PutSeq(ctx, seq, e.Key, string(e.Value))
+			}
+			if errs[j] != nil {
+				errs[j] = fmt.Errorf("key %q: %w", e.Key, errs[j])
+			}
+		}(j, e)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func loadImportProgress(path, dump string, size int64) (*importProgress, error) {
+	abs, err := filepath.Abs(dump)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		var id [8]byte
+		_, _ = rand.Read(id[:])
+		return &importProgress{Dump: abs, Size: size, ClientID: "import-" + hex.EncodeToString(id[:])}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p importProgress
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("error: progress file %s is corrupt: %w", path, err)
+	}
+	if p.Size != size {
+		return nil, fmt.Errorf("error: %s is for a dump of %d bytes, %s has %d; remove it to start over", path, p.Size, dump, size)
+	}
+	return &p, nil
+}
+
+// written in one step, like the state file
+func saveImportProgress(path string, p *importProgress) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/O-Nicolinho/sixpaths_kv/client"
+	"github.com/O-Nicolinho/sixpaths_kv/internal/sixpaths_kvs"
+)
+
+// kvctl/main.go is a command-line client for the cluster.
+// it talks to the router, or with -node to one node directly, and keeps its
+// client ID, last seq and read token in a state file (see state.go), so
+// writes are numbered for dedup without anyone having to pick a seq by hand.
+
+const usage = `usage: kvctl [flags] <command> [args]
+
+commands:
+  get KEY                 print the value of KEY
+  put KEY VALUE           set KEY to VALUE ("-" reads the value from stdin)
+  delete KEY              delete KEY
+  scan [-prefix P] [-after K] [-limit N] [-all]
+                          list keys in order
+  watch [-prefix P]       print changes to keys as they happen, until interrupted
+  batch FILE              run the JSON lines in FILE ("-" for stdin) in order, e.g.
+                            {"op": "put", "key": "a", "value": "1"}
+                            {"op": "delete", "key": "b"}
+                            {"op": "get", "key": "a"}
+  cluster status          show every node's health and counters
+  backup DEST             back a node (-node) up into the directory DEST, or a
+                          DEST ending in .tar, or "-" for a tar on stdout
+  restore [-to-index N] BACKUP DATADIR
+                          build a node's data dir from a backup (a directory or
+                          .tar), up to log index N; the node must not be running
+  export [-format jsonl|binary] [-prefix P] FILE
+                          dump the cluster's keys (or one node's, with -node)
+                          to FILE ("-" for stdout)
+  import [-batch N] [-progress FILE] DUMP
+                          write every key of a dump, run it again to resume
+
+flags:
+`
+
+type ctl struct {
+	base   string // router or node URL
+	node   string // the node's ID, "" when talking to the router
+	output string // "table" or "json"
+	http   *http.Client
+	c      *client.Client
+	st     *state
+	out    io.Writer
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	addr := flag.String("addr", "http://127.0.0.1:8080", "router URL")
+	node := flag.String("node", "", "talk to this node (n1..n6) directly instead of the router")
+	host := flag.String("host", "127.0.0.1", "host of the nodes, with -node")
+	statePath := flag.String("state", defaultStatePath(), "file that keeps the client ID, seq and read token")
+	clientID := flag.String("client", "", "write under this client ID instead of the one in the state file")
+	output := flag.String("o", "table", "output format: table or json")
+	consistency := flag.String("consistency", "", "read consistency: linearizable, sequential or stale")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout of each request")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *output != "table" && *output != "json" {
+		fail(fmt.Errorf("error: unknown output format %q, want table or json", *output))
+	}
+	if *consistency != "" {
+		if _, err := sixpaths_kvs.ParseReadConsistency(*consistency); err != nil {
+			fail(err)
+		}
+	}
+
+	k := &ctl{
+		base:   strings.TrimRight(*addr, "/"),
+		output: *output,
+		http:   &http.Client{Timeout: *timeout},
+		out:    os.Stdout,
+	}
+	if *node != "" {
+		cfg, _, err := sixpaths_kvs.ConfigForID(*node)
+		if err != nil {
+			fail(err)
+		}
+		k.node = cfg.ID
+		k.base = "http://" + *host + cfg.ClientAddr
+	}
+
+	// these never write through the client, so they don't hold the state lock
+	cmd := args[0]
+	readOnly := cmd == "watch" || cmd == "cluster" || cmd == "backup" || cmd == "restore" ||
+		cmd == "export" || cmd == "import"
+	st, err := loadState(*statePath, !readOnly)
+	if err != nil {
+		fail(err)
+	}
+	id := st.ClientID
+	if *clientID != "" {
+		id = *clientID
+	}
+	k.st = st
+	k.c = client.New(k.base, client.Options{ClientID: id, Consistency: *consistency, HTTPClient: k.http})
+	k.c.SetSeq(st.Seqs[id])
+	k.c.SetToken(st.Token)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	err = k.run(ctx, cmd, args[1:])
+	stop()
+
+	if !readOnly {
+		st.Token = k.c.Token()
+		if serr := st.save(); serr != nil && err == nil {
+			err = serr
+		}
+		st.release()
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "kvctl:", err)
+	os.Exit(1)
+}
+
+func (k *ctl) run(ctx context.Context, cmd string, args []string) error {
+	switch cmd {
+	case "get":
+		if len(args) != 1 {
+			return errors.New("usage: kvctl get KEY")
+		}
+		return k.get(ctx, args[0])
+	case "put":
+		if len(args) != 2 {
+			return errors.New("usage: kvctl put KEY VALUE")
+		}
+		value := args[1]
+		if value == "-" {
+			b, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return err
+			}
+			value = string(b)
+		}
+		return k.write(ctx, "put", args[0], value)
+	case "delete":
+		if len(args) != 1 {
+			return errors.New("usage: kvctl delete KEY")
+		}
+		return k.write(ctx, "delete", args[0], "")
+	case "scan":
+		return k.scan(ctx, args)
+	case "watch":
+		return k.watch(ctx, args)
+	case "batch":
+		if len(args) != 1 {
+			return errors.New("usage: kvctl batch FILE")
+		}
+		return k.batch(ctx, args[0])
+	case "cluster":
+		if len(args) != 1 || args[0] != "status" {
+			return errors.New("usage: kvctl cluster status")
+		}
+		return k.clusterStatus(ctx)
+	case "backup":
+		if len(args) != 1 {
+			return errors.New("usage: kvctl -node N backup DEST")
+		}
+		return k.backup(ctx, args[0])
+	case "restore":
+		return k.restore(args)
+	case "export":
+		return k.export(ctx, args)
+	case "import":
+		return k.importDump(ctx, args)
+	default:
+		return fmt.Errorf("error: unknown command %q, see kvctl -h", cmd)
+	}
+}
+
+// ===== output =====
+
+func (k *ctl) printJSON(v any) {
+	enc := json.NewEncoder(k.out)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func (k *ctl) table(header string, rows [][]string) {
+	tw := tabwriter.NewWriter(k.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, header)
+	for _, r := range rows {
+		fmt.Fprintln(tw, strings.Join(r, "\t"))
+	}
+	_ = tw.Flush()
+}
+
+type getResult struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type writeResult struct {
+	Op  string `json:"op"`
+	Key string `json:"key"`
+	client.WriteResult
+}
+
+// ===== commands =====
+
+func (k *ctl) get(ctx context.Context, key string) error {
+	v, err := k.c.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if k.output == "json" {
+		k.printJSON(getResult{Key: key, Value: v})
+		return nil
+	}
+	fmt.Fprintln(k.out, v)
+	return nil
+}
+
+func (k *ctl) write(ctx context.Context, op, key, value string) error {
+	res, err := k.doWrite(ctx, op, key, value)
+	if err != nil {
+		return err
+	}
+	if k.output == "json" {
+		k.printJSON(res)
+		return nil
+	}
+	k.table("OP\tKEY\tSUCCESS\tINDEX\tPREV", [][]string{writeRow(res)})
+	return nil
+}
+
+// sends one write, the seq it uses is saved before it goes out
+func (k *ctl) doWrite(ctx context.Context, op, key, value string) (writeResult, error) {
+	k.st.Seqs[k.c.ClientID()] = k.c.Seq() + 1
+	if err := k.st.save(); err != nil {
+		return writeResult{}, err
+	}
+	var res client.WriteResult
+	var err error
+	switch op {
+	case "put":
+		res, err = k.c.Put(ctx, key, value)
+	case "delete":
+		res, err = k.c.Delete(ctx, key)
+	default:
+		return writeResult{}, fmt.Errorf("error: unknown op %q", op)
+	}
+	return writeResult{Op: op, Key: key, WriteResult: res}, err
+}
+
+func writeRow(res writeResult) []string {
+	return []string{res.Op, res.Key, fmt.Sprint(res.Success), fmt.Sprint(res.LogIndex), res.PrevValue}
+}
+
+func (k *ctl) scan(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "only keys starting with this")
+	after := fs.String("after", "", "only keys after this one")
+	limit := fs.Int("limit", 0, "keys per page (default: the server's)")
+	all := fs.Bool("all", false, "keep fetching pages until the last key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	opts := client.ScanOptions{Prefix: *prefix, After: *after, Limit: *limit}
+	var entries []client.ScanEntry
+	more := false
+	for {
+		page, err := k.c.Scan(ctx, opts)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, page.Entries...)
+		more = page.More
+		if !*all || !more || len(page.Entries) == 0 {
+			break
+		}
+		opts.After = page.Entries[len(page.Entries)-1].Key
+	}
+
+	if k.output == "json" {
+		if entries == nil {
+			entries = []client.ScanEntry{}
+		}
+		k.printJSON(map[string]any{"entries": entries, "more": more})
+		return nil
+	}
+	rows := make([][]string, 0, len(entries))
+	for _, e := range entries {
+		v := e.Value
+		if e.Streamed {
+			v = "(streamed)"
+		}
+		rows = append(rows, []string{e.Key, fmt.Sprint(e.Size), v})
+	}
+	k.table("KEY\tSIZE\tVALUE", rows)
+	if more {
+		fmt.Fprintf(k.out, "(more keys after %q, use -after or -all)\n", entries[len(entries)-1].Key)
+	}
+	return nil
+}
+
+func (k *ctl) watch(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "only keys starting with this")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(k.out)
+	if k.output == "table" {
+		fmt.Fprintf(k.out, "%-4s %-8s %-6s %-24s %s\n", "NODE", "INDEX", "TYPE", "KEY", "VALUE")
+	}
+	return k.c.Watch(ctx, *prefix, func(ev client.WatchEvent) error {
+		if k.output == "json" {
+			return enc.Encode(ev)
+		}
+		v := ev.Value
+		if ev.Streamed {
+			v = fmt.Sprintf("(streamed, %d bytes)", ev.Size)
+		}
+		_, err := fmt.Fprintf(k.out, "%-4s %-8d %-6s %-24s %s\n", ev.Node, ev.Index, ev.Type, ev.Key, v)
+		return err
+	})
+}
+
+type batchOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// runs the ops in file one after the other and stops at the first failure,
+// later writes may depend on the ones before them
+func (k *ctl) batch(ctx context.Context, file string) error {
+	in := os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var results []any
+	var rows [][]string
+	sc := bufio.NewScanner(in)
+	sc.Buffer(make([]byte, 64<<10), 4<<20)
+	line := 0
+	var err error
+	for sc.Scan() {
+		line++
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var op batchOp
+		if err = json.Unmarshal(sc.Bytes(), &op); err != nil {
+			err = fmt.Errorf("error: line %d: %w", line, err)
+			break
+		}
+		if op.Key == "" {
+			err = fmt.Errorf("error: line %d: missing key", line)
+			break
+		}
+		if op.Op == "get" {
+			var v string
+			if v, err = k.c.Get(ctx, op.Key); err != nil {
+				err = fmt.Errorf("error: line %d: get %s: %w", line, op.Key, err)
+				break
+			}
+			results = append(results, getResult{Key: op.Key, Value: v})
+			rows = append(rows, []string{"get", op.Key, "true", "", v})
+			continue
+		}
+		var res writeResult
+		if res, err = k.doWrite(ctx, op.Op, op.Key, op.Value); err != nil {
+			err = fmt.Errorf("error: line %d: %s %s: %w", line, op.Op, op.Key, err)
+			break
+		}
+		results = append(results, res)
+		rows = append(rows, writeRow(res))
+	}
+	if err == nil {
+		err = sc.Err()
+	}
+
+	// whatever ran before a failure is still reported
+	if k.output == "json" {
+		if results == nil {
+			results = []any{}
+		}
+		k.printJSON(results)
+	} else {
+		k.table("OP\tKEY\tSUCCESS\tINDEX\tVALUE/PREV", rows)
+	}
+	return err
+}
+
+// ===== cluster status =====
+
+type nodeStatus struct {
+	ID        string                        `json:"id"`
+	Addr      string                        `json:"addr,omitempty"`
+	Reachable bool                          `json:"reachable"`
+	LastIndex uint64                        `json:"lastIndex"`
+	ReadOnly  string                        `json:"readOnly,omitempty"`
+	Error     string                        `json:"error,omitempty"`
+	Metrics   *sixpaths_kvs.MetricsSnapshot `json:"metrics,omitempty"`
+}
+
+type clusterStatus struct {
+	Status string       `json:"status"`
+	Nodes  []nodeStatus `json:"nodes"`
+}
+
+func (k *ctl) clusterStatus(ctx context.Context) error {
+	var cs clusterStatus
+	var err error
+	if k.node != "" {
+		cs, err = k.nodeStatus(ctx)
+	} else {
+		cs, err = k.routerStatus(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	if k.output == "json" {
+		k.printJSON(cs)
+	} else {
+		rows := make([][]string, 0, len(cs.Nodes))
+		for _, n := range cs.Nodes {
+			row := []string{n.ID, n.Addr, "down", "-", "-", "-", "-", "-", n.Error}
+			if n.Reachable {
+				row[2], row[3] = "up", fmt.Sprint(n.LastIndex)
+			}
+			if n.ReadOnly != "" {
+				row[2], row[8] = "read-only", n.ReadOnly
+			}
+			if m := n.Metrics; m != nil {
+				row[4], row[5], row[6], row[7] = fmt.Sprint(m.ExecTotal), fmt.Sprint(m.PutTotal), fmt.Sprint(m.DelTotal), fmt.Sprint(m.DedupHits)
+			}
+			rows = append(rows, row)
+		}
+		k.table("NODE\tADDR\tSTATE\tLAST INDEX\tEXECS\tPUTS\tDELETES\tDEDUP HITS\tERROR", rows)
+		fmt.Fprintln(k.out, "cluster:", cs.Status)
+	}
+	if cs.Status == "down" {
+		return errors.New("error: no node is reachable")
+	}
+	return nil
+}
+
+// the router's /health and /metrics, merged by node
+func (k *ctl) routerStatus(ctx context.Context) (clusterStatus, error) {
+	var cs clusterStatus
+	// the router answers 503 with the same body when every node is down
+	if err := k.getJSON(ctx, "/health", &cs, http.StatusServiceUnavailable); err != nil {
+		return cs, err
+	}
+	var metrics struct {
+		Nodes []struct {
+			ID      string                        `json:"id"`
+			Metrics *sixpaths_kvs.MetricsSnapshot `json:"metrics"`
+		} `json:"nodes"`
+	}
+	if err := k.getJSON(ctx, "/metrics", &metrics); err != nil {
+		return cs, err
+	}
+	for i := range cs.Nodes {
+		for _, m := range metrics.Nodes {
+			if m.ID == cs.Nodes[i].ID {
+				cs.Nodes[i].Metrics = m.Metrics
+			}
+		}
+	}
+	return cs, nil
+}
+
+// one node's /health and /metrics
+func (k *ctl) nodeStatus(ctx context.Context) (clusterStatus, error) {
+	ns := nodeStatus{ID: k.node, Addr: strings.TrimPrefix(k.base, "http://")}
+	var health struct {
+		LastIndex uint64 `json:"lastIndex"`
+		ReadOnly  string `json:"readOnly"`
+		DiskLow   string `json:"diskLow"`
+	}
+	var m sixpaths_kvs.MetricsSnapshot
+	err := k.getJSON(ctx, "/health", &health)
+	if err == nil {
+		err = k.getJSON(ctx, "/metrics", &m)
+	}
+	if err != nil {
+		ns.Error = err.Error()
+		return clusterStatus{Status: "down", Nodes: []nodeStatus{ns}}, nil
+	}
+	ns.Reachable, ns.LastIndex, ns.ReadOnly, ns.Metrics = true, health.LastIndex, health.ReadOnly, &m
+	// a node short on disk can't take writes either, the router reports it the same way
+	if ns.ReadOnly == "" {
+		ns.ReadOnly = health.DiskLow
+	}
+	if ns.ReadOnly != "" {
+		return clusterStatus{Status: "degraded", Nodes: []nodeStatus{ns}}, nil
+	}
+	return clusterStatus{Status: "ok", Nodes: []nodeStatus{ns}}, nil
+}
+
+// GETs path and decodes the answer into out, statuses other than 200 are
+// errors unless listed in also
+func (k *ctl) getJSON(ctx context.Context, path string, out any, also ...int) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.base+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ok := resp.StatusCode == http.StatusOK
+	for _, s := range also {
+		ok = ok || resp.StatusCode == s
+	}
+	if !ok {
+		return fmt.Errorf("error: GET %s answered %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
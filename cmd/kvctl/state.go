@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// state.go keeps kvctl's client state between runs: the client ID it writes
+// under, the last seq it used under each client ID (-client can pick another)
+// and its read-your-writes token. seqs must never be reused under one client
+// ID, or the cluster's dedup would answer a new write with an old write's
+// result, so the next seq is saved before a write is sent, and a lock file
+// keeps two kvctl runs from sharing a seq, however long they run.
+
+// how long we wait for another kvctl to let go of the state file
+const lockWait = 10 * time.Second
+
+// a lock older than this was left behind by a kvctl that died. while we
+// hold the lock we touch it every lockRefresh, so a long batch keeps it
+const (
+	staleLock   = 5 * time.Minute
+	lockRefresh = staleLock / 5
+)
+
+type state struct {
+	ClientID string            `json:"clientId"` // used unless -client says otherwise
+	Seqs     map[string]uint64 `json:"seqs"`     // client ID -> last seq used
+	Token    string            `json:"token,omitempty"`
+
+	path        string
+	lock        string        // "" when we don't hold the lock
+	stopRefresh chan struct{} // closed by release to stop touching the lock
+}
+
+func defaultStatePath() string {
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "sixpaths", "kvctl.json")
+	}
+	return ".kvctl.json"
+}
+
+// loads the state at path, creating a fresh client ID if there is none yet.
+// with lock set the state file stays locked until release.
+func loadState(path string, lock bool) (*state, error) {
+	st := &state{path: path}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if lock {
+		if err := st.acquire(); err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		st.release()
+		return nil, err
+	default:
+		if err := json.Unmarshal(b, st); err != nil {
+			st.release()
+			return nil, fmt.Errorf("error: state file %s is corrupt: %w", path, err)
+		}
+	}
+
+	if st.ClientID == "" {
+		var id [8]byte
+		_, _ = rand.Read(id[:])
+		st.ClientID = "kvctl-" + hex.EncodeToString(id[:])
+	}
+	if st.Seqs == nil {
+		st.Seqs = make(map[string]uint64)
+	}
+	return st, nil
+}
+
+func (st *state) acquire() error {
+	lock := st.path + ".lock"
+	deadline := time.Now().Add(lockWait)
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			st.lock = lock
+			st.stopRefresh = make(chan struct{})
+			go refreshLock(lock, st.stopRefresh)
+			return nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return err
+		}
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > staleLock {
+			_ = os.Remove(lock)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("error: state file %s is locked by another kvctl (remove %s if none is running)", st.path, lock)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// keeps the lock's mtime fresh until stop is closed
+func refreshLock(lock string, stop chan struct{}) {
+	t := time.NewTicker(lockRefresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-t.C:
+			_ = os.Chtimes(lock, now, now)
+		}
+	}
+}
+
+func (st *state) release() {
+	if st.lock != "" {
+		close(st.stopRefresh)
+		_ = os.Remove(st.lock)
+		st.lock = ""
+	}
+}
+
+// writes the state out, replacing the old file in one step so a crash
+// can't leave half of it behind
+func (st *state) save() error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.path)
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"context"
 	"flag"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
@@ -19,35 +19,82 @@ import (
 
 func main() {
 	id := flag.String("id", "", "node ID (n1..n6)")
+	engine := flag.String("engine", "", "storage engine, overrides the cluster config (default: map)")
+	logLevel := flag.String("log-level", "info", "log level: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "log format: text or json")
+	traceFile := flag.String("trace-file", "", "append trace spans to this file as OTLP JSON")
+	traceEndpoint := flag.String("trace-endpoint", "", "post trace spans to this OTLP/HTTP collector, e.g. http://127.0.0.1:4318/v1/traces")
+	readOnlyOnCorrupt := flag.Bool("readonly-on-corrupt-wal", false, "if the WAL is damaged in the middle, serve reads from the records before the damage instead of refusing to start")
+	slowThreshold := flag.Duration("slow-threshold", sixpaths_kvs.DefaultSlowThreshold, "requests at least this slow are kept for /admin/slow")
+	minFreeMB := flag.Uint64("min-free-mb", 0, "only take deletes while the data dir's filesystem has fewer MiB free than this (0: no limit)")
+	minFreePct := flag.Float64("min-free-pct", 0, "same as -min-free-mb as a percentage of the filesystem's size, the larger limit wins")
+	diskCheck := flag.Duration("disk-check-interval", sixpaths_kvs.DefaultDiskCheckInterval, "how often free disk space is checked")
 	flag.Parse()
 
+	logger, err := sixpaths_kvs.NewLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		fatal("bad logging flags", "err", err)
+	}
+	slog.SetDefault(logger)
+
 	if *id == "" {
-		log.Fatalf("must provide -id (n1..n6)")
+		fatal("must provide -id (n1..n6)")
 	}
 
 	// Look up our config and the full cluster.
 	cfg, all, err := sixpaths_kvs.ConfigForID(*id)
 	if err != nil {
-		log.Fatalf("ConfigForID: %v", err)
+		fatal("ConfigForID failed", "err", err)
+	}
+	if *engine != "" {
+		cfg.Engine = *engine
+	}
+
+	tracer, err := sixpaths_kvs.OpenTracer("sixpaths-kvs-"+cfg.ID, *traceFile, *traceEndpoint)
+	if err != nil {
+		fatal("OpenTracer failed", "err", err)
 	}
+	defer func() {
+		if err := tracer.Close(); err != nil {
+			slog.Error("tracer.Close failed", "err", err)
+		}
+	}()
 
 	// Boot node (WAL open + replay -> Store), with ID + peers filled in.
-	node, err := sixpaths_kvs.OpenClusterNode(cfg, all)
+	node, err := sixpaths_kvs.OpenClusterNodeWithOptions(cfg, all, sixpaths_kvs.NodeOptions{
+		Tracer:    tracer,
+		Inspector: sixpaths_kvs.NewInspector(*slowThreshold, 0),
+
+		ReadOnlyOnCorruptWAL: *readOnlyOnCorrupt,
+
+		MinFreeBytes:      *minFreeMB << 20,
+		MinFreePercent:    *minFreePct,
+		DiskCheckInterval: *diskCheck,
+	})
 	if err != nil {
-		log.Fatalf("OpenClusterNode failed: %v", err)
+		fatal("OpenClusterNode failed", "err", err)
 	}
 	defer func() {
 		if err := node.Close(); err != nil {
-			log.Printf("node.Close error: %v", err)
+			slog.Error("node.Close failed", "err", err)
 		}
 	}()
 
 	// Start HTTP server on cfg.ClientAddr
 	srv := sixpaths_kvs.NewHTTPServer(node, cfg.ClientAddr)
 	go func() {
-		log.Printf("serving at %s (id=%s data=%s)", cfg.ClientAddr, cfg.ID, cfg.DataDir)
+		slog.Info("serving http", "addr", cfg.ClientAddr, "id", cfg.ID, "data", cfg.DataDir, "engine", cfg.Engine)
 		if err := srv.Start(); err != nil {
-			log.Printf("server exited: %v", err)
+			slog.Error("server exited", "err", err)
+		}
+	}()
+
+	// Start the binary RPC listener on cfg.RPCAddr (used by the router)
+	rpcSrv := sixpaths_kvs.NewRPCServer(sixpaths_kvs.NewNodeRPCHandler(node), cfg.RPCAddr)
+	go func() {
+		slog.Info("serving rpc", "addr", cfg.RPCAddr, "id", cfg.ID)
+		if err := rpcSrv.Start(); err != nil && err != sixpaths_kvs.ErrRPCClosed {
+			slog.Error("rpc server exited", "err", err)
 		}
 	}()
 
@@ -59,7 +106,15 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Printf("server shutdown error: %v", err)
+		slog.Error("server shutdown failed", "err", err)
+	}
+	if err := rpcSrv.Shutdown(ctx); err != nil {
+		slog.Error("rpc server shutdown failed", "err", err)
 	}
-	log.Printf("adieu")
+	slog.Info("adieu")
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/O-Nicolinho/sixpaths_kv/internal/sixpaths_kvs"
+)
+
+// cluster.go answers the router's cluster-wide /metrics and /health.
+// both ask every node at once, so a dead node costs one timeout instead of
+// one per node, and both say which nodes couldn't be reached rather than
+// passing them off as idle.
+
+// how long we wait on a node before calling it unreachable
+const nodePollTimeout = 500 * time.Millisecond
+
+type nodeMetrics struct {
+	ID        string `json:"id"`
+	Addr      string `json:"addr"`
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+	// nil when the node couldn't be reached, so it can't pass for an idle one
+	Metrics *sixpaths_kvs.MetricsSnapshot `json:"metrics,omitempty"`
+}
+
+type clusterMetrics struct {
+	Nodes       []nodeMetrics                `json:"nodes"`
+	Totals      sixpaths_kvs.MetricsSnapshot `json:"totals"` // over the reachable nodes
+	Reachable   int                          `json:"reachable"`
+	Unreachable int                          `json:"unreachable"`
+}
+
+type nodeHealth struct {
+	ID        string `json:"id"`
+	Addr      string `json:"addr"`
+	Reachable bool   `json:"reachable"`
+	LastIndex uint64 `json:"lastIndex"`
+	ReadOnly  string `json:"readOnly,omitempty"` // why the node refuses writes
+	Error     string `json:"error,omitempty"`
+}
+
+type clusterHealth struct {
+	// "ok", "degraded" when some shards are unreachable or read-only, "down"
+	// when all are unreachable
+	Status string       `json:"status"`
+	Nodes  []nodeHealth `json:"nodes"`
+}
+
+// GET /metrics
+// every node's counters plus the cluster totals
+func (r *router) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		proxyError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	out := clusterMetrics{Nodes: make([]nodeMetrics, len(r.nodes))}
+	var wg sync.WaitGroup
+	for i, n := range r.nodes {
+		wg.Add(1)
+		go func(i int, n sixpaths_kvs.NodeConfig) {
+			defer wg.Done()
+			nm := nodeMetrics{ID: n.ID, Addr: n.ClientAddr}
+			snap, err := r.fetchMetrics(req.Context(), n)
+			if err != nil {
+				slog.WarnContext(req.Context(), "metrics fetch failed", "node", n.ID, "addr", n.ClientAddr, "err", err)
+				nm.Error = err.Error()
+			} else {
+				nm.Reachable = true
+				nm.Metrics = &snap
+			}
+			out.Nodes[i] = nm
+		}(i, n)
+	}
+	wg.Wait()
+
+	for _, nm := range out.Nodes {
+		if !nm.Reachable {
+			out.Unreachable++
+			continue
+		}
+		out.Reachable++
+		out.Totals.ExecTotal += nm.Metrics.ExecTotal
+		out.Totals.PutTotal += nm.Metrics.PutTotal
+		out.Totals.DelTotal += nm.Metrics.DelTotal
+		out.Totals.DedupHits += nm.Metrics.DedupHits
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (r *router) fetchMetrics(ctx context.Context, n sixpaths_kvs.NodeConfig) (sixpaths_kvs.MetricsSnapshot, error) {
+	var snap sixpaths_kvs.MetricsSnapshot
+	url := fmt.Sprintf("http://%s%s/metrics", r.backendHost, n.ClientAddr)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return snap, err
+	}
+	req.Header.Set(sixpaths_kvs.RequestIDHeader, sixpaths_kvs.RequestIDFromContext(ctx))
+
+	resp, err := r.pollHTTP.Do(req)
+	if err != nil {
+		return snap, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return snap, fmt.Errorf("node answered %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&snap); err != nil {
+		return snap, fmt.Errorf("decoding metrics: %w", err)
+	}
+	return snap, nil
+}
+
+// GET /health
+// asks every node for its last index, the router is degraded while any
+// shard is unreachable or read-only and down (503) when none of them answers
+func (r *router) handleHealth(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		proxyError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), nodePollTimeout)
+	defer cancel()
+	resps, errs := r.fanout(ctx, func(sixpaths_kvs.NodeConfig) *sixpaths_kvs.RPCRequest {
+		return &sixpaths_kvs.RPCRequest{Op: sixpaths_kvs.OpHealth}
+	})
+
+	out := clusterHealth{Nodes: make([]nodeHealth, len(r.nodes))}
+	up, writable := 0, 0
+	for i, n := range r.nodes {
+		nh := nodeHealth{ID: n.ID, Addr: n.RPCAddr}
+		switch {
+		case errs[i] != nil:
+			nh.Error = errs[i].Error()
+		case resps[i].Status != sixpaths_kvs.StatusOK:
+			nh.Error = resps[i].Err
+		default:
+			nh.Reachable = true
+			nh.LastIndex = resps[i].LogIndex
+			if !resps[i].Success {
+				nh.ReadOnly = resps[i].Err
+			} else {
+				writable++
+			}
+			up++
+		}
+		out.Nodes[i] = nh
+	}
+
+	status := http.StatusOK
+	switch {
+	case writable == len(r.nodes):
+		out.Status = "ok"
+	case up == 0:
+		out.Status = "down"
+		status = http.StatusServiceUnavailable
+	default:
+		out.Status = "degraded"
+	}
+	writeJSON(w, status, out)
+}
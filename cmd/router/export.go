@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/O-Nicolinho/sixpaths_kv/internal/sixpaths_kvs"
+)
+
+// export.go answers /export for the whole cluster. every node's dump is
+// opened first, so the nodes take their snapshots at about the same time,
+// and then copied into one dump one node after the other: a section per
+// node, with one end marker for all of them (see dump.go).
+
+// GET /export?[format=jsonl|binary]&[prefix=P]
+func (r *router) handleExport(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		proxyError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := req.URL.Query()
+	format, err := sixpaths_kvs.ParseDumpFormat(q.Get("format"))
+	if err != nil {
+		proxyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	sixpaths_kvs.SetOpStreaming(req.Context())
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	// the nodes all write binary, it's the cheaper one to read back
+	path := "/export?" + url.Values{"format": {sixpaths_kvs.DumpBinary}, "prefix": {q.Get("prefix")}}.Encode()
+	streams := make([]*http.Response, len(r.nodes))
+	errs := make([]error, len(r.nodes))
+	var wg sync.WaitGroup
+	for i, n := range r.nodes {
+		wg.Add(1)
+		go func(i int, n sixpaths_kvs.NodeConfig) {
+			defer wg.Done()
+			resp, err := r.nodeGet(ctx, n, path)
+			if err == nil && resp.StatusCode != http.StatusOK {
+				resp.Body.Close()
+				err = fmt.Errorf("node answered %s", resp.Status)
+			}
+			streams[i], errs[i] = resp, err
+		}(i, n)
+	}
+	wg.Wait()
+	defer func() {
+		for _, s := range streams {
+			if s != nil && s.StatusCode == http.StatusOK {
+				s.Body.Close()
+			}
+		}
+	}()
+	for i, n := range r.nodes {
+		if errs[i] != nil {
+			slog.WarnContext(ctx, "proxy export failed", "node", n.ID, "addr", n.ClientAddr, "err", errs[i])
+			proxyError(w, http.StatusBadGateway, fmt.Sprintf("backend %s unavailable", n.ID))
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+	if format == sixpaths_kvs.DumpJSONL {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.WriteHeader(http.StatusOK)
+
+	dw, _ := sixpaths_kvs.NewDumpWriter(w, format)
+	for i, n := range r.nodes {
+		if err := copySection(dw, streams[i].Body); err != nil {
+			// the status is out already, the dump just ends without its end marker
+			slog.WarnContext(ctx, "proxy export failed", "node", n.ID, "addr", n.ClientAddr, "err", err)
+			return
+		}
+	}
+	if err := dw.Close(); err != nil {
+		slog.WarnContext(ctx, "export write failed", "err", err)
+	}
+}
+
+// copies one node's dump into dw as a section
+func copySection(dw *sixpaths_kvs.DumpWriter, body io.Reader) error {
+	dr, err := sixpaths_kvs.NewDumpReader(body)
+	if err != nil {
+		return err
+	}
+	started := false
+	for {
+		e, err := dr.Next()
+		// the header comes before the first entry, or before the end of a node with no keys
+		if !started && (err == nil || err == io.EOF) {
+			if herr := dw.WriteHeader(dr.Header()); herr != nil {
+				return herr
+			}
+			started = true
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := dw.WriteEntry(e); err != nil {
+			return err
+		}
+	}
+}
@@ -1,15 +1,18 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"hash/fnv"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/O-Nicolinho/sixpaths_kv/internal/sixpaths_kvs"
@@ -17,20 +20,36 @@ import (
 
 // router/main.go is the front-end router for our cluster
 // to allow 3rd parties to interact with our kv store.
-// we handle /put, /delete, /get, /metrics.
+// we handle /put, /delete, /get, /scan, /watch, /export, /stream, /session, /metrics, /health.
 // for writes and reads, we hash it in order to
 // make sure that the right command is sent to the right node.
+// requests are forwarded to the nodes over the binary RPC protocol,
+// and the router also offers that protocol to clients on its own listener.
 
 // the router is a stateless front-end that works as an interface for interactions with the our KV cluster
 type router struct {
-	nodes       []sixpaths_kvs.NodeConfig // list of backend nodes in the cluster
-	backendHost string                    // the host where we can actually reach the nodes
+	nodes       []sixpaths_kvs.NodeConfig          // list of backend nodes in the cluster
+	backendHost string                             // the host where we can actually reach the nodes
+	clients     map[string]*sixpaths_kvs.RPCClient // one persistent rpc connection per node ID
+	streamHTTP  *http.Client                       // for /stream, /scan, /watch and /export, which have no overall timeout
+	pollHTTP    *http.Client                       // for /metrics, short timeout so a dead node can't stall it
+	sessions    *sessionTokens                     // read-your-writes tokens of router sessions
+	metrics     *routerMetrics
+	tracer      *sixpaths_kvs.Tracer // nil when tracing is off
+	inspect     *sixpaths_kvs.Inspector
 }
 
-type nodeMetrics struct {
-	ID      string                       `json:"id"`
-	Addr    string                       `json:"addr"`
-	Metrics sixpaths_kvs.MetricsSnapshot `json:"metrics"`
+type putDelResp struct {
+	Success   bool   `json:"success"`
+	PrevValue string `json:"prevValue"`
+	LogIndex  uint64 `json:"logIndex"`
+	Token     string `json:"token,omitempty"` // read-your-writes token, see tokens.go
+}
+
+type getResp struct {
+	Value    string `json:"value"`
+	LogIndex uint64 `json:"logIndex"`
+	Token    string `json:"token,omitempty"`
 }
 
 func main() {
@@ -40,41 +59,132 @@ func main() {
 	//the backendhost is the host we use to talk to backend nodes
 	// the ports of the nodes are in NodeConfig.Clientaddr
 	backendHost := flag.String("backend-host", "127.0.0.1", "host for backend nodes")
+
+	// the rpcAddr is where the router accepts binary protocol clients ("" disables it)
+	rpcAddr := flag.String("rpc-addr", ":8081", "router binary rpc listen address")
+
+	logLevel := flag.String("log-level", "info", "log level: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "log format: text or json")
+	traceFile := flag.String("trace-file", "", "append trace spans to this file as OTLP JSON")
+	traceEndpoint := flag.String("trace-endpoint", "", "post trace spans to this OTLP/HTTP collector, e.g. http://127.0.0.1:4318/v1/traces")
+	slowThreshold := flag.Duration("slow-threshold", sixpaths_kvs.DefaultSlowThreshold, "requests at least this slow are kept for /admin/slow")
 	flag.Parse()
 
+	logger, err := sixpaths_kvs.NewLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		fatal("bad logging flags", "err", err)
+	}
+	slog.SetDefault(logger)
+
+	tracer, err := sixpaths_kvs.OpenTracer("sixpaths-router", *traceFile, *traceEndpoint)
+	if err != nil {
+		fatal("OpenTracer failed", "err", err)
+	}
+
 	// we load the static cluster config (which includes IDs, client ports, datadirs, etc)
 	nodes := sixpaths_kvs.ClusterConfig()
 	if len(nodes) == 0 {
-		log.Fatalf("no nodes in cluster config")
+		fatal("no nodes in cluster config")
 	}
 
 	// we build the router with the cluster nodes and backend host we got
 	r := &router{
 		nodes:       nodes,
 		backendHost: *backendHost,
+		clients:     make(map[string]*sixpaths_kvs.RPCClient, len(nodes)),
+		streamHTTP:  &http.Client{},
+		pollHTTP:    &http.Client{Timeout: nodePollTimeout},
+		sessions:    newSessionTokens(),
+		metrics:     newRouterMetrics(),
+		tracer:      tracer,
+		inspect:     sixpaths_kvs.NewInspector(*slowThreshold, 0),
+	}
+	for _, n := range nodes {
+		r.clients[n.ID] = sixpaths_kvs.NewRPCClient(r.backendHost + n.RPCAddr)
 	}
 
 	// we only expose put and get on the router
 	mux := http.NewServeMux()
 	mux.HandleFunc("/put", r.handlePut)
 	mux.HandleFunc("/get", r.handleGet)
+	mux.HandleFunc("/scan", r.handleScan)
+	mux.HandleFunc("/watch", r.handleWatch)
+	mux.HandleFunc("/export", r.handleExport)
 	mux.HandleFunc("/metrics", r.handleMetrics)
+	mux.HandleFunc("/health", r.handleHealth)
 	mux.HandleFunc("/delete", r.handleDelete)
+	mux.HandleFunc("/stream", r.handleStream)
+	mux.HandleFunc("/session", r.handleSession)
+	mux.HandleFunc("/session/keepalive", r.handleKeepAlive)
+	mux.Handle("/metrics/prometheus", r.metrics.reg)
+	mux.HandleFunc("/admin/slow", r.inspect.ServeSlow)
+	mux.HandleFunc("/admin/inflight", r.inspect.ServeInFlight)
 
 	srv := &http.Server{
 		Addr:              *addr,
-		Handler:           mux,
+		Handler:           withRequestID(r.metrics.instrument(r.traced(mux))),
 		ReadTimeout:       5 * time.Second,
 		ReadHeaderTimeout: 2 * time.Second,
 		WriteTimeout:      10 * time.Second,
 		IdleTimeout:       60 * time.Second,
 	}
 
+	// a listener that fails brings the router down the same way a signal does,
+	// so the other one is still shut down and buffered spans still get out
+	failed := make(chan struct{}, 2)
+
+	var rpcSrv *sixpaths_kvs.RPCServer
+	if *rpcAddr != "" {
+		rpcSrv = sixpaths_kvs.NewRPCServer(r, *rpcAddr)
+		go func() {
+			slog.Info("router rpc listening", "addr", *rpcAddr)
+			if err := rpcSrv.Start(); err != nil && err != sixpaths_kvs.ErrRPCClosed {
+				slog.Error("router rpc server failed", "err", err)
+				failed <- struct{}{}
+			}
+		}()
+	}
+
 	// start server!
-	log.Printf("router listening at %s, managing %d nodes", *addr, len(nodes))
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("router server error: %v", err)
+	go func() {
+		slog.Info("router listening", "addr", *addr, "nodes", len(nodes))
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("router server failed", "err", err)
+			failed <- struct{}{}
+		}
+	}()
+
+	// Graceful shutdown on SIGINT/SIGTERM
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM)
+	exitCode := 0
+	select {
+	case <-sigch:
+	case <-failed:
+		exitCode = 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("server shutdown failed", "err", err)
+	}
+	if rpcSrv != nil {
+		if err := rpcSrv.Shutdown(ctx); err != nil {
+			slog.Error("rpc server shutdown failed", "err", err)
+		}
+	}
+	// only once nothing can start a span anymore
+	if err := tracer.Close(); err != nil {
+		slog.Error("tracer.Close failed", "err", err)
 	}
+	slog.Info("adieu")
+	os.Exit(exitCode)
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
 
 // ===== helpers =====
@@ -99,6 +209,186 @@ func proxyError(w http.ResponseWriter, status int, msg string) {
 	})
 }
 
+// reads a small JSON body into dst
+func readJSON(req *http.Request, dst any) error {
+	body, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+	_ = req.Body.Close()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, dst)
+}
+
+// gives every request an ID (or keeps the client's), it goes into the
+// request's context and back out in the response header
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := sixpaths_kvs.RequestIDFromHeader(req.Header)
+		w.Header().Set(sixpaths_kvs.RequestIDHeader, id)
+		next.ServeHTTP(w, req.WithContext(sixpaths_kvs.ContextWithRequestID(req.Context(), id)))
+	})
+}
+
+// runs each request in a server span, continuing the client's trace if it
+// sent a traceparent
+func (r *router) traced(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route := req.URL.Path
+		if !r.metrics.routes[route] {
+			route = "other"
+		}
+		ctx := sixpaths_kvs.ContextWithTraceparent(req.Context(), req.Header.Get(sixpaths_kvs.TraceparentHeader))
+		ctx, span := r.tracer.Start(ctx, "router.http "+req.Method+" "+route, sixpaths_kvs.SpanKindServer)
+		defer span.End()
+
+		ctx, op := r.inspect.Begin(ctx, "http", req.Method+" "+req.URL.Path)
+		if key := req.URL.Query().Get("key"); key != "" {
+			sixpaths_kvs.SetOpKey(ctx, key)
+		}
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sr, req.WithContext(ctx))
+		op.Finish(strconv.Itoa(sr.status))
+	})
+}
+
+// sends req to the node over its persistent rpc connection, along with the
+// request ID and trace context in ctx
+func (r *router) forward(ctx context.Context, node sixpaths_kvs.NodeConfig, req *sixpaths_kvs.RPCRequest) (*sixpaths_kvs.RPCResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	ctx, span := sixpaths_kvs.StartSpan(ctx, "router.proxy "+req.Op.String(), sixpaths_kvs.SpanKindClient)
+	defer span.End()
+	span.SetAttr("node", node.ID)
+
+	fwd := *req
+	if fwd.RequestID == "" {
+		fwd.RequestID = sixpaths_kvs.RequestIDFromContext(ctx)
+	}
+	fwd.Traceparent = sixpaths_kvs.TraceparentFromContext(ctx)
+	req = &fwd
+
+	start := time.Now()
+	resp, err := r.clients[node.ID].Do(ctx, req)
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	dur := time.Since(start)
+	r.metrics.backend.WithLabelValues(node.ID, outcome).Observe(dur.Seconds())
+	sixpaths_kvs.AddPhase(ctx, sixpaths_kvs.PhaseBackend, dur)
+	span.SetError(err)
+	return resp, err
+}
+
+// maps an rpc status onto the HTTP status the node itself would have used
+func httpStatus(st sixpaths_kvs.RPCStatus) int {
+	switch st {
+	case sixpaths_kvs.StatusOK:
+		return http.StatusOK
+	case sixpaths_kvs.StatusNotFound:
+		return http.StatusNotFound
+	case sixpaths_kvs.StatusBadRequest:
+		return http.StatusBadRequest
+	case sixpaths_kvs.StatusConflict:
+		return http.StatusConflict
+	case sixpaths_kvs.StatusGone:
+		return http.StatusGone
+	case sixpaths_kvs.StatusUnavailable:
+		return http.StatusServiceUnavailable
+	case sixpaths_kvs.StatusDiskFull:
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writes the node's answer to a put or delete in the node's JSON shape,
+// plus the read token for it
+func (r *router) writeWriteResp(w http.ResponseWriter, node sixpaths_kvs.NodeConfig, client string, resp *sixpaths_kvs.RPCResponse) {
+	if resp.Status != sixpaths_kvs.StatusOK {
+		proxyError(w, httpStatus(resp.Status), resp.Err)
+		return
+	}
+	r.sessions.observe(client, node.ID, resp.LogIndex)
+	writeJSON(w, http.StatusOK, putDelResp{
+		Success:   resp.Success,
+		PrevValue: string(resp.Value),
+		LogIndex:  resp.LogIndex,
+		Token:     nodeToken(node.ID, resp.LogIndex),
+	})
+}
+
+// ServeRPC handles requests from binary protocol clients, forwarding
+// them to the node that owns the key.
+func (r *router) ServeRPC(ctx context.Context, req *sixpaths_kvs.RPCRequest) *sixpaths_kvs.RPCResponse {
+	id := req.RequestID
+	if id == "" {
+		id = sixpaths_kvs.NewRequestID()
+	}
+	ctx = sixpaths_kvs.ContextWithRequestID(ctx, id)
+	ctx, span := r.tracer.Start(sixpaths_kvs.ContextWithTraceparent(ctx, req.Traceparent),
+		"router.rpc "+req.Op.String(), sixpaths_kvs.SpanKindServer)
+	defer span.End()
+	ctx, op := r.inspect.Begin(ctx, "rpc", req.Op.String())
+	sixpaths_kvs.SetOpKey(ctx, string(req.Key))
+	resp := r.serveRPC(ctx, req)
+	op.Finish(resp.Status.String())
+	return resp
+}
+
+func (r *router) serveRPC(ctx context.Context, req *sixpaths_kvs.RPCRequest) *sixpaths_kvs.RPCResponse {
+	switch req.Op {
+	case sixpaths_kvs.OpPut, sixpaths_kvs.OpDelete, sixpaths_kvs.OpGet:
+		if len(req.Key) == 0 {
+			return &sixpaths_kvs.RPCResponse{Status: sixpaths_kvs.StatusBadRequest, Err: "missing key"}
+		}
+		node := r.pickNodeForKey(string(req.Key))
+		sess := req.ClientID
+		if req.ClientID != "" {
+			client, err := r.clientFor(node, req.ClientID)
+			if err != nil {
+				return &sixpaths_kvs.RPCResponse{Status: sixpaths_kvs.StatusBadRequest, Err: err.Error()}
+			}
+			fwd := *req
+			fwd.ClientID = client
+			// router sessions read their own writes
+			if fwd.Op == sixpaths_kvs.OpGet {
+				fwd.MinIndex = max(fwd.MinIndex, r.sessions.minIndex(sess, node.ID))
+			}
+			req = &fwd
+		}
+		resp, err := r.forward(ctx, node, req)
+		if err != nil {
+			slog.WarnContext(ctx, "proxy rpc failed", "op", req.Op, "node", node.ID, "addr", node.RPCAddr, "err", err)
+			return &sixpaths_kvs.RPCResponse{Status: sixpaths_kvs.StatusError, Err: "backend unavailable"}
+		}
+		if resp.Status == sixpaths_kvs.StatusOK {
+			r.sessions.observe(sess, node.ID, resp.LogIndex)
+		}
+		return resp
+	case sixpaths_kvs.OpHealth:
+		return &sixpaths_kvs.RPCResponse{Status: sixpaths_kvs.StatusOK, Success: true}
+	case sixpaths_kvs.OpRegisterSession:
+		tok, fail := r.registerSession(ctx, req.Value)
+		if fail != nil {
+			return fail
+		}
+		return &sixpaths_kvs.RPCResponse{Status: sixpaths_kvs.StatusOK, Success: true, Value: []byte(tok)}
+	case sixpaths_kvs.OpKeepAlive:
+		return r.keepAlive(ctx, req.ClientID)
+	default:
+		return &sixpaths_kvs.RPCResponse{Status: sixpaths_kvs.StatusBadRequest, Err: fmt.Sprintf("unknown op %d", req.Op)}
+	}
+}
+
 // ===== handlers =====
 
 // POST /put
@@ -106,14 +396,13 @@ func proxyError(w http.ResponseWriter, status int, msg string) {
 
 // the router routes a PUT from a client to the correct backend node,
 // it reads and parses the body to extract the key and
-// forwards the info to the node, while streaming the node's response
+// forwards the command to the node over the binary protocol
 func (r *router) handlePut(w http.ResponseWriter, req *http.Request) {
 	if req.Method != http.MethodPost {
 		proxyError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
-	// Read whole body once so we can both inspect it and forward it.
 	body, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
 	if err != nil {
 		proxyError(w, http.StatusBadRequest, "unable to read body")
@@ -139,26 +428,35 @@ func (r *router) handlePut(w http.ResponseWriter, req *http.Request) {
 	// we choose node the node according to our pickNodeForKey funct
 
 	node := r.pickNodeForKey(parsed.Key)
+	sixpaths_kvs.SetOpKey(req.Context(), parsed.Key)
 
-	log.Printf("ROUTER: PUT key=%q client=%s seq=%d -> node=%s addr=%s",
-		parsed.Key, parsed.Client, parsed.Seq, node.ID, node.ClientAddr)
+	// a router session token becomes the node's own session
+	client, err := r.clientFor(node, parsed.Client)
+	if err != nil {
+		proxyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	backendURL := fmt.Sprintf("http://%s%s/put", r.backendHost, node.ClientAddr)
-	resp, err := http.Post(backendURL, "application/json", bytes.NewReader(body))
+	slog.DebugContext(req.Context(), "route put", "key", parsed.Key, "client", client, "seq", parsed.Seq,
+		"node", node.ID, "addr", node.RPCAddr)
+
+	resp, err := r.forward(req.Context(), node, &sixpaths_kvs.RPCRequest{
+		Op:       sixpaths_kvs.OpPut,
+		ClientID: client,
+		Seq:      parsed.Seq,
+		Key:      []byte(parsed.Key),
+		Value:    []byte(parsed.Value),
+	})
 	if err != nil {
-		log.Printf("proxy PUT to %s failed: %v", backendURL, err)
+		slog.WarnContext(req.Context(), "proxy put failed", "node", node.ID, "addr", node.RPCAddr, "err", err)
 		proxyError(w, http.StatusBadGateway, "backend unavailable")
 		return
 	}
-	defer resp.Body.Close()
 
-	// Forward status code and body as-is.
-	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-	w.WriteHeader(resp.StatusCode)
-	_, _ = io.Copy(w, resp.Body)
+	r.writeWriteResp(w, node, parsed.Client, resp)
 }
 
-// GET /get?key=...
+// GET /get?key=...[&consistency=...][&client=...][&token=n1=12,...]
 
 // handleGet routes a client's GET to the correct node based on the key
 func (r *router) handleGet(w http.ResponseWriter, req *http.Request) {
@@ -167,87 +465,135 @@ func (r *router) handleGet(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	key := req.URL.Query().Get("key")
+	q := req.URL.Query()
+	key := q.Get("key")
 	if key == "" {
 		proxyError(w, http.StatusBadRequest, "missing key")
 		return
 	}
+	level, err := sixpaths_kvs.ParseReadConsistency(q.Get("consistency"))
+	if err != nil {
+		proxyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	// we pick the backend node we're get'ing from based on the hashed key
+	// every key lives on exactly one node, so all levels go to the same place
 	node := r.pickNodeForKey(key)
 
-	log.Printf("ROUTER: GET key=%q -> node=%s addr=%s", key, node.ID, node.ClientAddr)
+	// a sequential read has to see the client's writes on that node
+	sess := q.Get("client")
+	client, err := r.clientFor(node, sess)
+	if err != nil {
+		proxyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// the read waits for whatever the client's token (or its router
+	// session) says it has already seen on that node
+	tok, err := parseIndexToken(q.Get("token"))
+	if err != nil {
+		proxyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	minIndex := max(tok[node.ID], r.sessions.minIndex(sess, node.ID))
 
-	q := url.Values{}
-	q.Set("key", key)
-	backendURL := fmt.Sprintf("http://%s%s/get?%s", r.backendHost, node.ClientAddr, q.Encode())
+	slog.DebugContext(req.Context(), "route get", "key", key, "consistency", level.String(), "min_index", minIndex,
+		"node", node.ID, "addr", node.RPCAddr)
 
-	resp, err := http.Get(backendURL)
+	resp, err := r.forward(req.Context(), node, &sixpaths_kvs.RPCRequest{
+		Op:          sixpaths_kvs.OpGet,
+		ClientID:    client,
+		Key:         []byte(key),
+		Consistency: level,
+		MinIndex:    minIndex,
+	})
 	if err != nil {
-		log.Printf("proxy GET to %s failed: %v", backendURL, err)
+		slog.WarnContext(req.Context(), "proxy get failed", "node", node.ID, "addr", node.RPCAddr, "err", err)
 		proxyError(w, http.StatusBadGateway, "backend unavailable")
 		return
 	}
-	defer resp.Body.Close()
 
-	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-	w.WriteHeader(resp.StatusCode)
-	_, _ = io.Copy(w, resp.Body)
+	if resp.Status != sixpaths_kvs.StatusOK {
+		proxyError(w, httpStatus(resp.Status), resp.Err)
+		return
+	}
+	r.sessions.observe(sess, node.ID, resp.LogIndex)
+	writeJSON(w, http.StatusOK, getResp{
+		Value:    string(resp.Value),
+		LogIndex: resp.LogIndex,
+		Token:    nodeToken(node.ID, resp.LogIndex),
+	})
 }
 
-// we get metrics for each of the nodes and create a new cluster wide metrics report
-func (r *router) handleMetrics(w http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodGet {
+// PUT /stream?client=C&seq=N&key=K and GET /stream?key=K
+
+// handleStream proxies a streamed value to or from the node that owns the key.
+// bodies are piped straight through, so the router never holds a whole
+// value in memory.
+func (r *router) handleStream(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPut && req.Method != http.MethodGet {
 		proxyError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
-	// simple HTTP client with a small timeout so a dead node doesn't block everything
-	client := &http.Client{
-		Timeout: 500 * time.Millisecond,
+	key := req.URL.Query().Get("key")
+	if key == "" {
+		proxyError(w, http.StatusBadRequest, "missing key")
+		return
 	}
 
-	var out []nodeMetrics
+	// large values take longer than our usual server timeouts allow
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
 
-	for _, n := range r.nodes {
-		url := fmt.Sprintf("http://%s%s/metrics", r.backendHost, n.ClientAddr)
+	node := r.pickNodeForKey(key)
 
-		resp, err := client.Get(url)
+	slog.DebugContext(req.Context(), "route stream", "method", req.Method, "key", key, "node", node.ID, "addr", node.ClientAddr)
+
+	// a router session token becomes the node's own session
+	q := req.URL.Query()
+	if c := q.Get("client"); c != "" {
+		client, err := r.clientFor(node, c)
 		if err != nil {
-			log.Printf("router: metrics fetch failed for node=%s addr=%s: %v", n.ID, n.ClientAddr, err)
-			// still include an entry, but mark metrics as zero-values
-			out = append(out, nodeMetrics{
-				ID:      n.ID,
-				Addr:    n.ClientAddr,
-				Metrics: sixpaths_kvs.MetricsSnapshot{},
-			})
-			continue
+			proxyError(w, http.StatusBadRequest, err.Error())
+			return
 		}
+		q.Set("client", client)
+	}
 
-		var snap sixpaths_kvs.MetricsSnapshot
-		if err := json.NewDecoder(resp.Body).Decode(&snap); err != nil {
-			log.Printf("router: metrics decode failed for node=%s addr=%s: %v", n.ID, n.ClientAddr, err)
-			_ = resp.Body.Close()
-			out = append(out, nodeMetrics{
-				ID:      n.ID,
-				Addr:    n.ClientAddr,
-				Metrics: sixpaths_kvs.MetricsSnapshot{},
-			})
-			continue
-		}
-		_ = resp.Body.Close()
+	backendURL := fmt.Sprintf("http://%s%s/stream?%s", r.backendHost, node.ClientAddr, q.Encode())
 
-		out = append(out, nodeMetrics{
-			ID:      n.ID,
-			Addr:    n.ClientAddr,
-			Metrics: snap,
-		})
+	var body io.Reader
+	if req.Method == http.MethodPut {
+		body = req.Body
+	}
+	out, err := http.NewRequestWithContext(req.Context(), req.Method, backendURL, body)
+	if err != nil {
+		proxyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	out.ContentLength = req.ContentLength
+	out.Header.Set(sixpaths_kvs.RequestIDHeader, sixpaths_kvs.RequestIDFromContext(req.Context()))
+	if tp := sixpaths_kvs.TraceparentFromContext(req.Context()); tp != "" {
+		out.Header.Set(sixpaths_kvs.TraceparentHeader, tp)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Cache-Control", "no-store")
-	w.WriteHeader(http.StatusOK)
-	_ = json.NewEncoder(w).Encode(out)
+	resp, err := r.streamHTTP.Do(out)
+	if err != nil {
+		slog.WarnContext(req.Context(), "proxy stream failed", "node", node.ID, "url", backendURL, "err", err)
+		proxyError(w, http.StatusBadGateway, "backend unavailable")
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	if cl := resp.Header.Get("Content-Length"); cl != "" {
+		w.Header().Set("Content-Length", cl)
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
 }
 
 // routes a client's DELETE intruct to the correct backend node
@@ -257,7 +603,6 @@ func (r *router) handleDelete(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Read body so we can both inspect and forward it.
 	body, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
 	if err != nil {
 		proxyError(w, http.StatusBadRequest, "unable to read body")
@@ -282,24 +627,30 @@ func (r *router) handleDelete(w http.ResponseWriter, req *http.Request) {
 
 	// Pick backend node based on hashed key.
 	node := r.pickNodeForKey(parsed.Key)
+	sixpaths_kvs.SetOpKey(req.Context(), parsed.Key)
 
-	// Log which node this delete is going to.
-	log.Printf("ROUTER: DELETE key=%q client=%s seq=%d -> node=%s addr=%s",
-		parsed.Key, parsed.Client, parsed.Seq, node.ID, node.ClientAddr)
-
-	backendURL := fmt.Sprintf("http://%s%s/delete", r.backendHost, node.ClientAddr)
+	// a router session token becomes the node's own session
+	client, err := r.clientFor(node, parsed.Client)
+	if err != nil {
+		proxyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	// Forward the request body to the backend node as POST /delete.
-	resp, err := http.Post(backendURL, "application/json", bytes.NewReader(body))
+	// Log which node this delete is going to.
+	slog.DebugContext(req.Context(), "route delete", "key", parsed.Key, "client", client, "seq", parsed.Seq,
+		"node", node.ID, "addr", node.RPCAddr)
+
+	resp, err := r.forward(req.Context(), node, &sixpaths_kvs.RPCRequest{
+		Op:       sixpaths_kvs.OpDelete,
+		ClientID: client,
+		Seq:      parsed.Seq,
+		Key:      []byte(parsed.Key),
+	})
 	if err != nil {
-		log.Printf("proxy DELETE to %s failed: %v", backendURL, err)
+		slog.WarnContext(req.Context(), "proxy delete failed", "node", node.ID, "addr", node.RPCAddr, "err", err)
 		proxyError(w, http.StatusBadGateway, "backend unavailable")
 		return
 	}
-	defer resp.Body.Close()
 
-	// Forward backend response status + body to the client.
-	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-	w.WriteHeader(resp.StatusCode)
-	_, _ = io.Copy(w, resp.Body)
+	r.writeWriteResp(w, node, parsed.Client, resp)
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/O-Nicolinho/sixpaths_kv/internal/sixpaths_kvs"
+)
+
+// metrics.go holds the router's own Prometheus metrics, served on
+// /metrics/prometheus. the per-node metrics are scraped from the nodes.
+
+type routerMetrics struct {
+	reg     *sixpaths_kvs.PromRegistry
+	latency *sixpaths_kvs.HistogramVec // client requests by route, method and status
+	backend *sixpaths_kvs.HistogramVec // rpc round trips by node and outcome
+	routes  map[string]bool
+}
+
+func newRouterMetrics() *routerMetrics {
+	reg := sixpaths_kvs.NewPromRegistry()
+	return &routerMetrics{
+		reg: reg,
+		latency: reg.NewHistogramVec("sixpaths_router_request_duration_seconds",
+			"Latency of HTTP requests to the router.", sixpaths_kvs.LatencyBuckets, "route", "method", "status"),
+		backend: reg.NewHistogramVec("sixpaths_router_backend_duration_seconds",
+			"Latency of rpc calls from the router to the nodes.", sixpaths_kvs.LatencyBuckets, "node", "outcome"),
+		routes: map[string]bool{
+			"/put": true, "/delete": true, "/get": true, "/scan": true, "/watch": true, "/export": true, "/stream": true,
+			"/session": true, "/session/keepalive": true,
+			"/metrics": true, "/metrics/prometheus": true, "/health": true,
+			"/admin/slow": true, "/admin/inflight": true,
+		},
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// lets http.ResponseController reach the underlying writer
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// records the latency of every request that goes through next
+func (m *routerMetrics) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sr, req)
+
+		route := req.URL.Path
+		if !m.routes[route] {
+			route = "other"
+		}
+		m.latency.WithLabelValues(route, req.Method, strconv.Itoa(sr.status)).Observe(time.Since(start).Seconds())
+	})
+}
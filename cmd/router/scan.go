@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/O-Nicolinho/sixpaths_kv/internal/sixpaths_kvs"
+)
+
+// scan.go answers /scan and /watch, which unlike every other route span all
+// the shards. keys are spread over the nodes by hash, so a scan asks every
+// node for its next page and merges them in key order, and a watch follows
+// every node's change stream at once.
+
+type scanResp struct {
+	Entries []sixpaths_kvs.ScanEntry `json:"entries"`
+	More    bool                     `json:"more"`
+	Token   string                   `json:"token,omitempty"` // one index per node, see tokens.go
+}
+
+// one node's page, as /scan on the node answers it
+type nodeScanResp struct {
+	Entries  []sixpaths_kvs.ScanEntry `json:"entries"`
+	More     bool                     `json:"more"`
+	LogIndex uint64                   `json:"logIndex"`
+	Error    string                   `json:"error"` // only when the node answered an error
+}
+
+// GET /scan?[prefix=P][&after=K][&limit=N][&consistency=...][&client=C][&token=...]
+// returns the next page of keys across the cluster in key order
+func (r *router) handleScan(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		proxyError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	q := req.URL.Query()
+	if _, err := sixpaths_kvs.ParseReadConsistency(q.Get("consistency")); err != nil {
+		proxyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit := sixpaths_kvs.DefaultScanLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			proxyError(w, http.StatusBadRequest, "bad limit")
+			return
+		}
+		if n > 0 {
+			limit = min(n, sixpaths_kvs.MaxScanLimit)
+		}
+	}
+	tok, err := parseIndexToken(q.Get("token"))
+	if err != nil {
+		proxyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	sess := q.Get("client")
+
+	slog.DebugContext(req.Context(), "route scan", "prefix", q.Get("prefix"), "after", q.Get("after"), "limit", limit)
+
+	// every node returns its own first limit keys after after, so the first
+	// limit keys of the union are the cluster's next page
+	pages := make([]nodeScanResp, len(r.nodes))
+	errs := make([]error, len(r.nodes))
+	var wg sync.WaitGroup
+	for i, n := range r.nodes {
+		wg.Add(1)
+		go func(i int, n sixpaths_kvs.NodeConfig) {
+			defer wg.Done()
+			client, err := r.clientFor(n, sess)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			nq := url.Values{}
+			for _, p := range []string{"prefix", "after", "consistency", "timeoutMs"} {
+				if v := q.Get(p); v != "" {
+					nq.Set(p, v)
+				}
+			}
+			nq.Set("limit", strconv.Itoa(limit))
+			if client != "" {
+				nq.Set("client", client)
+			}
+			if mi := max(tok[n.ID], r.sessions.minIndex(sess, n.ID)); mi > 0 {
+				nq.Set("minIndex", strconv.FormatUint(mi, 10))
+			}
+			pages[i], errs[i] = r.scanNode(req.Context(), n, nq)
+		}(i, n)
+	}
+	wg.Wait()
+
+	// a page with a shard missing would silently skip its keys, so it's all or nothing
+	out := scanResp{Entries: []sixpaths_kvs.ScanEntry{}}
+	seen := indexToken{}
+	for i, n := range r.nodes {
+		if errs[i] != nil {
+			slog.WarnContext(req.Context(), "proxy scan failed", "node", n.ID, "addr", n.ClientAddr, "err", errs[i])
+			proxyError(w, http.StatusBadGateway, fmt.Sprintf("backend %s unavailable", n.ID))
+			return
+		}
+		out.Entries = append(out.Entries, pages[i].Entries...)
+		out.More = out.More || pages[i].More
+		seen.observe(n.ID, pages[i].LogIndex)
+		r.sessions.observe(sess, n.ID, pages[i].LogIndex)
+	}
+	sort.Slice(out.Entries, func(i, j int) bool { return out.Entries[i].Key < out.Entries[j].Key })
+	if len(out.Entries) > limit {
+		out.Entries = out.Entries[:limit]
+		out.More = true
+	}
+	out.Token = seen.String()
+	writeJSON(w, http.StatusOK, out)
+}
+
+// fetches one page from a node, errors the node answered with are returned
+// as errors too
+func (r *router) scanNode(ctx context.Context, n sixpaths_kvs.NodeConfig, q url.Values) (nodeScanResp, error) {
+	var page nodeScanResp
+	resp, err := r.nodeGet(ctx, n, "/scan?"+q.Encode())
+	if err != nil {
+		return page, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = json.NewDecoder(resp.Body).Decode(&page)
+		return page, fmt.Errorf("node answered %s: %s", resp.Status, page.Error)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return page, fmt.Errorf("decoding scan: %w", err)
+	}
+	return page, nil
+}
+
+// GET path on node over HTTP, carrying the request ID and trace context
+func (r *router) nodeGet(ctx context.Context, n sixpaths_kvs.NodeConfig, path string) (*http.Response, error) {
+	out, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s%s%s", r.backendHost, n.ClientAddr, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	out.Header.Set(sixpaths_kvs.RequestIDHeader, sixpaths_kvs.RequestIDFromContext(ctx))
+	if tp := sixpaths_kvs.TraceparentFromContext(ctx); tp != "" {
+		out.Header.Set(sixpaths_kvs.TraceparentHeader, tp)
+	}
+	return r.streamHTTP.Do(out)
+}
+
+// GET /watch?[prefix=P]
+// streams the changes from every node as one JSON event per line. events
+// from one node come in log order, there's no order between nodes. if any
+// node's stream ends, a final {"error": "..."} line names it and the watch
+// ends, so the client can reconnect instead of silently missing a shard.
+func (r *router) handleWatch(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		proxyError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	sixpaths_kvs.SetOpStreaming(req.Context())
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	path := "/watch?" + url.Values{"prefix": {req.URL.Query().Get("prefix")}}.Encode()
+
+	// we only start streaming once every node is watching, so no shard's
+	// events are missed from the start
+	streams := make([]*http.Response, len(r.nodes))
+	errs := make([]error, len(r.nodes))
+	var wg sync.WaitGroup
+	for i, n := range r.nodes {
+		wg.Add(1)
+		go func(i int, n sixpaths_kvs.NodeConfig) {
+			defer wg.Done()
+			resp, err := r.nodeGet(ctx, n, path)
+			if err == nil && resp.StatusCode != http.StatusOK {
+				resp.Body.Close()
+				err = fmt.Errorf("node answered %s", resp.Status)
+			}
+			streams[i], errs[i] = resp, err
+		}(i, n)
+	}
+	wg.Wait()
+	for i, n := range r.nodes {
+		if errs[i] != nil {
+			slog.WarnContext(ctx, "proxy watch failed", "node", n.ID, "addr", n.ClientAddr, "err", errs[i])
+			for _, s := range streams {
+				if s != nil && s.StatusCode == http.StatusOK {
+					s.Body.Close()
+				}
+			}
+			proxyError(w, http.StatusBadGateway, fmt.Sprintf("backend %s unavailable", n.ID))
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	_ = rc.Flush()
+
+	var mu sync.Mutex // one line at a time
+	stopped := false  // set once the handler is done with w
+	ended := make(chan string, len(r.nodes))
+	wg = sync.WaitGroup{}
+	for i, n := range r.nodes {
+		wg.Add(1)
+		go func(n sixpaths_kvs.NodeConfig, body *http.Response) {
+			defer wg.Done()
+			defer body.Body.Close()
+			sc := bufio.NewScanner(body.Body)
+			sc.Buffer(make([]byte, 64<<10), 4<<20)
+			for sc.Scan() {
+				mu.Lock()
+				if stopped {
+					mu.Unlock()
+					return
+				}
+				_, err := w.Write(append(sc.Bytes(), '\n'))
+				if err == nil {
+					err = rc.Flush()
+				}
+				mu.Unlock()
+				if err != nil {
+					break
+				}
+			}
+			ended <- n.ID
+		}(n, streams[i])
+	}
+
+	var id string
+	select {
+	case <-ctx.Done():
+	case id = <-ended:
+	}
+	mu.Lock()
+	stopped = true
+	if ctx.Err() == nil {
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "watch on " + id + " ended"})
+		_ = rc.Flush()
+	}
+	mu.Unlock()
+	// cancelling closes the other streams, w must not be touched once we return
+	cancel()
+	wg.Wait()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/O-Nicolinho/sixpaths_kv/internal/sixpaths_kvs"
+)
+
+// session.go lets clients use sessions through the router.
+// every node keeps its own sessions, so registering through the router opens
+// one session on each node and hands back a token naming all of them:
+//   rs:n1=sess-5-<token>,n2=sess-9-<token>,...
+// the token itself holds the node sessions, the router picks the node's one
+// out of it whenever a write for that node comes in. what the router does
+// keep per token is the highest index it has seen from each node (see
+// sessionTokens in tokens.go), for read-your-writes; that's only a cache,
+// an entry idle for sessionTokenIdle is dropped and a restart loses them all.
+
+const routerSessionPrefix = "rs:"
+
+var (
+	errBadSessionToken = errors.New("error: malformed router session token")
+	errBadIndexToken   = errors.New("error: malformed read token, expected node=index,...")
+)
+
+type sessionReq struct {
+	TTLMs int64 `json:"ttlMs"`
+}
+
+type keepAliveReq struct {
+	Session string `json:"session"`
+}
+
+type sessionResp struct {
+	Session string `json:"session"`
+	TTLMs   int64  `json:"ttlMs,omitempty"`
+}
+
+// parses a router session token into node ID -> node session ID
+func parseSessionToken(tok string) (map[string]string, error) {
+	if !strings.HasPrefix(tok, routerSessionPrefix) {
+		return nil, errBadSessionToken
+	}
+	out := make(map[string]string)
+	for _, part := range strings.Split(tok[len(routerSessionPrefix):], ",") {
+		id, sess, ok := strings.Cut(part, "=")
+		if !ok || id == "" || sess == "" {
+			return nil, errBadSessionToken
+		}
+		out[id] = sess
+	}
+	return out, nil
+}
+
+// resolves the client ID to send to node: router session tokens turn into the
+// node's own session, anything else is passed through as is
+func (r *router) clientFor(node sixpaths_kvs.NodeConfig, client string) (string, error) {
+	if !strings.HasPrefix(client, routerSessionPrefix) {
+		return client, nil
+	}
+	sessions, err := parseSessionToken(client)
+	if err != nil {
+		return "", err
+	}
+	sess, ok := sessions[node.ID]
+	if !ok {
+		return "", errBadSessionToken
+	}
+	return sess, nil
+}
+
+// sends req to every node in parallel, the responses come back in r.nodes order
+func (r *router) fanout(ctx context.Context, build func(n sixpaths_kvs.NodeConfig) *sixpaths_kvs.RPCRequest) ([]*sixpaths_kvs.RPCResponse, []error) {
+	resps := make([]*sixpaths_kvs.RPCResponse, len(r.nodes))
+	errs := make([]error, len(r.nodes))
+
+	var wg sync.WaitGroup
+	for i, n := range r.nodes {
+		wg.Add(1)
+		go func(i int, n sixpaths_kvs.NodeConfig) {
+			defer wg.Done()
+			resps[i], errs[i] = r.forward(ctx, n, build(n))
+		}(i, n)
+	}
+	wg.Wait()
+	return resps, errs
+}
+
+// opens a session on every node and returns the token for all of them.
+// if any node fails, the sessions opened on the others just expire.
+// ttl is the encoded TTL, as sent in an OpRegisterSession request.
+func (r *router) registerSession(ctx context.Context, ttl []byte) (string, *sixpaths_kvs.RPCResponse) {
+	resps, errs := r.fanout(ctx, func(sixpaths_kvs.NodeConfig) *sixpaths_kvs.RPCRequest {
+		return &sixpaths_kvs.RPCRequest{
+			Op:    sixpaths_kvs.OpRegisterSession,
+			Value: ttl,
+		}
+	})
+
+	parts := make([]string, 0, len(r.nodes))
+	for i, n := range r.nodes {
+		if errs[i] != nil {
+			slog.WarnContext(ctx, "session register failed", "node", n.ID, "err", errs[i])
+			return "", &sixpaths_kvs.RPCResponse{Status: sixpaths_kvs.StatusError, Err: "backend unavailable"}
+		}
+		if resps[i].Status != sixpaths_kvs.StatusOK {
+			return "", resps[i]
+		}
+		parts = append(parts, n.ID+"="+string(resps[i].Value))
+	}
+	return routerSessionPrefix + strings.Join(parts, ","), nil
+}
+
+// refreshes the token's session on every node, it fails if any of them expired
+func (r *router) keepAlive(ctx context.Context, tok string) *sixpaths_kvs.RPCResponse {
+	sessions, err := parseSessionToken(tok)
+	if err != nil {
+		return &sixpaths_kvs.RPCResponse{Status: sixpaths_kvs.StatusBadRequest, Err: err.Error()}
+	}
+
+	resps, errs := r.fanout(ctx, func(n sixpaths_kvs.NodeConfig) *sixpaths_kvs.RPCRequest {
+		return &sixpaths_kvs.RPCRequest{
+			Op:       sixpaths_kvs.OpKeepAlive,
+			ClientID: sessions[n.ID],
+		}
+	})
+
+	for i, n := range r.nodes {
+		if errs[i] != nil {
+			slog.WarnContext(ctx, "session keepalive failed", "node", n.ID, "err", errs[i])
+			return &sixpaths_kvs.RPCResponse{Status: sixpaths_kvs.StatusError, Err: "backend unavailable"}
+		}
+		if resps[i].Status != sixpaths_kvs.StatusOK {
+			return resps[i]
+		}
+	}
+	return &sixpaths_kvs.RPCResponse{Status: sixpaths_kvs.StatusOK, Success: true, Value: []byte(tok)}
+}
+
+// POST /session
+// Body: {"ttlMs": N}   (optional)
+func (r *router) handleSession(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		proxyError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var parsed sessionReq
+	if req.ContentLength != 0 {
+		if err := readJSON(req, &parsed); err != nil {
+			proxyError(w, http.StatusBadRequest, "invalid JSON")
+			return
+		}
+	}
+	if parsed.TTLMs < 0 {
+		proxyError(w, http.StatusBadRequest, "ttlMs must not be negative")
+		return
+	}
+	ttl := time.Duration(parsed.TTLMs) * time.Millisecond
+	if ttl == 0 {
+		ttl = sixpaths_kvs.DefaultSessionTTL
+	}
+
+	tok, fail := r.registerSession(req.Context(), sixpaths_kvs.EncodeSessionTTL(ttl))
+	if fail != nil {
+		proxyError(w, httpStatus(fail.Status), fail.Err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sessionResp{Session: tok, TTLMs: ttl.Milliseconds()})
+}
+
+// POST /session/keepalive
+// Body: {"session": "rs:..."}
+func (r *router) handleKeepAlive(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		proxyError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var parsed keepAliveReq
+	if err := readJSON(req, &parsed); err != nil {
+		proxyError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+
+	resp := r.keepAlive(req.Context(), parsed.Session)
+	if resp.Status != sixpaths_kvs.StatusOK {
+		proxyError(w, httpStatus(resp.Status), resp.Err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sessionResp{Session: parsed.Session})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokens.go implements read-your-writes tokens on the router.
+// log indexes are per node, so a token lists one per node:
+//   n1=12,n3=40
+// writes and reads answer with the index they reached on their node, a
+// client merges those into its token and passes it back on reads as
+// ?token=..., and the router turns it into the minIndex of the owning node.
+// for router sessions (rs:...) the router also keeps the token itself, so
+// session clients get read-your-writes without carrying anything.
+
+// session tokens idle for longer than this are forgotten
+const sessionTokenIdle = 10 * time.Minute
+
+type indexToken map[string]uint64
+
+func parseIndexToken(s string) (indexToken, error) {
+	tok := indexToken{}
+	if s == "" {
+		return tok, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		id, v, ok := strings.Cut(part, "=")
+		if !ok || id == "" {
+			return nil, errBadIndexToken
+		}
+		idx, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, errBadIndexToken
+		}
+		tok.observe(id, idx)
+	}
+	return tok, nil
+}
+
+func (t indexToken) observe(node string, idx uint64) {
+	if idx > t[node] {
+		t[node] = idx
+	}
+}
+
+func (t indexToken) String() string {
+	ids := make([]string, 0, len(t))
+	for id := range t {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	parts := make([]string, 0, len(ids))
+	for _, id := range ids {
+		parts = append(parts, id+"="+strconv.FormatUint(t[id], 10))
+	}
+	return strings.Join(parts, ",")
+}
+
+// the token a single node answer turns into
+func nodeToken(node string, idx uint64) string {
+	if idx == 0 {
+		return ""
+	}
+	return indexToken{node: idx}.String()
+}
+
+// sessionTokens remembers the highest index each router session has seen per node
+type sessionTokens struct {
+	mu   sync.Mutex
+	toks map[string]*sessionToken
+	last time.Time // last prune
+}
+
+type sessionToken struct {
+	tok  indexToken
+	used time.Time
+}
+
+func newSessionTokens() *sessionTokens {
+	return &sessionTokens{toks: make(map[string]*sessionToken)}
+}
+
+// records that session sess has seen index idx on node
+func (st *sessionTokens) observe(sess, node string, idx uint64) {
+	if !strings.HasPrefix(sess, routerSessionPrefix) || idx == 0 {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	st.pruneLocked(now)
+
+	e, ok := st.toks[sess]
+	if !ok {
+		e = &sessionToken{tok: indexToken{}}
+		st.toks[sess] = e
+	}
+	e.tok.observe(node, idx)
+	e.used = now
+}
+
+// the index session sess has to see on node, 0 if none
+func (st *sessionTokens) minIndex(sess, node string) uint64 {
+	if !strings.HasPrefix(sess, routerSessionPrefix) {
+		return 0
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	e, ok := st.toks[sess]
+	if !ok {
+		return 0
+	}
+	e.used = time.Now()
+	return e.tok[node]
+}
+
+func (st *sessionTokens) pruneLocked(now time.Time) {
+	if now.Sub(st.last) < time.Minute {
+		return
+	}
+	st.last = now
+	for sess, e := range st.toks {
+		if now.Sub(e.used) > sessionTokenIdle {
+			delete(st.toks, sess)
+		}
+	}
+}
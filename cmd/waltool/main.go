@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/O-Nicolinho/sixpaths_kv/internal/sixpaths_kvs"
+)
+
+// waltool/main.go inspects and repairs a node's WAL while the node is down.
+// dump, verify and stats only ever read the log (see wal_inspect.go), the
+// one command that changes it is truncate, and it backs the file up first.
+// PATH is the WAL file or the node's data directory.
+
+const usage = `usage: waltool <command> [flags] PATH
+
+commands:
+  dump [-max-value N]     print every record as a JSON line, with its offset
+  verify                  check checksums and index continuity, report the first problem
+  stats                   count records by type, keys, clients and bytes
+  truncate -at-offset N   cut the log at offset N, after copying it to PATH.bak-<time>
+
+PATH is a WAL file or a node's data directory. verify exits 1 if the log has a problem.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	cmd, args := os.Args[1], os.Args[2:]
+
+	var err error
+	switch cmd {
+	case "dump":
+		err = dump(args)
+	case "verify":
+		err = verify(args)
+	case "stats":
+		err = stats(args)
+	case "truncate":
+		err = truncate(args)
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "waltool: unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "waltool:", err)
+		os.Exit(1)
+	}
+}
+
+// parses a command's flags and returns the WAL path it was given
+func parseArgs(fs *flag.FlagSet, args []string) (string, error) {
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: waltool %s [flags] PATH\n", fs.Name())
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return "", fmt.Errorf("error: %s takes exactly one PATH", fs.Name())
+	}
+	path := fs.Arg(0)
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, "wal")
+	}
+	return path, nil
+}
+
+type dumpRecord struct {
+	Offset      int64  `json:"offset"`
+	Size        int    `json:"size"`
+	Index       uint64 `json:"index"`
+	Time        string `json:"time,omitempty"`
+	Type        string `json:"type"`
+	Client      string `json:"client,omitempty"`
+	Seq         uint64 `json:"seq,omitempty"`
+	Key         string `json:"key,omitempty"`
+	Value       string `json:"value,omitempty"`
+	ValueBase64 string `json:"valueBase64,omitempty"` // values that aren't UTF-8, like chunks
+	ValueLen    int    `json:"valueLen"`
+	Truncated   bool   `json:"truncated,omitempty"` // only the first -max-value bytes are shown
+}
+
+func dump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	maxValue := fs.Int("max-value", 256, "show at most this many bytes of each value, -1 for all")
+	path, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	scan, err := sixpaths_kvs.ScanWAL(path, func(fr sixpaths_kvs.WALFrame) error {
+		cmd := fr.Record.Cmd
+		d := dumpRecord{
+			Offset:   fr.Offset,
+			Size:     fr.Size,
+			Index:    fr.Record.LogIndex,
+			Type:     cmd.Instruct.String(),
+			Client:   cmd.ClientID,
+			Seq:      cmd.Seq,
+			Key:      string(cmd.Key),
+			ValueLen: len(cmd.Value),
+		}
+		if cmd.Time != 0 {
+			d.Time = time.Unix(0, cmd.Time).UTC().Format(time.RFC3339Nano)
+		}
+		v := cmd.Value
+		if *maxValue >= 0 && len(v) > *maxValue {
+			v, d.Truncated = v[:*maxValue], true
+		}
+		if utf8.Valid(v) {
+			d.Value = string(v)
+		} else {
+			d.ValueBase64 = base64.StdEncoding.EncodeToString(v)
+		}
+		return enc.Encode(d)
+	})
+	if err != nil {
+		return err
+	}
+	if scan.Problem != nil {
+		return scan.Problem
+	}
+	return nil
+}
+
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	path, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	scan, err := sixpaths_kvs.ScanWAL(path, nil)
+	if err != nil {
+		return err
+	}
+	if p := scan.Problem; p != nil {
+		fmt.Printf("CORRUPT %s\n", path)
+		fmt.Printf("  problem:    %s at offset %d\n", p.Kind, p.Offset)
+		fmt.Printf("  detail:     %v\n", p.Err)
+		fmt.Printf("  good:       %d records, indexes %d..%d, ending at offset %d\n",
+			scan.Records, scan.FirstIndex, scan.LastIndex, scan.GoodEnd)
+		fmt.Printf("  after that: %d bytes\n", scan.Size-scan.GoodEnd)
+		fmt.Printf("  to drop everything from the problem on (a backup is kept):\n")
+		fmt.Printf("    waltool truncate -at-offset %d %s\n", scan.GoodEnd, path)
+		return fmt.Errorf("error: %s has a %s problem at offset %d", path, p.Kind, p.Offset)
+	}
+	fmt.Printf("OK %s: %d records, indexes %d..%d, %d bytes\n", path, scan.Records, scan.FirstIndex, scan.LastIndex, scan.Size)
+	return nil
+}
+
+type typeStats struct {
+	Records int   `json:"records"`
+	Bytes   int64 `json:"bytes"`
+}
+
+type walStats struct {
+	Path          string                `json:"path"`
+	Version       int                   `json:"version"`
+	SizeBytes     int64                 `json:"sizeBytes"`
+	Records       int                   `json:"records"`
+	FirstIndex    uint64                `json:"firstIndex"`
+	LastIndex     uint64                `json:"lastIndex"`
+	FirstTime     string                `json:"firstTime,omitempty"`
+	LastTime      string                `json:"lastTime,omitempty"`
+	ByType        map[string]*typeStats `json:"byType"`
+	Keys          int                   `json:"keys"` // distinct user keys written or deleted
+	Clients       int                   `json:"clients"`
+	LargestRecord int                   `json:"largestRecordBytes"`
+	Problem       string                `json:"problem,omitempty"`
+}
+
+func stats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print JSON instead of text")
+	path, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	st := walStats{Path: path, ByType: make(map[string]*typeStats)}
+	keys := make(map[string]struct{})
+	clients := make(map[string]struct{})
+	var firstTime, lastTime int64
+	scan, err := sixpaths_kvs.ScanWAL(path, func(fr sixpaths_kvs.WALFrame) error {
+		cmd := fr.Record.Cmd
+		ts := st.ByType[cmd.Instruct.String()]
+		if ts == nil {
+			ts = &typeStats{}
+			st.ByType[cmd.Instruct.String()] = ts
+		}
+		ts.Records++
+		ts.Bytes += int64(fr.Size)
+		st.LargestRecord = max(st.LargestRecord, fr.Size)
+		if cmd.Instruct == sixpaths_kvs.CmdPut || cmd.Instruct == sixpaths_kvs.CmdDelete || cmd.Instruct == sixpaths_kvs.CmdPutManifest {
+			keys[string(cmd.Key)] = struct{}{}
+		}
+		if cmd.ClientID != "" {
+			clients[cmd.ClientID] = struct{}{}
+		}
+		if cmd.Time != 0 {
+			if firstTime == 0 {
+				firstTime = cmd.Time
+			}
+			lastTime = cmd.Time
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	st.Version = scan.Version
+	st.SizeBytes = scan.Size
+	st.Records = scan.Records
+	st.FirstIndex, st.LastIndex = scan.FirstIndex, scan.LastIndex
+	st.Keys, st.Clients = len(keys), len(clients)
+	if firstTime != 0 {
+		st.FirstTime = time.Unix(0, firstTime).UTC().Format(time.RFC3339Nano)
+		st.LastTime = time.Unix(0, lastTime).UTC().Format(time.RFC3339Nano)
+	}
+	if scan.Problem != nil {
+		st.Problem = scan.Problem.Error()
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(st)
+	}
+	fmt.Printf("path:           %s (v%d)\n", st.Path, st.Version)
+	fmt.Printf("size:           %d bytes\n", st.SizeBytes)
+	fmt.Printf("records:        %d (indexes %d..%d)\n", st.Records, st.FirstIndex, st.LastIndex)
+	if st.FirstTime != "" {
+		fmt.Printf("time:           %s .. %s\n", st.FirstTime, st.LastTime)
+	}
+	fmt.Printf("keys:           %d\n", st.Keys)
+	fmt.Printf("clients:        %d\n", st.Clients)
+	fmt.Printf("largest record: %d bytes\n", st.LargestRecord)
+	types := make([]string, 0, len(st.ByType))
+	for t := range st.ByType {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		fmt.Printf("  %-17s %8d records %12d bytes\n", t, st.ByType[t].Records, st.ByType[t].Bytes)
+	}
+	if st.Problem != "" {
+		fmt.Printf("problem:        %s\n", st.Problem)
+	}
+	return nil
+}
+
+func truncate(args []string) error {
+	fs := flag.NewFlagSet("truncate", flag.ContinueOnError)
+	offset := fs.Int64("at-offset", -1, "offset to cut the log at, as printed by verify or dump (required)")
+	path, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if *offset < 0 {
+		return fmt.Errorf("error: truncate needs -at-offset")
+	}
+
+	backup, err := sixpaths_kvs.TruncateWALAt(path, *offset)
+	if backup != "" {
+		fmt.Printf("backup: %s\n", backup)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("truncated %s at offset %d\n", path, *offset)
+	return nil
+}
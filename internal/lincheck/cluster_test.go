@@ -0,0 +1,316 @@
+package lincheck
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/O-Nicolinho/sixpaths_kv/internal/sixpaths_kvs"
+)
+
+// cluster_test.go runs clients against an in-process cluster while requests
+// get lost on the way there or back and nodes crash and come back, then
+// checks that what the clients saw is linearizable. A write whose answer got
+// lost is sent again with the same seq, so the node's dedup has to make sure
+// it's applied once; a node that restarts has to come back with every write
+// it answered.
+
+// a node of the test cluster, restart swaps the node under the handler
+type testNode struct {
+	dir string
+
+	mu   sync.RWMutex // held for writing while the node is down
+	node *sixpaths_kvs.Node
+	h    http.Handler
+}
+
+func startTestNode(t *testing.T) *testNode {
+	tn := &testNode{dir: t.TempDir()}
+	if err := tn.open(); err != nil {
+		t.Fatalf("open node: %v", err)
+	}
+	t.Cleanup(func() { _ = tn.node.Close() })
+	return tn
+}
+
+func (tn *testNode) open() error {
+	// a failure should show the history, not thousands of request logs
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	n, err := sixpaths_kvs.OpenNodeWithOptions(tn.dir, sixpaths_kvs.NodeOptions{Logger: quiet})
+	if err != nil {
+		return err
+	}
+	tn.node = n
+	tn.h = sixpaths_kvs.NewHTTPServer(n, "").Handler()
+	return nil
+}
+
+// a node that's down turns requests away, like a connection being refused
+func (tn *testNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !tn.mu.TryRLock() {
+		http.Error(w, "node is down", http.StatusServiceUnavailable)
+		return
+	}
+	defer tn.mu.RUnlock()
+	tn.h.ServeHTTP(w, r)
+}
+
+// closes the node once the requests it's serving are done and opens it again
+// from its data dir
+func (tn *testNode) restart() error {
+	tn.mu.Lock()
+	defer tn.mu.Unlock()
+	if err := tn.node.Close(); err != nil {
+		return err
+	}
+	return tn.open()
+}
+
+var (
+	errDropped = errors.New("injected: request dropped")
+	errLost    = errors.New("injected: response lost")
+)
+
+// flakyTransport loses some requests before they reach the node, and the
+// responses of some that did
+type flakyTransport struct {
+	base http.RoundTripper
+	drop float64 // chance a request never arrives
+	lose float64 // chance a response never comes back
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func (f *flakyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	roll := f.rng.Float64()
+	f.mu.Unlock()
+	if roll < f.drop {
+		return nil, errDropped
+	}
+	resp, err := f.base.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	if roll < f.drop+f.lose {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, errLost
+	}
+	return resp, nil
+}
+
+type linClient struct {
+	id    int
+	name  string
+	seq   uint64
+	http  *http.Client
+	nodes []string
+}
+
+// picks the node that owns key, the same way the router does
+func (c *linClient) base(key string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	idx := int(h.Sum32()) % len(c.nodes)
+	if idx < 0 {
+		idx = -idx
+	}
+	return c.nodes[idx]
+}
+
+// how often a client tries an operation before giving up on it
+const maxAttempts = 30
+
+// runs op until the node answers it, a write is resent with the same seq
+func (c *linClient) run(ctx context.Context, rec *Recorder, kind OpKind, key, value string) {
+	call := rec.Invoke(c.id, kind, key, value)
+	var seq uint64
+	if kind != OpGet {
+		c.seq++
+		seq = c.seq
+	}
+	for range maxAttempts {
+		out, found, done, err := c.try(ctx, kind, key, value, seq)
+		if err == nil {
+			call.Return(out, found)
+			return
+		}
+		if done {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	call.Fail()
+}
+
+// done is true if trying again won't help
+func (c *linClient) try(ctx context.Context, kind OpKind, key, value string, seq uint64) (out string, found, done bool, err error) {
+	var req *http.Request
+	switch kind {
+	case OpGet:
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, c.base(key)+"/get?"+url.Values{"key": {key}}.Encode(), nil)
+	default:
+		path := "/put"
+		body := map[string]any{"client": c.name, "seq": seq, "key": key}
+		if kind == OpPut {
+			body["value"] = value
+		} else {
+			path = "/delete"
+		}
+		b, _ := json.Marshal(body)
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, c.base(key)+path, bytes.NewReader(b))
+	}
+	if err != nil {
+		return "", false, true, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", false, false, err
+	}
+	defer resp.Body.Close()
+
+	var r struct {
+		Value     string `json:"value"`
+		PrevValue string `json:"prevValue"`
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			return "", false, false, err
+		}
+		if kind == OpGet {
+			return r.Value, true, false, nil
+		}
+		// values are never empty, so no previous value means there was none
+		return r.PrevValue, r.PrevValue != "", false, nil
+	case resp.StatusCode == http.StatusNotFound && kind == OpGet:
+		return "", false, false, nil
+	case resp.StatusCode == http.StatusConflict:
+		// the result fell out of the dedup window
+		return "", false, true, errors.New(resp.Status)
+	}
+	return "", false, false, errors.New(resp.Status)
+}
+
+func TestClusterLinearizableUnderFaults(t *testing.T) {
+	const (
+		nodes        = 3
+		clients      = 6
+		opsPerClient = 150
+	)
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	seed := uint64(time.Now().UnixNano())
+	t.Logf("seed %d", seed)
+
+	var tns []*testNode
+	var addrs []string
+	for range nodes {
+		tn := startTestNode(t)
+		srv := httptest.NewServer(tn)
+		t.Cleanup(srv.Close)
+		tns = append(tns, tn)
+		addrs = append(addrs, srv.URL)
+	}
+
+	rec := NewRecorder()
+	ctx := t.Context()
+
+	// nodes crash and come back until the clients are done
+	stop := make(chan struct{})
+	var restarts atomic.Int64
+	var crashErr error
+	crashDone := make(chan struct{})
+	go func() {
+		defer close(crashDone)
+		rng := rand.New(rand.NewPCG(seed, 1))
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			if err := tns[rng.IntN(nodes)].restart(); err != nil {
+				crashErr = err
+				return
+			}
+			restarts.Add(1)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := &linClient{
+				id:   i,
+				name: fmt.Sprintf("lin-%d", i),
+				http: &http.Client{
+					Timeout: 5 * time.Second,
+					Transport: &flakyTransport{
+						base: http.DefaultTransport,
+						drop: 0.1,
+						lose: 0.1,
+						rng:  rand.New(rand.NewPCG(seed, uint64(i)+2)),
+					},
+				},
+				nodes: addrs,
+			}
+			rng := rand.New(rand.NewPCG(seed, uint64(i)+100))
+			for j := range opsPerClient {
+				key := keys[rng.IntN(len(keys))]
+				switch roll := rng.IntN(10); {
+				case roll < 5:
+					c.run(ctx, rec, OpGet, key, "")
+				case roll < 9:
+					c.run(ctx, rec, OpPut, key, fmt.Sprintf("c%d-%d", i, j))
+				default:
+					c.run(ctx, rec, OpDelete, key, "")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	<-crashDone
+	if crashErr != nil {
+		t.Fatalf("restart: %v", crashErr)
+	}
+
+	h := rec.History()
+	var unknown int
+	for _, op := range h {
+		if op.Unknown {
+			unknown++
+		}
+	}
+	t.Logf("%d ops (%d with unknown outcome), %d restarts", len(h), unknown, restarts.Load())
+	if restarts.Load() == 0 {
+		t.Fatalf("no node was restarted while the clients ran")
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	res, err := Check(checkCtx, h)
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if !res.Ok {
+		t.Fatalf("seed %d: %v", seed, res)
+	}
+}
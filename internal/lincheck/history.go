@@ -0,0 +1,72 @@
+package lincheck
+
+import (
+	"sync"
+	"time"
+)
+
+// history.go records the operations clients run, for Check. Clients call
+// Invoke right before sending an operation and Return or Fail on the Call
+// once they know how it went, from as many goroutines as they like. Times
+// come from the monotonic clock.
+
+type Recorder struct {
+	start time.Time
+
+	mu  sync.Mutex
+	ops []Operation
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{start: time.Now()}
+}
+
+// Call is an operation that was sent and hasn't been recorded yet.
+type Call struct {
+	r  *Recorder
+	op Operation
+}
+
+// Invoke notes that client is about to send an operation, value is only used
+// by puts.
+func (r *Recorder) Invoke(client int, kind OpKind, key, value string) *Call {
+	op := Operation{Client: client, Kind: kind, Key: key, Value: value}
+	op.Call = r.now()
+	return &Call{r: r, op: op}
+}
+
+// Return records the operation with what came back, see Operation.Output and
+// Operation.Found.
+func (c *Call) Return(output string, found bool) {
+	c.op.Return = c.r.now()
+	c.op.Output = output
+	c.op.Found = found
+	c.r.add(c.op)
+}
+
+// Fail records that the client gave up on the operation without knowing
+// whether it happened. A get that failed changed nothing, so it's dropped.
+func (c *Call) Fail() {
+	if c.op.Kind == OpGet {
+		return
+	}
+	c.op.Unknown = true
+	c.r.add(c.op)
+}
+
+// History returns the operations recorded so far.
+func (r *Recorder) History() []Operation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Operation(nil), r.ops...)
+}
+
+func (r *Recorder) now() int64 {
+	return time.Since(r.start).Nanoseconds()
+}
+
+func (r *Recorder) add(op Operation) {
+	r.mu.Lock()
+	r.ops = append(r.ops, op)
+	r.mu.Unlock()
+}
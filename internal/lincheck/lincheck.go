@@ -0,0 +1,302 @@
+// Package lincheck checks recorded histories of client operations against
+// the key-value store for linearizability.
+package lincheck
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// lincheck.go implements the checker. A history is linearizable if every
+// operation can be given a single point in time between its call and its
+// return such that, taken in that order, the operations behave like they ran
+// one at a time against a plain map. Keys don't interact, so we split the
+// history by key and check each part on its own, which keeps the search
+// small (P-compositionality).
+// The search is the one from Wing & Gong, with Lowe's memoization, as used
+// by Porcupine: we walk the history in time order, try to linearize each call
+// that's pending, and backtrack when we hit a return whose call we couldn't
+// place. (linearized set, state) pairs we've been in before are skipped.
+
+type OpKind uint8
+
+const (
+	OpGet OpKind = iota
+	OpPut
+	OpDelete
+)
+
+func (k OpKind) String() string {
+	switch k {
+	case OpGet:
+		return "get"
+	case OpPut:
+		return "put"
+	case OpDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("op(%d)", uint8(k))
+}
+
+// Operation is one client operation as it was seen by the client.
+type Operation struct {
+	Client int
+	Kind   OpKind
+	Key    string
+	Value  string // the value a put wrote
+
+	// what came back: for a get the value read, for a put the previous value
+	Output string
+	Found  bool // a get found the key, or a put replaced a value
+
+	// when the client sent it and heard back, in ns since the history started
+	Call   int64
+	Return int64
+
+	// we never heard back, a write may or may not have happened; its output
+	// and Return mean nothing
+	Unknown bool
+}
+
+func (op Operation) String() string {
+	var in string
+	switch op.Kind {
+	case OpGet, OpDelete:
+		in = fmt.Sprintf("%s(%q)", op.Kind, op.Key)
+	default:
+		in = fmt.Sprintf("%s(%q, %q)", op.Kind, op.Key, op.Value)
+	}
+	if op.Unknown {
+		return fmt.Sprintf("c%d %s -> ? [%d, ...]", op.Client, in, op.Call)
+	}
+	out := "<none>"
+	if op.Found {
+		out = fmt.Sprintf("%q", op.Output)
+	}
+	return fmt.Sprintf("c%d %s -> %s [%d, %d]", op.Client, in, out, op.Call, op.Return)
+}
+
+// Result is what Check found.
+type Result struct {
+	Ok  bool
+	Key string      // the first key whose history isn't linearizable
+	Ops []Operation // its history, by call time
+}
+
+func (r Result) String() string {
+	if r.Ok {
+		return "linearizable"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "history of key %q is not linearizable:\n", r.Key)
+	for _, op := range r.Ops {
+		fmt.Fprintf(&b, "  %s\n", op)
+	}
+	return b.String()
+}
+
+// Check checks a history key by key. It gives up with ctx's error if ctx is
+// done before it has an answer.
+func Check(ctx context.Context, ops []Operation) (Result, error) {
+	byKey := make(map[string][]Operation)
+	var keys []string
+	for _, op := range ops {
+		if _, ok := byKey[op.Key]; !ok {
+			keys = append(keys, op.Key)
+		}
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		ok, err := CheckKey(ctx, byKey[k])
+		if err != nil {
+			return Result{}, err
+		}
+		if !ok {
+			part := byKey[k]
+			sort.SliceStable(part, func(i, j int) bool { return part[i].Call < part[j].Call })
+			return Result{Key: k, Ops: part}, nil
+		}
+	}
+	return Result{Ok: true}, nil
+}
+
+// the state of one key
+type regState struct {
+	value string
+	found bool
+}
+
+// applies op to s, ok is false if op's output can't have come from s
+func step(s regState, op Operation) (bool, regState) {
+	switch op.Kind {
+	case OpGet:
+		if op.Unknown {
+			return true, s
+		}
+		return op.Found == s.found && (!s.found || op.Output == s.value), s
+	case OpPut:
+		next := regState{value: op.Value, found: true}
+		if op.Unknown {
+			return true, next
+		}
+		return op.Found == s.found && (!s.found || op.Output == s.value), next
+	case OpDelete:
+		return true, regState{}
+	}
+	return false, s
+}
+
+// one call or return in the history, kept in a doubly linked list by time
+type entry struct {
+	op    int // index into the key's operations
+	call  bool
+	time  int64
+	match *entry // a call's return
+	prev  *entry
+	next  *entry
+}
+
+// CheckKey checks the history of a single key.
+func CheckKey(ctx context.Context, ops []Operation) (bool, error) {
+	events := make([]*entry, 0, 2*len(ops))
+	for i, op := range ops {
+		ret := op.Return
+		// we may place an operation we never heard back from anywhere after its
+		// call, at the very end it has no effect anyone saw
+		if op.Unknown {
+			ret = math.MaxInt64
+		}
+		c := &entry{op: i, call: true, time: op.Call}
+		r := &entry{op: i, time: ret}
+		c.match = r
+		events = append(events, c, r)
+	}
+	// on a tie, calls go first, so the operations count as overlapping
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].time != events[j].time {
+			return events[i].time < events[j].time
+		}
+		return events[i].call && !events[j].call
+	})
+	head := &entry{}
+	prev := head
+	for _, e := range events {
+		prev.next = e
+		e.prev = prev
+		prev = e
+	}
+
+	type frame struct {
+		e     *entry
+		state regState
+	}
+	var stack []frame
+	lin := newBitset(len(ops))
+	seen := make(cache)
+	state := regState{}
+	e := head.next
+	for steps := 0; head.next != nil; steps++ {
+		if steps%4096 == 0 && ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		if e.call {
+			if ok, next := step(state, ops[e.op]); ok {
+				lin.set(e.op)
+				if seen.add(lin, next) {
+					stack = append(stack, frame{e: e, state: state})
+					state = next
+					lift(e)
+					e = head.next
+					continue
+				}
+				lin.clear(e.op)
+			}
+			e = e.next
+			continue
+		}
+		// a return whose call we couldn't place, so we undo the last choice
+		if len(stack) == 0 {
+			return false, nil
+		}
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = f.state
+		lin.clear(f.e.op)
+		unlift(f.e)
+		e = f.e.next
+	}
+	return true, nil
+}
+
+// takes a call and its return out of the list
+func lift(e *entry) {
+	e.prev.next = e.next
+	e.next.prev = e.prev // a call is always followed by its return
+	m := e.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+// puts back what lift took out
+func unlift(e *entry) {
+	m := e.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
+
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int)   { b[i/64] |= 1 << (i % 64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1 << (i % 64) }
+
+func (b bitset) hash() uint64 {
+	h := uint64(14695981039346656037)
+	for _, w := range b {
+		h ^= w
+		h *= 1099511628211
+	}
+	return h
+}
+
+func (b bitset) equal(o bitset) bool {
+	for i := range b {
+		if b[i] != o[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// (linearized set, state) pairs the search has been in
+type cache map[uint64][]cacheEntry
+
+type cacheEntry struct {
+	lin   bitset
+	state regState
+}
+
+// adds the pair, false if it was there already
+func (c cache) add(lin bitset, s regState) bool {
+	h := lin.hash()
+	for _, ce := range c[h] {
+		if ce.state == s && ce.lin.equal(lin) {
+			return false
+		}
+	}
+	c[h] = append(c[h], cacheEntry{lin: append(bitset(nil), lin...), state: s})
+	return true
+}
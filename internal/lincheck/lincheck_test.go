@@ -0,0 +1,146 @@
+package lincheck
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func put(client int, key, value, prev string, call, ret int64) Operation {
+	return Operation{Client: client, Kind: OpPut, Key: key, Value: value, Output: prev, Found: prev != "", Call: call, Return: ret}
+}
+
+func get(client int, key, value string, call, ret int64) Operation {
+	return Operation{Client: client, Kind: OpGet, Key: key, Output: value, Found: value != "", Call: call, Return: ret}
+}
+
+func del(client int, key string, call, ret int64) Operation {
+	return Operation{Client: client, Kind: OpDelete, Key: key, Call: call, Return: ret}
+}
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		name string
+		ops  []Operation
+		ok   bool
+	}{
+		{"empty", nil, true},
+		{"sequential", []Operation{
+			get(1, "k", "", 0, 1),
+			put(1, "k", "a", "", 2, 3),
+			get(2, "k", "a", 4, 5),
+			del(1, "k", 6, 7),
+			get(2, "k", "", 8, 9),
+		}, true},
+		{"stale read", []Operation{
+			put(1, "k", "a", "", 0, 1),
+			put(1, "k", "b", "a", 2, 3),
+			get(2, "k", "a", 4, 5),
+		}, false},
+		{"no going back once a new value was read", []Operation{
+			put(1, "k", "a", "", 0, 1),
+			put(1, "k", "b", "a", 2, 10),
+			get(2, "k", "b", 3, 4),
+			get(3, "k", "a", 5, 6),
+		}, false},
+		{"overlapping reads", []Operation{
+			put(1, "k", "a", "", 0, 1),
+			put(1, "k", "b", "a", 2, 10),
+			get(3, "k", "a", 3, 5),
+			get(2, "k", "b", 4, 6),
+		}, true},
+		{"reordered concurrent puts", []Operation{
+			put(1, "k", "a", "b", 0, 10),
+			put(2, "k", "b", "", 1, 5),
+			get(3, "k", "a", 11, 12),
+		}, true},
+		{"wrong previous value", []Operation{
+			put(1, "k", "a", "", 0, 1),
+			put(2, "k", "b", "", 2, 3),
+		}, false},
+		{"keys are independent", []Operation{
+			put(1, "x", "a", "", 0, 1),
+			get(2, "y", "", 2, 3),
+			get(2, "x", "a", 4, 5),
+		}, true},
+		{"unknown write may have happened", []Operation{
+			{Client: 1, Kind: OpPut, Key: "k", Value: "a", Call: 0, Unknown: true},
+			get(2, "k", "", 1, 2),
+			get(2, "k", "a", 3, 4),
+		}, true},
+		{"unknown write may not have happened", []Operation{
+			{Client: 1, Kind: OpPut, Key: "k", Value: "a", Call: 0, Unknown: true},
+			get(2, "k", "", 5, 6),
+		}, true},
+		{"unknown write can't go back in time", []Operation{
+			get(2, "k", "a", 0, 1),
+			{Client: 1, Kind: OpPut, Key: "k", Value: "a", Call: 2, Unknown: true},
+		}, false},
+		// a retried put that dedup missed lands a second time, after a later write
+		{"write applied twice", []Operation{
+			put(1, "k", "a", "", 0, 3),
+			put(2, "k", "b", "a", 4, 5),
+			get(3, "k", "a", 6, 7),
+		}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := Check(context.Background(), tc.ops)
+			if err != nil {
+				t.Fatalf("Check: %v", err)
+			}
+			if res.Ok != tc.ok {
+				t.Fatalf("Check = %v, want ok=%v", res, tc.ok)
+			}
+			if !res.Ok && res.Key != tc.ops[0].Key {
+				t.Fatalf("failing key = %q", res.Key)
+			}
+		})
+	}
+}
+
+func TestCheckManyConcurrentWriters(t *testing.T) {
+	// every put overlaps every other one and a final read sees the last
+	// value, which leaves only one order, the search must find it without
+	// trying all of them
+	const n = 60
+	var ops []Operation
+	prev := ""
+	for i := range n {
+		v := string(rune('A'+i%26)) + strings.Repeat("x", i/26)
+		ops = append(ops, put(i, "k", v, prev, int64(i), int64(1000+i)))
+		prev = v
+	}
+	ops = append(ops, get(n, "k", prev, 2000, 2001))
+	res, err := Check(context.Background(), ops)
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if !res.Ok {
+		t.Fatalf("Check = %v", res)
+	}
+}
+
+func TestCheckGivesUp(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Check(ctx, []Operation{put(1, "k", "a", "", 0, 1)}); err == nil {
+		t.Fatalf("Check with a done context returned no error")
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder()
+	c := r.Invoke(1, OpPut, "k", "a")
+	c.Return("", false)
+	r.Invoke(2, OpGet, "k", "").Fail()
+	r.Invoke(3, OpDelete, "k", "").Fail()
+
+	h := r.History()
+	if len(h) != 2 {
+		t.Fatalf("history has %d ops, want 2 (the failed get is dropped): %v", len(h), h)
+	}
+	if h[0].Unknown || h[0].Return < h[0].Call || !h[1].Unknown || h[1].Kind != OpDelete {
+		t.Fatalf("history = %v", h)
+	}
+}
@@ -2,6 +2,7 @@ package sixpaths_kvs
 
 import (
 	"errors"
+	"fmt"
 )
 
 // apply.go defines the Command type which allows us to interface with the KV store
@@ -14,24 +15,55 @@ type Command struct {
 	Seq      uint64
 	Key      []byte
 	Value    []byte
+	Time     int64 // unix nanos, stamped by the node when the command is logged
 }
 
 type CommandType uint8
 
 const (
-	CmdUnknown CommandType = iota // invalid or unset
-	CmdPut     CommandType = 1    // = 1
-	CmdDelete  CommandType = 2    // = 2
+	CmdUnknown         CommandType = iota // invalid or unset
+	CmdPut             CommandType = 1    // = 1
+	CmdDelete          CommandType = 2    // = 2
+	CmdPutChunk        CommandType = 3    // = 3, one chunk of a streamed value (see stream.go)
+	CmdPutManifest     CommandType = 4    // = 4, commits a streamed value by writing its manifest
+	CmdRegisterSession CommandType = 5    // = 5, opens a client session (see session.go)
+	CmdKeepAlive       CommandType = 6    // = 6, refreshes the session in ClientID
+	CmdDropChunks      CommandType = 7    // = 7, drops the chunks of an upload that never committed
+
+	// the highest valid CommandType, moves along when a new one is added
+	lastCommandType = CmdDropChunks
 )
 
+func (t CommandType) String() string {
+	switch t {
+	case CmdPut:
+		return "put"
+	case CmdDelete:
+		return "delete"
+	case CmdPutChunk:
+		return "put_chunk"
+	case CmdPutManifest:
+		return "put_manifest"
+	case CmdRegisterSession:
+		return "register_session"
+	case CmdKeepAlive:
+		return "keepalive"
+	case CmdDropChunks:
+		return "drop_chunks"
+	}
+	return fmt.Sprintf("cmd%d", uint8(t))
+}
+
 func validType(t CommandType) bool {
-	return t == CmdPut || t == CmdDelete // these are the only valid CommandType nums
+	// these are the only valid CommandType nums
+	return t >= CmdPut && t <= lastCommandType
 }
 
 type ApplyResult struct {
 	Success   bool
 	PrevValue []byte // To see what was deleted or overwritten
 	LogIndex  uint64
+	SessionID string // set by session commands
 }
 
 func (s *Store) Apply(cmd Command, logindex uint64) (ApplyResult, error) {
@@ -49,81 +81,143 @@ func (s *Store) Apply(cmd Command, logindex uint64) (ApplyResult, error) {
 		return r, errors.New("error: new apply request index is not equal to last log index + 1")
 	}
 
-	// we check whether the SEQ num provided by the cmd is the equal (or older) than
-	// the last SEQ num provided by this particular client.
-	// Since SEQ nums are unique per request, if these two are the same
-	// then we are dealing with a duplicate request.
-	if cmd.Seq <= s.dedupMap[cmd.ClientID].seq {
-		r.PrevValue = s.dedupMap[cmd.ClientID].result.PrevValue
+	// every change this command makes goes into one batch for the engine
+	b := &Batch{Index: logindex}
+
+	// expired sessions are dropped as logged time moves on
+	sc := s.sweepSessionsLocked(cmd.Time, b)
+
+	// how the command changes the key count and stored bytes
+	var st storeStats
+
+	// once the batch is in, the command counts as applied
+	commit := func() error {
+		s.addStatsLocked(st, b)
+		if err := s.engine.ApplyBatch(b); err != nil {
+			return err
+		}
 		s.lastlogi = logindex
-		// return previous ApplyResult if we are dealing with a dupe
-		return s.dedupMap[cmd.ClientID].result, nil
+		s.stats.keys += st.keys
+		s.stats.bytes += st.bytes
+		s.commitSessionsLocked(cmd.Time, sc)
+		s.notifyAppliedLocked()
+		return nil
+	}
+
+	if cmd.Instruct == CmdRegisterSession || cmd.Instruct == CmdKeepAlive {
+		if err := s.applySessionCmdLocked(cmd, logindex, b, sc, &r); err != nil {
+			return r, err
+		}
+		if err := commit(); err != nil {
+			return ApplyResult{LogIndex: logindex, PrevValue: []byte{}}, err
+		}
+		return r, nil
+	}
 
+	// Exec never logs a command from a dead session, but the session
+	// may have been swept by the time the log is replayed, so it's a no-op
+	if !s.refreshSessionLocked(cmd, b, sc) {
+		if err := commit(); err != nil {
+			return r, err
+		}
+		return r, nil
 	}
 
-	switch cmd.Instruct {
-	case CmdPut: // Put
-		v, ok := s.kv[string(cmd.Key)]
-		input := append([]byte(nil), cmd.Value...)
-		if !ok {
-			s.kv[string(cmd.Key)] = input
-			s.lastlogi = logindex
-			r.Success = true
-
-			//update dedup accordingly after successful Put()
-			e := s.dedupMap[cmd.ClientID]
-			e.seq = cmd.Seq
-			e.result = r
-			s.dedupMap[cmd.ClientID] = e
-
-			return r, nil
+	// chunks share the seq of the upload they belong to, only the manifest
+	// that commits the upload takes part in dedup.
+	if cmd.Instruct == CmdPutChunk {
+		b.Put(cmd.Key, cmd.Value)
+		st.bytes += int64(len(cmd.Value))
+		if err := commit(); err != nil {
+			return r, err
 		}
-		// we make a copy of the original value that we're overwriting
-		oldvalcopy := append([]byte(nil), v...)
-		r.PrevValue = oldvalcopy
-		s.kv[string(cmd.Key)] = input
 		r.Success = true
-		s.lastlogi = logindex
+		return r, nil
+	}
 
-		//update dedup accordingly
-		e := s.dedupMap[cmd.ClientID]
-		e.seq = cmd.Seq
-		e.result = r
-		s.dedupMap[cmd.ClientID] = e
+	// an upload that failed leaves its chunks behind, unless it committed
+	// after all: another try with the same seq may have got through
+	if cmd.Instruct == CmdDropChunks {
+		if m, ok := parseManifest(cmd.Value); ok {
+			if _, ds := s.dedupMap[m.ClientID].lookup(m.Seq); ds == dedupNew {
+				if err := s.dropUploadLocked(b, m, &st); err != nil {
+					return r, err
+				}
+			}
+		}
+		if err := commit(); err != nil {
+			return r, err
+		}
+		r.Success = true
+		return r, nil
+	}
 
+	// we check whether this client already had a request with this SEQ num applied.
+	// Since SEQ nums are unique per request, if it did
+	// then we are dealing with a duplicate request.
+	// (Exec turns away seqs that fell out of the window before logging them,
+	// so those only show up here if the log was written by an older version)
+	prev, ds := s.dedupMap[cmd.ClientID].lookup(cmd.Seq)
+	if ds != dedupNew {
+		// nothing changes, but the engine still learns the index was applied
+		if err := commit(); err != nil {
+			return r, err
+		}
+		// return previous ApplyResult if we are dealing with a dupe
+		if ds == dedupHit {
+			return prev, nil
+		}
 		return r, nil
+	}
+
+	if cmd.Instruct != CmdPut && cmd.Instruct != CmdPutManifest && cmd.Instruct != CmdDelete {
+		return r, errors.New("error: Apply failed, invalid cmd passed")
+	}
+
+	// we look up the value we're about to overwrite or delete
+	v, ok, err := s.engine.Get(cmd.Key)
+	if err != nil {
+		return r, err
+	}
 
+	if ok {
+		// we keep a copy of the original value for the result,
+		// unless it was a streamed value, whose chunks we drop instead
+		if m, isM := parseManifest(v); isM {
+			dropChunks(b, m)
+			st.bytes -= int64(m.Size)
+		} else {
+			r.PrevValue = v
+		}
+		st.keys--
+		st.bytes -= int64(len(cmd.Key) + len(v))
+	}
+
+	switch cmd.Instruct {
+	case CmdPut, CmdPutManifest: // Put (a manifest is put like any other value)
+		b.Put(cmd.Key, cmd.Value)
+		st.keys++
+		st.bytes += int64(len(cmd.Key) + len(cmd.Value))
 	case CmdDelete: // Delete
-		v, ok := s.kv[string(cmd.Key)]
 		// if we try to delete an empty value we just return sucess without changing the kv store
-		if !ok {
-			r.Success = true
-			s.lastlogi = logindex
-
-			e := s.dedupMap[cmd.ClientID]
-			e.seq = cmd.Seq
-			e.result = r
-			s.dedupMap[cmd.ClientID] = e
-			return r, nil
+		if ok {
+			b.Delete(cmd.Key)
 		}
-		// we make a copy of the byte slice to not alter it
-		prev := append([]byte(nil), v...)
-
-		delete(s.kv, string(cmd.Key))
-		r.PrevValue = prev
-		r.Success = true
-		s.lastlogi = logindex
+	}
 
-		// update dedup accordingly
-		e := s.dedupMap[cmd.ClientID]
-		e.seq = cmd.Seq
-		e.result = r
-		s.dedupMap[cmd.ClientID] = e
+	r.Success = true
 
-		return r, nil
+	//update dedup accordingly after a successful Put() or Delete()
+	e := s.dedupMap[cmd.ClientID].with(cmd.Seq, r)
+	// a durable engine keeps the dedup entry together with the write itself
+	if s.durable {
+		putDedupChanges(b, cmd.ClientID, s.dedupMap[cmd.ClientID], e)
+	}
 
-	default:
-		return r, errors.New("error: Apply failed, invalid cmd passed")
+	if err := commit(); err != nil {
+		return ApplyResult{LogIndex: logindex, PrevValue: []byte{}}, err
 	}
+	s.dedupMap[cmd.ClientID] = e
 
+	return r, nil
 }
@@ -30,7 +30,7 @@ func TestApplyPut(t *testing.T) {
 		t.Fatalf("Apply Put() logindex = %d, logindex=1 expected.", out.LogIndex)
 	}
 
-	v, ok := s.kv[string(com.Key)]
+	v, ok, _ := s.engine.Get(com.Key)
 	if !ok {
 		t.Fatal("No value in map at key: 'Alpha'")
 	}
@@ -109,7 +109,7 @@ func TestApplyDelete(t *testing.T) {
 		t.Fatal("Apply Delete() success = false")
 	}
 
-	v, ok := s.kv[string(com2.Key)]
+	v, ok, _ := s.engine.Get(com2.Key)
 
 	if ok {
 		t.Fatalf("Delete() operation failed, value at key: %v", v)
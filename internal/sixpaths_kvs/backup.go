@@ -0,0 +1,581 @@
+package sixpaths_kvs
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// backup.go takes backups of a running node and rebuilds data dirs from them.
+// A backup is a directory with three files:
+//
+//	snapshot     every key the engine held as of BaseIndex, internal keys included
+//	wal          a log of the records BaseIndex+1..LastIndex, in the WAL format
+//	BACKUP.json  what the backup holds (BackupInfo), written last
+//
+// BaseIndex is how far the engine had persisted when the backup was taken:
+// 0 for the map engine, whose WAL holds everything, and the last flush for a
+// durable engine, whose WAL was trimmed up to there. Both parts are cut under
+// the node's write lock, so they line up with each other exactly.
+// RestoreBackup loads the snapshot into a fresh engine and writes out the log
+// up to any index from BaseIndex to LastIndex, which lets us roll a shard back
+// to just before a given write. Over HTTP a backup travels as a tar stream.
+
+const backupFormat = 1
+
+const (
+	backupInfoFile     = "BACKUP.json"
+	backupSnapshotFile = "snapshot"
+	backupWALFile      = "wal"
+)
+
+var snapshotHeader = []byte("SNAPv1-BE\x00")
+
+// temporary dirs get a random suffix, so a new one never lands on what a
+// crashed process left behind, and leftovers can be told apart from
+// anything else by their name. backups taken for a tar stream go into the
+// data dir as backup-<suffix>, restores build the data dir next to itself
+// as <dataDir>.restoring-<suffix>.
+const (
+	backupTempPrefix  = "backup-"
+	restoreTempSuffix = ".restoring-"
+	tempSuffixLen     = 8
+)
+
+func tempName(prefix string) string {
+	var suffix [tempSuffixLen]byte
+	_, _ = rand.Read(suffix[:])
+	return prefix + hex.EncodeToString(suffix[:])
+}
+
+// whether name is one tempName(prefix) could have made
+func isTempName(name, prefix string) bool {
+	suffix, ok := strings.CutPrefix(name, prefix)
+	if !ok || len(suffix) != 2*tempSuffixLen {
+		return false
+	}
+	_, err := hex.DecodeString(suffix)
+	return err == nil
+}
+
+// removes every temporary dir in dir made with prefix
+func sweepTempDirs(fsys FS, dir, prefix string) error {
+	names, err := fsys.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if isTempName(name, prefix) {
+			if err := fsys.RemoveAll(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// BackupInfo describes a backup, it's kept in its BACKUP.json.
+type BackupInfo struct {
+	Format    int       `json:"format"`
+	Node      string    `json:"node,omitempty"`
+	Engine    string    `json:"engine"`
+	BaseIndex uint64    `json:"baseIndex"` // the snapshot holds the state as of this index
+	LastIndex uint64    `json:"lastIndex"` // the last record in the backup's log
+	Entries   int64     `json:"snapshotEntries"`
+	Records   int64     `json:"walRecords"`
+	Created   time.Time `json:"created"`
+}
+
+// RestoreOptions tunes RestoreBackup, the zero value restores everything.
+type RestoreOptions struct {
+	// the last log index to restore, 0 means the backup's LastIndex
+	ToIndex uint64
+}
+
+// implemented by durable engines that can give a view of only what they
+// have on disk, as of the index they return
+type persistedSnapshotter interface {
+	persistedSnapshot() (EngineSnapshot, uint64, error)
+}
+
+// Backup writes a consistent backup of the node into dir, which must be
+// empty or not exist yet. Writes go on while it runs, they're just not in it.
+func (n *Node) Backup(ctx context.Context, dir string) (*BackupInfo, error) {
+	if err := createEmptyDir(n.fs, dir); err != nil {
+		return nil, err
+	}
+
+	// we cut the snapshot and the log at the same index, under the write lock
+	n.mu.Lock()
+	info := &BackupInfo{Format: backupFormat, Node: n.id, Engine: n.engine, LastIndex: n.last, Created: time.Now().UTC()}
+	walEnd := n.wal.offset
+	// our own handle keeps the log we're copying around if a trim replaces it
+	walf, err := n.fs.OpenFile(n.wal.path, os.O_RDONLY, 0)
+	if err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	defer walf.Close()
+	snap, base, err := n.backupSnapshot()
+	n.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+	info.BaseIndex = base
+
+	if info.Entries, err = writeSnapshotFile(ctx, n.fs, filepath.Join(dir, backupSnapshotFile), snap); err != nil {
+		return nil, err
+	}
+	src := &WAL{f: walf, path: n.wal.path, hdrLen: len(walHeader)}
+	if info.Records, err = copyWALRange(ctx, src, walEnd, n.fs, filepath.Join(dir, backupWALFile), base, info.LastIndex); err != nil {
+		return nil, err
+	}
+
+	b, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(n.fs, filepath.Join(dir, backupInfoFile), append(b, '\n')); err != nil {
+		return nil, err
+	}
+	n.log.InfoContext(ctx, "backup", "dir", dir, "base_index", info.BaseIndex, "last_index", info.LastIndex,
+		"entries", info.Entries, "records", info.Records)
+	return info, nil
+}
+
+// the engine's state the backup starts from and its index, the caller must hold n.mu
+func (n *Node) backupSnapshot() (EngineSnapshot, uint64, error) {
+	engine := n.store.engine
+	if _, durable := engine.(DurableEngine); !durable {
+		// the log has everything, the snapshot is empty
+		return &mapSnapshot{}, 0, nil
+	}
+	if ps, ok := engine.(persistedSnapshotter); ok {
+		return ps.persistedSnapshot()
+	}
+	// we can't tell the engine's disk state apart, so we take all of it,
+	// and the backup can only be restored to the index it was taken at
+	snap, err := engine.Snapshot()
+	return snap, n.last, err
+}
+
+// writes every entry of snap to path, returns how many there were
+func writeSnapshotFile(ctx context.Context, fsys FS, path string, snap EngineSnapshot) (int64, error) {
+	f, err := fsys.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	bw := bufio.NewWriterSize(f, 64<<10)
+
+	if _, err := bw.Write(snapshotHeader); err != nil {
+		return 0, err
+	}
+	// each entry is [u32 klen][u32 vlen][u32 crc of key and value][key][value]
+	var count int64
+	var werr error
+	err = snap.Iterate(nil, func(key, value []byte) bool {
+		if werr = ctx.Err(); werr != nil {
+			return false
+		}
+		var hdr [12]byte
+		binary.BigEndian.PutUint32(hdr[0:], uint32(len(key)))
+		binary.BigEndian.PutUint32(hdr[4:], uint32(len(value)))
+		crc := crc32.Update(crc32.ChecksumIEEE(key), crc32.IEEETable, value)
+		binary.BigEndian.PutUint32(hdr[8:], crc)
+		if _, werr = bw.Write(hdr[:]); werr != nil {
+			return false
+		}
+		if _, werr = bw.Write(key); werr != nil {
+			return false
+		}
+		if _, werr = bw.Write(value); werr != nil {
+			return false
+		}
+		count++
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if werr != nil {
+		return 0, werr
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	return count, f.Sync()
+}
+
+// calls fn with every entry of the snapshot file at path on fsys
+func readSnapshotFile(fsys FS, path string, fn func(key, value []byte) error) (int64, error) {
+	f, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	br := bufio.NewReaderSize(f, 64<<10)
+
+	hdr := make([]byte, len(snapshotHeader))
+	if _, err := io.ReadFull(br, hdr); err != nil || string(hdr) != string(snapshotHeader) {
+		return 0, fmt.Errorf("error: %s is not a backup snapshot", path)
+	}
+	var count int64
+	for {
+		var eh [12]byte
+		if _, err := io.ReadFull(br, eh[:]); err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, fmt.Errorf("error: snapshot entry %d is cut short: %w", count, err)
+		}
+		klen, vlen := binary.BigEndian.Uint32(eh[0:]), binary.BigEndian.Uint32(eh[4:])
+		// the same bound the WAL puts on a frame
+		if uint64(klen)+uint64(vlen) > 1<<30 {
+			return count, fmt.Errorf("error: snapshot entry %d has a bad length", count)
+		}
+		kv := make([]byte, int(klen)+int(vlen))
+		if _, err := io.ReadFull(br, kv); err != nil {
+			return count, fmt.Errorf("error: snapshot entry %d is cut short: %w", count, err)
+		}
+		if crc32.ChecksumIEEE(kv) != binary.BigEndian.Uint32(eh[8:]) {
+			return count, fmt.Errorf("error: snapshot entry %d: %w", count, errBadCRC)
+		}
+		if err := fn(kv[:klen], kv[klen:]); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// writes a new log at dst on fsys with the records from..to of src (from
+// excluded), reading src no further than end. the records must follow on from
+// each other.
+func copyWALRange(ctx context.Context, src *WAL, end int64, fsys FS, dst string, from, to uint64) (int64, error) {
+	f, err := fsys.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	bw := bufio.NewWriterSize(f, 64<<10)
+	if _, err := bw.Write(walHeader); err != nil {
+		return 0, err
+	}
+
+	next := from + 1
+	var count int64
+	for off := int64(src.hdrLen); off < end && next <= to; {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		enc, n, err := src.readFrameAt(off)
+		if err != nil {
+			return count, fmt.Errorf("error: reading the log at offset %d: %w", off, err)
+		}
+		off += int64(n)
+		rec, err := Decode(enc)
+		if err != nil {
+			return count, fmt.Errorf("error: reading the log at offset %d: %w", off-int64(n), err)
+		}
+		// records the engine already has may still be in the log
+		if rec.LogIndex < next {
+			continue
+		}
+		if rec.LogIndex != next {
+			return count, fmt.Errorf("error: the log has no record %d, it goes on at %d", next, rec.LogIndex)
+		}
+		fr, err := Encode(&rec)
+		if err != nil {
+			return count, err
+		}
+		if _, err := bw.Write(fr); err != nil {
+			return count, err
+		}
+		count++
+		next++
+	}
+	if next <= to {
+		return count, fmt.Errorf("error: the log ends at record %d, want %d", next-1, to)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return count, err
+	}
+	return count, f.Sync()
+}
+
+// ReadBackupInfo reads the BACKUP.json of the backup in dir.
+func ReadBackupInfo(dir string) (*BackupInfo, error) {
+	return ReadBackupInfoWithFS(OSFS, dir)
+}
+
+// ReadBackupInfoWithFS is ReadBackupInfo on fsys.
+func ReadBackupInfoWithFS(fsys FS, dir string) (*BackupInfo, error) {
+	b, err := readFile(fsys, filepath.Join(dir, backupInfoFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error: %s is not a complete backup, it has no %s", dir, backupInfoFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var info BackupInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		return nil, fmt.Errorf("error: bad %s: %w", backupInfoFile, err)
+	}
+	if info.Format != backupFormat {
+		return nil, fmt.Errorf("error: backup format %d is not supported", info.Format)
+	}
+	return &info, nil
+}
+
+// RestoreBackup builds the data dir of a node from the backup in dir. dataDir
+// must be empty or not exist yet; the node is written next to it first and
+// moved into place once complete. What a restore that crashed left next to
+// dataDir is removed by the next one into it.
+func RestoreBackup(dir, dataDir string, opts RestoreOptions) (*BackupInfo, error) {
+	return RestoreBackupWithFS(OSFS, dir, dataDir, opts)
+}
+
+// RestoreBackupWithFS is RestoreBackup with both the backup and dataDir on fsys.
+func RestoreBackupWithFS(fsys FS, dir, dataDir string, opts RestoreOptions) (*BackupInfo, error) {
+	info, err := ReadBackupInfoWithFS(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	to := opts.ToIndex
+	if to == 0 {
+		to = info.LastIndex
+	}
+	if to < info.BaseIndex || to > info.LastIndex {
+		return nil, fmt.Errorf("error: the backup can be restored to indexes %d..%d, not %d", info.BaseIndex, info.LastIndex, to)
+	}
+	if err := createEmptyDir(fsys, dataDir); err != nil {
+		return nil, err
+	}
+
+	dataDir = filepath.Clean(dataDir)
+	prefix := filepath.Base(dataDir) + restoreTempSuffix
+	if err := sweepTempDirs(fsys, filepath.Dir(dataDir), prefix); err != nil {
+		return nil, err
+	}
+	tmp := filepath.Join(filepath.Dir(dataDir), tempName(prefix))
+	if err := fsys.MkdirAll(tmp, 0o755); err != nil {
+		return nil, err
+	}
+	if err := restoreInto(fsys, dir, tmp, info, to); err != nil {
+		_ = fsys.RemoveAll(tmp)
+		return nil, err
+	}
+
+	// dataDir is empty, so it can go
+	if err := fsys.Remove(dataDir); err != nil {
+		_ = fsys.RemoveAll(tmp)
+		return nil, err
+	}
+	if err := fsys.Rename(tmp, dataDir); err != nil {
+		return nil, err
+	}
+	if err := fsys.SyncDir(filepath.Dir(dataDir)); err != nil {
+		return nil, err
+	}
+
+	out := *info
+	out.LastIndex = to
+	out.Records = int64(to - info.BaseIndex)
+	return &out, nil
+}
+
+func restoreInto(fsys FS, dir, dataDir string, info *BackupInfo, to uint64) error {
+	engine, err := OpenEngineWithFS(fsys, info.Engine, filepath.Join(dataDir, info.Engine))
+	if err != nil {
+		return err
+	}
+	de, durable := engine.(DurableEngine)
+	if !durable && info.Entries > 0 {
+		_ = engine.Close()
+		return fmt.Errorf("error: engine %q doesn't keep data on disk, it can't hold a snapshot", info.Engine)
+	}
+
+	// the snapshot goes in as batches at the base index
+	b := &Batch{Index: info.BaseIndex}
+	count, err := readSnapshotFile(fsys, filepath.Join(dir, backupSnapshotFile), func(key, value []byte) error {
+		b.Put(key, value)
+		if len(b.Ops) < 1024 {
+			return nil
+		}
+		err := engine.ApplyBatch(b)
+		b = &Batch{Index: info.BaseIndex}
+		return err
+	})
+	if err == nil && len(b.Ops) > 0 {
+		err = engine.ApplyBatch(b)
+	}
+	if err == nil && count != info.Entries {
+		err = fmt.Errorf("error: the snapshot has %d entries, the backup says %d", count, info.Entries)
+	}
+	if err == nil && durable {
+		_, err = de.Flush()
+	}
+	if cerr := engine.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	walPath := filepath.Join(dir, backupWALFile)
+	walf, err := fsys.OpenFile(walPath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer walf.Close()
+	st, err := walf.Stat()
+	if err != nil {
+		return err
+	}
+	src := &WAL{f: walf, path: walPath, hdrLen: len(walHeader)}
+	if _, err := copyWALRange(context.Background(), src, st.Size(), fsys, filepath.Join(dataDir, "wal"), info.BaseIndex, to); err != nil {
+		return err
+	}
+	return fsys.SyncDir(dataDir)
+}
+
+// WriteBackupTar takes a backup of the node and writes it to w as a tar
+// stream. The backup is put together in the node's data dir first.
+func (n *Node) WriteBackupTar(ctx context.Context, w io.Writer) (*BackupInfo, error) {
+	dir, info, cleanup, err := n.backupToTemp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	return info, writeBackupTar(w, n.fs, dir)
+}
+
+// takes a backup into a temporary dir under the data dir, cleanup removes it.
+// one a crash kept from being cleaned up is removed when the node next opens.
+func (n *Node) backupToTemp(ctx context.Context) (string, *BackupInfo, func(), error) {
+	tmp := filepath.Join(n.dataDir, tempName(backupTempPrefix))
+	if err := n.fs.MkdirAll(tmp, 0o755); err != nil {
+		return "", nil, nil, err
+	}
+	cleanup := func() { _ = n.fs.RemoveAll(tmp) }
+
+	dir := filepath.Join(tmp, "backup")
+	info, err := n.Backup(ctx, dir)
+	if err != nil {
+		cleanup()
+		return "", nil, nil, err
+	}
+	return dir, info, cleanup, nil
+}
+
+func writeBackupTar(w io.Writer, fsys FS, dir string) error {
+	tw := tar.NewWriter(w)
+	// BACKUP.json goes last, so a stream that's cut short can't pass for a backup
+	for _, name := range []string{backupSnapshotFile, backupWALFile, backupInfoFile} {
+		if err := addTarFile(tw, fsys, dir, name); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func addTarFile(tw *tar.Writer, fsys FS, dir, name string) error {
+	f, err := fsys.OpenFile(filepath.Join(dir, name), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: name, Mode: 0o644, Size: st.Size(), ModTime: st.ModTime(), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// ExtractBackupTar unpacks a backup written by WriteBackupTar into dir, which
+// must be empty or not exist yet.
+func ExtractBackupTar(r io.Reader, dir string) (*BackupInfo, error) {
+	return ExtractBackupTarWithFS(OSFS, r, dir)
+}
+
+// ExtractBackupTarWithFS is ExtractBackupTar on fsys.
+func ExtractBackupTarWithFS(fsys FS, r io.Reader, dir string) (*BackupInfo, error) {
+	if err := createEmptyDir(fsys, dir); err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// we only take the files a backup has, nothing can land outside dir
+		switch hdr.Name {
+		case backupSnapshotFile, backupWALFile, backupInfoFile:
+		default:
+			return nil, fmt.Errorf("error: unexpected file %q in backup", hdr.Name)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("error: %q in backup is not a regular file", hdr.Name)
+		}
+		if err := extractFile(fsys, tr, filepath.Join(dir, hdr.Name)); err != nil {
+			return nil, err
+		}
+	}
+	if err := fsys.SyncDir(dir); err != nil {
+		return nil, err
+	}
+	return ReadBackupInfoWithFS(fsys, dir)
+}
+
+func extractFile(fsys FS, r io.Reader, path string) error {
+	f, err := fsys.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// makes sure dir exists and has nothing in it
+func createEmptyDir(fsys FS, dir string) error {
+	if err := fsys.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	names, err := fsys.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("error: %s is not empty", dir)
+	}
+	return nil
+}
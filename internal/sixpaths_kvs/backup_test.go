@@ -0,0 +1,215 @@
+package sixpaths_kvs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func putKeys(t *testing.T, n *Node, from, to int) {
+	t.Helper()
+	for i := from; i <= to; i++ {
+		cmd := Command{Instruct: CmdPut, ClientID: "c1", Seq: uint64(i), Key: fmt.Appendf(nil, "k%d", i), Value: fmt.Appendf(nil, "v%d", i)}
+		if _, err := n.Exec(cmd); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+	}
+}
+
+// opens the node restored into dir and checks that it holds k1..kn only
+func checkRestored(t *testing.T, dir, engine string, want int) {
+	t.Helper()
+	checkRestoredOn(t, nil, dir, engine, want)
+}
+
+// checkRestored on fsys, nil means OSFS
+func checkRestoredOn(t *testing.T, fsys FS, dir, engine string, want int) {
+	t.Helper()
+	n, err := OpenNodeWithOptions(dir, NodeOptions{FS: fsys, Engine: engine})
+	if err != nil {
+		t.Fatalf("OpenNode on the restored dir: %v", err)
+	}
+	defer n.Close()
+	if n.LastIndex() != uint64(want) {
+		t.Fatalf("restored node is at index %d, want %d", n.LastIndex(), want)
+	}
+	for i := 1; i <= want+1; i++ {
+		v, err := n.Get(fmt.Sprintf("k%d", i))
+		if i <= want && (err != nil || string(v) != fmt.Sprintf("v%d", i)) {
+			t.Fatalf("Get(k%d) = %q, %v", i, v, err)
+		}
+		if i > want && err == nil {
+			t.Fatalf("k%d is there, it was written after index %d", i, want)
+		}
+	}
+	// dedup state comes back too, a retry of the last write isn't applied twice
+	res, err := n.Exec(Command{Instruct: CmdPut, ClientID: "c1", Seq: uint64(want), Key: []byte("other"), Value: []byte("x")})
+	if err != nil || res.LogIndex != uint64(want) {
+		t.Fatalf("retry of seq %d = %+v, %v", want, res, err)
+	}
+}
+
+func TestBackupAndRestoreToIndex(t *testing.T) {
+	n, err := OpenNode(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	defer n.Close()
+	putKeys(t, n, 1, 5)
+
+	bdir := filepath.Join(t.TempDir(), "backup")
+	info, err := n.Backup(context.Background(), bdir)
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if info.BaseIndex != 0 || info.LastIndex != 5 || info.Records != 5 || info.Engine != DefaultEngine {
+		t.Fatalf("backup = %+v", info)
+	}
+	// writes after the backup aren't in it
+	putKeys(t, n, 6, 7)
+
+	all := filepath.Join(t.TempDir(), "all")
+	if _, err := RestoreBackup(bdir, all, RestoreOptions{}); err != nil {
+		t.Fatalf("RestoreBackup: %v", err)
+	}
+	checkRestored(t, all, "", 5)
+
+	to3 := filepath.Join(t.TempDir(), "to3")
+	if _, err := RestoreBackup(bdir, to3, RestoreOptions{ToIndex: 3}); err != nil {
+		t.Fatalf("RestoreBackup to 3: %v", err)
+	}
+	checkRestored(t, to3, "", 3)
+
+	if _, err := RestoreBackup(bdir, filepath.Join(t.TempDir(), "x"), RestoreOptions{ToIndex: 9}); err == nil {
+		t.Fatalf("restored past the end of the backup")
+	}
+	// a restore never writes over a data dir in use
+	if _, err := RestoreBackup(bdir, all, RestoreOptions{}); err == nil {
+		t.Fatalf("restored into a dir that isn't empty")
+	}
+}
+
+func TestBackupLSMStartsAtFlush(t *testing.T) {
+	n, err := OpenNodeWithOptions(t.TempDir(), NodeOptions{Engine: "lsm"})
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	defer n.Close()
+	putKeys(t, n, 1, 4)
+
+	// we flush and trim by hand, the memtable is far from full
+	n.mu.Lock()
+	idx, err := n.store.engine.(DurableEngine).Flush()
+	if err == nil {
+		err = n.wal.TrimThrough(idx)
+	}
+	n.mu.Unlock()
+	if err != nil || idx != 4 {
+		t.Fatalf("flush = %d, %v", idx, err)
+	}
+	putKeys(t, n, 5, 8)
+
+	var tarball bytes.Buffer
+	info, err := n.WriteBackupTar(context.Background(), &tarball)
+	if err != nil {
+		t.Fatalf("WriteBackupTar: %v", err)
+	}
+	if info.BaseIndex != 4 || info.LastIndex != 8 || info.Records != 4 {
+		t.Fatalf("backup = %+v", info)
+	}
+
+	bdir := filepath.Join(t.TempDir(), "backup")
+	if _, err := ExtractBackupTar(&tarball, bdir); err != nil {
+		t.Fatalf("ExtractBackupTar: %v", err)
+	}
+	to6 := filepath.Join(t.TempDir(), "to6")
+	if _, err := RestoreBackup(bdir, to6, RestoreOptions{ToIndex: 6}); err != nil {
+		t.Fatalf("RestoreBackup to 6: %v", err)
+	}
+	checkRestored(t, to6, "lsm", 6)
+
+	// the log before the flush is gone, so is the way back to it
+	if _, err := RestoreBackup(bdir, filepath.Join(t.TempDir(), "x"), RestoreOptions{ToIndex: 3}); err == nil {
+		t.Fatalf("restored to before the backup's base index")
+	}
+}
+
+func TestBackupTarOnMemFS(t *testing.T) {
+	m := NewMemFS()
+	n, err := OpenNodeWithOptions("/data", NodeOptions{FS: m})
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	defer n.Close()
+	putKeys(t, n, 1, 3)
+
+	var buf bytes.Buffer
+	if _, err := n.WriteBackupTar(context.Background(), &buf); err != nil {
+		t.Fatalf("WriteBackupTar: %v", err)
+	}
+	// the temporary backup is put together on the node's FS and cleaned up
+	if names, _ := m.ReadDir("/data"); len(names) != 1 || names[0] != "wal" {
+		t.Fatalf("data dir after the backup holds %v", names)
+	}
+
+	bdir := filepath.Join(t.TempDir(), "backup")
+	if _, err := ExtractBackupTar(&buf, bdir); err != nil {
+		t.Fatalf("ExtractBackupTar: %v", err)
+	}
+	data := filepath.Join(t.TempDir(), "restored")
+	if _, err := RestoreBackup(bdir, data, RestoreOptions{}); err != nil {
+		t.Fatalf("RestoreBackup: %v", err)
+	}
+	checkRestored(t, data, "", 3)
+}
+
+func TestBackupTempDirsAreSwept(t *testing.T) {
+	m := NewMemFS()
+	n, err := OpenNodeWithOptions("/data", NodeOptions{FS: m})
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	putKeys(t, n, 1, 3)
+	if _, err := n.Backup(context.Background(), "/backup"); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if err := n.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// what a process that crashed half way through a tar backup and a
+	// restore leaves behind, next to things that only look alike
+	for _, dir := range []string{
+		"/data/" + tempName(backupTempPrefix) + "/backup",
+		"/data/backup-notes",
+		"/restored" + restoreTempSuffix + "0123456789abcdef/map",
+		"/other" + restoreTempSuffix + "0123456789abcdef",
+	} {
+		if err := m.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+	}
+
+	n, err = OpenNodeWithOptions("/data", NodeOptions{FS: m})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if err := n.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if names, _ := m.ReadDir("/data"); !slices.Equal(names, []string{"backup-notes", "wal"}) {
+		t.Fatalf("data dir after reopening holds %v", names)
+	}
+
+	if _, err := RestoreBackupWithFS(m, "/backup", "/restored", RestoreOptions{}); err != nil {
+		t.Fatalf("RestoreBackup: %v", err)
+	}
+	want := []string{"backup", "data", "other" + restoreTempSuffix + "0123456789abcdef", "restored"}
+	if names, _ := m.ReadDir("/"); !slices.Equal(names, want) {
+		t.Fatalf("after the restore / holds %v", names)
+	}
+	checkRestoredOn(t, m, "/restored", "", 3)
+}
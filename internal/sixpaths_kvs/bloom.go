@@ -0,0 +1,80 @@
+package sixpaths_kvs
+
+import (
+	"hash/fnv"
+)
+
+// bloom.go implements the bloom filters our SSTables carry.
+// A filter answers "is this key maybe in the table?" so a Get can skip
+// reading data blocks from tables that definitely don't have the key.
+
+type bloomFilter struct {
+	bits []byte
+	k    uint8 // number of probes per key
+}
+
+// hash of a key, we derive all k probes from this one value
+func bloomHash(key []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	return h.Sum64()
+}
+
+// builds a filter holding all of the given key hashes
+func newBloomFilter(hashes []uint64, bitsPerKey int) bloomFilter {
+	nbits := len(hashes) * bitsPerKey
+	if nbits < 64 {
+		nbits = 64
+	}
+
+	// ln(2) * bits per key is the number of probes that minimizes false positives
+	k := uint8(float64(bitsPerKey) * 0.69)
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+
+	f := bloomFilter{bits: make([]byte, (nbits+7)/8), k: k}
+	nbits = len(f.bits) * 8
+
+	for _, h := range hashes {
+		// double hashing: probe i is h1 + i*h2
+		h1, h2 := uint32(h), uint32(h>>32)
+		for i := uint8(0); i < k; i++ {
+			pos := (h1 + uint32(i)*h2) % uint32(nbits)
+			f.bits[pos/8] |= 1 << (pos % 8)
+		}
+	}
+	return f
+}
+
+func (f bloomFilter) mayContain(key []byte) bool {
+	if len(f.bits) == 0 {
+		return true
+	}
+	nbits := uint32(len(f.bits) * 8)
+	h := bloomHash(key)
+	h1, h2 := uint32(h), uint32(h>>32)
+	for i := uint8(0); i < f.k; i++ {
+		pos := (h1 + uint32(i)*h2) % nbits
+		if f.bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// [bits...][u8 k]
+func (f bloomFilter) encode() []byte {
+	out := append([]byte(nil), f.bits...)
+	return append(out, f.k)
+}
+
+func decodeBloomFilter(b []byte) bloomFilter {
+	if len(b) < 1 {
+		return bloomFilter{}
+	}
+	return bloomFilter{bits: b[:len(b)-1], k: b[len(b)-1]}
+}
@@ -4,22 +4,24 @@ import "fmt"
 
 // cluster.go defines the static config for our KV cluster
 // it lists all the nodes along with their corresponding
-// IDs, HTTP ports, and Data directories
+// IDs, HTTP ports, binary RPC ports, Data directories and storage engines
 
 type NodeConfig struct {
 	ID         string
 	ClientAddr string // HTTP port for clients
+	RPCAddr    string // binary protocol port (router and clients)
 	DataDir    string
+	Engine     string // storage engine name, "" means DefaultEngine
 }
 
 // Static 6-node cluster config.
 var staticCluster = []NodeConfig{
-	{ID: "n1", ClientAddr: ":8090", DataDir: "./data1"},
-	{ID: "n2", ClientAddr: ":8091", DataDir: "./data2"},
-	{ID: "n3", ClientAddr: ":8092", DataDir: "./data3"},
-	{ID: "n4", ClientAddr: ":8093", DataDir: "./data4"},
-	{ID: "n5", ClientAddr: ":8094", DataDir: "./data5"},
-	{ID: "n6", ClientAddr: ":8095", DataDir: "./data6"},
+	{ID: "n1", ClientAddr: ":8090", RPCAddr: ":9190", DataDir: "./data1"},
+	{ID: "n2", ClientAddr: ":8091", RPCAddr: ":9191", DataDir: "./data2"},
+	{ID: "n3", ClientAddr: ":8092", RPCAddr: ":9192", DataDir: "./data3"},
+	{ID: "n4", ClientAddr: ":8093", RPCAddr: ":9193", DataDir: "./data4"},
+	{ID: "n5", ClientAddr: ":8094", RPCAddr: ":9194", DataDir: "./data5"},
+	{ID: "n6", ClientAddr: ":8095", RPCAddr: ":9195", DataDir: "./data6"},
 }
 
 // returns (thisNode, allNodes, error).
@@ -0,0 +1,394 @@
+package sixpaths_kvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// crash_test.go runs nodes on a MemFS and crashes them at random, sometimes
+// right after a write to the log failed, fell short or couldn't be synced.
+// After every restart the node must hold exactly the writes it acknowledged,
+// plus at most the one write whose outcome the client never learned, and a
+// retry of an acknowledged write must still be recognized. A node whose log
+// failed may also be recovered in place instead, then the failed write is
+// gone for good. Both engines are run, the lsm one with a memtable small
+// enough that crashes and faults land around its flushes and the WAL trims
+// that follow them.
+
+var errInjected = errors.New("injected I/O error")
+
+var crashKeys = []string{"k0", "k1", "k2", "k3", "k4", "k5", "k6", "k7"}
+
+func init() {
+	RegisterEngine("lsm-crash", func(fsys FS, dir string) (StorageEngine, error) {
+		opts := smallLSMOptions()
+		opts.MemtableSize = 1 << 10
+		return OpenLSMEngineWithFS(fsys, dir, opts)
+	})
+}
+
+var crashEngines = []string{"map", "lsm-crash"}
+
+func openMemNode(t *testing.T, m *MemFS, engine string) *Node {
+	t.Helper()
+	n, err := OpenNodeWithOptions("/data", NodeOptions{FS: m, Engine: engine})
+	if err != nil {
+		t.Fatalf("open node after crash: %v", err)
+	}
+	return n
+}
+
+// a process that crashed doesn't go on compacting, so the node left behind
+// by a crash has its background work stopped first
+func stopBackground(n *Node) {
+	if e, ok := n.store.engine.(*lsmEngine); ok && !e.opts.DisableCompactions {
+		close(e.closing)
+		e.wg.Wait()
+	}
+}
+
+// the node's keys, as a map
+func memNodeState(n *Node) map[string]string {
+	state := make(map[string]string)
+	for _, k := range crashKeys {
+		if v, err := n.store.Get(k); err == nil {
+			state[k] = string(v)
+		}
+	}
+	return state
+}
+
+func applyToModel(model map[string]string, cmd Command) map[string]string {
+	next := maps.Clone(model)
+	if cmd.Instruct == CmdDelete {
+		delete(next, string(cmd.Key))
+	} else {
+		next[string(cmd.Key)] = string(cmd.Value)
+	}
+	return next
+}
+
+func TestCrashRecoveryRandomized(t *testing.T) {
+	for _, engine := range crashEngines {
+		for seed := range uint64(25) {
+			t.Run(fmt.Sprintf("%s/seed=%d", engine, seed), func(t *testing.T) {
+				crashRun(t, engine, seed)
+			})
+		}
+	}
+}
+
+// one node on a MemFS, through 300 random steps
+func crashRun(t *testing.T, engine string, seed uint64) {
+	rng := rand.New(rand.NewPCG(seed, 0x5eed))
+	m := NewMemFS()
+	n := openMemNode(t, m, engine)
+
+	model := map[string]string{}
+	var seq, acked uint64 // acked is the log index of the last acknowledged write
+	var last Command
+	var lastRes ApplyResult
+
+	// a torn crash keeps part of what wasn't synced
+	crash := func() {
+		stopBackground(n)
+		if rng.IntN(2) == 0 {
+			m.Crash(rng)
+		} else {
+			m.Crash(nil)
+		}
+		n = openMemNode(t, m, engine)
+	}
+	check := func(what string) {
+		t.Helper()
+		if got := memNodeState(n); !maps.Equal(got, model) {
+			t.Fatalf("%s: node holds %v, want %v", what, got, model)
+		}
+		if got := n.LastIndex(); got != acked {
+			t.Fatalf("%s: last index %d, want %d", what, got, acked)
+		}
+	}
+
+	for step := range 300 {
+		seq++
+		cmd := Command{Instruct: CmdPut, ClientID: "crash", Seq: seq, Key: []byte(crashKeys[rng.IntN(len(crashKeys))])}
+		if rng.IntN(5) == 0 {
+			cmd.Instruct = CmdDelete
+		} else {
+			cmd.Value = fmt.Appendf(nil, "v%d", step)
+		}
+
+		switch roll := rng.IntN(100); {
+		case roll < 10:
+			crash()
+			check(fmt.Sprintf("step %d, crash", step))
+
+		case roll < 28:
+			// a flush of the engine's files, or the WAL trim that follows it,
+			// fails. the write itself is logged and acknowledged
+			op := []FSOp{FSWrite, FSSync, FSRename, FSSyncDir}[rng.IntN(4)]
+			inEngine := rng.IntN(2) == 0
+			m.SetFaults(func(o FSOp, name string) error {
+				if o == op && !strings.HasSuffix(name, "/wal") && strings.HasPrefix(name, "/data/"+engine) == inEngine {
+					return errInjected
+				}
+				return nil
+			})
+			res, err := n.Exec(cmd)
+			m.SetFaults(nil)
+			if err != nil {
+				t.Fatalf("step %d: Exec with failing engine files: %v", step, err)
+			}
+			model = applyToModel(model, cmd)
+			acked = res.LogIndex
+			last, lastRes = cmd, res
+			// a trim that failed after its rename leaves the node read-only
+			if n.ReadOnly() != nil {
+				if rng.IntN(2) == 0 {
+					if err := n.RecoverWAL(); err != nil {
+						t.Fatalf("step %d: RecoverWAL after a failed trim: %v", step, err)
+					}
+				} else {
+					crash()
+				}
+			}
+			check(fmt.Sprintf("step %d, failing engine files", step))
+
+		case roll < 38:
+			// the write to the log fails in one of the ways a disk can
+			var fault func(FSOp) error
+			switch rng.IntN(3) {
+			case 0:
+				fault = func(op FSOp) error {
+					if op == FSWrite {
+						return errInjected
+					}
+					return nil
+				}
+			case 1:
+				short := rng.IntN(16)
+				fault = func(op FSOp) error {
+					if op == FSWrite {
+						return &ShortWrite{N: short, Err: errInjected}
+					}
+					return nil
+				}
+			default:
+				fault = func(op FSOp) error {
+					if op == FSSync {
+						return errInjected
+					}
+					return nil
+				}
+			}
+			m.SetFaults(func(op FSOp, name string) error {
+				if strings.HasSuffix(name, "/wal") {
+					return fault(op)
+				}
+				return nil
+			})
+			if _, err := n.Exec(cmd); !errors.Is(err, errInjected) || !errors.Is(err, ErrReadOnly) {
+				t.Fatalf("step %d: Exec with a failing log = %v, want the injected error", step, err)
+			}
+			m.SetFaults(nil)
+			if _, err := n.Exec(cmd); !errors.Is(err, ErrReadOnly) {
+				t.Fatalf("step %d: Exec after a failed write = %v, want ErrReadOnly", step, err)
+			}
+			if rng.IntN(2) == 0 {
+				if err := n.RecoverWAL(); err != nil {
+					t.Fatalf("step %d: RecoverWAL: %v", step, err)
+				}
+				// later appends and crashes go on from the recovered log
+				check(fmt.Sprintf("step %d, recovered after a failed write", step))
+				continue
+			}
+			crash()
+			// the write may or may not have made it, but nothing else changed
+			with := applyToModel(model, cmd)
+			if got := memNodeState(n); maps.Equal(got, with) && n.LastIndex() == acked+1 {
+				model = with
+				acked++
+			}
+			check(fmt.Sprintf("step %d, crash after a failed write", step))
+
+		default:
+			res, err := n.Exec(cmd)
+			if err != nil {
+				t.Fatalf("step %d: Exec: %v", step, err)
+			}
+			model = applyToModel(model, cmd)
+			acked = res.LogIndex
+			last, lastRes = cmd, res
+		}
+	}
+
+	// the last acknowledged write is still known after one more crash
+	crash()
+	check("final crash")
+	if last.Seq != 0 {
+		res, err := n.Exec(last)
+		if err != nil || res.LogIndex != lastRes.LogIndex {
+			t.Fatalf("retry of seq %d after crash = %+v, %v, want log index %d", last.Seq, res, err, lastRes.LogIndex)
+		}
+		check("retry after crash")
+	}
+}
+
+func TestWALFailureDegradesNode(t *testing.T) {
+	m := NewMemFS()
+	n := openMemNode(t, m, "")
+	defer n.Close()
+	h := NewHTTPServer(n, "").Handler()
+	put := func(seq uint64) (ApplyResult, error) {
+		return n.Exec(Command{Instruct: CmdPut, ClientID: "c1", Seq: seq, Key: []byte("k"), Value: fmt.Appendf(nil, "v%d", seq)})
+	}
+	call := func(method, path string) (int, string) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w.Code, w.Body.String()
+	}
+
+	if _, err := put(1); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	m.SetFaults(func(op FSOp, name string) error {
+		if op == FSSync {
+			return errInjected
+		}
+		return nil
+	})
+	if _, err := put(2); !errors.Is(err, ErrWALFailed) || !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("put with a failing fsync = %v, want ErrWALFailed and ErrReadOnly", err)
+	}
+	if _, body := call(http.MethodGet, "/health"); !strings.Contains(body, `"status":"degraded"`) {
+		t.Fatalf("/health = %s, want degraded", body)
+	}
+
+	// the disk still fails, so the log can't be checked out
+	if code, _ := call(http.MethodPost, "/admin/wal/recover"); code != http.StatusServiceUnavailable {
+		t.Fatalf("recover with a failing disk = %d, want 503", code)
+	}
+	m.SetFaults(nil)
+	if _, err := put(3); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("put before recovering = %v, want ErrReadOnly", err)
+	}
+	if code, body := call(http.MethodPost, "/admin/wal/recover"); code != http.StatusOK {
+		t.Fatalf("recover = %d %s", code, body)
+	}
+	res, err := put(2)
+	if err != nil || res.LogIndex != 2 {
+		t.Fatalf("put after recovering = %+v, %v, want it logged at index 2", res, err)
+	}
+
+	// what's on disk is exactly what was acknowledged
+	m.Crash(nil)
+	n2 := openMemNode(t, m, "")
+	defer n2.Close()
+	if v, err := n2.Get("k"); err != nil || string(v) != "v2" || n2.LastIndex() != 2 {
+		t.Fatalf("after a crash k = %q, %v at index %d", v, err, n2.LastIndex())
+	}
+}
+
+func TestTrimSyncDirFailureKeepsNewLog(t *testing.T) {
+	m := NewMemFS()
+	w, err := NewWALWithFS(m, "/data/wal")
+	if err != nil {
+		t.Fatalf("NewWALWithFS: %v", err)
+	}
+	put := func(idx uint64) error {
+		return w.Append(&Record{LogIndex: idx, Cmd: Command{Instruct: CmdPut, ClientID: "c1", Seq: idx, Key: []byte("k"), Value: []byte("v")}})
+	}
+	for i := uint64(1); i <= 3; i++ {
+		if err := put(i); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	// the rename goes through, syncing the directory after it doesn't
+	m.SetFaults(func(op FSOp, name string) error {
+		if op == FSSyncDir {
+			return errInjected
+		}
+		return nil
+	})
+	if err := w.TrimThrough(2); !errors.Is(err, ErrWALFailed) {
+		t.Fatalf("TrimThrough with a failing SyncDir = %v, want ErrWALFailed", err)
+	}
+	if err := put(4); !errors.Is(err, ErrWALFailed) {
+		t.Fatalf("Append after a failed trim = %v, want ErrWALFailed", err)
+	}
+	m.SetFaults(nil)
+	if err := w.Recover(3); err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	if err := put(4); err != nil {
+		t.Fatalf("Append after recovering: %v", err)
+	}
+
+	// the append went to the log that's in the directory
+	m.Crash(nil)
+	w2, err := NewWALWithFS(m, "/data/wal")
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer w2.Close()
+	recs, last, err := w2.ReplayAll()
+	if err != nil || last != 4 || len(recs) != 2 || recs[0].LogIndex != 3 {
+		t.Fatalf("after a crash: %d records up to %d, %v, want 3..4", len(recs), last, err)
+	}
+}
+
+// a restore crashed at any point leaves either no data dir at all, or an
+// empty one, or the whole restored node, and can be run again
+func TestRestoreBackupCrash(t *testing.T) {
+	for _, engine := range crashEngines {
+		t.Run(engine, func(t *testing.T) {
+			m := NewMemFS()
+			n := openMemNode(t, m, engine)
+			putKeys(t, n, 1, 40)
+			if _, err := n.Backup(context.Background(), "/backup"); err != nil {
+				t.Fatalf("Backup: %v", err)
+			}
+			if err := n.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			for crashAt := 1; ; crashAt++ {
+				data := fmt.Sprintf("/restored%d", crashAt)
+				ops := 0
+				m.SetFaults(func(op FSOp, name string) error {
+					if ops++; ops == crashAt {
+						return errInjected
+					}
+					return nil
+				})
+				_, err := RestoreBackupWithFS(m, "/backup", data, RestoreOptions{})
+				if err == nil {
+					// got through without reaching the fault, every op was tried
+					m.SetFaults(nil)
+					checkRestoredOn(t, m, data, engine, 40)
+					return
+				}
+				m.Crash(nil)
+
+				names, rerr := m.ReadDir(data)
+				if rerr == nil && len(names) > 0 {
+					checkRestoredOn(t, m, data, engine, 40)
+					continue
+				}
+				// nothing that made it can get in the way of another go
+				if _, err := RestoreBackupWithFS(m, "/backup", data, RestoreOptions{}); err != nil {
+					t.Fatalf("restore after a crash at op %d: %v", crashAt, err)
+				}
+				checkRestoredOn(t, m, data, engine, 40)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package sixpaths_kvs
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// dedup.go keeps track of which requests each client has already had applied.
+// For every client we remember the results of its last dedupWindow requests,
+// keyed by seq, so a retry of any of them gets back exactly the answer the
+// original got, even when the client pipelines requests and they arrive out
+// of order. Seqs that fell out of the window are answered with
+// ErrResultUnavailable instead of a result that belongs to another request.
+
+// how many recent results we keep per client
+const dedupWindow = 64
+
+var ErrResultUnavailable = errors.New("error: result for this seq is no longer available, it fell out of the dedup window")
+
+type Dedup struct {
+	evicted uint64        // highest seq that was dropped from the window, the low watermark
+	window  []dedupResult // results of recent requests, ascending by seq
+}
+
+type dedupResult struct {
+	seq    uint64
+	result ApplyResult
+}
+
+type dedupState uint8
+
+const (
+	dedupNew  dedupState = iota // seq was never applied
+	dedupHit                    // seq was applied, its result is in the window
+	dedupGone                   // seq is below the window, we can't tell what happened to it
+)
+
+// looks up seq in the window
+func (d Dedup) lookup(seq uint64) (ApplyResult, dedupState) {
+	i := sort.Search(len(d.window), func(i int) bool { return d.window[i].seq >= seq })
+	if i < len(d.window) && d.window[i].seq == seq {
+		return d.window[i].result, dedupHit
+	}
+	if seq <= d.evicted {
+		return ApplyResult{}, dedupGone
+	}
+	return ApplyResult{}, dedupNew
+}
+
+// returns a copy of d with the result for seq added, dropping the oldest
+// result once the window is full. d itself is left untouched, so the store
+// only sees the new window once the write made it into the engine.
+func (d Dedup) with(seq uint64, r ApplyResult) Dedup {
+	i := sort.Search(len(d.window), func(i int) bool { return d.window[i].seq >= seq })
+
+	w := make([]dedupResult, 0, len(d.window)+1)
+	w = append(w, d.window[:i]...)
+	w = append(w, dedupResult{seq: seq, result: r})
+	w = append(w, d.window[i:]...)
+
+	out := Dedup{evicted: d.evicted, window: w}
+	for len(out.window) > dedupWindow {
+		if out.window[0].seq > out.evicted {
+			out.evicted = out.window[0].seq
+		}
+		out.window = out.window[1:]
+	}
+	return out
+}
+
+// returns how seq from clientID was handled before and, for a hit, its result
+func (store *Store) lookupDedup(clientID string, seq uint64) (ApplyResult, dedupState) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return store.dedupMap[clientID].lookup(seq)
+}
+
+// ===== Dedup persistence =====
+
+// durable engines keep a small head per client under dedupKeyPrefix, with
+// the low watermark, and every result in the window as a record of its own
+// under dedupEntryPrefix, so a write only adds its own result and deletes
+// the ones that fell out of the window.
+const (
+	dedupKeyPrefix   = "\x00d/"
+	dedupEntryPrefix = "\x00r/"
+)
+
+func dedupKey(clientID string) []byte {
+	return []byte(dedupKeyPrefix + clientID)
+}
+
+// the seq goes last and has a fixed length, so the client ID can be cut
+// back out of the key whatever bytes it holds
+func dedupEntryKey(clientID string, seq uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte(dedupEntryPrefix+clientID), seq)
+}
+
+// splits a key made by dedupEntryKey
+func parseDedupEntryKey(key []byte) (string, uint64, bool) {
+	if len(key) < len(dedupEntryPrefix)+8 {
+		return "", 0, false
+	}
+	n := len(key) - 8
+	return string(key[len(dedupEntryPrefix):n]), binary.BigEndian.Uint64(key[n:]), true
+}
+
+// [u64 evicted]
+func encodeDedup(d Dedup) []byte {
+	return binary.BigEndian.AppendUint64(nil, d.evicted)
+}
+
+// queues in b what adding seq to d, which gave next, changed for clientID:
+// the new result, deletes for the results that fell out of the window, and
+// the head if the watermark moved
+func putDedupChanges(b *Batch, clientID string, d, next Dedup) {
+	kept := make(map[uint64]bool, len(next.window))
+	for _, e := range next.window {
+		kept[e.seq] = true
+	}
+	for _, e := range d.window {
+		if !kept[e.seq] {
+			b.Delete(dedupEntryKey(clientID, e.seq))
+		}
+		delete(kept, e.seq)
+	}
+	for _, e := range next.window {
+		if kept[e.seq] {
+			b.Put(dedupEntryKey(clientID, e.seq), appendDedupResult(nil, e))
+		}
+	}
+	if next.evicted != d.evicted {
+		b.Put(dedupKey(clientID), encodeDedup(next))
+	}
+}
+
+// queues in b the deletes for everything stored for clientID's window
+func deleteDedup(b *Batch, clientID string, d Dedup) {
+	b.Delete(dedupKey(clientID))
+	for _, e := range d.window {
+		b.Delete(dedupEntryKey(clientID, e.seq))
+	}
+}
+
+func appendDedupResult(out []byte, e dedupResult) []byte {
+	out = binary.BigEndian.AppendUint64(out, e.seq)
+	if e.result.Success {
+		out = append(out, 1)
+	} else {
+		out = append(out, 0)
+	}
+	out = binary.BigEndian.AppendUint64(out, e.result.LogIndex)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(e.result.PrevValue)))
+	return append(out, e.result.PrevValue...)
+}
+
+func readDedupResult(r *rpcReader) dedupResult {
+	var e dedupResult
+	e.seq = r.u64()
+	e.result.Success = r.u8() == 1
+	e.result.LogIndex = r.u64()
+	e.result.PrevValue = r.bytes(int(r.u32()))
+	if e.result.PrevValue == nil {
+		e.result.PrevValue = []byte{}
+	}
+	return e
+}
+
+// decodes one result stored under dedupEntryPrefix
+func decodeDedupResult(b []byte) (dedupResult, bool) {
+	r := rpcReader{buf: b}
+	e := readDedupResult(&r)
+	return e, r.err == nil
+}
+
+// decodes a head, the results come in on their own
+func decodeDedup(b []byte) (Dedup, bool) {
+	if len(b) != 8 {
+		return Dedup{}, false
+	}
+	return Dedup{evicted: binary.BigEndian.Uint64(b)}, true
+}
@@ -0,0 +1,140 @@
+package sixpaths_kvs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDedupWindowReturnsExactResults(t *testing.T) {
+	dir := t.TempDir()
+	n, err := OpenNode(dir)
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+
+	put := func(seq uint64, val string) (ApplyResult, error) {
+		return n.Exec(Command{Instruct: CmdPut, ClientID: "c1", Seq: seq, Key: []byte("k"), Value: []byte(val)})
+	}
+
+	// a pipelining client: seq 2 lands before seq 1
+	r2, err := put(2, "two")
+	if err != nil {
+		t.Fatalf("put 2: %v", err)
+	}
+	r1, err := put(1, "one")
+	if err != nil {
+		t.Fatalf("put 1: %v", err)
+	}
+	if !r1.Success || r1.LogIndex == r2.LogIndex || string(r1.PrevValue) != "two" {
+		t.Fatalf("seq 1 after seq 2 was not applied: %+v", r1)
+	}
+
+	// retries get their own result back, not the latest one
+	again, err := put(2, "two")
+	if err != nil {
+		t.Fatalf("retry 2: %v", err)
+	}
+	if again.LogIndex != r2.LogIndex || len(again.PrevValue) != 0 {
+		t.Fatalf("retry of seq 2 = %+v, want %+v", again, r2)
+	}
+	again, err = put(1, "one")
+	if err != nil || again.LogIndex != r1.LogIndex {
+		t.Fatalf("retry of seq 1 = %+v, %v, want %+v", again, err, r1)
+	}
+
+	// push seq 1 and 2 out of the window
+	for seq := uint64(3); seq < 3+dedupWindow; seq++ {
+		if _, err := put(seq, fmt.Sprint(seq)); err != nil {
+			t.Fatalf("put %d: %v", seq, err)
+		}
+	}
+	last := n.LastIndex()
+	if _, err := put(1, "one"); !errors.Is(err, ErrResultUnavailable) {
+		t.Fatalf("retry of evicted seq: err = %v, want ErrResultUnavailable", err)
+	}
+	if n.LastIndex() != last {
+		t.Fatalf("evicted seq was logged")
+	}
+
+	if err := n.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// replay builds the same window
+	n, err = OpenNode(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer n.Close()
+
+	if _, err := put(2, "two"); !errors.Is(err, ErrResultUnavailable) {
+		t.Fatalf("after replay, evicted seq: err = %v, want ErrResultUnavailable", err)
+	}
+	r, err := put(3+dedupWindow-1, "")
+	if err != nil || r.LogIndex != last {
+		t.Fatalf("after replay, retry of last seq = %+v, %v, want logIndex %d", r, err, last)
+	}
+}
+
+// an engine that remembers the last batch it got
+type batchRecorder struct {
+	DurableEngine
+	last *Batch
+}
+
+func (r *batchRecorder) ApplyBatch(b *Batch) error {
+	r.last = b
+	return r.DurableEngine.ApplyBatch(b)
+}
+
+func TestDedupStoresOneResultPerWrite(t *testing.T) {
+	dir := t.TempDir()
+	e, err := OpenLSMEngine(dir, DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("OpenLSMEngine: %v", err)
+	}
+	rec := &batchRecorder{DurableEngine: e}
+	s, err := NewStoreWithEngine(rec)
+	if err != nil {
+		t.Fatalf("NewStoreWithEngine: %v", err)
+	}
+
+	big := make([]byte, 4096)
+	for seq := uint64(1); seq <= 2*dedupWindow; seq++ {
+		if _, err := s.Apply(Command{Instruct: CmdPut, ClientID: "c1", Seq: seq, Key: []byte("k"), Value: big}, seq); err != nil {
+			t.Fatalf("Apply %d: %v", seq, err)
+		}
+		// the value, the new result, the one that fell out, the head and the stats
+		if len(rec.last.Ops) > 5 {
+			t.Fatalf("seq %d wrote %d keys", seq, len(rec.last.Ops))
+		}
+	}
+	var stored int
+	_ = e.Iterate([]byte(dedupEntryPrefix), func(key, value []byte) bool {
+		stored++
+		return true
+	})
+	if stored != dedupWindow {
+		t.Fatalf("%d results stored, want %d", stored, dedupWindow)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	e, err = OpenLSMEngine(dir, DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	s, err = NewStoreWithEngine(e)
+	if err != nil {
+		t.Fatalf("NewStoreWithEngine: %v", err)
+	}
+	defer s.Close()
+	if r, st := s.lookupDedup("c1", 2*dedupWindow); st != dedupHit || r.LogIndex != 2*dedupWindow || len(r.PrevValue) != len(big) {
+		t.Fatalf("last seq after reopen = %+v, %v", r, st)
+	}
+	if _, st := s.lookupDedup("c1", dedupWindow); st != dedupGone {
+		t.Fatalf("evicted seq after reopen = %v, want dedupGone", st)
+	}
+}
@@ -0,0 +1,101 @@
+package sixpaths_kvs
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// diskspace.go keeps a node from filling up its disk. With a threshold set
+// (NodeOptions.MinFreeBytes or MinFreePercent), a goroutine checks the free
+// space of the data dir's filesystem every DiskCheckInterval. Below the
+// threshold the node turns away writes that add data with ErrDiskFull (507
+// over HTTP) and keeps serving reads. Deletes and keepalives still go
+// through, and so do engine flushes and compaction, so an operator can make
+// room without a restart. Writes are taken again once free space is back
+// above the threshold by a tenth, so the node doesn't flap at the edge.
+// How free space is read is per platform, see diskusage_*.go.
+
+// how often the free space is checked when the options don't say
+const DefaultDiskCheckInterval = 5 * time.Second
+
+// returned by writes while the node is short on disk space
+var ErrDiskFull = errors.New("error: not enough free disk space, only deletes are accepted")
+
+var errDiskUsageUnsupported = errors.New("error: free disk space can't be read on this platform")
+
+// DiskUsage is the size and free space of a filesystem, in bytes. Free is
+// what an unprivileged process can still use.
+type DiskUsage struct {
+	Total uint64
+	Free  uint64
+}
+
+// the free space below which writes are turned away, 0 if there's no guard
+func (n *Node) minFree(u DiskUsage) uint64 {
+	return max(n.minFreeBytes, uint64(float64(u.Total)*n.minFreePercent/100))
+}
+
+// starts the goroutine that watches the free space, Close stops it
+func (n *Node) startDiskMonitor(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultDiskCheckInterval
+	}
+	n.diskStop = make(chan struct{})
+	n.diskDone = make(chan struct{})
+	go func() {
+		defer close(n.diskDone)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			if err := n.checkDisk(); errors.Is(err, errDiskUsageUnsupported) {
+				n.log.Warn("disk_guard_off", "err", err)
+				return
+			}
+			select {
+			case <-n.diskStop:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// reads the free space once and moves the node in or out of low-disk mode
+func (n *Node) checkDisk() error {
+	u, err := n.fs.Usage(n.dataDir)
+	if err != nil {
+		if !errors.Is(err, errDiskUsageUnsupported) {
+			n.log.Error("disk_usage_failed", "dir", n.dataDir, "err", err)
+		}
+		return err
+	}
+	limit := n.minFree(u)
+	low := n.DiskLow() != nil
+	switch {
+	case !low && u.Free < limit:
+		err := fmt.Errorf("%w: %d bytes free, at least %d needed", ErrDiskFull, u.Free, limit)
+		n.diskLow.Store(&err)
+		n.log.Error("disk_low", "free", u.Free, "total", u.Total, "min_free", limit)
+	case low && u.Free >= limit+limit/10:
+		n.diskLow.Store(nil)
+		n.log.Warn("disk_ok", "free", u.Free, "total", u.Total, "min_free", limit)
+	}
+	return nil
+}
+
+// DiskLow returns why the node turns away writes that add data (wrapping
+// ErrDiskFull), or nil while it has enough free space.
+func (n *Node) DiskLow() error {
+	if p := n.diskLow.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// writes that can't hurt while the disk is low: deletes and chunk drops free
+// space once the engine compacts, and keepalives keep sessions (and their
+// dedup) alive
+func allowedOnLowDisk(t CommandType) bool {
+	return t == CmdDelete || t == CmdKeepAlive || t == CmdDropChunks
+}
@@ -0,0 +1,134 @@
+package sixpaths_kvs
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskLowOnlyTakesDeletes(t *testing.T) {
+	m := NewMemFS()
+	m.SetCapacity(1 << 20)
+	// the monitor only checks when it starts, the test checks by hand after that
+	n, err := OpenNodeWithOptions("/data", NodeOptions{FS: m, MinFreeBytes: 64 << 10, DiskCheckInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	defer n.Close()
+	h := NewHTTPServer(n, "").Handler()
+	call := func(method, path, body string) (int, string) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w.Code, w.Body.String()
+	}
+	put := Command{Instruct: CmdPut, ClientID: "c1", Seq: 1, Key: []byte("a"), Value: []byte("1")}
+	first, err := n.Exec(put)
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	// the disk fills up to leave less than the threshold
+	shrink := func(free int64) {
+		t.Helper()
+		u, err := m.Usage("/data")
+		if err != nil {
+			t.Fatalf("Usage: %v", err)
+		}
+		m.SetCapacity(int64(u.Total-u.Free) + free)
+		if err := n.checkDisk(); err != nil {
+			t.Fatalf("checkDisk: %v", err)
+		}
+	}
+	shrink(32 << 10)
+	if err := n.DiskLow(); !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("DiskLow = %v, want ErrDiskFull", err)
+	}
+	if _, err := n.Exec(Command{Instruct: CmdPut, ClientID: "c1", Seq: 2, Key: []byte("b"), Value: []byte("2")}); !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("put on a full disk = %v, want ErrDiskFull", err)
+	}
+	if code, body := call(http.MethodPost, "/put", `{"client":"c2","seq":1,"key":"b","value":"2"}`); code != http.StatusInsufficientStorage {
+		t.Fatalf("PUT on a full disk = %d %s, want 507", code, body)
+	}
+	if res := execErrResponse(ErrDiskFull); res.Status != StatusDiskFull {
+		t.Fatalf("rpc status = %v, want %v", res.Status, StatusDiskFull)
+	}
+	if _, body := call(http.MethodGet, "/health", ""); !strings.Contains(body, `"status":"disk_low"`) {
+		t.Fatalf("/health = %s, want disk_low", body)
+	}
+
+	// a retry of an applied write is still answered, reads and deletes go on
+	if res, err := n.Exec(put); err != nil || res.LogIndex != first.LogIndex {
+		t.Fatalf("retry = %+v, %v, want log index %d", res, err, first.LogIndex)
+	}
+	if v, err := n.Get("a"); err != nil || string(v) != "1" {
+		t.Fatalf("get = %q, %v", v, err)
+	}
+	if _, err := n.Exec(Command{Instruct: CmdDelete, ClientID: "c1", Seq: 3, Key: []byte("a")}); err != nil {
+		t.Fatalf("delete on a full disk: %v", err)
+	}
+
+	// just above the threshold isn't enough to take writes again
+	shrink(65 << 10)
+	if n.DiskLow() == nil {
+		t.Fatal("disk guard let go right at the threshold")
+	}
+	shrink(1 << 20)
+	if err := n.DiskLow(); err != nil {
+		t.Fatalf("DiskLow after making room = %v", err)
+	}
+	if _, err := n.Exec(Command{Instruct: CmdPut, ClientID: "c1", Seq: 4, Key: []byte("b"), Value: []byte("2")}); err != nil {
+		t.Fatalf("put after making room: %v", err)
+	}
+	if _, body := call(http.MethodGet, "/health", ""); !strings.Contains(body, `"status":"ok"`) {
+		t.Fatalf("/health = %s, want ok", body)
+	}
+}
+
+func TestDiskMonitorPercent(t *testing.T) {
+	m := NewMemFS()
+	m.SetCapacity(1 << 20)
+	// nothing is ever 100% free, the monitor's first check turns writes away
+	n, err := OpenNodeWithOptions("/data", NodeOptions{FS: m, MinFreePercent: 100, DiskCheckInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	defer n.Close()
+	for deadline := time.Now().Add(time.Second); n.DiskLow() == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("the disk monitor never noticed the disk was full")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	_, err = n.Exec(Command{Instruct: CmdPut, ClientID: "c1", Seq: 1, Key: []byte("k"), Value: []byte("v")})
+	if !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("put = %v, want ErrDiskFull", err)
+	}
+}
+
+func TestMemFSCapacity(t *testing.T) {
+	m := NewMemFS()
+	if _, err := m.Usage("/"); !errors.Is(err, errDiskUsageUnsupported) {
+		t.Fatalf("Usage without a capacity = %v", err)
+	}
+	m.SetCapacity(10)
+	f := writeMemFile(t, m, "/a", "12345", false)
+	if n, err := f.Write([]byte("6789ab")); n != 5 || !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("write past capacity = %d, %v, want 5 bytes and ErrNoSpace", n, err)
+	}
+	if u, _ := m.Usage("/"); u.Total != 10 || u.Free != 0 {
+		t.Fatalf("Usage = %+v", u)
+	}
+	// overwriting in place takes no more room
+	g, err := m.OpenFile("/a", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := fmt.Fprint(g, "overwrite"); err != nil {
+		t.Fatalf("overwrite on a full fs: %v", err)
+	}
+}
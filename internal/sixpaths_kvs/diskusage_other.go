@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package sixpaths_kvs
+
+// diskusage_other.go is for platforms we can't read free space on yet, the
+// disk guard turns itself off there.
+
+func diskUsage(path string) (DiskUsage, error) {
+	return DiskUsage{}, errDiskUsageUnsupported
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd
+
+package sixpaths_kvs
+
+import "syscall"
+
+// diskusage_unix.go reads free space with statfs(2).
+
+func diskUsage(path string) (DiskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return DiskUsage{}, err
+	}
+	bs := uint64(st.Bsize)
+	return DiskUsage{Total: uint64(st.Blocks) * bs, Free: uint64(st.Bavail) * bs}, nil
+}
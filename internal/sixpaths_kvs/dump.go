@@ -0,0 +1,441 @@
+package sixpaths_kvs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf8"
+)
+
+// dump.go writes and reads logical dumps of the keyspace, for moving data
+// between clusters or into other systems. Unlike a backup (backup.go) a dump
+// only has user keys and their values, no log and no internal state, and
+// can be loaded into any cluster with ordinary writes.
+//
+// A dump is one or more sections, each a DumpHeader naming the node that
+// wrote it and the log index its keys are a snapshot of, followed by that
+// node's entries in key order. An end marker with the number of entries
+// closes the dump, so one that was cut short doesn't pass for a whole one.
+// There is no per-key version or TTL to carry: the store keeps neither.
+//
+// Two encodings:
+//
+//	jsonl   one JSON object per line: a header {"dump":"sixpaths","version":1,...},
+//	        entries {"key":..,"value":..}, values that aren't UTF-8 in valueBase64,
+//	        and {"end":true,"entries":N}
+//	binary  "SXDUMP1\x00", then records [u8 type][u32 len][payload][u32 crc of type and payload]
+//	        with type 'H' (payload: the header as JSON), 'E' ([u8 flags][u32 klen][key][value])
+//	        or 'Z' ([u64 entries])
+
+const (
+	DumpJSONL  = "jsonl"
+	DumpBinary = "binary"
+)
+
+const dumpVersion = 1
+
+var dumpMagic = []byte("SXDUMP1\x00")
+
+const (
+	dumpRecHeader = 'H'
+	dumpRecEntry  = 'E'
+	dumpRecEnd    = 'Z'
+
+	dumpFlagStreamed = 1
+)
+
+// DumpHeader starts the section of a dump one node wrote.
+type DumpHeader struct {
+	Node     string `json:"node,omitempty"`
+	LogIndex uint64 `json:"logIndex"` // the node's keys are a snapshot as of this index
+}
+
+// DumpEntry is one key of a dump.
+type DumpEntry struct {
+	Key      string
+	Value    []byte
+	Streamed bool // the value was uploaded with /stream, and should be again
+}
+
+// one line of a jsonl dump
+type dumpLine struct {
+	Dump     string `json:"dump,omitempty"`
+	Version  int    `json:"version,omitempty"`
+	Node     string `json:"node,omitempty"`
+	LogIndex uint64 `json:"logIndex,omitempty"`
+
+	Key         *string `json:"key,omitempty"`
+	KeyBase64   string  `json:"keyBase64,omitempty"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 string  `json:"valueBase64,omitempty"`
+	Streamed    bool    `json:"streamed,omitempty"`
+
+	End     bool  `json:"end,omitempty"`
+	Entries int64 `json:"entries,omitempty"`
+}
+
+// ParseDumpFormat checks a dump format name, "" means jsonl.
+func ParseDumpFormat(s string) (string, error) {
+	switch s {
+	case "", DumpJSONL:
+		return DumpJSONL, nil
+	case DumpBinary:
+		return DumpBinary, nil
+	}
+	return "", fmt.Errorf("error: unknown dump format %q, want jsonl or binary", s)
+}
+
+// ===== Writing =====
+
+// DumpWriter writes a dump, Close writes the end marker.
+type DumpWriter struct {
+	bw      *bufio.Writer
+	format  string
+	entries int64
+}
+
+func NewDumpWriter(w io.Writer, format string) (*DumpWriter, error) {
+	format, err := ParseDumpFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	dw := &DumpWriter{bw: bufio.NewWriterSize(w, 64<<10), format: format}
+	if format == DumpBinary {
+		if _, err := dw.bw.Write(dumpMagic); err != nil {
+			return nil, err
+		}
+	}
+	return dw, nil
+}
+
+// Entries returns how many entries were written so far.
+func (dw *DumpWriter) Entries() int64 {
+	return dw.entries
+}
+
+func (dw *DumpWriter) WriteHeader(h DumpHeader) error {
+	if dw.format == DumpJSONL {
+		return dw.line(dumpLine{Dump: "sixpaths", Version: dumpVersion, Node: h.Node, LogIndex: h.LogIndex})
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return dw.record(dumpRecHeader, b)
+}
+
+func (dw *DumpWriter) WriteEntry(e DumpEntry) error {
+	dw.entries++
+	if dw.format == DumpJSONL {
+		l := dumpLine{Streamed: e.Streamed}
+		if utf8.ValidString(e.Key) {
+			l.Key = &e.Key
+		} else {
+			l.KeyBase64 = base64.StdEncoding.EncodeToString([]byte(e.Key))
+		}
+		if utf8.Valid(e.Value) {
+			v := string(e.Value)
+			l.Value = &v
+		} else {
+			l.ValueBase64 = base64.StdEncoding.EncodeToString(e.Value)
+		}
+		return dw.line(l)
+	}
+
+	p := make([]byte, 0, 5+len(e.Key)+len(e.Value))
+	var flags byte
+	if e.Streamed {
+		flags |= dumpFlagStreamed
+	}
+	p = append(p, flags)
+	p = binary.BigEndian.AppendUint32(p, uint32(len(e.Key)))
+	p = append(p, e.Key...)
+	p = append(p, e.Value...)
+	return dw.record(dumpRecEntry, p)
+}
+
+// Flush sends what's buffered on to the underlying writer.
+func (dw *DumpWriter) Flush() error {
+	return dw.bw.Flush()
+}
+
+// Close ends the dump and flushes it, the underlying writer stays open.
+func (dw *DumpWriter) Close() error {
+	var err error
+	if dw.format == DumpJSONL {
+		err = dw.line(dumpLine{End: true, Entries: dw.entries})
+	} else {
+		err = dw.record(dumpRecEnd, binary.BigEndian.AppendUint64(nil, uint64(dw.entries)))
+	}
+	if err != nil {
+		return err
+	}
+	return dw.bw.Flush()
+}
+
+func (dw *DumpWriter) line(l dumpLine) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	_, err = dw.bw.Write(append(b, '\n'))
+	return err
+}
+
+func (dw *DumpWriter) record(typ byte, payload []byte) error {
+	var hdr [5]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(payload)))
+	crc := crc32.Update(crc32.ChecksumIEEE(hdr[:1]), crc32.IEEETable, payload)
+	if _, err := dw.bw.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := dw.bw.Write(payload); err != nil {
+		return err
+	}
+	_, err := dw.bw.Write(binary.BigEndian.AppendUint32(nil, crc))
+	return err
+}
+
+// ===== Reading =====
+
+// DumpReader reads a dump in either encoding.
+type DumpReader struct {
+	br      *bufio.Reader
+	format  string
+	header  DumpHeader
+	entries int64
+	line    int // for error messages, lines or records read so far
+	done    bool
+}
+
+// NewDumpReader tells the encoding of the dump in r from its first bytes.
+func NewDumpReader(r io.Reader) (*DumpReader, error) {
+	dr := &DumpReader{br: bufio.NewReaderSize(r, 64<<10), format: DumpJSONL}
+	start, err := dr.br.Peek(len(dumpMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if bytes.Equal(start, dumpMagic) {
+		dr.format = DumpBinary
+		_, _ = dr.br.Discard(len(dumpMagic))
+	}
+	return dr, nil
+}
+
+func (dr *DumpReader) Format() string {
+	return dr.format
+}
+
+// Header returns the header of the section the last entry was in.
+func (dr *DumpReader) Header() DumpHeader {
+	return dr.header
+}
+
+// Next returns the next entry. It returns io.EOF after the end marker, and
+// io.ErrUnexpectedEOF if the dump ends without one.
+func (dr *DumpReader) Next() (DumpEntry, error) {
+	for {
+		if dr.done {
+			return DumpEntry{}, io.EOF
+		}
+		var e DumpEntry
+		var isEntry bool
+		var err error
+		if dr.format == DumpJSONL {
+			e, isEntry, err = dr.nextLine()
+		} else {
+			e, isEntry, err = dr.nextRecord()
+		}
+		if err != nil {
+			return DumpEntry{}, err
+		}
+		if isEntry {
+			dr.entries++
+			return e, nil
+		}
+	}
+}
+
+// reads one line, the bool is false for headers and the end marker
+func (dr *DumpReader) nextLine() (DumpEntry, bool, error) {
+	b, err := dr.br.ReadBytes('\n')
+	if len(b) == 0 && err != nil {
+		if err == io.EOF {
+			return DumpEntry{}, false, io.ErrUnexpectedEOF
+		}
+		return DumpEntry{}, false, err
+	}
+	dr.line++
+	if len(bytes.TrimSpace(b)) == 0 {
+		return DumpEntry{}, false, nil
+	}
+	var l dumpLine
+	if err := json.Unmarshal(b, &l); err != nil {
+		return DumpEntry{}, false, fmt.Errorf("error: dump line %d: %w", dr.line, err)
+	}
+
+	switch {
+	case l.Dump != "":
+		if l.Dump != "sixpaths" || l.Version != dumpVersion {
+			return DumpEntry{}, false, fmt.Errorf("error: dump line %d: unsupported dump %q version %d", dr.line, l.Dump, l.Version)
+		}
+		dr.header = DumpHeader{Node: l.Node, LogIndex: l.LogIndex}
+		return DumpEntry{}, false, nil
+	case l.End:
+		return DumpEntry{}, false, dr.end(l.Entries)
+	}
+
+	e := DumpEntry{Streamed: l.Streamed}
+	switch {
+	case l.Key != nil:
+		e.Key = *l.Key
+	case l.KeyBase64 != "":
+		k, err := base64.StdEncoding.DecodeString(l.KeyBase64)
+		if err != nil {
+			return DumpEntry{}, false, fmt.Errorf("error: dump line %d: bad keyBase64: %w", dr.line, err)
+		}
+		e.Key = string(k)
+	default:
+		return DumpEntry{}, false, fmt.Errorf("error: dump line %d has no key", dr.line)
+	}
+	switch {
+	case l.Value != nil:
+		e.Value = []byte(*l.Value)
+	case l.ValueBase64 != "":
+		if e.Value, err = base64.StdEncoding.DecodeString(l.ValueBase64); err != nil {
+			return DumpEntry{}, false, fmt.Errorf("error: dump line %d: bad valueBase64: %w", dr.line, err)
+		}
+	default:
+		e.Value = []byte{}
+	}
+	return e, true, nil
+}
+
+// reads one binary record, the bool is false for headers and the end marker
+func (dr *DumpReader) nextRecord() (DumpEntry, bool, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(dr.br, hdr[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return DumpEntry{}, false, err
+	}
+	dr.line++
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > 1<<30 {
+		return DumpEntry{}, false, fmt.Errorf("error: dump record %d has a bad length", dr.line)
+	}
+	buf := make([]byte, n+4)
+	if _, err := io.ReadFull(dr.br, buf); err != nil {
+		return DumpEntry{}, false, io.ErrUnexpectedEOF
+	}
+	payload := buf[:n]
+	crc := crc32.Update(crc32.ChecksumIEEE(hdr[:1]), crc32.IEEETable, payload)
+	if crc != binary.BigEndian.Uint32(buf[n:]) {
+		return DumpEntry{}, false, fmt.Errorf("error: dump record %d: checksum mismatch", dr.line)
+	}
+
+	switch hdr[0] {
+	case dumpRecHeader:
+		var h DumpHeader
+		if err := json.Unmarshal(payload, &h); err != nil {
+			return DumpEntry{}, false, fmt.Errorf("error: dump record %d: bad header: %w", dr.line, err)
+		}
+		dr.header = h
+		return DumpEntry{}, false, nil
+	case dumpRecEnd:
+		if len(payload) != 8 {
+			return DumpEntry{}, false, fmt.Errorf("error: dump record %d: bad end marker", dr.line)
+		}
+		return DumpEntry{}, false, dr.end(int64(binary.BigEndian.Uint64(payload)))
+	case dumpRecEntry:
+		if len(payload) < 5 {
+			return DumpEntry{}, false, fmt.Errorf("error: dump record %d: entry is too short", dr.line)
+		}
+		klen := binary.BigEndian.Uint32(payload[1:])
+		if uint64(klen) > uint64(len(payload)-5) {
+			return DumpEntry{}, false, fmt.Errorf("error: dump record %d: key runs past the entry", dr.line)
+		}
+		return DumpEntry{
+			Key:      string(payload[5 : 5+klen]),
+			Value:    payload[5+klen:],
+			Streamed: payload[0]&dumpFlagStreamed != 0,
+		}, true, nil
+	}
+	return DumpEntry{}, false, fmt.Errorf("error: dump record %d has unknown type %q", dr.line, hdr[0])
+}
+
+func (dr *DumpReader) end(entries int64) error {
+	if entries != dr.entries {
+		return fmt.Errorf("error: the dump says it has %d entries, we read %d", entries, dr.entries)
+	}
+	dr.done = true
+	return nil
+}
+
+// ===== Export =====
+
+// Export writes a section with every user key starting with prefix to dw.
+// The keys come from one snapshot of the engine, streamed values included.
+func (n *Node) Export(ctx context.Context, dw *DumpWriter, prefix string) error {
+	// the snapshot is taken under the write lock, so it's exactly as of n.last
+	n.mu.Lock()
+	h := DumpHeader{Node: n.id, LogIndex: n.last}
+	snap, err := n.store.engine.Snapshot()
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	if err := dw.WriteHeader(h); err != nil {
+		return err
+	}
+	var werr error
+	err = snap.Iterate([]byte(prefix), func(key, value []byte) bool {
+		if werr = ctx.Err(); werr != nil {
+			return false
+		}
+		if isInternalKey(key) {
+			return true
+		}
+		e := DumpEntry{Key: string(key), Value: value}
+		if m, isM := parseManifest(value); isM {
+			e.Streamed = true
+			if e.Value, werr = readChunks(snap, m); werr != nil {
+				werr = fmt.Errorf("error: exporting %q: %w", key, werr)
+				return false
+			}
+		}
+		werr = dw.WriteEntry(e)
+		return werr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return werr
+}
+
+// puts a streamed value back together from the chunks in snap
+func readChunks(snap EngineSnapshot, m manifest) ([]byte, error) {
+	out := make([]byte, 0, m.Size)
+	for i := uint32(0); i < m.Chunks; i++ {
+		v, ok, err := snap.Get(chunkKey(m.ClientID, m.Seq, i))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ErrValueChanged
+		}
+		out = append(out, v...)
+	}
+	return out, nil
+}
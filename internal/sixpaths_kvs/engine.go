@@ -0,0 +1,359 @@
+package sixpaths_kvs
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// engine.go defines the StorageEngine interface that sits behind our Store.
+// The Store keeps the KV semantics (dedup, log indexes, chunked values),
+// while the engine only has to know how to keep bytes around.
+// The default engine is an in-memory map, others can be registered by name
+// and picked per node through NodeConfig.Engine.
+
+type StorageEngine interface {
+	// returns a copy of the value at key, the bool is false if there is none
+	Get(key []byte) ([]byte, bool, error)
+	// applies every op in the batch, all of them or none of them
+	ApplyBatch(b *Batch) error
+	// calls fn for every key with the given prefix in ascending key order
+	// until fn returns false
+	Iterate(prefix []byte, fn func(key, value []byte) bool) error
+	// returns a read-only, point-in-time view of the engine
+	Snapshot() (EngineSnapshot, error)
+	Close() error
+}
+
+// DurableEngine is implemented by engines that keep data on disk themselves.
+// For them the node only replays the part of the WAL the engine doesn't
+// already have, and trims the WAL once the engine has flushed.
+type DurableEngine interface {
+	StorageEngine
+	// log index of the last batch that is safely on disk
+	PersistedIndex() uint64
+	// true once enough has been written that a flush is worth it
+	NeedsFlush() bool
+	// persists everything applied so far and returns its log index
+	Flush() (uint64, error)
+}
+
+// RangeEngine is implemented by engines that can start iterating part way
+// into a prefix. Store.Scan pages through a prefix with it, instead of
+// snapshotting the engine and walking everything before the page again.
+type RangeEngine interface {
+	// calls fn for at most limit keys with the given prefix that are >= start,
+	// in ascending key order, until fn returns false
+	IterateRange(prefix, start []byte, limit int, fn func(key, value []byte) bool) error
+}
+
+// EngineSnapshot is a frozen view of an engine, it must be released once done.
+type EngineSnapshot interface {
+	Get(key []byte) ([]byte, bool, error)
+	Iterate(prefix []byte, fn func(key, value []byte) bool) error
+	Release()
+}
+
+// Batch is the set of changes a single command makes to the engine.
+type Batch struct {
+	Index uint64 // log index of the command that produced the batch
+	Ops   []BatchOp
+}
+
+type BatchOp struct {
+	Key    []byte
+	Value  []byte
+	Delete bool
+}
+
+func (b *Batch) Put(key, value []byte) {
+	b.Ops = append(b.Ops, BatchOp{Key: key, Value: value})
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.Ops = append(b.Ops, BatchOp{Key: key, Delete: true})
+}
+
+// ===== Engine registry =====
+
+// the engine used when a node doesn't ask for one
+const DefaultEngine = "map"
+
+// EngineFactory opens an engine that keeps its files (if any) under dir on fsys.
+type EngineFactory func(fsys FS, dir string) (StorageEngine, error)
+
+var (
+	enginesMu sync.Mutex
+	engines   = map[string]EngineFactory{
+		"map": func(FS, string) (StorageEngine, error) { return newMapEngine(), nil },
+	}
+)
+
+// RegisterEngine makes an engine available to OpenEngine under name.
+func RegisterEngine(name string, f EngineFactory) {
+	enginesMu.Lock()
+	defer enginesMu.Unlock()
+	engines[name] = f
+}
+
+// OpenEngine opens the engine registered under name ("" means DefaultEngine).
+func OpenEngine(name string, dir string) (StorageEngine, error) {
+	return OpenEngineWithFS(OSFS, name, dir)
+}
+
+// OpenEngineWithFS is OpenEngine on fsys.
+func OpenEngineWithFS(fsys FS, name string, dir string) (StorageEngine, error) {
+	if name == "" {
+		name = DefaultEngine
+	}
+
+	enginesMu.Lock()
+	f, ok := engines[name]
+	enginesMu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("error: unknown storage engine %q", name)
+	}
+	return f(fsys, dir)
+}
+
+// ===== Map engine =====
+
+// the map engine splits its keys over this many independently locked
+// stripes, so readers and writers of different keys rarely meet on a lock
+const mapStripes = 32
+
+// mapEngine keeps everything in Go maps. Nothing is persisted, the node
+// rebuilds it from the WAL on every boot.
+type mapEngine struct {
+	stripes [mapStripes]mapStripe
+}
+
+type mapStripe struct {
+	mu sync.RWMutex
+	kv map[string][]byte
+
+	// the keys of kv in order, for IterateRange. a batch that adds or
+	// removes a key throws it away, the next range rebuilds it.
+	sorted   []string
+	sortedOK bool
+
+	_ [32]byte // keeps neighbouring stripes off the same cache line
+}
+
+func newMapEngine() *mapEngine {
+	e := &mapEngine{}
+	for i := range e.stripes {
+		e.stripes[i].kv = make(map[string][]byte)
+	}
+	return e
+}
+
+func stripeFor(key []byte) int {
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return int(h.Sum32() % mapStripes)
+}
+
+func (e *mapEngine) Get(key []byte) ([]byte, bool, error) {
+	st := &e.stripes[stripeFor(key)]
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	v, ok := st.kv[string(key)]
+	if !ok {
+		return nil, false, nil
+	}
+	return append([]byte{}, v...), true, nil
+}
+
+func (e *mapEngine) ApplyBatch(b *Batch) error {
+	// we lock every stripe the batch touches, always in ascending order
+	// so two batches can't deadlock, and readers never see half a batch
+	var touched [mapStripes]bool
+	for _, op := range b.Ops {
+		touched[stripeFor(op.Key)] = true
+	}
+	for i := range e.stripes {
+		if touched[i] {
+			e.stripes[i].mu.Lock()
+		}
+	}
+	defer func() {
+		for i := range e.stripes {
+			if touched[i] {
+				e.stripes[i].mu.Unlock()
+			}
+		}
+	}()
+
+	for _, op := range b.Ops {
+		st := &e.stripes[stripeFor(op.Key)]
+		_, had := st.kv[string(op.Key)]
+		if had == op.Delete {
+			st.sorted, st.sortedOK = nil, false
+		}
+		if op.Delete {
+			delete(st.kv, string(op.Key))
+			continue
+		}
+		st.kv[string(op.Key)] = append([]byte(nil), op.Value...)
+	}
+	return nil
+}
+
+// Iterate isn't a snapshot: keys written while it runs may or may not show up.
+func (e *mapEngine) Iterate(prefix []byte, fn func(key, value []byte) bool) error {
+	var keys []string
+	for i := range e.stripes {
+		st := &e.stripes[i]
+		st.mu.RLock()
+		keys = append(keys, sortedKeys(st.kv, prefix)...)
+		st.mu.RUnlock()
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v, ok, _ := e.Get([]byte(k))
+		if !ok {
+			continue
+		}
+		if !fn([]byte(k), v) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// IterateRange takes at most limit keys from every stripe, found in the
+// stripe's sorted keys and merged into the page, and holds one stripe's
+// lock at a time. Like Iterate
+// it isn't a snapshot, a batch that spans stripes may show up in part, but a
+// command only ever changes one user key.
+func (e *mapEngine) IterateRange(prefix, start []byte, limit int, fn func(key, value []byte) bool) error {
+	if limit <= 0 {
+		return nil
+	}
+	from := max(string(start), string(prefix))
+
+	type kv struct {
+		k string
+		v []byte
+	}
+	var page, run, merged []kv
+	for i := range e.stripes {
+		st := &e.stripes[i]
+		unlock := st.lockSorted()
+		run = run[:0]
+		for j := sort.SearchStrings(st.sorted, from); j < len(st.sorted) && len(run) < limit; j++ {
+			k := st.sorted[j]
+			if !strings.HasPrefix(k, string(prefix)) {
+				break
+			}
+			// values are never modified in place, so sharing them is safe
+			run = append(run, kv{k, st.kv[k]})
+		}
+		unlock()
+
+		// both are sorted already, merging them keeps the first limit
+		merged = merged[:0]
+		a, b := page, run
+		for len(merged) < limit && (len(a) > 0 || len(b) > 0) {
+			if len(b) == 0 || (len(a) > 0 && a[0].k < b[0].k) {
+				merged, a = append(merged, a[0]), a[1:]
+			} else {
+				merged, b = append(merged, b[0]), b[1:]
+			}
+		}
+		page, merged = merged, page
+	}
+
+	for _, p := range page {
+		if !fn([]byte(p.k), append([]byte{}, p.v...)) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// locks the stripe for reading with its sorted keys up to date, rebuilding
+// them first if a batch threw them away. returns the matching unlock.
+func (st *mapStripe) lockSorted() func() {
+	st.mu.RLock()
+	if st.sortedOK {
+		return st.mu.RUnlock
+	}
+	st.mu.RUnlock()
+
+	st.mu.Lock()
+	if !st.sortedOK {
+		st.sorted = sortedKeys(st.kv, nil)
+		st.sortedOK = true
+	}
+	return st.mu.Unlock
+}
+
+// the map engine's snapshot is a full copy, fine for the sizes it can hold anyway
+func (e *mapEngine) Snapshot() (EngineSnapshot, error) {
+	// holding every stripe at once gives us a consistent cut
+	for i := range e.stripes {
+		e.stripes[i].mu.RLock()
+	}
+	defer func() {
+		for i := range e.stripes {
+			e.stripes[i].mu.RUnlock()
+		}
+	}()
+
+	cp := make(map[string][]byte)
+	for i := range e.stripes {
+		for k, v := range e.stripes[i].kv {
+			// values are never modified in place, so sharing them is safe
+			cp[k] = v
+		}
+	}
+	return &mapSnapshot{kv: cp}, nil
+}
+
+func (e *mapEngine) Close() error {
+	return nil
+}
+
+type mapSnapshot struct {
+	kv map[string][]byte
+}
+
+func (s *mapSnapshot) Get(key []byte) ([]byte, bool, error) {
+	v, ok := s.kv[string(key)]
+	if !ok {
+		return nil, false, nil
+	}
+	return append([]byte{}, v...), true, nil
+}
+
+func (s *mapSnapshot) Iterate(prefix []byte, fn func(key, value []byte) bool) error {
+	for _, k := range sortedKeys(s.kv, prefix) {
+		if !fn([]byte(k), append([]byte{}, s.kv[k]...)) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *mapSnapshot) Release() {
+	s.kv = nil
+}
+
+func sortedKeys(kv map[string][]byte, prefix []byte) []string {
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		if bytes.HasPrefix([]byte(k), prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
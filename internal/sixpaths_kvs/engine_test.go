@@ -0,0 +1,75 @@
+package sixpaths_kvs
+
+import "testing"
+
+func TestMapEngineIterateAndSnapshot(t *testing.T) {
+	e, err := OpenEngine("", "")
+	if err != nil {
+		t.Fatalf("OpenEngine: %v", err)
+	}
+	defer e.Close()
+
+	b := &Batch{Index: 1}
+	b.Put([]byte("b/2"), []byte("two"))
+	b.Put([]byte("a/1"), []byte("one"))
+	b.Put([]byte("b/1"), []byte("uno"))
+	if err := e.ApplyBatch(b); err != nil {
+		t.Fatalf("ApplyBatch: %v", err)
+	}
+
+	ranged := func(start string, limit int) []string {
+		var keys []string
+		_ = e.(RangeEngine).IterateRange([]byte("b/"), []byte(start), limit, func(k, v []byte) bool {
+			keys = append(keys, string(k))
+			return true
+		})
+		return keys
+	}
+	if keys := ranged("", 10); len(keys) != 2 || keys[0] != "b/1" || keys[1] != "b/2" {
+		t.Fatalf("IterateRange(b/) = %v, want [b/1 b/2]", keys)
+	}
+
+	snap, err := e.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	defer snap.Release()
+
+	b = &Batch{Index: 2}
+	b.Delete([]byte("b/1"))
+	b.Put([]byte("b/3"), []byte("three"))
+	if err := e.ApplyBatch(b); err != nil {
+		t.Fatalf("ApplyBatch: %v", err)
+	}
+
+	var keys []string
+	_ = e.Iterate([]byte("b/"), func(k, v []byte) bool {
+		keys = append(keys, string(k))
+		return true
+	})
+	if len(keys) != 2 || keys[0] != "b/2" || keys[1] != "b/3" {
+		t.Fatalf("Iterate(b/) = %v, want [b/2 b/3]", keys)
+	}
+
+	// the sorted keys the first range built follow the second batch
+	if keys := ranged("b/2", 1); len(keys) != 1 || keys[0] != "b/2" {
+		t.Fatalf("IterateRange(b/, b/2, 1) = %v, want [b/2]", keys)
+	}
+	if keys := ranged("b/", 10); len(keys) != 2 || keys[0] != "b/2" || keys[1] != "b/3" {
+		t.Fatalf("IterateRange(b/) = %v, want [b/2 b/3]", keys)
+	}
+
+	// the snapshot still sees the state from before the second batch
+	keys = nil
+	_ = snap.Iterate(nil, func(k, v []byte) bool {
+		keys = append(keys, string(k))
+		return true
+	})
+	if len(keys) != 3 || keys[0] != "a/1" || keys[1] != "b/1" || keys[2] != "b/2" {
+		t.Fatalf("snapshot Iterate = %v, want [a/1 b/1 b/2]", keys)
+	}
+
+	if _, err := OpenEngine("nope", ""); err == nil {
+		t.Fatal("expected error for unknown engine")
+	}
+}
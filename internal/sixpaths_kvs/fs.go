@@ -0,0 +1,104 @@
+package sixpaths_kvs
+
+import (
+	"io"
+	"os"
+	"sort"
+)
+
+// fs.go is the filesystem a node keeps its data dir on. The WAL, the lsm
+// engine's tables and MANIFEST, opening a node, quarantining a damaged log
+// and writing backups all go through FS, so tests can run a node on MemFS
+// (memfs.go) and see what a crash, a torn write or a failing fsync does to
+// it. OSFS is the real one. Restoring a backup goes through FS as well,
+// only the offline WAL tools still use the os package directly.
+
+// FS is the part of a filesystem the node needs.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	// ReadDir returns the names in dir, sorted
+	ReadDir(dir string) ([]string, error)
+	// SyncDir makes new, renamed and removed names in dir durable
+	SyncDir(dir string) error
+	// Usage returns the size and free space of the filesystem path is on
+	Usage(path string) (DiskUsage, error)
+}
+
+// File is an open file of an FS.
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+}
+
+// OSFS is the operating system's filesystem.
+var OSFS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// a nil *os.File must not turn into a non-nil File
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (osFS) Rename(oldpath, newpath string) error         { return os.Rename(oldpath, newpath) }
+func (osFS) Remove(name string) error                     { return os.Remove(name) }
+func (osFS) RemoveAll(path string) error                  { return os.RemoveAll(path) }
+func (osFS) Usage(path string) (DiskUsage, error)         { return diskUsage(path) }
+
+// fsyncs a directory so renames and new files in it are durable
+func (osFS) SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (osFS) ReadDir(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// the FS to use when none was given
+func orOSFS(fsys FS) FS {
+	if fsys == nil {
+		return OSFS
+	}
+	return fsys
+}
+
+// reads the whole file at name
+func readFile(fsys FS, name string) ([]byte, error) {
+	f, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
@@ -5,8 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
-	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 )
 
@@ -36,16 +37,42 @@ type putDelResp struct {
 }
 
 type getResp struct {
-	Value string `json:"value"`
+	Value    string `json:"value"`
+	LogIndex uint64 `json:"logIndex"` // applied index the read saw, usable as a minIndex token
+}
+
+type scanResp struct {
+	Entries  []ScanEntry `json:"entries"`
+	More     bool        `json:"more"` // there are keys after the last entry
+	LogIndex uint64      `json:"logIndex"`
 }
 
 type errResp struct {
 	Error string `json:"error"`
 }
 
+type sessionReq struct {
+	TTLMs int64 `json:"ttlMs"`
+}
+
+type keepAliveReq struct {
+	Session string `json:"session"`
+}
+
+type sessionResp struct {
+	Session  string `json:"session"`
+	TTLMs    int64  `json:"ttlMs,omitempty"`
+	LogIndex uint64 `json:"logIndex"`
+}
+
 type healthResp struct {
+	// "ok", "read_only" while the node refuses writes, "degraded" when that's
+	// because a WAL write failed and the log needs recovering, or "disk_low"
+	// while it only takes deletes for lack of disk space
 	Status    string `json:"status"`
 	LastIndex uint64 `json:"lastIndex"`
+	ReadOnly  string `json:"readOnly,omitempty"` // why
+	DiskLow   string `json:"diskLow,omitempty"`  // why
 }
 
 // =====Server =====
@@ -55,16 +82,30 @@ type HTTPServer struct {
 	addr string         //Listen address
 	mux  *http.ServeMux // router (routes paths to handlers)
 	srv  *http.Server   // (our http server)
+
+	prom    *PromRegistry // the server's own metrics, the node's are served alongside
+	latency *HistogramVec // request latency by route, method and status
+	routes  map[string]bool
 }
 
 // constructs the http server, registers routes, and prepares an http.Server with
 // reasonable timeouts.
 func NewHTTPServer(node *Node, addr string) *HTTPServer {
+	return NewHTTPServerWithRegistry(node, addr, nil)
+}
+
+// like NewHTTPServer, but the server's own metrics go to reg (nil means a
+// fresh registry), so tests can look at them
+func NewHTTPServerWithRegistry(node *Node, addr string, reg *PromRegistry) *HTTPServer {
+	if reg == nil {
+		reg = NewPromRegistry()
+	}
 	mux := http.NewServeMux()
 	h := &HTTPServer{
 		node: node,
 		addr: addr,
 		mux:  mux,
+		prom: reg,
 	}
 
 	// each path maps to a handler method
@@ -72,8 +113,28 @@ func NewHTTPServer(node *Node, addr string) *HTTPServer {
 	mux.HandleFunc("/put", h.handlePut)
 	mux.HandleFunc("/delete", h.handleDel)
 	mux.HandleFunc("/get", h.handleGet)
+	mux.HandleFunc("/scan", h.handleScan)
+	mux.HandleFunc("/watch", h.handleWatch)
+	mux.HandleFunc("/export", h.handleExport)
+	mux.HandleFunc("/stream", h.handleStream)
+	mux.HandleFunc("/session", h.handleSession)
+	mux.HandleFunc("/session/keepalive", h.handleKeepAlive)
 	mux.HandleFunc("/health", h.handleHealth)
 	mux.HandleFunc("/metrics", h.handleMetrics)
+	mux.HandleFunc("/metrics/prometheus", h.handlePromMetrics)
+	mux.HandleFunc("/admin/slow", node.inspect.ServeSlow)
+	mux.HandleFunc("/admin/inflight", node.inspect.ServeInFlight)
+	mux.HandleFunc("/admin/backup", h.handleBackup)
+	mux.HandleFunc("/admin/wal/recover", h.handleWALRecover)
+
+	h.latency = h.prom.NewHistogramVec("sixpaths_http_request_duration_seconds",
+		"Latency of HTTP requests to the node.", LatencyBuckets, "route", "method", "status")
+	h.routes = map[string]bool{
+		"/put": true, "/delete": true, "/get": true, "/scan": true, "/watch": true, "/export": true, "/stream": true,
+		"/session": true, "/session/keepalive": true,
+		"/health": true, "/metrics": true, "/metrics/prometheus": true,
+		"/admin/slow": true, "/admin/inflight": true, "/admin/backup": true, "/admin/wal/recover": true,
+	}
 
 	// we set timeouts we deem appropriate
 	h.srv = &http.Server{
@@ -98,6 +159,17 @@ func (h *HTTPServer) Shutdown(ctx context.Context) error {
 	return h.srv.Shutdown(ctx)
 }
 
+// Handler returns the server's handler, for serving it some other way than
+// Start, like from an httptest.Server.
+func (h *HTTPServer) Handler() http.Handler {
+	return h.srv.Handler
+}
+
+// Registry returns the server's own metrics, the node's are in node.Metrics().
+func (h *HTTPServer) Registry() *PromRegistry {
+	return h.prom
+}
+
 type statusRecorder struct {
 	http.ResponseWriter
 	status      int
@@ -123,9 +195,34 @@ func (sr *statusRecorder) Write(p []byte) (int, error) {
 	return n, err
 }
 
+// lets http.ResponseController reach the underlying writer
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
 func (h *HTTPServer) withLogging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+
+		// requests through the router carry its ID, direct ones get their own
+		id := RequestIDFromHeader(r.Header)
+		w.Header().Set(RequestIDHeader, id)
+
+		// unknown paths share one label so they can't blow up the series count
+		route := r.URL.Path
+		if !h.routes[route] {
+			route = "other"
+		}
+
+		ctx := ContextWithTraceparent(ContextWithRequestID(r.Context(), id), r.Header.Get(TraceparentHeader))
+		ctx, span := h.node.tracer.Start(ctx, "node.http "+r.Method+" "+route, SpanKindServer)
+		defer span.End()
+		ctx, op := h.node.inspect.Begin(ctx, "http", r.Method+" "+r.URL.Path)
+		if key := r.URL.Query().Get("key"); key != "" {
+			SetOpKey(ctx, key)
+		}
+		r = r.WithContext(ctx)
+
 		sr := &statusRecorder{
 			ResponseWriter: w,
 			status:         http.StatusOK, // default if never set explicitly
@@ -134,9 +231,12 @@ func (h *HTTPServer) withLogging(next http.Handler) http.Handler {
 		next.ServeHTTP(sr, r)
 
 		dur := time.Since(start)
+		span.SetAttr("http.status_code", sr.status)
+		op.Finish(strconv.Itoa(sr.status))
+		h.latency.WithLabelValues(route, r.Method, strconv.Itoa(sr.status)).Observe(dur.Seconds())
 
-		log.Printf("method=%s path=%s status=%d bytes=%d dur=%s remote=%s",
-			r.Method, r.URL.Path, sr.status, sr.bytes, dur, r.RemoteAddr)
+		h.node.log.InfoContext(r.Context(), "http_request", "method", r.Method, "path", r.URL.Path,
+			"status", sr.status, "bytes", sr.bytes, "dur", dur, "remote", r.RemoteAddr)
 	})
 }
 
@@ -163,6 +263,8 @@ func (h *HTTPServer) handlePut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	SetOpKey(r.Context(), req.Key)
+
 	// now we map the json request to our Command struct
 	cmd := Command{
 		Instruct: CmdPut,
@@ -172,16 +274,12 @@ func (h *HTTPServer) handlePut(w http.ResponseWriter, r *http.Request) {
 		Value:    []byte(req.Value),
 	}
 	// now we execute the command via our node
-	res, err := h.node.Exec(cmd)
+	res, err := h.node.ExecContext(r.Context(), cmd)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+		writeError(w, execErrStatus(err), err.Error())
 		return
 	}
 
-	// we increase metric counters
-	IncExec()
-	IncPut()
-
 	// build and send json response
 	writeJSON(w, http.StatusOK, putDelResp{
 		Success:   res.Success,
@@ -208,6 +306,7 @@ func (h *HTTPServer) handleDel(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "missing client/seq/key")
 		return
 	}
+	SetOpKey(r.Context(), req.Key)
 	// we map the json request to our Command struct
 	cmd := Command{
 		Instruct: CmdDelete,
@@ -216,14 +315,11 @@ func (h *HTTPServer) handleDel(w http.ResponseWriter, r *http.Request) {
 		Key:      []byte(req.Key),
 	}
 	// we execute the command
-	res, err := h.node.Exec(cmd)
+	res, err := h.node.ExecContext(r.Context(), cmd)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+		writeError(w, execErrStatus(err), err.Error())
 		return
 	}
-	// increase metrics
-	IncExec()
-	IncDel()
 	// build and send json
 	writeJSON(w, http.StatusOK, putDelResp{
 		Success:   res.Success,
@@ -232,26 +328,309 @@ func (h *HTTPServer) handleDel(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// GET /get?key=K
+// GET /get?key=K[&consistency=linearizable|sequential|stale][&client=C][&minIndex=N][&timeoutMs=T]
+// sequential reads see at least the last write of client C, and any read
+// waits (up to T ms) until index N is applied, see read.go
 func (h *HTTPServer) handleGet(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		methodNotAllowed(w)
 		return
 	}
 	// read query key from URL
-	key := r.URL.Query().Get("key")
+	q := r.URL.Query()
+	key := q.Get("key")
 	if key == "" {
 		writeError(w, http.StatusBadRequest, "missing key")
 		return
 	}
-	val, err := h.node.Get(key)
+	ctx, opts, cancel, err := readOptions(r.Context(), q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer cancel()
+
+	val, applied, err := h.node.Read(ctx, key, opts)
 	if err != nil {
+		// chunked values exist, they just can't be returned as JSON
+		if errors.Is(err, ErrChunkedValue) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if errors.Is(err, ErrReadTimeout) {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
 		// If your Store.Get returns a specific not-found error, map to 404
 		// Otherwise default to 404 on any error here.
 		writeError(w, http.StatusNotFound, err.Error())
 		return
 	}
-	writeJSON(w, http.StatusOK, getResp{Value: string(val)})
+	writeJSON(w, http.StatusOK, getResp{Value: string(val), LogIndex: applied})
+}
+
+// parses the consistency, client, minIndex and timeoutMs parameters shared by
+// /get and /scan, the returned ctx carries the timeout and cancel must be called
+func readOptions(ctx context.Context, q url.Values) (context.Context, ReadOptions, context.CancelFunc, error) {
+	level, err := ParseReadConsistency(q.Get("consistency"))
+	if err != nil {
+		return nil, ReadOptions{}, nil, err
+	}
+	opts := ReadOptions{Consistency: level, ClientID: q.Get("client")}
+	if v := q.Get("minIndex"); v != "" {
+		if opts.MinIndex, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return nil, ReadOptions{}, nil, errors.New("bad minIndex")
+		}
+	}
+	if v := q.Get("timeoutMs"); v != "" {
+		ms, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, ReadOptions{}, nil, errors.New("bad timeoutMs")
+		}
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(ms)*time.Millisecond)
+		return ctx, opts, cancel, nil
+	}
+	return ctx, opts, func() {}, nil
+}
+
+// GET /scan?[prefix=P][&after=K][&limit=N][&consistency=...][&client=C][&minIndex=N][&timeoutMs=T]
+// returns the next page of keys in order, pass the last key back as after
+// for the page after it, see scan.go
+func (h *HTTPServer) handleScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	q := r.URL.Query()
+	ctx, ropts, cancel, err := readOptions(r.Context(), q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer cancel()
+	opts := ScanOptions{ReadOptions: ropts, Prefix: q.Get("prefix"), After: q.Get("after")}
+	if v := q.Get("limit"); v != "" {
+		if opts.Limit, err = strconv.Atoi(v); err != nil || opts.Limit < 0 {
+			writeError(w, http.StatusBadRequest, "bad limit")
+			return
+		}
+	}
+
+	entries, more, applied, err := h.node.Scan(ctx, opts)
+	if err != nil {
+		if errors.Is(err, ErrReadTimeout) {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if entries == nil {
+		entries = []ScanEntry{}
+	}
+	writeJSON(w, http.StatusOK, scanResp{Entries: entries, More: more, LogIndex: applied})
+}
+
+// GET /watch?[prefix=P]
+// streams every change to keys under P as one JSON WatchEvent per line until
+// the client goes away. a watcher that falls behind gets a final
+// {"error": "..."} line, see watch.go
+func (h *HTTPServer) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	SetOpStreaming(r.Context())
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	watcher := h.node.Watch(ctx, r.URL.Query().Get("prefix"))
+
+	// the stream lives as long as the client wants it, not WriteTimeout
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	_ = rc.Flush()
+
+	enc := json.NewEncoder(w)
+	for ev := range watcher.Events() {
+		if err := enc.Encode(ev); err != nil {
+			return
+		}
+		// we flush once we've caught up, so a burst goes out in one write
+		if len(watcher.Events()) == 0 {
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+	if err := watcher.Err(); err != nil {
+		_ = enc.Encode(errResp{Error: err.Error()})
+		_ = rc.Flush()
+	}
+}
+
+// GET /export?[format=jsonl|binary]&[prefix=P]
+// streams every key under P as a dump, see dump.go. if something goes wrong
+// once the dump is on its way it's cut off before its end marker.
+func (h *HTTPServer) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	q := r.URL.Query()
+	format, err := ParseDumpFormat(q.Get("format"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	SetOpStreaming(r.Context())
+
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+	if format == DumpJSONL {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.WriteHeader(http.StatusOK)
+
+	dw, _ := NewDumpWriter(w, format)
+	err = h.node.Export(r.Context(), dw, q.Get("prefix"))
+	if err == nil {
+		err = dw.Close()
+	}
+	if err != nil {
+		h.node.log.ErrorContext(r.Context(), "export_failed", "err", err)
+	}
+}
+
+// PUT /stream?client=C&seq=N&key=K   (body: the raw value)
+// GET /stream?key=K                  (response: the raw value)
+// streams values of any size in chunks, see stream.go
+func (h *HTTPServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	key := q.Get("key")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, "missing key")
+		return
+	}
+
+	// large values take longer than our usual server timeouts allow
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	switch r.Method {
+	case http.MethodPut:
+		defer r.Body.Close()
+
+		client := q.Get("client")
+		seq, _ := strconv.ParseUint(q.Get("seq"), 10, 64)
+		if client == "" || seq == 0 {
+			writeError(w, http.StatusBadRequest, "missing client/seq/key")
+			return
+		}
+
+		res, err := h.node.PutStreamContext(r.Context(), client, seq, []byte(key), r.Body)
+		if err != nil {
+			writeError(w, execErrStatus(err), err.Error())
+			return
+		}
+
+		writeJSON(w, http.StatusOK, putDelResp{
+			Success:   res.Success,
+			PrevValue: string(res.PrevValue),
+			LogIndex:  res.LogIndex,
+		})
+
+	case http.MethodGet:
+		body, size, err := h.node.GetStream(key)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		defer body.Close()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+		// once the status is out we can't report errors anymore, the client
+		// notices the short body instead
+		if _, err := io.Copy(w, body); err != nil {
+			h.node.log.WarnContext(r.Context(), "stream aborted", "key", key, "err", err)
+		}
+
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// POST /session
+// Body: {"ttlMs": N}   (optional, defaults to 60s)
+// registers a client session, its ID is then used as the client in writes
+func (h *HTTPServer) handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	var req sessionReq
+	if r.ContentLength != 0 {
+		if err := decodeJSON(w, r, &req, 1<<10); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if req.TTLMs < 0 {
+		writeError(w, http.StatusBadRequest, "ttlMs must not be negative")
+		return
+	}
+	ttl := time.Duration(req.TTLMs) * time.Millisecond
+	if ttl == 0 {
+		ttl = DefaultSessionTTL
+	}
+
+	res, err := h.node.RegisterSessionContext(r.Context(), ttl)
+	if err != nil {
+		writeError(w, execErrStatus(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, sessionResp{
+		Session:  res.SessionID,
+		TTLMs:    ttl.Milliseconds(),
+		LogIndex: res.LogIndex,
+	})
+}
+
+// POST /session/keepalive
+// Body: {"session": "sess-N"}
+func (h *HTTPServer) handleKeepAlive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	var req keepAliveReq
+	if err := decodeJSON(w, r, &req, 1<<10); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Session == "" {
+		writeError(w, http.StatusBadRequest, "missing session")
+		return
+	}
+
+	res, err := h.node.KeepAliveContext(r.Context(), req.Session)
+	if err == nil && !res.Success {
+		err = ErrSessionExpired
+	}
+	if err != nil {
+		writeError(w, execErrStatus(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, sessionResp{
+		Session:  res.SessionID,
+		LogIndex: res.LogIndex,
+	})
 }
 
 // GET /health
@@ -261,10 +640,68 @@ func (h *HTTPServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 		methodNotAllowed(w)
 		return
 	}
-	writeJSON(w, http.StatusOK, healthResp{
-		Status:    "ok",
-		LastIndex: h.node.last,
-	})
+	resp := healthResp{Status: "ok", LastIndex: h.node.LastIndex()}
+	if err := h.node.ReadOnly(); err != nil {
+		resp.Status, resp.ReadOnly = "read_only", err.Error()
+		if errors.Is(err, ErrWALFailed) {
+			resp.Status = "degraded"
+		}
+	}
+	if err := h.node.DiskLow(); err != nil {
+		resp.DiskLow = err.Error()
+		if resp.Status == "ok" {
+			resp.Status = "disk_low"
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// POST /admin/wal/recover
+// checks the log of a node that went read-only after a failed WAL write and
+// takes writes again if it's sound, see Node.RecoverWAL
+func (h *HTTPServer) handleWALRecover(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	if err := h.node.RecoverWAL(); err != nil {
+		status := http.StatusServiceUnavailable
+		if h.node.ReadOnly() != nil && !errors.Is(h.node.ReadOnly(), ErrWALFailed) {
+			status = http.StatusConflict
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, healthResp{Status: "ok", LastIndex: h.node.LastIndex()})
+}
+
+// GET /admin/backup
+// streams a consistent backup of the node as a tar archive, see backup.go.
+// the index range it covers is in the X-Backup-* headers as well.
+func (h *HTTPServer) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	SetOpStreaming(r.Context())
+	dir, info, cleanup, err := h.node.backupToTemp(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer cleanup()
+
+	// a big backup takes longer than WriteTimeout to send
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("X-Backup-Base-Index", strconv.FormatUint(info.BaseIndex, 10))
+	w.Header().Set("X-Backup-Last-Index", strconv.FormatUint(info.LastIndex, 10))
+	w.WriteHeader(http.StatusOK)
+	if err := writeBackupTar(w, h.node.fs, dir); err != nil {
+		// the status is out already, the client sees a cut-off archive
+		h.node.log.ErrorContext(r.Context(), "backup_send_failed", "err", err)
+	}
 }
 
 // GET /metrics
@@ -274,7 +711,20 @@ func (h *HTTPServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
 		methodNotAllowed(w)
 		return
 	}
-	writeJSON(w, http.StatusOK, Snapshot())
+	writeJSON(w, http.StatusOK, h.node.Metrics().Snapshot())
+}
+
+// GET /metrics/prometheus
+// node and server metrics in the Prometheus text format
+func (h *HTTPServer) handlePromMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = h.node.Metrics().Registry().WriteTo(w)
+	_, _ = h.prom.WriteTo(w)
 }
 
 // Helpers
@@ -300,6 +750,26 @@ func decodeJSON(w http.ResponseWriter, r *http.Request, dst any, maxBytes int64)
 	return nil
 }
 
+// maps an Exec() error to an HTTP status, bad input is the client's fault
+func execErrStatus(err error) int {
+	if errors.Is(err, ErrReservedKey) || errors.Is(err, ErrReservedValue) || errors.Is(err, ErrReservedClientID) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, ErrSessionExpired) {
+		return http.StatusGone
+	}
+	if errors.Is(err, ErrResultUnavailable) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, ErrReadOnly) {
+		return http.StatusServiceUnavailable
+	}
+	if errors.Is(err, ErrDiskFull) {
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
 func writeJSON(w http.ResponseWriter, status int, v any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Cache-Control", "no-store")
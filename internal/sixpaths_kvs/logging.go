@@ -0,0 +1,120 @@
+package sixpaths_kvs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// logging.go sets up structured logging for nodes and the router.
+// Every request gets an ID: the router makes one up (or keeps the one the
+// client sent), forwards it to the node in the X-Request-ID header or the
+// rpc request, and every log line written for that request carries it as
+// request_id, on both sides.
+
+const RequestIDHeader = "X-Request-ID"
+
+// longest request ID we pass along, longer ones are replaced
+const maxRequestIDLen = 64
+
+type requestIDKey struct{}
+
+// ContextWithRequestID returns a copy of ctx carrying id.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID in ctx, or "".
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID returns a random 16 hex digit ID.
+func NewRequestID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// RequestIDFromHeader returns the ID the caller sent in h, or a new one if
+// it sent none or one we won't pass along.
+func RequestIDFromHeader(h http.Header) string {
+	if id := h.Get(RequestIDHeader); validRequestID(id) {
+		return id
+	}
+	return NewRequestID()
+}
+
+// IDs end up in log lines and in a u8-length rpc field, so we keep them short
+// and printable
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseLogLevel parses "debug", "info", "warn" or "error".
+func ParseLogLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return 0, errors.New("error: unknown log level " + s + ", want debug, info, warn or error")
+	}
+	return l, nil
+}
+
+// NewLogger returns a logger writing to w at the given level, format is
+// "text" or "json". Lines logged with a context that carries a request ID
+// get a request_id attribute.
+func NewLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	l, err := ParseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: l}
+
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "text", "":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, errors.New("error: unknown log format " + format + ", want text or json")
+	}
+	return slog.New(requestIDHandler{h}), nil
+}
+
+// adds the request ID of the record's context to the record
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
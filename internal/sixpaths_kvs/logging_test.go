@@ -0,0 +1,92 @@
+package sixpaths_kvs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDFromHeader(t *testing.T) {
+	h := http.Header{}
+	h.Set(RequestIDHeader, "abc-123")
+	if got := RequestIDFromHeader(h); got != "abc-123" {
+		t.Fatalf("got %q, want the caller's ID", got)
+	}
+	for _, bad := range []string{"", "has space", strings.Repeat("x", maxRequestIDLen+1)} {
+		h.Set(RequestIDHeader, bad)
+		if got := RequestIDFromHeader(h); got == bad || len(got) != 16 {
+			t.Fatalf("ID %q was not replaced, got %q", bad, got)
+		}
+	}
+}
+
+func TestNewLoggerRejectsBadFlags(t *testing.T) {
+	if _, err := NewLogger(&bytes.Buffer{}, "loud", "text"); err == nil {
+		t.Fatal("expected an error for an unknown level")
+	}
+	if _, err := NewLogger(&bytes.Buffer{}, "info", "xml"); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
+
+// every line the node logs for a request carries its ID
+func TestNodeLogsCarryRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, "debug", "json")
+	if err != nil {
+		t.Fatalf("NewLogger: %v", err)
+	}
+	n, err := OpenNodeWithOptions(t.TempDir(), NodeOptions{Logger: logger})
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	defer n.Close()
+	buf.Reset()
+
+	h := NewHTTPServer(n, "")
+	body := `{"client":"c1","seq":1,"key":"k","value":"v"}`
+	for i := 0; i < 2; i++ { // the second one is a dedup hit
+		req := httptest.NewRequest(http.MethodPost, "/put", strings.NewReader(body))
+		req.Header.Set(RequestIDHeader, "req-42")
+		w := httptest.NewRecorder()
+		h.srv.Handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || w.Header().Get(RequestIDHeader) != "req-42" {
+			t.Fatalf("status %d, request ID header %q", w.Code, w.Header().Get(RequestIDHeader))
+		}
+	}
+
+	// rpc requests carry it in the frame
+	if _, err := n.ExecContext(ContextWithRequestID(context.Background(), "req-43"),
+		Command{Instruct: CmdDelete, ClientID: "c1", Seq: 2, Key: []byte("k")}); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	seen := map[string]string{}
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatalf("bad log line %q: %v", sc.Text(), err)
+		}
+		id, _ := line["request_id"].(string)
+		if id == "" {
+			t.Fatalf("log line without request ID: %s", sc.Text())
+		}
+		seen[line["msg"].(string)] += id + " "
+	}
+	want := map[string]string{
+		"wal_append":   "req-42 req-43 ",
+		"dedup_hit":    "req-42 ",
+		"http_request": "req-42 req-42 ",
+	}
+	for msg, ids := range want {
+		if seen[msg] != ids {
+			t.Fatalf("%s lines have IDs %q, want %q", msg, seen[msg], ids)
+		}
+	}
+}
@@ -0,0 +1,879 @@
+package sixpaths_kvs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// lsm.go implements an on-disk log-structured merge tree storage engine,
+// for shards whose data doesn't fit in memory.
+// Writes land in an in-memory memtable. Once it grows past a threshold the
+// node flushes it into an immutable sorted table (see sstable.go) in level 0,
+// and trims its WAL, which up to then was the memtable's recovery log.
+// A background goroutine merges tables down into larger, non-overlapping
+// levels (leveled compaction) and drops deleted keys on the way.
+// The MANIFEST file records which tables make up each level and the last
+// log index that is safely on disk.
+
+func init() {
+	RegisterEngine("lsm", func(fsys FS, dir string) (StorageEngine, error) {
+		return OpenLSMEngineWithFS(fsys, dir, DefaultLSMOptions())
+	})
+}
+
+type LSMOptions struct {
+	MemtableSize       int   // flush the memtable once it holds this many bytes
+	BlockSize          int   // target size of a data block
+	BloomBitsPerKey    int   // bloom filter bits per key (~1% false positives at 10)
+	L0CompactionFiles  int   // compact level 0 once it has this many tables
+	BaseLevelSize      int64 // max bytes in level 1, each level below holds 10x more
+	TargetTableSize    int64 // compaction output is split into tables of about this size
+	MaxLevels          int
+	DisableCompactions bool // for tests
+}
+
+func DefaultLSMOptions() LSMOptions {
+	return LSMOptions{
+		MemtableSize:      4 << 20,
+		BlockSize:         4 << 10,
+		BloomBitsPerKey:   10,
+		L0CompactionFiles: 4,
+		BaseLevelSize:     10 << 20,
+		TargetTableSize:   2 << 20,
+		MaxLevels:         7,
+	}
+}
+
+type memEntry struct {
+	kind  uint8
+	value []byte
+}
+
+type lsmEngine struct {
+	fs   FS
+	dir  string
+	opts LSMOptions
+
+	mu       sync.RWMutex
+	mem      map[string]memEntry
+	memSize  int
+	applied  uint64       // index of the last batch applied (possibly only in memory)
+	flushed  uint64       // index of the last batch that is on disk
+	levels   [][]*sstable // levels[0] newest first, the others sorted by key
+	nextFile uint64
+	closed   bool
+	stopping bool // a Close is under way, later ones return right away
+
+	compactCh chan struct{}
+	closing   chan struct{}
+	wg        sync.WaitGroup
+}
+
+// on-disk form of the MANIFEST
+type lsmManifest struct {
+	FlushedIndex uint64            `json:"flushedIndex"`
+	NextFile     uint64            `json:"nextFile"`
+	Levels       [][]lsmTableEntry `json:"levels"`
+}
+
+type lsmTableEntry struct {
+	Num  uint64 `json:"num"`
+	Size int64  `json:"size"`
+}
+
+func OpenLSMEngine(dir string, opts LSMOptions) (*lsmEngine, error) {
+	return OpenLSMEngineWithFS(OSFS, dir, opts)
+}
+
+// OpenLSMEngineWithFS is OpenLSMEngine on fsys.
+func OpenLSMEngineWithFS(fsys FS, dir string, opts LSMOptions) (*lsmEngine, error) {
+	if err := fsys.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	e := &lsmEngine{
+		fs:        fsys,
+		dir:       dir,
+		opts:      opts,
+		mem:       make(map[string]memEntry),
+		levels:    make([][]*sstable, opts.MaxLevels),
+		nextFile:  1,
+		compactCh: make(chan struct{}, 1),
+		closing:   make(chan struct{}),
+	}
+
+	// we load the manifest, if there is one
+	raw, err := readFile(fsys, filepath.Join(dir, "MANIFEST"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	live := make(map[uint64]bool)
+	if err == nil {
+		var m lsmManifest
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return nil, fmt.Errorf("error: bad LSM manifest: %w", err)
+		}
+		e.flushed = m.FlushedIndex
+		e.applied = m.FlushedIndex
+		e.nextFile = m.NextFile
+
+		for lvl, tables := range m.Levels {
+			if lvl >= len(e.levels) {
+				e.closeTables()
+				return nil, fmt.Errorf("error: LSM manifest has %d levels, we support %d", len(m.Levels), len(e.levels))
+			}
+			for _, te := range tables {
+				t, err := openSSTable(fsys, e.tablePath(te.Num), te.Num)
+				if err != nil {
+					e.closeTables()
+					return nil, fmt.Errorf("error: opening table %d: %w", te.Num, err)
+				}
+				e.levels[lvl] = append(e.levels[lvl], t)
+				live[te.Num] = true
+			}
+		}
+	}
+
+	// tables not in the manifest are leftovers of a flush or compaction
+	// that crashed before committing, we remove them
+	names, err := fsys.ReadDir(dir)
+	if err != nil {
+		e.closeTables()
+		return nil, err
+	}
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".sst") {
+			continue
+		}
+		num, perr := strconv.ParseUint(strings.TrimSuffix(name, ".sst"), 10, 64)
+		if perr == nil && !live[num] {
+			_ = fsys.Remove(filepath.Join(dir, name))
+		}
+	}
+
+	if !opts.DisableCompactions {
+		e.wg.Add(1)
+		go e.compactLoop()
+		e.maybeScheduleCompaction()
+	}
+
+	return e, nil
+}
+
+func (e *lsmEngine) tablePath(num uint64) string {
+	return filepath.Join(e.dir, fmt.Sprintf("%06d.sst", num))
+}
+
+// ===== StorageEngine =====
+
+func (e *lsmEngine) Get(key []byte) ([]byte, bool, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return nil, false, errors.New("error: LSM engine is closed")
+	}
+	return lsmGet(e.mem, e.levels, key)
+}
+
+// lookup order is newest to oldest: memtable, level 0 (newest table first),
+// then one table per deeper level
+func lsmGet(mem map[string]memEntry, levels [][]*sstable, key []byte) ([]byte, bool, error) {
+	if me, ok := mem[string(key)]; ok {
+		if me.kind == kindDelete {
+			return nil, false, nil
+		}
+		return append([]byte{}, me.value...), true, nil
+	}
+
+	for lvl, tables := range levels {
+		if lvl == 0 {
+			for _, t := range tables {
+				kind, v, found, err := t.get(key)
+				if err != nil {
+					return nil, false, err
+				}
+				if found {
+					return v, kind == kindPut, nil
+				}
+			}
+			continue
+		}
+
+		// deeper levels don't overlap, so at most one table can have the key
+		i := sort.Search(len(tables), func(i int) bool {
+			return bytes.Compare(tables[i].largest, key) >= 0
+		})
+		if i == len(tables) {
+			continue
+		}
+		kind, v, found, err := tables[i].get(key)
+		if err != nil {
+			return nil, false, err
+		}
+		if found {
+			return v, kind == kindPut, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (e *lsmEngine) ApplyBatch(b *Batch) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return errors.New("error: LSM engine is closed")
+	}
+
+	for _, op := range b.Ops {
+		me := memEntry{kind: kindPut, value: append([]byte(nil), op.Value...)}
+		if op.Delete {
+			// tombstones have to be written down too, older tables may still have the key
+			me = memEntry{kind: kindDelete}
+		}
+		if old, ok := e.mem[string(op.Key)]; ok {
+			e.memSize -= len(op.Key) + len(old.value)
+		}
+		e.mem[string(op.Key)] = me
+		e.memSize += len(op.Key) + len(me.value)
+	}
+	if b.Index > e.applied {
+		e.applied = b.Index
+	}
+	return nil
+}
+
+func (e *lsmEngine) Iterate(prefix []byte, fn func(key, value []byte) bool) error {
+	snap, err := e.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+	return snap.Iterate(prefix, fn)
+}
+
+// IterateRange seeks every table to start instead of walking the prefix
+// from its first key.
+func (e *lsmEngine) IterateRange(prefix, start []byte, limit int, fn func(key, value []byte) bool) error {
+	snap, err := e.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+	return snap.(*lsmSnapshot).iterateFrom(prefix, start, limit, fn)
+}
+
+func (e *lsmEngine) Snapshot() (EngineSnapshot, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return nil, errors.New("error: LSM engine is closed")
+	}
+
+	// the memtable is bounded by MemtableSize, so copying it is cheap enough.
+	// tables are immutable, we only need to keep them from being deleted.
+	mem := make(map[string]memEntry, len(e.mem))
+	for k, v := range e.mem {
+		mem[k] = v
+	}
+	levels := make([][]*sstable, len(e.levels))
+	for lvl, tables := range e.levels {
+		levels[lvl] = append([]*sstable(nil), tables...)
+		for _, t := range tables {
+			t.ref()
+		}
+	}
+	return &lsmSnapshot{mem: mem, levels: levels}, nil
+}
+
+// like Snapshot, but without the memtable: the view is of what's on disk,
+// as of the returned index. backups start from it (see backup.go).
+func (e *lsmEngine) persistedSnapshot() (EngineSnapshot, uint64, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return nil, 0, errors.New("error: LSM engine is closed")
+	}
+	levels := make([][]*sstable, len(e.levels))
+	for lvl, tables := range e.levels {
+		levels[lvl] = append([]*sstable(nil), tables...)
+		for _, t := range tables {
+			t.ref()
+		}
+	}
+	return &lsmSnapshot{mem: map[string]memEntry{}, levels: levels}, e.flushed, nil
+}
+
+func (e *lsmEngine) Close() error {
+	e.mu.Lock()
+	if e.closed || e.stopping {
+		e.mu.Unlock()
+		return nil
+	}
+	e.stopping = true
+	e.mu.Unlock()
+
+	// stop compactions first so nothing swaps tables under us
+	close(e.closing)
+	e.wg.Wait()
+
+	// flushing on close means the next boot has less WAL to replay
+	_, err := e.Flush()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	e.closeTables()
+	return err
+}
+
+// drops the engine's references to all tables, the caller must hold e.mu
+func (e *lsmEngine) closeTables() {
+	for lvl, tables := range e.levels {
+		for _, t := range tables {
+			t.unref()
+		}
+		e.levels[lvl] = nil
+	}
+}
+
+// ===== DurableEngine =====
+
+func (e *lsmEngine) PersistedIndex() uint64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.flushed
+}
+
+func (e *lsmEngine) NeedsFlush() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.memSize >= e.opts.MemtableSize
+}
+
+// writes the memtable out as a new level 0 table. the writes are blocked
+// meanwhile, which keeps this simple: the memtable is small.
+func (e *lsmEngine) Flush() (uint64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return 0, errors.New("error: LSM engine is closed")
+	}
+	if e.applied == e.flushed {
+		return e.flushed, nil
+	}
+
+	if len(e.mem) > 0 {
+		keys := make([]string, 0, len(e.mem))
+		for k := range e.mem {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		num := e.nextFile
+		e.nextFile++
+		w, err := newSSTWriter(e.fs, e.tablePath(num), e.opts.BlockSize, e.opts.BloomBitsPerKey)
+		if err != nil {
+			return 0, err
+		}
+		for _, k := range keys {
+			me := e.mem[k]
+			if err := w.add([]byte(k), me.kind, me.value); err != nil {
+				w.abort()
+				return 0, err
+			}
+		}
+		if _, err := w.finish(); err != nil {
+			w.abort()
+			return 0, err
+		}
+		t, err := openSSTable(e.fs, e.tablePath(num), num)
+		if err != nil {
+			return 0, err
+		}
+
+		// newest level 0 table goes first
+		e.levels[0] = append([]*sstable{t}, e.levels[0]...)
+	}
+
+	prevFlushed := e.flushed
+	e.flushed = e.applied
+	if err := e.writeManifest(); err != nil {
+		// the table isn't committed, forget about it and keep the memtable
+		if len(e.mem) > 0 {
+			t := e.levels[0][0]
+			e.levels[0] = e.levels[0][1:]
+			t.obsolete.Store(true)
+			t.unref()
+		}
+		e.flushed = prevFlushed
+		return 0, err
+	}
+
+	e.mem = make(map[string]memEntry)
+	e.memSize = 0
+	e.maybeScheduleCompaction()
+
+	return e.flushed, nil
+}
+
+// atomically replaces the MANIFEST, the caller must hold e.mu
+func (e *lsmEngine) writeManifest() error {
+	m := lsmManifest{
+		FlushedIndex: e.flushed,
+		NextFile:     e.nextFile,
+		Levels:       make([][]lsmTableEntry, len(e.levels)),
+	}
+	for lvl, tables := range e.levels {
+		m.Levels[lvl] = []lsmTableEntry{}
+		for _, t := range tables {
+			m.Levels[lvl] = append(m.Levels[lvl], lsmTableEntry{Num: t.num, Size: t.size})
+		}
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(e.fs, filepath.Join(e.dir, "MANIFEST"), raw)
+}
+
+// writes to a temp file, fsyncs it and renames it over path
+func writeFileAtomic(fsys FS, path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := fsys.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := fsys.Rename(tmp, path); err != nil {
+		return err
+	}
+	return fsys.SyncDir(filepath.Dir(path))
+}
+
+// ===== Compaction =====
+
+func (e *lsmEngine) maybeScheduleCompaction() {
+	if e.opts.DisableCompactions {
+		return
+	}
+	select {
+	case e.compactCh <- struct{}{}:
+	default:
+	}
+}
+
+func (e *lsmEngine) compactLoop() {
+	defer e.wg.Done()
+	for {
+		select {
+		case <-e.closing:
+			return
+		case <-e.compactCh:
+		}
+
+		// keep going while there is work, but stop promptly on close
+		for {
+			select {
+			case <-e.closing:
+				return
+			default:
+			}
+			did, err := e.compactOnce()
+			if err != nil {
+				slog.Error("lsm: compaction failed", "err", err)
+				break
+			}
+			if !did {
+				break
+			}
+		}
+	}
+}
+
+// max bytes level lvl (>= 1) may hold before we push it down
+func (e *lsmEngine) maxLevelBytes(lvl int) int64 {
+	size := e.opts.BaseLevelSize
+	for i := 1; i < lvl; i++ {
+		size *= 10
+	}
+	return size
+}
+
+func levelBytes(tables []*sstable) int64 {
+	var total int64
+	for _, t := range tables {
+		total += t.size
+	}
+	return total
+}
+
+// tables in a sorted level whose key range touches [lo, hi]
+func overlapping(tables []*sstable, lo, hi []byte) []*sstable {
+	var out []*sstable
+	for _, t := range tables {
+		if bytes.Compare(t.largest, lo) >= 0 && bytes.Compare(t.smallest, hi) <= 0 {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func keyRange(tables []*sstable) (lo, hi []byte) {
+	for _, t := range tables {
+		if lo == nil || bytes.Compare(t.smallest, lo) < 0 {
+			lo = t.smallest
+		}
+		if hi == nil || bytes.Compare(t.largest, hi) > 0 {
+			hi = t.largest
+		}
+	}
+	return lo, hi
+}
+
+// picks and runs one compaction, returns false if there was nothing to do
+func (e *lsmEngine) compactOnce() (bool, error) {
+	e.mu.RLock()
+	if e.closed {
+		e.mu.RUnlock()
+		return false, nil
+	}
+
+	level := -1
+	var inputs []*sstable
+	if len(e.levels[0]) >= e.opts.L0CompactionFiles {
+		// level 0 tables overlap each other, so we take all of them at once
+		level = 0
+		inputs = append(inputs, e.levels[0]...)
+	} else {
+		for lvl := 1; lvl < len(e.levels)-1; lvl++ {
+			if levelBytes(e.levels[lvl]) > e.maxLevelBytes(lvl) {
+				// we push the oldest table (lowest number) down
+				level = lvl
+				oldest := e.levels[lvl][0]
+				for _, t := range e.levels[lvl] {
+					if t.num < oldest.num {
+						oldest = t
+					}
+				}
+				inputs = []*sstable{oldest}
+				break
+			}
+		}
+	}
+	if level < 0 {
+		e.mu.RUnlock()
+		return false, nil
+	}
+
+	out := level + 1
+	lo, hi := keyRange(inputs)
+	next := overlapping(e.levels[out], lo, hi)
+
+	// tombstones can go once no deeper level could still hold the key
+	dropTombstones := true
+	for lvl := out + 1; lvl < len(e.levels); lvl++ {
+		if len(overlapping(e.levels[lvl], lo, hi)) > 0 {
+			dropTombstones = false
+			break
+		}
+	}
+
+	// sources in priority order: newer tables shadow older ones
+	var iters []lsmIter
+	for _, t := range inputs {
+		iters = append(iters, t.iter())
+	}
+	for _, t := range next {
+		iters = append(iters, t.iter())
+	}
+	e.mu.RUnlock()
+
+	// only this goroutine removes tables, so the inputs stay valid while
+	// we merge without holding the lock
+	outputs, err := e.writeMerged(newMergeIter(iters), dropTombstones)
+	if err != nil {
+		return false, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	removed := make(map[*sstable]bool)
+	for _, t := range inputs {
+		removed[t] = true
+	}
+	for _, t := range next {
+		removed[t] = true
+	}
+
+	var keep0 []*sstable
+	for _, t := range e.levels[level] {
+		if !removed[t] {
+			keep0 = append(keep0, t)
+		}
+	}
+	var keepOut []*sstable
+	for _, t := range e.levels[out] {
+		if !removed[t] {
+			keepOut = append(keepOut, t)
+		}
+	}
+	keepOut = append(keepOut, outputs...)
+	sort.Slice(keepOut, func(i, j int) bool {
+		return bytes.Compare(keepOut[i].smallest, keepOut[j].smallest) < 0
+	})
+
+	oldLevel, oldOut := e.levels[level], e.levels[out]
+	e.levels[level], e.levels[out] = keep0, keepOut
+	if err := e.writeManifest(); err != nil {
+		e.levels[level], e.levels[out] = oldLevel, oldOut
+		for _, t := range outputs {
+			t.obsolete.Store(true)
+			t.unref()
+		}
+		return false, err
+	}
+
+	for t := range removed {
+		t.obsolete.Store(true)
+		t.unref()
+	}
+	return true, nil
+}
+
+// writes the merged stream into new tables of about TargetTableSize each
+func (e *lsmEngine) writeMerged(it *mergeIter, dropTombstones bool) ([]*sstable, error) {
+	var outputs []*sstable
+	var w *sstWriter
+	var num uint64
+
+	fail := func(err error) ([]*sstable, error) {
+		if w != nil {
+			w.abort()
+		}
+		for _, t := range outputs {
+			t.obsolete.Store(true)
+			t.unref()
+		}
+		return nil, err
+	}
+
+	finish := func() error {
+		if _, err := w.finish(); err != nil {
+			return err
+		}
+		t, err := openSSTable(e.fs, e.tablePath(num), num)
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, t)
+		w = nil
+		return nil
+	}
+
+	for it.seek(nil); it.valid(); it.next() {
+		if it.kind() == kindDelete && dropTombstones {
+			continue
+		}
+		if w == nil {
+			e.mu.Lock()
+			num = e.nextFile
+			e.nextFile++
+			e.mu.Unlock()
+
+			var err error
+			w, err = newSSTWriter(e.fs, e.tablePath(num), e.opts.BlockSize, e.opts.BloomBitsPerKey)
+			if err != nil {
+				return fail(err)
+			}
+		}
+		if err := w.add(it.key(), it.kind(), it.value()); err != nil {
+			return fail(err)
+		}
+		if int64(w.size()) >= e.opts.TargetTableSize {
+			if err := finish(); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if err := it.err(); err != nil {
+		return fail(err)
+	}
+	if w != nil {
+		if err := finish(); err != nil {
+			return fail(err)
+		}
+	}
+	return outputs, nil
+}
+
+// ===== Snapshot =====
+
+type lsmSnapshot struct {
+	mem    map[string]memEntry
+	levels [][]*sstable
+}
+
+func (s *lsmSnapshot) Get(key []byte) ([]byte, bool, error) {
+	return lsmGet(s.mem, s.levels, key)
+}
+
+func (s *lsmSnapshot) Iterate(prefix []byte, fn func(key, value []byte) bool) error {
+	return s.iterateFrom(prefix, prefix, -1, fn)
+}
+
+// like Iterate, starting at the first key >= start, for at most limit keys
+// (or all of them if limit < 0)
+func (s *lsmSnapshot) iterateFrom(prefix, start []byte, limit int, fn func(key, value []byte) bool) error {
+	// the memtable first, then the tables in the same order Get uses
+	iters := []lsmIter{newMemIter(s.mem)}
+	for _, tables := range s.levels {
+		for _, t := range tables {
+			iters = append(iters, t.iter())
+		}
+	}
+
+	if bytes.Compare(start, prefix) < 0 {
+		start = prefix
+	}
+	it := newMergeIter(iters)
+	for it.seek(start); it.valid() && bytes.HasPrefix(it.key(), prefix) && limit != 0; it.next() {
+		if it.kind() == kindDelete {
+			continue
+		}
+		if !fn(append([]byte(nil), it.key()...), append([]byte(nil), it.value()...)) {
+			return nil
+		}
+		limit--
+	}
+	return it.err()
+}
+
+func (s *lsmSnapshot) Release() {
+	for _, tables := range s.levels {
+		for _, t := range tables {
+			t.unref()
+		}
+	}
+	s.levels = nil
+}
+
+// ===== Iterators =====
+
+// lsmIter is what the merge iterator consumes, both tables and memtables provide it
+type lsmIter interface {
+	seek(key []byte) // positions at the first entry >= key
+	next()
+	valid() bool
+	key() []byte
+	kind() uint8
+	value() []byte
+	err() error
+}
+
+type memIter struct {
+	keys []string
+	mem  map[string]memEntry
+	i    int
+}
+
+func newMemIter(mem map[string]memEntry) *memIter {
+	keys := make([]string, 0, len(mem))
+	for k := range mem {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return &memIter{keys: keys, mem: mem}
+}
+
+func (it *memIter) seek(key []byte) {
+	it.i = sort.SearchStrings(it.keys, string(key))
+}
+func (it *memIter) next()         { it.i++ }
+func (it *memIter) valid() bool   { return it.i < len(it.keys) }
+func (it *memIter) key() []byte   { return []byte(it.keys[it.i]) }
+func (it *memIter) kind() uint8   { return it.mem[it.keys[it.i]].kind }
+func (it *memIter) value() []byte { return it.mem[it.keys[it.i]].value }
+func (it *memIter) err() error    { return nil }
+
+// mergeIter merges sorted sources into one sorted stream. when several
+// sources have the same key, the one listed first (the newest) wins.
+// we only ever merge a handful of sources, so a linear scan for the
+// smallest key is plenty.
+type mergeIter struct {
+	iters []lsmIter
+	cur   int // index of the source the current entry comes from, -1 if done
+	error error
+}
+
+func newMergeIter(iters []lsmIter) *mergeIter {
+	return &mergeIter{iters: iters, cur: -1}
+}
+
+func (m *mergeIter) seek(key []byte) {
+	for _, it := range m.iters {
+		it.seek(key)
+	}
+	m.pick()
+}
+
+func (m *mergeIter) next() {
+	if m.cur < 0 {
+		return
+	}
+	// skip the current key in every source that has it
+	k := append([]byte(nil), m.iters[m.cur].key()...)
+	for _, it := range m.iters {
+		if it.valid() && bytes.Equal(it.key(), k) {
+			it.next()
+		}
+	}
+	m.pick()
+}
+
+func (m *mergeIter) pick() {
+	m.cur = -1
+	for i, it := range m.iters {
+		if err := it.err(); err != nil {
+			m.error = err
+			return
+		}
+		if !it.valid() {
+			continue
+		}
+		if m.cur < 0 || bytes.Compare(it.key(), m.iters[m.cur].key()) < 0 {
+			m.cur = i
+		}
+	}
+}
+
+func (m *mergeIter) valid() bool   { return m.cur >= 0 && m.error == nil }
+func (m *mergeIter) key() []byte   { return m.iters[m.cur].key() }
+func (m *mergeIter) kind() uint8   { return m.iters[m.cur].kind() }
+func (m *mergeIter) value() []byte { return m.iters[m.cur].value() }
+func (m *mergeIter) err() error    { return m.error }
@@ -0,0 +1,228 @@
+package sixpaths_kvs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func smallLSMOptions() LSMOptions {
+	opts := DefaultLSMOptions()
+	opts.MemtableSize = 4 << 10
+	opts.BlockSize = 256
+	opts.L0CompactionFiles = 2
+	opts.BaseLevelSize = 16 << 10
+	opts.TargetTableSize = 8 << 10
+	return opts
+}
+
+func TestLSMEngineFlushCompactReopen(t *testing.T) {
+	dir := t.TempDir()
+	e, err := OpenLSMEngine(dir, smallLSMOptions())
+	if err != nil {
+		t.Fatalf("OpenLSMEngine: %v", err)
+	}
+
+	const keys = 2000
+	idx := uint64(0)
+	for i := 0; i < keys; i++ {
+		idx++
+		b := &Batch{Index: idx}
+		b.Put([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("value%d", i)))
+		if err := e.ApplyBatch(b); err != nil {
+			t.Fatalf("ApplyBatch: %v", err)
+		}
+		if e.NeedsFlush() {
+			if _, err := e.Flush(); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+		}
+	}
+
+	// delete every other key, the tombstones have to shadow the older tables
+	for i := 0; i < keys; i += 2 {
+		idx++
+		b := &Batch{Index: idx}
+		b.Delete([]byte(fmt.Sprintf("key%05d", i)))
+		if err := e.ApplyBatch(b); err != nil {
+			t.Fatalf("ApplyBatch delete: %v", err)
+		}
+		if e.NeedsFlush() {
+			if _, err := e.Flush(); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+		}
+	}
+
+	// give the background compaction a moment to push tables down
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		e.mu.RLock()
+		l0 := len(e.levels[0])
+		e.mu.RUnlock()
+		if l0 < e.opts.L0CompactionFiles {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	check := func(e *lsmEngine) {
+		t.Helper()
+		for i := 0; i < keys; i++ {
+			v, ok, err := e.Get([]byte(fmt.Sprintf("key%05d", i)))
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if i%2 == 0 {
+				if ok {
+					t.Fatalf("key%05d should be deleted, got %q", i, v)
+				}
+				continue
+			}
+			if !ok || string(v) != fmt.Sprintf("value%d", i) {
+				t.Fatalf("key%05d = %q (found=%v), want value%d", i, v, ok, i)
+			}
+		}
+
+		n := 0
+		prev := ""
+		err := e.Iterate([]byte("key"), func(k, v []byte) bool {
+			if string(k) <= prev {
+				t.Fatalf("Iterate out of order: %q after %q", k, prev)
+			}
+			prev = string(k)
+			n++
+			return true
+		})
+		if err != nil {
+			t.Fatalf("Iterate: %v", err)
+		}
+		if n != keys/2 {
+			t.Fatalf("Iterate saw %d keys, want %d", n, keys/2)
+		}
+	}
+	check(e)
+
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	e, err = OpenLSMEngine(dir, smallLSMOptions())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer e.Close()
+
+	if e.PersistedIndex() != idx {
+		t.Fatalf("PersistedIndex = %d, want %d", e.PersistedIndex(), idx)
+	}
+	check(e)
+}
+
+func TestNodeWithLSMEngineTrimsWAL(t *testing.T) {
+	RegisterEngine("lsm-small", func(fsys FS, dir string) (StorageEngine, error) {
+		return OpenLSMEngineWithFS(fsys, dir, smallLSMOptions())
+	})
+
+	dir := t.TempDir()
+	n, err := OpenNodeWithOptions(dir, NodeOptions{Engine: "lsm-small"})
+	if err != nil {
+		t.Fatalf("OpenNodeWithOptions: %v", err)
+	}
+
+	const writes = 300
+	for i := 1; i <= writes; i++ {
+		_, err := n.Exec(Command{
+			Instruct: CmdPut,
+			ClientID: "c1",
+			Seq:      uint64(i),
+			Key:      []byte(fmt.Sprintf("k%03d", i)),
+			Value:    []byte(fmt.Sprintf("some value number %d", i)),
+		})
+		if err != nil {
+			t.Fatalf("Exec %d: %v", i, err)
+		}
+	}
+
+	// the flushed records are gone from the WAL
+	recs, _, err := n.wal.ReplayAll()
+	if err != nil {
+		t.Fatalf("ReplayAll: %v", err)
+	}
+	if len(recs) >= writes {
+		t.Fatalf("WAL still holds %d records, expected it to be trimmed", len(recs))
+	}
+
+	if err := n.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "lsm-small", "MANIFEST")); err != nil {
+		t.Fatalf("no MANIFEST written: %v", err)
+	}
+
+	n, err = OpenNodeWithOptions(dir, NodeOptions{Engine: "lsm-small"})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer n.Close()
+
+	if n.LastIndex() != writes {
+		t.Fatalf("LastIndex = %d, want %d", n.LastIndex(), writes)
+	}
+	if keys, _ := n.store.Stats(); keys != writes {
+		t.Fatalf("after reopen Stats reports %d keys, want %d", keys, writes)
+	}
+	for i := 1; i <= writes; i++ {
+		v, err := n.Get(fmt.Sprintf("k%03d", i))
+		if err != nil || string(v) != fmt.Sprintf("some value number %d", i) {
+			t.Fatalf("Get k%03d = %q, %v", i, v, err)
+		}
+	}
+
+	// dedup state survived the trim as well
+	last := uint64(writes - 5)
+	if _, err := n.Exec(Command{Instruct: CmdPut, ClientID: "c1", Seq: last, Key: []byte("k295"), Value: []byte("again")}); err != nil {
+		t.Fatalf("Exec retry: %v", err)
+	}
+	if n.LastIndex() != writes {
+		t.Fatalf("retry was applied again: LastIndex = %d", n.LastIndex())
+	}
+	if v, _ := n.Get("k295"); string(v) != "some value number 295" {
+		t.Fatalf("retry overwrote k295 with %q", v)
+	}
+	if _, err := n.Exec(Command{Instruct: CmdPut, ClientID: "c1", Seq: 5, Key: []byte("k005"), Value: []byte("again")}); !errors.Is(err, ErrResultUnavailable) {
+		t.Fatalf("retry below the dedup window: err = %v, want ErrResultUnavailable", err)
+	}
+}
+
+func TestLSMEngineConcurrentClose(t *testing.T) {
+	e, err := OpenLSMEngine(t.TempDir(), smallLSMOptions())
+	if err != nil {
+		t.Fatalf("OpenLSMEngine: %v", err)
+	}
+	b := &Batch{Index: 1}
+	b.Put([]byte("k"), []byte("v"))
+	if err := e.ApplyBatch(b); err != nil {
+		t.Fatalf("ApplyBatch: %v", err)
+	}
+
+	// every Close starts at once, so they all find the engine still open
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if err := e.Close(); err != nil {
+				t.Errorf("Close: %v", err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+}
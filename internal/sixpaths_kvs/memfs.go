@@ -0,0 +1,566 @@
+package sixpaths_kvs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memfs.go implements MemFS, an FS in memory for crash tests.
+// Every file remembers what it held at its last Sync, and every directory
+// which names it had at its last SyncDir. Crash throws away everything
+// newer, the way a power cut would: unsynced bytes are gone (or, asked for,
+// a random part of what was appended survives, a torn write), and so are
+// files that were created or renamed without the directory being synced.
+// Handles opened before a crash stop working. Directories themselves are
+// durable as soon as they're made, and so is renaming one.
+// SetFaults makes chosen operations fail, a write can also be cut short.
+// SetCapacity gives the filesystem a size, writes past it fail with
+// ErrNoSpace like on a full disk.
+
+// FSOp names an operation of MemFS, for SetFaults
+type FSOp string
+
+const (
+	FSOpen     FSOp = "open"
+	FSRead     FSOp = "read"
+	FSWrite    FSOp = "write"
+	FSSync     FSOp = "sync"
+	FSTruncate FSOp = "truncate"
+	FSRename   FSOp = "rename"
+	FSRemove   FSOp = "remove"
+	FSMkdir    FSOp = "mkdir"
+	FSSyncDir  FSOp = "syncdir"
+)
+
+// ShortWrite, returned by a fault func for a write, makes the write put down
+// its first N bytes and then fail with Err.
+type ShortWrite struct {
+	N   int
+	Err error
+}
+
+func (s *ShortWrite) Error() string { return "short write: " + s.Err.Error() }
+func (s *ShortWrite) Unwrap() error { return s.Err }
+
+// ErrNoSpace is what writes to a full MemFS fail with.
+var ErrNoSpace = errors.New("no space left on device")
+
+// ErrCrashed is returned by handles opened before a MemFS crash.
+var ErrCrashed = errors.New("error: memfs: the file was opened before a crash")
+
+type MemFS struct {
+	mu       sync.Mutex
+	files    map[string]*memInode // what's there now
+	durable  map[string]*memInode // what a crash leaves
+	dirs     map[string]bool
+	gen      uint64 // bumped by every crash
+	fault    func(op FSOp, name string) error
+	capacity int64 // 0 means no limit
+}
+
+type memInode struct {
+	name    string // where it was last linked, faults and errors on open handles go by it
+	data    []byte
+	synced  []byte
+	modTime time.Time
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files:   make(map[string]*memInode),
+		durable: make(map[string]*memInode),
+		dirs:    map[string]bool{"/": true, ".": true},
+	}
+}
+
+// SetFaults calls fn before every operation, an error it returns is what the
+// operation fails with (see ShortWrite for writes). nil turns faults off.
+func (m *MemFS) SetFaults(fn func(op FSOp, name string) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fault = fn
+}
+
+// SetCapacity sets how many bytes the files may take up in all, 0 means no
+// limit. Files that already take more keep what they have.
+func (m *MemFS) SetCapacity(bytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.capacity = bytes
+}
+
+// Usage reports the capacity and what's left of it, a MemFS without one
+// can't say how full it is.
+func (m *MemFS) Usage(path string) (DiskUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.capacity == 0 {
+		return DiskUsage{}, errDiskUsageUnsupported
+	}
+	return DiskUsage{Total: uint64(m.capacity), Free: uint64(max(m.capacity-m.used(), 0))}, nil
+}
+
+// bytes taken up by files, the caller holds m.mu
+func (m *MemFS) used() int64 {
+	var n int64
+	seen := make(map[*memInode]bool)
+	for _, ino := range m.files {
+		if !seen[ino] {
+			seen[ino] = true
+			n += int64(len(ino.data))
+		}
+	}
+	return n
+}
+
+// Crash loses everything that wasn't synced. With rng set, files that were
+// appended to since their last sync keep a random part of the new bytes.
+func (m *MemFS) Crash(rng *rand.Rand) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gen++
+	m.fault = nil
+	files := make(map[string]*memInode, len(m.durable))
+	for name, ino := range m.durable {
+		kept := ino.synced
+		if rng != nil && len(ino.data) > len(ino.synced) && bytes.HasPrefix(ino.data, ino.synced) {
+			kept = ino.data[:len(ino.synced)+rng.IntN(len(ino.data)-len(ino.synced)+1)]
+		}
+		ino.data = append([]byte(nil), kept...)
+		ino.synced = append([]byte(nil), kept...)
+		ino.name = name
+		files[name] = ino
+	}
+	// inodes that only had a name that's now gone are dropped
+	m.files = files
+}
+
+// ReadFile returns the current contents of name.
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ino, ok := m.files[filepath.Clean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return append([]byte(nil), ino.data...), nil
+}
+
+// the caller holds m.mu
+func (m *MemFS) check(op FSOp, name string) error {
+	if m.fault == nil {
+		return nil
+	}
+	return m.fault(op, name)
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if err := m.check(FSOpen, name); err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	if m.dirs[name] {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	ino, ok := m.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		if !m.dirs[filepath.Dir(name)] {
+			return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		ino = &memInode{name: name, modTime: time.Now()}
+		m.files[name] = ino
+	}
+	if flag&os.O_TRUNC != 0 {
+		ino.data = nil
+	}
+	return &memFile{fs: m, ino: ino, gen: m.gen, flag: flag}, nil
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if m.dirs[name] {
+		return memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	ino, ok := m.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return memFileInfo{name: filepath.Base(name), size: int64(len(ino.data)), modTime: ino.modTime}, nil
+}
+
+func (m *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path = filepath.Clean(path)
+	if err := m.check(FSMkdir, path); err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	for p := path; !m.dirs[p]; p = filepath.Dir(p) {
+		if _, ok := m.files[p]; ok {
+			return &os.PathError{Op: "mkdir", Path: p, Err: errors.New("not a directory")}
+		}
+		m.dirs[p] = true
+	}
+	return nil
+}
+
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	if err := m.check(FSRename, oldpath); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	if !m.dirs[filepath.Dir(newpath)] {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if m.dirs[oldpath] {
+		return m.renameDir(oldpath, newpath)
+	}
+	ino, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = ino
+	ino.name = newpath
+	return nil
+}
+
+// moves a whole directory, the caller holds m.mu. directories are always
+// durable in a MemFS, so the names under it are moved in what a crash
+// leaves as well.
+func (m *MemFS) renameDir(oldpath, newpath string) error {
+	if _, ok := m.files[newpath]; ok || m.dirs[newpath] {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrExist}
+	}
+	moved := func(p string) (string, bool) {
+		if p == oldpath {
+			return newpath, true
+		}
+		if rest, ok := strings.CutPrefix(p, oldpath+string(filepath.Separator)); ok {
+			return filepath.Join(newpath, rest), true
+		}
+		return "", false
+	}
+	for _, names := range []map[string]*memInode{m.files, m.durable} {
+		next := make(map[string]*memInode, len(names))
+		for name, ino := range names {
+			if to, ok := moved(name); ok {
+				delete(names, name)
+				next[to] = ino
+			}
+		}
+		maps.Copy(names, next)
+	}
+	for name, ino := range m.files {
+		ino.name = name
+	}
+	var dirs []string
+	for dir := range m.dirs {
+		if to, ok := moved(dir); ok {
+			delete(m.dirs, dir)
+			dirs = append(dirs, to)
+		}
+	}
+	for _, dir := range dirs {
+		m.dirs[dir] = true
+	}
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if err := m.check(FSRemove, name); err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if !m.dirs[name] {
+		return &os.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if len(m.list(name)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *MemFS) RemoveAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path = filepath.Clean(path)
+	if err := m.check(FSRemove, path); err != nil {
+		return &os.PathError{Op: "remove", Path: path, Err: err}
+	}
+	under := func(p string) bool { return p == path || strings.HasPrefix(p, path+string(filepath.Separator)) }
+	for name := range m.files {
+		if under(name) {
+			delete(m.files, name)
+		}
+	}
+	for dir := range m.dirs {
+		if under(dir) {
+			delete(m.dirs, dir)
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) ReadDir(dir string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir = filepath.Clean(dir)
+	if !m.dirs[dir] {
+		return nil, &os.PathError{Op: "readdir", Path: dir, Err: fs.ErrNotExist}
+	}
+	return m.list(dir), nil
+}
+
+// the names in dir, the caller holds m.mu
+func (m *MemFS) list(dir string) []string {
+	var names []string
+	for name := range m.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	for d := range m.dirs {
+		if d != dir && filepath.Dir(d) == dir {
+			names = append(names, filepath.Base(d))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *MemFS) SyncDir(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir = filepath.Clean(dir)
+	if err := m.check(FSSyncDir, dir); err != nil {
+		return &os.PathError{Op: "sync", Path: dir, Err: err}
+	}
+	if !m.dirs[dir] {
+		return &os.PathError{Op: "sync", Path: dir, Err: fs.ErrNotExist}
+	}
+	for name := range m.durable {
+		if filepath.Dir(name) == dir {
+			delete(m.durable, name)
+		}
+	}
+	for name, ino := range m.files {
+		if filepath.Dir(name) == dir {
+			m.durable[name] = ino
+		}
+	}
+	return nil
+}
+
+type memFile struct {
+	fs     *MemFS
+	ino    *memInode
+	gen    uint64
+	flag   int
+	off    int64
+	closed bool
+}
+
+// the caller holds f.fs.mu
+func (f *memFile) usable(op string) error {
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.ino.name, Err: fs.ErrClosed}
+	}
+	if f.gen != f.fs.gen {
+		return &os.PathError{Op: op, Path: f.ino.name, Err: ErrCrashed}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	n, err := f.readAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	n, err := f.readAt(p, off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// the caller holds f.fs.mu
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if err := f.usable("read"); err != nil {
+		return 0, err
+	}
+	if err := f.fs.check(FSRead, f.ino.name); err != nil {
+		return 0, &os.PathError{Op: "read", Path: f.ino.name, Err: err}
+	}
+	if off >= int64(len(f.ino.data)) {
+		return 0, io.EOF
+	}
+	return copy(p, f.ino.data[off:]), nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.usable("write"); err != nil {
+		return 0, err
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.ino.name, Err: errors.New("file not open for writing")}
+	}
+	n := len(p)
+	ferr := f.fs.check(FSWrite, f.ino.name)
+	if ferr != nil {
+		n = 0
+		var short *ShortWrite
+		if errors.As(ferr, &short) {
+			n = min(max(short.N, 0), len(p))
+		}
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.off = int64(len(f.ino.data))
+	}
+	if f.fs.capacity > 0 {
+		room := f.fs.capacity - f.fs.used() + max(int64(len(f.ino.data))-f.off, 0)
+		if int64(n) > room {
+			n = int(max(room, 0))
+			if ferr == nil {
+				ferr = ErrNoSpace
+			}
+		}
+	}
+	if end := f.off + int64(n); end > int64(len(f.ino.data)) {
+		f.ino.data = append(f.ino.data, make([]byte, end-int64(len(f.ino.data)))...)
+	}
+	copy(f.ino.data[f.off:], p[:n])
+	f.off += int64(n)
+	f.ino.modTime = time.Now()
+	if ferr != nil {
+		return n, &os.PathError{Op: "write", Path: f.ino.name, Err: ferr}
+	}
+	return n, nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.usable("seek"); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.ino.data))
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.ino.name, Err: errors.New("bad whence")}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.ino.name, Err: errors.New("negative offset")}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.usable("sync"); err != nil {
+		return err
+	}
+	if err := f.fs.check(FSSync, f.ino.name); err != nil {
+		return &os.PathError{Op: "sync", Path: f.ino.name, Err: err}
+	}
+	f.ino.synced = append(f.ino.synced[:0], f.ino.data...)
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.usable("truncate"); err != nil {
+		return err
+	}
+	if err := f.fs.check(FSTruncate, f.ino.name); err != nil {
+		return &os.PathError{Op: "truncate", Path: f.ino.name, Err: err}
+	}
+	if size < int64(len(f.ino.data)) {
+		f.ino.data = f.ino.data[:size]
+	} else {
+		f.ino.data = append(f.ino.data, make([]byte, size-int64(len(f.ino.data)))...)
+	}
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.usable("stat"); err != nil {
+		return nil, err
+	}
+	return memFileInfo{name: filepath.Base(f.ino.name), size: int64(len(f.ino.data)), modTime: f.ino.modTime}, nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.ino.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return i.dir }
+func (i memFileInfo) Sys() any           { return nil }
+
+func (i memFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0o755
+	}
+	return 0o644
+}
@@ -0,0 +1,113 @@
+package sixpaths_kvs
+
+import (
+	"errors"
+	"math/rand/v2"
+	"os"
+	"testing"
+)
+
+func writeMemFile(t *testing.T, m *MemFS, name, data string, sync bool) File {
+	t.Helper()
+	f, err := m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := f.Write([]byte(data)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			t.Fatalf("Sync: %v", err)
+		}
+	}
+	return f
+}
+
+func TestMemFSCrashKeepsOnlySynced(t *testing.T) {
+	m := NewMemFS()
+	_ = m.MkdirAll("/d", 0o755)
+	f := writeMemFile(t, m, "/d/a", "synced", true)
+	_, _ = f.Write([]byte("+lost"))
+	if err := m.SyncDir("/d"); err != nil {
+		t.Fatalf("SyncDir: %v", err)
+	}
+	// never made durable by a SyncDir
+	writeMemFile(t, m, "/d/b", "new", true)
+
+	m.Crash(nil)
+	if got, _ := m.ReadFile("/d/a"); string(got) != "synced" {
+		t.Fatalf("/d/a after crash = %q, want the synced part", got)
+	}
+	if _, err := m.Stat("/d/b"); !os.IsNotExist(err) {
+		t.Fatalf("/d/b survived a crash without a dir sync: %v", err)
+	}
+	if _, err := f.Write([]byte("x")); !errors.Is(err, ErrCrashed) {
+		t.Fatalf("write through a handle from before the crash = %v, want ErrCrashed", err)
+	}
+}
+
+func TestMemFSTornCrashKeepsPrefix(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	for range 20 {
+		m := NewMemFS()
+		f := writeMemFile(t, m, "/a", "base", true)
+		_ = m.SyncDir("/")
+		_, _ = f.Write([]byte("0123456789"))
+		m.Crash(rng)
+		got, _ := m.ReadFile("/a")
+		if len(got) < 4 || string(got) != "base0123456789"[:len(got)] {
+			t.Fatalf("after a torn crash /a = %q, want a prefix of the writes that starts with the synced part", got)
+		}
+	}
+}
+
+func TestMemFSRenameNeedsDirSync(t *testing.T) {
+	m := NewMemFS()
+	writeMemFile(t, m, "/old", "v1", true)
+	_ = m.SyncDir("/")
+	writeMemFile(t, m, "/tmp", "v2", true)
+	if err := m.Rename("/tmp", "/old"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	m.Crash(nil)
+	if got, _ := m.ReadFile("/old"); string(got) != "v1" {
+		t.Fatalf("/old = %q, the rename was never synced", got)
+	}
+
+	writeMemFile(t, m, "/tmp", "v2", true)
+	_ = m.Rename("/tmp", "/old")
+	_ = m.SyncDir("/")
+	m.Crash(nil)
+	if got, _ := m.ReadFile("/old"); string(got) != "v2" {
+		t.Fatalf("/old = %q after a synced rename", got)
+	}
+}
+
+func TestMemFSFaults(t *testing.T) {
+	m := NewMemFS()
+	boom := errors.New("boom")
+	m.SetFaults(func(op FSOp, name string) error {
+		switch op {
+		case FSWrite:
+			return &ShortWrite{N: 3, Err: boom}
+		case FSSync:
+			return boom
+		}
+		return nil
+	})
+	f, err := m.OpenFile("/a", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if n, err := f.Write([]byte("abcdef")); n != 3 || !errors.Is(err, boom) {
+		t.Fatalf("short write = %d, %v", n, err)
+	}
+	if err := f.Sync(); !errors.Is(err, boom) {
+		t.Fatalf("Sync = %v, want the injected error", err)
+	}
+	m.SetFaults(nil)
+	if got, _ := m.ReadFile("/a"); string(got) != "abc" {
+		t.Fatalf("/a = %q after a short write", got)
+	}
+}
@@ -1,30 +1,93 @@
 package sixpaths_kvs
 
-import "sync/atomic"
+import "time"
 
-// metrics.go implements simple counters for our KV node
-// It trakcs total Exec calls, Puts, Deleters, and dedup hits
-// Metrics work on a per node basis.
+// metrics.go implements the metrics of a single KV node.
+// Every Node owns a Metrics (pass one in through NodeOptions.Metrics to
+// look at it from the outside, e.g. in tests), so several nodes in one
+// process keep their counts apart. It tracks total Exec calls, Puts,
+// Deletes and dedup hits, and holds the node's Prometheus registry.
+// A Metrics handed to a node that is reopened keeps its counters and the
+// WAL fsync histogram, the gauges are registered again and follow the
+// newest node.
 
-var (
-	execTotal uint64
-	putTotal  uint64
-	delTotal  uint64
-	dedupHits uint64
-)
+type Metrics struct {
+	reg *PromRegistry
 
-func IncExec() {
-	atomic.AddUint64(&execTotal, 1)
+	Exec      *Counter // commands logged and applied
+	Put       *Counter // puts applied, streamed values count once
+	Del       *Counter // deletes applied
+	DedupHits *Counter // retries answered from the dedup window
+
+	walFsync *Histogram // handed to the WAL of every node that uses us
+}
+
+func NewMetrics() *Metrics {
+	reg := NewPromRegistry()
+	return &Metrics{
+		reg:       reg,
+		Exec:      reg.NewCounter("sixpaths_exec_total", "Commands logged and applied."),
+		Put:       reg.NewCounter("sixpaths_put_total", "Puts applied."),
+		Del:       reg.NewCounter("sixpaths_delete_total", "Deletes applied."),
+		DedupHits: reg.NewCounter("sixpaths_dedup_hits_total", "Retried writes answered from the dedup window."),
+		walFsync: reg.NewHistogram("sixpaths_wal_fsync_duration_seconds",
+			"Time spent in fsync for each WAL append.", LatencyBuckets),
+	}
 }
 
-func IncPut() {
-	atomic.AddUint64(&putTotal, 1)
+// Registry returns the Prometheus registry the counters live in.
+func (m *Metrics) Registry() *PromRegistry {
+	return m.reg
 }
-func IncDel() {
-	atomic.AddUint64(&delTotal, 1)
+
+// counts a command that made it through Exec
+func (m *Metrics) observeExec(cmd Command) {
+	m.Exec.Inc()
+	switch cmd.Instruct {
+	case CmdPut, CmdPutManifest:
+		m.Put.Inc()
+	case CmdDelete:
+		m.Del.Inc()
+	}
 }
-func IncDedup() {
-	atomic.AddUint64(&dedupHits, 1)
+
+// registers the gauges that read the node's state at scrape time, replay is
+// how long opening the node took to replay its WAL
+func (m *Metrics) registerNode(n *Node, replay time.Duration) {
+	r := m.reg
+
+	n.wal.fsync = m.walFsync
+	r.NewGaugeFunc("sixpaths_wal_size_bytes", "Size of the WAL file.",
+		func() float64 { return float64(n.wal.Size()) })
+	r.NewGaugeFunc("sixpaths_wal_records", "Records currently held in the WAL.",
+		func() float64 { return float64(n.wal.Records()) })
+	r.NewGauge("sixpaths_wal_replay_duration_seconds",
+		"Time the node took to replay its WAL on startup.").Set(replay.Seconds())
+	r.NewGaugeFunc("sixpaths_last_applied_index", "Log index of the last applied command.",
+		func() float64 { return float64(n.store.LastApplied()) })
+	r.NewGaugeFunc("sixpaths_store_keys", "Number of keys in the store.",
+		func() float64 { k, _ := n.store.Stats(); return float64(k) })
+	r.NewGaugeFunc("sixpaths_read_only", "1 while the node refuses writes, see /health for why.",
+		func() float64 {
+			if n.ReadOnly() != nil {
+				return 1
+			}
+			return 0
+		})
+	r.NewGaugeFunc("sixpaths_disk_low", "1 while the node only takes deletes for lack of disk space.",
+		func() float64 {
+			if n.DiskLow() != nil {
+				return 1
+			}
+			return 0
+		})
+	// read at scrape time, 0 where free space can't be read
+	r.NewGaugeFunc("sixpaths_disk_free_bytes", "Free bytes on the filesystem of the data dir.",
+		func() float64 { u, _ := n.fs.Usage(n.dataDir); return float64(u.Free) })
+	r.NewGaugeFunc("sixpaths_disk_total_bytes", "Size of the filesystem of the data dir in bytes.",
+		func() float64 { u, _ := n.fs.Usage(n.dataDir); return float64(u.Total) })
+	r.NewGaugeFunc("sixpaths_store_bytes", "Bytes taken up by keys and values, streamed values included.",
+		func() float64 { _, b := n.store.Stats(); return float64(b) })
 }
 
 type MetricsSnapshot struct {
@@ -34,11 +97,11 @@ type MetricsSnapshot struct {
 	DedupHits uint64 `json:"dedup_hits"`
 }
 
-func Snapshot() MetricsSnapshot {
+func (m *Metrics) Snapshot() MetricsSnapshot {
 	return MetricsSnapshot{
-		ExecTotal: atomic.LoadUint64(&execTotal),
-		PutTotal:  atomic.LoadUint64(&putTotal),
-		DelTotal:  atomic.LoadUint64(&delTotal),
-		DedupHits: atomic.LoadUint64(&dedupHits),
+		ExecTotal: m.Exec.Value(),
+		PutTotal:  m.Put.Value(),
+		DelTotal:  m.Del.Value(),
+		DedupHits: m.DedupHits.Value(),
 	}
 }
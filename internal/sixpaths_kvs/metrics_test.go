@@ -0,0 +1,100 @@
+package sixpaths_kvs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNodesKeepSeparateMetrics(t *testing.T) {
+	m := NewMetrics()
+	a, err := OpenNodeWithOptions(t.TempDir(), NodeOptions{Metrics: m})
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	defer a.Close()
+	b, err := OpenNode(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	defer b.Close()
+
+	put := Command{Instruct: CmdPut, ClientID: "c1", Seq: 1, Key: []byte("k"), Value: []byte("v")}
+	for i := 0; i < 2; i++ { // the second one is a dedup hit
+		if _, err := a.Exec(put); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+	}
+	if _, err := a.Exec(Command{Instruct: CmdDelete, ClientID: "c1", Seq: 2, Key: []byte("k")}); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if _, err := b.Exec(put); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	want := MetricsSnapshot{ExecTotal: 2, PutTotal: 1, DelTotal: 1, DedupHits: 1}
+	if got := m.Snapshot(); got != want {
+		t.Fatalf("node a: %+v, want %+v", got, want)
+	}
+	want = MetricsSnapshot{ExecTotal: 1, PutTotal: 1}
+	if got := b.Metrics().Snapshot(); got != want {
+		t.Fatalf("node b: %+v, want %+v", got, want)
+	}
+
+	// the server's own metrics stay out of the node's registry
+	reg := NewPromRegistry()
+	h := NewHTTPServerWithRegistry(a, "", reg)
+	w := httptest.NewRecorder()
+	h.srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/get?key=k", nil))
+	var sb strings.Builder
+	if _, err := reg.WriteTo(&sb); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if !strings.Contains(sb.String(), `route="/get",method="GET",status="404"`) {
+		t.Fatalf("server registry is missing the /get request:\n%s", sb.String())
+	}
+	sb.Reset()
+	_, _ = m.Registry().WriteTo(&sb)
+	if strings.Contains(sb.String(), "sixpaths_http_request") || !strings.Contains(sb.String(), "sixpaths_exec_total 2\n") {
+		t.Fatalf("unexpected node registry:\n%s", sb.String())
+	}
+}
+
+func TestReopenedNodeReplacesItsMetrics(t *testing.T) {
+	m := NewMetrics()
+	dir := t.TempDir()
+	a, err := OpenNodeWithOptions(dir, NodeOptions{Metrics: m})
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	if _, err := a.Exec(Command{Instruct: CmdPut, ClientID: "c1", Seq: 1, Key: []byte("k"), Value: []byte("v")}); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	b, err := OpenNodeWithOptions(dir, NodeOptions{Metrics: m})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer b.Close()
+	if _, err := b.Exec(Command{Instruct: CmdPut, ClientID: "c1", Seq: 2, Key: []byte("k2"), Value: []byte("v")}); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	var sb strings.Builder
+	_, _ = m.Registry().WriteTo(&sb)
+	out := sb.String()
+	if c := strings.Count(out, "# TYPE sixpaths_store_keys "); c != 1 {
+		t.Fatalf("sixpaths_store_keys exported %d times:\n%s", c, out)
+	}
+	// the gauges read the open node, not the closed one
+	if !strings.Contains(out, "sixpaths_store_keys 2\n") {
+		t.Fatalf("gauges don't follow the reopened node:\n%s", out)
+	}
+	// while the fsync histogram, like the counters, carries on from the first
+	if !strings.Contains(out, "sixpaths_wal_fsync_duration_seconds_count 2\n") || !strings.Contains(out, "sixpaths_exec_total 2\n") {
+		t.Fatalf("counts were reset by the reopen:\n%s", out)
+	}
+}
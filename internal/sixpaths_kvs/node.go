@@ -1,11 +1,14 @@
 package sixpaths_kvs
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,21 +29,73 @@ type Node struct {
 	last    uint64
 	mu      sync.Mutex
 	dataDir string
+	engine  string // name of the storage engine
+	fs      FS     // what the data dir is on
+
+	metrics *Metrics
+	log     *slog.Logger
+	tracer  *Tracer
+	inspect *Inspector
+	watch   watchHub
+
+	readOnly atomic.Pointer[error] // why writes are refused, nil while writable
+
+	// the disk guard, see diskspace.go
+	minFreeBytes   uint64
+	minFreePercent float64
+	diskLow        atomic.Pointer[error] // why writes that add data are refused
+	diskStop       chan struct{}
+	diskDone       chan struct{}
 }
 
+// NodeOptions tunes how a node is opened, the zero value gives the defaults.
+type NodeOptions struct {
+	Engine  string       // name of the storage engine, "" means DefaultEngine
+	Metrics *Metrics     // where the node counts what it does, nil means a fresh one
+	Logger  *slog.Logger // nil means slog.Default()
+	Tracer  *Tracer      // nil turns tracing off
+	// tracks in-flight and slow requests, nil means one with DefaultSlowThreshold
+	Inspector *Inspector
+	// when the WAL is damaged in the middle (see WALCorruptionError), start
+	// read-only from the records before the damage instead of failing
+	ReadOnlyOnCorruptWAL bool
+	// the filesystem the data dir is on, nil means OSFS
+	FS FS
+	// writes that add data are turned away while the data dir's filesystem
+	// has less free space than the larger of these, 0 for both turns the
+	// guard off (see diskspace.go)
+	MinFreeBytes   uint64
+	MinFreePercent float64
+	// how often free space is checked, 0 means DefaultDiskCheckInterval
+	DiskCheckInterval time.Duration
+}
+
+// returned by writes to a node that can't take them, see Node.ReadOnly
+var ErrReadOnly = errors.New("error: node is read-only")
+
 func OpenNode(dataDir string) (*Node, error) {
+	return OpenNodeWithOptions(dataDir, NodeOptions{})
+}
+
+func OpenNodeWithOptions(dataDir string, opts NodeOptions) (*Node, error) {
+
+	fsys := orOSFS(opts.FS)
+	engineName := opts.Engine
+	if engineName == "" {
+		engineName = DefaultEngine
+	}
 
 	// we check whether the dir at dataDir exists
-	info, err := os.Stat(dataDir)
+	info, err := fsys.Stat(dataDir)
 
 	if err != nil {
 		if os.IsNotExist(err) {
 			// if it doesn't exist, we create it.
-			if mkErr := os.MkdirAll(dataDir, 0o755); mkErr != nil {
+			if mkErr := fsys.MkdirAll(dataDir, 0o755); mkErr != nil {
 				return nil, fmt.Errorf("error: OpenNode() failure, unable to create directory: %w", mkErr)
 			}
 			// refresh info after creating the dir
-			if info, err = os.Stat(dataDir); err != nil {
+			if info, err = fsys.Stat(dataDir); err != nil {
 				return nil, fmt.Errorf("stat %q failed after mkdir: %w", dataDir, err)
 			}
 		} else {
@@ -57,11 +112,35 @@ func OpenNode(dataDir string) (*Node, error) {
 	// filepath dataDir/wal
 	pth := filepath.Join(dataDir, "wal")
 
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	// a backup that was being put together for a tar stream when we went down
+	// is of no use to anyone anymore
+	if err := sweepTempDirs(fsys, dataDir, backupTempPrefix); err != nil {
+		logger.Warn("backup_sweep_failed", "err", err)
+	}
+
 	// we create a new WAL using the path dataDir/wal
-	nwal, err := NewWAL(pth)
+	nwal, err := NewWALWithFS(fsys, pth)
+	var corrupt *WALCorruptionError
+	if errors.As(err, &corrupt) {
+		// a damaged v1 log isn't upgraded, it's kept aside untouched and the
+		// node can't serve from it, not even read-only
+		if qerr := quarantineWAL(fsys, dataDir, corrupt); qerr != nil {
+			logger.Error("wal_quarantine_failed", "err", qerr)
+		}
+		logger.Error("wal_corrupt", "path", corrupt.Path, "offset", corrupt.Offset, "problem", corrupt.Kind,
+			"damaged_from", corrupt.FirstDamaged, "damaged_to", corrupt.LastDamaged,
+			"intact_from", corrupt.ResumeIndex, "intact_to", corrupt.LastIndex,
+			"quarantine", corrupt.Quarantine, "version", "v1")
+	}
 	if err != nil {
 		return nil, fmt.Errorf("error: OpenNode() failure, unable to create WAL: %w", err)
 	}
+	nwal.log = logger
 	// ensure we close the WAL on any failure below
 	defer func() {
 		if err != nil {
@@ -73,21 +152,53 @@ func OpenNode(dataDir string) (*Node, error) {
 	// this will allow us to use these records to recreate the KV store
 	t0 := time.Now()
 	recs, lastidx, err := nwal.ReplayAll()
-	log.Printf("wal_replay records=%d lastIndex=%d dur_ms=%d", len(recs), lastidx, time.Since(t0).Milliseconds())
+	replayDur := time.Since(t0)
+	logger.Info("wal_replay", "records", len(recs), "last_index", lastidx, "dur_ms", replayDur.Milliseconds())
+	if errors.As(err, &corrupt) {
+		// we never cut committed records off, a copy of the log is kept
+		// aside for repair and we either stop here or serve what we have
+		if qerr := quarantineWAL(fsys, dataDir, corrupt); qerr != nil {
+			logger.Error("wal_quarantine_failed", "err", qerr)
+		}
+		logger.Error("wal_corrupt", "path", corrupt.Path, "offset", corrupt.Offset, "problem", corrupt.Kind,
+			"damaged_from", corrupt.FirstDamaged, "damaged_to", corrupt.LastDamaged,
+			"intact_from", corrupt.ResumeIndex, "intact_to", corrupt.LastIndex,
+			"quarantine", corrupt.Quarantine, "read_only", opts.ReadOnlyOnCorruptWAL)
+		if !opts.ReadOnlyOnCorruptWAL {
+			return nil, corrupt
+		}
+		err = nil
+	}
 	if err != nil {
 		// on failure we close the WAL
 		return nil, err
 	}
 
-	// now we create a new KV store
-	nstore, err := NewStore()
+	// now we open the storage engine and create a new KV store on top of it
+	engine, err := OpenEngineWithFS(fsys, engineName, filepath.Join(dataDir, engineName))
 	if err != nil {
 		// on failure we close the WAL
 		return nil, err
 	}
+	nstore, err := NewStoreWithEngine(engine)
+	if err != nil {
+		_ = engine.Close()
+		return nil, err
+	}
+	// ensure we close the engine on any failure below
+	defer func() {
+		if err != nil {
+			_ = nstore.Close()
+		}
+	}()
 
 	// now we iterate over our records and Apply() them sequentially
+	// a durable engine already has everything up to the index it persisted,
+	// so those records are skipped
 	for _, rec := range recs {
+		if rec.LogIndex <= nstore.lastlogi {
+			continue
+		}
 		_, err = nstore.Apply(rec.Cmd, rec.LogIndex)
 		if err != nil {
 			// on failure we close the WAL
@@ -95,12 +206,40 @@ func OpenNode(dataDir string) (*Node, error) {
 		}
 	}
 
+	// after a WAL trim the log may be empty while the engine isn't
+	if nstore.lastlogi > lastidx {
+		lastidx = nstore.lastlogi
+	}
+
 	newNode := Node{
 		wal:     nwal,
 		store:   nstore,
 		last:    lastidx,
 		mu:      sync.Mutex{},
 		dataDir: dataDir,
+		engine:  engineName,
+		fs:      fsys,
+		log:     logger,
+		tracer:  opts.Tracer,
+		inspect: opts.Inspector,
+
+		minFreeBytes:   opts.MinFreeBytes,
+		minFreePercent: opts.MinFreePercent,
+	}
+	if newNode.inspect == nil {
+		newNode.inspect = NewInspector(DefaultSlowThreshold, 0)
+	}
+	newNode.metrics = opts.Metrics
+	if newNode.metrics == nil {
+		newNode.metrics = NewMetrics()
+	}
+	// replaying includes applying the records to the store
+	newNode.metrics.registerNode(&newNode, time.Since(t0))
+	if corrupt != nil {
+		newNode.setReadOnly(corrupt)
+	}
+	if opts.MinFreeBytes > 0 || opts.MinFreePercent > 0 {
+		newNode.startDiskMonitor(opts.DiskCheckInterval)
 	}
 
 	return &newNode, nil
@@ -113,6 +252,12 @@ func (n *Node) Close() error {
 		return nil
 	}
 
+	if n.diskStop != nil {
+		close(n.diskStop)
+		<-n.diskDone
+		n.diskStop = nil
+	}
+
 	//attempt to close the WAL
 	err := n.wal.Close()
 
@@ -120,25 +265,79 @@ func (n *Node) Close() error {
 	if err != nil {
 		return err
 	}
+
+	// then the store (and with it the storage engine)
+	if n.store != nil {
+		return n.store.Close()
+	}
 	//on success, return nil
 	return nil
 }
 
 func (n *Node) Exec(cmd Command) (ApplyResult, error) {
+	return n.ExecContext(context.Background(), cmd)
+}
+
+// ExecContext is Exec for a request, log lines written for the command carry
+// the request ID in ctx.
+func (n *Node) ExecContext(ctx context.Context, cmd Command) (ApplyResult, error) {
+	ctx, span := StartSpan(ctx, "node.exec", SpanKindInternal)
+	defer span.End()
+	span.SetAttr("cmd.type", int(cmd.Instruct))
+
 	// we take the lock to keep the writes serial
+	lock := startPhase(ctx, "node.lock_wait", PhaseLockWait)
 	n.mu.Lock()
+	lock.end(nil)
 	defer n.mu.Unlock()
+
+	if err := n.ReadOnly(); err != nil {
+		return ApplyResult{}, err
+	}
 	// we build the skeleton of the ApplyResult we're gonna return
 
+	// we stamp the command with the time it's logged at, session expiry
+	// is decided against this time only (see session.go)
+	cmd.Time = n.store.nextTime()
+	if cmd.Instruct == CmdRegisterSession {
+		cmd.Value = stampSessionToken(cmd.Value)
+	}
+
+	// the session prefix belongs to the IDs we hand out, a client that picked
+	// one like it on its own would otherwise be taken for a session
+	if isSessionID(cmd.ClientID) && !wellFormedSessionID(cmd.ClientID) {
+		return ApplyResult{}, ErrReservedClientID
+	}
+
+	// requests from an expired session are turned away before anything else,
+	// their dedup entry may already be gone so a retry can't be recognized
+	if cmd.Instruct != CmdRegisterSession && !n.store.clientAllowed(cmd.ClientID, cmd.Time) {
+		return ApplyResult{}, ErrSessionExpired
+	}
+
 	// we check if this request is a duplicate (by comparing Seqs)
-	n.store.mu.Lock()
-	if n.store.dedupMap[cmd.ClientID].seq >= cmd.Seq {
-		defer n.store.mu.Unlock()
-		IncDedup()
-		log.Printf("dedup hit client=%s seq=%d lastSeq=%d", cmd.ClientID, cmd.Seq, n.store.dedupMap[cmd.ClientID].seq)
-		return n.store.dedupMap[cmd.ClientID].result, nil
+	// chunks of a streamed value share the upload's seq, so they skip this,
+	// and so do session commands, which carry no seq
+	if cmd.Instruct == CmdPut || cmd.Instruct == CmdDelete || cmd.Instruct == CmdPutManifest {
+		dedup := startPhase(ctx, "node.dedup_check", PhaseDedupCheck)
+		res, st := n.store.lookupDedup(cmd.ClientID, cmd.Seq)
+		dedup.span.SetAttr("dedup.hit", st == dedupHit)
+		dedup.end(nil)
+		switch st {
+		case dedupHit:
+			n.metrics.DedupHits.Inc()
+			n.log.DebugContext(ctx, "dedup_hit", "client", cmd.ClientID, "seq", cmd.Seq, "log_index", res.LogIndex)
+			return res, nil
+		case dedupGone:
+			return ApplyResult{}, ErrResultUnavailable
+		}
+	}
+
+	// short on disk, only what frees space (or costs nothing) goes through,
+	// a retry of a write that was already applied is still answered above
+	if err := n.DiskLow(); err != nil && !allowedOnLowDisk(cmd.Instruct) {
+		return ApplyResult{}, err
 	}
-	n.store.mu.Unlock()
 
 	// we check if the cmd type is valid
 	if !validType(cmd.Instruct) {
@@ -146,6 +345,18 @@ func (n *Node) Exec(cmd Command) (ApplyResult, error) {
 		return ApplyResult{}, fmt.Errorf("error: invalid command")
 	}
 
+	// session commands and chunk drops don't touch any key of their own
+	if cmd.Instruct == CmdRegisterSession || cmd.Instruct == CmdKeepAlive || cmd.Instruct == CmdDropChunks {
+		cmd.Key = nil
+	} else if (cmd.Instruct == CmdPutChunk) != isInternalKey(cmd.Key) {
+		// chunk keys live in the internal keyspace, everything else must stay out of it
+		return ApplyResult{}, ErrReservedKey
+	}
+	// a regular value must not be mistaken for a manifest on the way back out
+	if _, isM := parseManifest(cmd.Value); isM && cmd.Instruct != CmdPutManifest && cmd.Instruct != CmdDropChunks {
+		return ApplyResult{}, ErrReservedValue
+	}
+
 	// we get the index for the next command application
 	nextIdx := n.last + 1
 
@@ -155,27 +366,154 @@ func (n *Node) Exec(cmd Command) (ApplyResult, error) {
 		Cmd:      cmd,
 	}
 	// we get the encoded record to add to our WAL
-	err := n.wal.Append(&appRec)
+	err := n.wal.AppendContext(ctx, &appRec)
 	if err != nil {
+		span.SetError(err)
+		// we can't tell what made it to disk, so we take no more writes
+		// until the log has been checked again, see RecoverWAL
+		if errors.Is(err, ErrWALFailed) {
+			n.setReadOnly(err)
+			n.log.ErrorContext(ctx, "wal_failed", "index", nextIdx, "err", err)
+			return ApplyResult{}, n.ReadOnly()
+		}
 		return ApplyResult{}, err
 	}
 
+	apply := startPhase(ctx, "store.apply", PhaseApply)
 	ap, err := n.store.Apply(cmd, nextIdx)
+	apply.end(err)
 	if err != nil {
+		span.SetError(err)
 		return ap, err
 	}
+	span.SetAttr("log.index", nextIdx)
 
 	n.last = nextIdx
+	n.metrics.observeExec(cmd)
+	n.publish(cmd, ap)
+
+	n.maybeFlush()
 
 	return ap, nil
 }
 
+// lets a durable engine flush its memtable once it's big enough, and then
+// trims the WAL records it no longer needs. the caller must hold n.mu.
+// failures aren't fatal: the records stay in the WAL and we try again later.
+func (n *Node) maybeFlush() {
+	de, ok := n.store.engine.(DurableEngine)
+	if !ok || !de.NeedsFlush() {
+		return
+	}
+
+	t0 := time.Now()
+	idx, err := de.Flush()
+	if err != nil {
+		n.log.Error("engine flush failed", "err", err)
+		return
+	}
+	if err := n.wal.TrimThrough(idx); err != nil {
+		n.log.Error("wal trim failed", "through", idx, "err", err)
+		// the log may be left on a file we can't trust, see RecoverWAL
+		if errors.Is(err, ErrWALFailed) {
+			n.setReadOnly(err)
+		}
+		return
+	}
+	n.log.Info("engine_flush", "index", idx, "dur_ms", time.Since(t0).Milliseconds())
+}
+
+// Inspector returns what tracks the node's in-flight and slow requests.
+func (n *Node) Inspector() *Inspector {
+	return n.inspect
+}
+
+// Tracer returns the node's tracer, nil if tracing is off.
+func (n *Node) Tracer() *Tracer {
+	return n.tracer
+}
+
+// Metrics returns the node's metrics.
+func (n *Node) Metrics() *Metrics {
+	return n.metrics
+}
+
 func (n *Node) Get(key string) ([]byte, error) {
 	return n.store.Get(key)
 }
 
+// ReadOnly returns why the node refuses writes (wrapping ErrReadOnly), or
+// nil if it takes them. Reads are served either way.
+func (n *Node) ReadOnly() error {
+	if p := n.readOnly.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// RecoverWAL lets a node that went read-only after a failed WAL write take
+// writes again, once the log's tail checks out (see WAL.Recover). A node that
+// is read-only for another reason stays that way.
+func (n *Node) RecoverWAL() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ro := n.ReadOnly()
+	if ro == nil {
+		return nil
+	}
+	if n.wal.Failed() == nil {
+		return fmt.Errorf("error: the WAL is fine, the node is read-only for another reason: %w", ro)
+	}
+	if err := n.wal.Recover(n.last); err != nil {
+		n.log.Error("wal_recover_failed", "last_index", n.last, "err", err)
+		return err
+	}
+	n.readOnly.Store(nil)
+	return nil
+}
+
+func (n *Node) setReadOnly(reason error) {
+	err := fmt.Errorf("%w: %w", ErrReadOnly, reason)
+	n.readOnly.Store(&err)
+}
+
+// copies a log with mid-log damage to dataDir/quarantine so it survives
+// whatever repair comes next, a node restarting on the same damage reuses
+// the copy it made the first time
+func quarantineWAL(fsys FS, dataDir string, c *WALCorruptionError) error {
+	dir := filepath.Join(dataDir, "quarantine")
+	if err := fsys.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	dst := filepath.Join(dir, fmt.Sprintf("wal.corrupt-%d-%d", c.Offset, c.Size))
+	if _, err := fsys.Stat(dst); err == nil {
+		c.Quarantine = dst
+		return nil
+	}
+	if err := copyFileSync(fsys, c.Path, dst); err != nil {
+		return err
+	}
+	c.Quarantine = dst
+	return nil
+}
+
+// returns the index of the last command written to the WAL
+func (n *Node) LastIndex() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.last
+}
+
 func OpenClusterNode(cfg NodeConfig, all []NodeConfig) (*Node, error) {
-	n, err := OpenNode(cfg.DataDir)
+	return OpenClusterNodeWithOptions(cfg, all, NodeOptions{})
+}
+
+// like OpenClusterNode, the engine comes from cfg unless opts names one
+func OpenClusterNodeWithOptions(cfg NodeConfig, all []NodeConfig, opts NodeOptions) (*Node, error) {
+	if opts.Engine == "" {
+		opts.Engine = cfg.Engine
+	}
+	n, err := OpenNodeWithOptions(cfg.DataDir, opts)
 	if err != nil {
 		return nil, err
 	}
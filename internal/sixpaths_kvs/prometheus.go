@@ -0,0 +1,338 @@
+package sixpaths_kvs
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// prometheus.go is a small implementation of the Prometheus text exposition
+// format, so nodes and the router can be scraped without pulling in the
+// Prometheus client library. It only has what we use: counters, gauges
+// (set directly or read from a func at scrape time) and histograms, the
+// latter optionally split by labels.
+
+// latency buckets in seconds, from half a millisecond up to 10s
+var LatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// PromRegistry holds a set of metrics and writes them out in text format.
+type PromRegistry struct {
+	mu      sync.Mutex
+	metrics []promMetric
+}
+
+type promMetric interface {
+	family() string
+	writeProm(w *bufio.Writer)
+}
+
+func NewPromRegistry() *PromRegistry {
+	return &PromRegistry{}
+}
+
+// a metric registered under a name that is already taken replaces the old
+// one in place, so a node reopened on the same registry doesn't export its
+// families twice, or keep reading the closed node
+func (r *PromRegistry) register(m promMetric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, old := range r.metrics {
+		if old.family() == m.family() {
+			r.metrics[i] = m
+			return
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes every metric in registration order.
+func (r *PromRegistry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	ms := append([]promMetric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range ms {
+		m.writeProm(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves the registry to a Prometheus scraper.
+func (r *PromRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = r.WriteTo(w)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ===== Counter =====
+
+type Counter struct {
+	name, help string
+	v          atomic.Uint64
+	fn         func() uint64
+}
+
+func (r *PromRegistry) NewCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	r.register(c)
+	return c
+}
+
+// NewCounterFunc registers a counter whose value is read from fn on every scrape.
+func (r *PromRegistry) NewCounterFunc(name, help string, fn func() uint64) *Counter {
+	c := &Counter{name: name, help: help, fn: fn}
+	r.register(c)
+	return c
+}
+
+func (c *Counter) Inc()         { c.v.Add(1) }
+func (c *Counter) Add(n uint64) { c.v.Add(n) }
+
+func (c *Counter) Value() uint64 {
+	if c.fn != nil {
+		return c.fn()
+	}
+	return c.v.Load()
+}
+
+func (c *Counter) family() string { return c.name }
+
+func (c *Counter) writeProm(w *bufio.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	writeSample(w, c.name, "", float64(c.Value()))
+}
+
+// ===== Gauge =====
+
+type Gauge struct {
+	name, help string
+	bits       atomic.Uint64
+	fn         func() float64
+}
+
+func (r *PromRegistry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	r.register(g)
+	return g
+}
+
+// NewGaugeFunc registers a gauge whose value is read from fn on every scrape.
+func (r *PromRegistry) NewGaugeFunc(name, help string, fn func() float64) *Gauge {
+	g := &Gauge{name: name, help: help, fn: fn}
+	r.register(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64) { g.bits.Store(math.Float64bits(v)) }
+
+func (g *Gauge) Value() float64 {
+	if g.fn != nil {
+		return g.fn()
+	}
+	return math.Float64frombits(g.bits.Load())
+}
+
+func (g *Gauge) family() string { return g.name }
+
+func (g *Gauge) writeProm(w *bufio.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	writeSample(w, g.name, "", g.Value())
+}
+
+// ===== Histogram =====
+
+type Histogram struct {
+	buckets []float64       // upper bounds, ascending, +Inf is implied
+	counts  []atomic.Uint64 // per bucket, not cumulative
+	count   atomic.Uint64
+	sumBits atomic.Uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]atomic.Uint64, len(buckets)+1)}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	for {
+		old := h.sumBits.Load()
+		if h.sumBits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) Count() uint64 { return h.count.Load() }
+
+func (h *Histogram) writeSamples(w *bufio.Writer, name, labels string) {
+	var cum uint64
+	for i, ub := range h.buckets {
+		cum += h.counts[i].Load()
+		writeSample(w, name+"_bucket", joinLabels(labels, `le="`+formatFloat(ub)+`"`), float64(cum))
+	}
+	cum += h.counts[len(h.buckets)].Load()
+	writeSample(w, name+"_bucket", joinLabels(labels, `le="+Inf"`), float64(cum))
+	writeSample(w, name+"_sum", labels, math.Float64frombits(h.sumBits.Load()))
+	writeSample(w, name+"_count", labels, float64(cum))
+}
+
+type singleHistogram struct {
+	name, help string
+	*Histogram
+}
+
+func (r *PromRegistry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &singleHistogram{name: name, help: help, Histogram: newHistogram(buckets)}
+	r.register(h)
+	return h.Histogram
+}
+
+func (h *singleHistogram) family() string { return h.name }
+
+func (h *singleHistogram) writeProm(w *bufio.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.writeSamples(w, h.name, "")
+}
+
+// HistogramVec is a histogram split by a fixed set of labels.
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu       sync.RWMutex
+	children map[string]*Histogram // keyed by the rendered label set
+}
+
+func (r *PromRegistry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := &HistogramVec{
+		name:     name,
+		help:     help,
+		labels:   labels,
+		buckets:  buckets,
+		children: make(map[string]*Histogram),
+	}
+	r.register(v)
+	return v
+}
+
+// WithLabelValues returns the histogram for the given label values, in the
+// order the labels were declared.
+func (v *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	var sb strings.Builder
+	for i, l := range v.labels {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		val := ""
+		if i < len(values) {
+			val = values[i]
+		}
+		sb.WriteString(l + `="` + escapeLabel(val) + `"`)
+	}
+	key := sb.String()
+
+	v.mu.RLock()
+	h, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return h
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if h, ok = v.children[key]; !ok {
+		h = newHistogram(v.buckets)
+		v.children[key] = h
+	}
+	return h
+}
+
+func (v *HistogramVec) family() string { return v.name }
+
+func (v *HistogramVec) writeProm(w *bufio.Writer) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	v.mu.RUnlock()
+	sort.Strings(keys)
+
+	writeHeader(w, v.name, v.help, "histogram")
+	for _, k := range keys {
+		v.mu.RLock()
+		h := v.children[k]
+		v.mu.RUnlock()
+		h.writeSamples(w, v.name, k)
+	}
+}
+
+// ===== Text format helpers =====
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	w.WriteString("# HELP " + name + " " + strings.ReplaceAll(help, "\n", " ") + "\n")
+	w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+func writeSample(w *bufio.Writer, name, labels string, v float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeLabel(s string) string {
+	if !strings.ContainsAny(s, "\\\"\n") {
+		return s
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
@@ -0,0 +1,80 @@
+package sixpaths_kvs
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPromRegistryTextFormat(t *testing.T) {
+	r := NewPromRegistry()
+	c := r.NewCounter("test_total", "A counter.")
+	h := r.NewHistogramVec("test_seconds", "A histogram.", []float64{0.1, 1}, "route")
+	c.Add(3)
+	h.WithLabelValues(`/a"b`).Observe(0.05)
+	h.WithLabelValues(`/a"b`).Observe(0.5)
+	h.WithLabelValues(`/a"b`).Observe(5)
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	want := `# HELP test_total A counter.
+# TYPE test_total counter
+test_total 3
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{route="/a\"b",le="0.1"} 1
+test_seconds_bucket{route="/a\"b",le="1"} 2
+test_seconds_bucket{route="/a\"b",le="+Inf"} 3
+test_seconds_sum{route="/a\"b"} 5.55
+test_seconds_count{route="/a\"b"} 3
+`
+	if buf.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestNodePromMetrics(t *testing.T) {
+	n, err := OpenNode(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	defer n.Close()
+
+	for i, kv := range [][2]string{{"a", "12"}, {"b", "345"}, {"a", "6"}} {
+		if _, err := n.Exec(Command{Instruct: CmdPut, ClientID: "c1", Seq: uint64(i + 1), Key: []byte(kv[0]), Value: []byte(kv[1])}); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+	}
+	if keys, size := n.store.Stats(); keys != 2 || size != int64(len("a6b345")) {
+		t.Fatalf("Stats = %d keys, %d bytes", keys, size)
+	}
+
+	h := NewHTTPServer(n, "")
+	for _, path := range []string{"/get?key=a", "/metrics/prometheus"} {
+		w := httptest.NewRecorder()
+		h.srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", path, w.Code)
+		}
+		if path != "/metrics/prometheus" {
+			continue
+		}
+		out := w.Body.String()
+		for _, line := range []string{
+			"sixpaths_store_keys 2\n",
+			"sixpaths_store_bytes 6\n",
+			"sixpaths_wal_records 3\n",
+			"sixpaths_wal_fsync_duration_seconds_count 3\n",
+			`sixpaths_http_request_duration_seconds_count{route="/get",method="GET",status="200"} 1` + "\n",
+			"# TYPE sixpaths_wal_replay_duration_seconds gauge\n",
+		} {
+			if !strings.Contains(out, line) {
+				t.Fatalf("metrics output is missing %q:\n%s", line, out)
+			}
+		}
+	}
+}
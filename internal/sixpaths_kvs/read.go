@@ -0,0 +1,158 @@
+package sixpaths_kvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// read.go implements reads with a selectable consistency level.
+//
+// Every key has exactly one copy in this cluster, on the node that owns its
+// shard, so that node is both the "leader" and the only "replica" for it.
+// A plain read of the store already reflects every acknowledged write there,
+// the levels below spell out the ordering a read is guaranteed, so callers
+// can keep asking for the same thing once shards have followers:
+//   - linearizable: read-index. We take the index of the last logged write
+//     (which waits out any write in flight) and read once it's applied.
+//   - sequential: at least the last write of the reading client is applied.
+//   - stale: whatever the store holds right now, never waits.
+//
+// On top of any level, a read can carry a minIndex token (the logIndex of an
+// earlier write, or of an earlier read) and then waits until the node has
+// applied at least that index, so a client always sees its own writes.
+
+type ReadConsistency uint8
+
+const (
+	ReadStale        ReadConsistency = iota // = 0, the behaviour /get always had
+	ReadSequential                          // = 1
+	ReadLinearizable                        // = 2
+)
+
+// how long a read waits for the index it needs before giving up
+const DefaultReadTimeout = 2 * time.Second
+
+var ErrReadTimeout = errors.New("error: timed out waiting for the node to apply the index this read needs")
+
+func (c ReadConsistency) String() string {
+	switch c {
+	case ReadStale:
+		return "stale"
+	case ReadSequential:
+		return "sequential"
+	case ReadLinearizable:
+		return "linearizable"
+	default:
+		return fmt.Sprintf("ReadConsistency(%d)", uint8(c))
+	}
+}
+
+// ParseReadConsistency maps a query parameter onto a level, "" means stale.
+func ParseReadConsistency(s string) (ReadConsistency, error) {
+	switch s {
+	case "", "stale":
+		return ReadStale, nil
+	case "sequential":
+		return ReadSequential, nil
+	case "linearizable":
+		return ReadLinearizable, nil
+	default:
+		return 0, fmt.Errorf("error: unknown consistency %q, expected linearizable, sequential or stale", s)
+	}
+}
+
+type ReadOptions struct {
+	Consistency ReadConsistency
+	ClientID    string // whose writes a sequential read must see
+	MinIndex    uint64 // read-your-writes token: the read waits until this index is applied
+}
+
+// Read returns the value at key once the node is far enough along for the
+// requested consistency, along with the applied index the read saw (a later
+// read passing it as MinIndex sees at least as much). ctx bounds the wait,
+// without a deadline we use DefaultReadTimeout.
+func (n *Node) Read(ctx context.Context, key string, opts ReadOptions) ([]byte, uint64, error) {
+	if err := n.waitForRead(ctx, opts); err != nil {
+		return nil, 0, err
+	}
+	applied := n.store.LastApplied()
+	val, err := n.store.Get(key)
+	return val, applied, err
+}
+
+// waits until the node is far enough along for a read with opts
+func (n *Node) waitForRead(ctx context.Context, opts ReadOptions) error {
+	var idx uint64
+	switch opts.Consistency {
+	case ReadLinearizable:
+		// n.mu is held across a whole Exec, so once we get it every write
+		// that was acknowledged before this read started is in the log
+		idx = n.LastIndex()
+	case ReadSequential:
+		idx = n.store.clientLastIndex(opts.ClientID)
+	case ReadStale:
+	default:
+		return fmt.Errorf("error: unknown consistency %d", opts.Consistency)
+	}
+
+	if opts.MinIndex > idx {
+		idx = opts.MinIndex
+	}
+
+	wait := startPhase(ctx, "store.read_wait", PhaseReadWait)
+	err := n.store.waitApplied(ctx, idx)
+	wait.end(err)
+	return err
+}
+
+// blocks until index idx is applied, or ctx is done
+func (store *Store) waitApplied(ctx context.Context, idx uint64) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultReadTimeout)
+		defer cancel()
+	}
+
+	for {
+		store.mu.RLock()
+		last, ch := store.lastlogi, store.appliedCh
+		store.mu.RUnlock()
+
+		if last >= idx {
+			return nil
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return ErrReadTimeout
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// wakes everyone in waitApplied, the caller holds store.mu
+func (store *Store) notifyAppliedLocked() {
+	close(store.appliedCh)
+	store.appliedCh = make(chan struct{})
+}
+
+// the log index of the latest write of clientID we still remember
+func (store *Store) clientLastIndex(clientID string) uint64 {
+	if clientID == "" {
+		return 0
+	}
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var idx uint64
+	for _, e := range store.dedupMap[clientID].window {
+		if e.result.LogIndex > idx {
+			idx = e.result.LogIndex
+		}
+	}
+	return idx
+}
@@ -0,0 +1,126 @@
+package sixpaths_kvs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReadConsistencyLevels(t *testing.T) {
+	n, err := OpenNode(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	defer n.Close()
+
+	if _, err := n.Exec(Command{Instruct: CmdPut, ClientID: "c1", Seq: 1, Key: []byte("k"), Value: []byte("v1")}); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	for _, level := range []ReadConsistency{ReadStale, ReadSequential, ReadLinearizable} {
+		v, _, err := n.Read(context.Background(), "k", ReadOptions{Consistency: level, ClientID: "c1"})
+		if err != nil || string(v) != "v1" {
+			t.Fatalf("%s read = %q, %v", level, v, err)
+		}
+	}
+
+	if _, err := ParseReadConsistency("eventual"); err == nil {
+		t.Fatalf("ParseReadConsistency accepted an unknown level")
+	}
+	if _, _, err := n.Read(context.Background(), "k", ReadOptions{Consistency: 9}); err == nil {
+		t.Fatalf("Read accepted an unknown level")
+	}
+}
+
+func TestLinearizableReadWaitsForWriteInFlight(t *testing.T) {
+	n, err := OpenNode(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	defer n.Close()
+
+	// we play a write that has been logged but not applied yet
+	n.mu.Lock()
+	n.last++
+	idx := n.last
+	cmd := Command{Instruct: CmdPut, ClientID: "c1", Seq: 1, Key: []byte("k"), Value: []byte("v1")}
+	if err := n.wal.Append(&Record{LogIndex: idx, Cmd: cmd}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	got := make(chan string, 1)
+	go func() {
+		v, _, _ := n.Read(context.Background(), "k", ReadOptions{Consistency: ReadLinearizable})
+		got <- string(v)
+	}()
+
+	// a stale read doesn't wait, and doesn't see the write either
+	if v, _, err := n.Read(context.Background(), "k", ReadOptions{Consistency: ReadStale}); err == nil {
+		t.Fatalf("stale read saw %q before the write was applied", v)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if _, err := n.store.Apply(cmd, idx); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	n.mu.Unlock()
+
+	select {
+	case v := <-got:
+		if v != "v1" {
+			t.Fatalf("linearizable read = %q, want v1", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("linearizable read never returned")
+	}
+}
+
+func TestWaitAppliedTimesOut(t *testing.T) {
+	s, err := NewStore()
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.waitApplied(ctx, 5); !errors.Is(err, ErrReadTimeout) {
+		t.Fatalf("waitApplied = %v, want ErrReadTimeout", err)
+	}
+}
+
+func TestReadWaitsForMinIndex(t *testing.T) {
+	n, err := OpenNode(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	defer n.Close()
+
+	// a token from the future times out
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := n.Read(ctx, "k", ReadOptions{MinIndex: 1}); !errors.Is(err, ErrReadTimeout) {
+		t.Fatalf("read ahead of the log: err = %v, want ErrReadTimeout", err)
+	}
+
+	// and is served as soon as the write lands
+	got := make(chan uint64, 1)
+	go func() {
+		v, applied, err := n.Read(context.Background(), "k", ReadOptions{MinIndex: 1})
+		if err != nil || string(v) != "v1" {
+			t.Errorf("read with minIndex = %q, %v", v, err)
+		}
+		got <- applied
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := n.Exec(Command{Instruct: CmdPut, ClientID: "c1", Seq: 1, Key: []byte("k"), Value: []byte("v1")}); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	select {
+	case applied := <-got:
+		if applied < 1 {
+			t.Fatalf("read reported applied index %d, want >= 1", applied)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("read with minIndex never returned")
+	}
+}
@@ -0,0 +1,913 @@
+package sixpaths_kvs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rpc.go implements a compact binary protocol for node and router traffic.
+// Instead of JSON over a fresh HTTP request per operation, peers keep a
+// persistent TCP connection open and exchange length-prefixed frames.
+// Every frame carries a request ID so many requests can be in flight
+// (pipelined) on one connection and answered in any order.
+
+// The field layout reuses the style of the WAL's Encode():
+// frame    = [u32 frameLen][body]
+// request  = [u64 reqID][u8 op][u8 clientIDlen][clientID bytes][u64 seq]
+// cont.      [u16 keyLen][key bytes][u32 valLen][value bytes]
+// cont.      [u8 consistency][u64 minIndex][u8 requestIDLen][requestID bytes]
+// cont.      [u8 traceparentLen][traceparent bytes]
+// response = [u64 reqID][u8 status][u8 success][u64 logIndex]
+// cont.      [u32 valLen][value bytes][u16 errLen][err bytes]
+
+// both sides send this right after connecting so we never talk to
+// something that isn't speaking our protocol.
+var rpcMagic = []byte("SPKRPC1\x00")
+
+// largest frame we accept. a put over HTTP is at most 1MB and bigger values
+// are streamed in chunks, so anything near this is a broken or hostile peer,
+// and we don't want to allocate whatever a length header asks for.
+const rpcMaxFrame = 16 << 20
+
+// how long the server waits for a peer to take a response off the socket
+const rpcWriteTimeout = 10 * time.Second
+
+// default number of requests a single connection may have in flight.
+// once a peer reaches it we stop reading from its socket, which pushes
+// back on the sender through TCP flow control.
+const rpcDefaultInflight = 128
+
+type RPCOp uint8
+
+const (
+	OpUnknown RPCOp = iota
+	OpPut
+	OpDelete
+	OpGet
+	OpHealth
+	OpRegisterSession // Value is the TTL in ms (u64), the response Value is the session ID
+	OpKeepAlive       // ClientID is the session
+)
+
+func (op RPCOp) String() string {
+	switch op {
+	case OpPut:
+		return "put"
+	case OpDelete:
+		return "delete"
+	case OpGet:
+		return "get"
+	case OpHealth:
+		return "health"
+	case OpRegisterSession:
+		return "register_session"
+	case OpKeepAlive:
+		return "keepalive"
+	}
+	return fmt.Sprintf("op%d", uint8(op))
+}
+
+type RPCStatus uint8
+
+const (
+	StatusOK RPCStatus = iota
+	StatusNotFound
+	StatusBadRequest
+	StatusError
+	StatusConflict
+	StatusGone        // the client's session has expired
+	StatusUnavailable // the node couldn't serve the request in time
+	StatusDiskFull    // the node is short on disk space, see ErrDiskFull
+)
+
+func (st RPCStatus) String() string {
+	switch st {
+	case StatusOK:
+		return "ok"
+	case StatusNotFound:
+		return "not_found"
+	case StatusBadRequest:
+		return "bad_request"
+	case StatusError:
+		return "error"
+	case StatusConflict:
+		return "conflict"
+	case StatusGone:
+		return "gone"
+	case StatusUnavailable:
+		return "unavailable"
+	case StatusDiskFull:
+		return "disk_full"
+	}
+	return fmt.Sprintf("status%d", uint8(st))
+}
+
+type RPCRequest struct {
+	ID       uint64
+	Op       RPCOp
+	ClientID string
+	Seq      uint64
+	Key      []byte
+	Value    []byte
+
+	// optional trailing fields, a frame may end before them
+	Consistency ReadConsistency // for OpGet
+	MinIndex    uint64          // for OpGet, see ReadOptions.MinIndex
+	RequestID   string          // for logging, see logging.go
+	Traceparent string          // W3C trace context, see trace.go
+}
+
+type RPCResponse struct {
+	ID       uint64
+	Status   RPCStatus
+	Success  bool
+	LogIndex uint64
+	Value    []byte // value for gets, previous value for writes
+	Err      string
+}
+
+var ErrRPCClosed = errors.New("rpc: connection closed")
+
+// ===== Encoding =====
+
+func encodeRPCRequest(req *RPCRequest) ([]byte, error) {
+	if len(req.ClientID) > math.MaxUint8 {
+		return nil, errors.New("invalid ClientID length, exceeds 8 bits")
+	}
+	if len(req.Key) > math.MaxUint16 {
+		return nil, errors.New("invalid key, length exceeds 16 bits")
+	}
+	if uint64(len(req.Value)) > math.MaxUint32 {
+		return nil, errors.New("invalid value, length exceeds 32 bits")
+	}
+	if len(req.RequestID) > math.MaxUint8 {
+		return nil, errors.New("invalid RequestID length, exceeds 8 bits")
+	}
+	if len(req.Traceparent) > math.MaxUint8 {
+		return nil, errors.New("invalid Traceparent length, exceeds 8 bits")
+	}
+
+	body := make([]byte, 0, 34+len(req.ClientID)+len(req.Key)+len(req.Value)+len(req.RequestID)+len(req.Traceparent))
+	body = binary.BigEndian.AppendUint64(body, req.ID)
+	body = append(body, uint8(req.Op))
+	body = append(body, uint8(len(req.ClientID)))
+	body = append(body, req.ClientID...)
+	body = binary.BigEndian.AppendUint64(body, req.Seq)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(req.Key)))
+	body = append(body, req.Key...)
+	body = binary.BigEndian.AppendUint32(body, uint32(len(req.Value)))
+	body = append(body, req.Value...)
+	body = append(body, uint8(req.Consistency))
+	body = binary.BigEndian.AppendUint64(body, req.MinIndex)
+	body = append(body, uint8(len(req.RequestID)))
+	body = append(body, req.RequestID...)
+	body = append(body, uint8(len(req.Traceparent)))
+	body = append(body, req.Traceparent...)
+
+	if len(body) > rpcMaxFrame {
+		return nil, fmt.Errorf("error: request of %d bytes exceeds the rpc frame limit of %d, stream large values", len(body), rpcMaxFrame)
+	}
+	return rpcFrame(body), nil
+}
+
+func encodeRPCResponse(resp *RPCResponse) []byte {
+	// the peer would refuse the frame and drop the connection
+	if 26+len(resp.Value) > rpcMaxFrame {
+		resp = &RPCResponse{ID: resp.ID, Status: StatusError, Err: fmt.Sprintf("error: value of %d bytes exceeds the rpc frame limit, read it with /stream", len(resp.Value))}
+	}
+	errMsg := resp.Err
+	if len(errMsg) > math.MaxUint16 {
+		errMsg = errMsg[:math.MaxUint16]
+	}
+
+	body := make([]byte, 0, 26+len(resp.Value)+len(errMsg))
+	body = binary.BigEndian.AppendUint64(body, resp.ID)
+	body = append(body, uint8(resp.Status))
+	if resp.Success {
+		body = append(body, 1)
+	} else {
+		body = append(body, 0)
+	}
+	body = binary.BigEndian.AppendUint64(body, resp.LogIndex)
+	body = binary.BigEndian.AppendUint32(body, uint32(len(resp.Value)))
+	body = append(body, resp.Value...)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(errMsg)))
+	body = append(body, errMsg...)
+
+	return rpcFrame(body)
+}
+
+// prefixes body with its length
+func rpcFrame(body []byte) []byte {
+	frame := make([]byte, 0, 4+len(body))
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(body)))
+	return append(frame, body...)
+}
+
+// rpcReader walks a frame body field by field, the same way Decode() does
+// with its need() helper.
+type rpcReader struct {
+	buf []byte
+	off int
+	err error
+}
+
+func (r *rpcReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf)-r.off < n {
+		r.err = fmt.Errorf("rpc: frame is too short, %d more bytes are needed. (off=%d, len=%d)", n, r.off, len(r.buf))
+		return nil
+	}
+	b := r.buf[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *rpcReader) u8() uint8 {
+	b := r.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *rpcReader) u16() uint16 {
+	b := r.take(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *rpcReader) u32() uint32 {
+	b := r.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *rpcReader) u64() uint64 {
+	b := r.take(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// returns a copy so the caller can keep it after the frame buffer is reused
+func (r *rpcReader) bytes(n int) []byte {
+	b := r.take(n)
+	if b == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+func decodeRPCRequest(body []byte) (RPCRequest, error) {
+	r := rpcReader{buf: body}
+	var req RPCRequest
+
+	req.ID = r.u64()
+	req.Op = RPCOp(r.u8())
+	req.ClientID = string(r.bytes(int(r.u8())))
+	req.Seq = r.u64()
+	req.Key = r.bytes(int(r.u16()))
+	req.Value = r.bytes(int(r.u32()))
+
+	// frames from older peers stop here, or after the consistency byte
+	if r.err == nil && r.off < len(r.buf) {
+		req.Consistency = ReadConsistency(r.u8())
+	}
+	if r.err == nil && r.off < len(r.buf) {
+		req.MinIndex = r.u64()
+	}
+	if r.err == nil && r.off < len(r.buf) {
+		req.RequestID = string(r.bytes(int(r.u8())))
+	}
+	if r.err == nil && r.off < len(r.buf) {
+		req.Traceparent = string(r.bytes(int(r.u8())))
+	}
+
+	if r.err != nil {
+		return RPCRequest{}, r.err
+	}
+	return req, nil
+}
+
+func decodeRPCResponse(body []byte) (RPCResponse, error) {
+	r := rpcReader{buf: body}
+	var resp RPCResponse
+
+	resp.ID = r.u64()
+	resp.Status = RPCStatus(r.u8())
+	resp.Success = r.u8() == 1
+	resp.LogIndex = r.u64()
+	resp.Value = r.bytes(int(r.u32()))
+	resp.Err = string(r.bytes(int(r.u16())))
+
+	if r.err != nil {
+		return RPCResponse{}, r.err
+	}
+	return resp, nil
+}
+
+// reads one length-prefixed frame body off the wire
+func readRPCFrame(br *bufio.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > rpcMaxFrame {
+		return nil, fmt.Errorf("rpc: frameLen %d overflows", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// exchanges the protocol magic on a fresh connection
+func rpcHandshake(conn net.Conn, rw *bufio.ReadWriter) error {
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := rw.Write(rpcMagic); err != nil {
+		return err
+	}
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+	got := make([]byte, len(rpcMagic))
+	if _, err := io.ReadFull(rw, got); err != nil {
+		return err
+	}
+	if !bytes.Equal(got, rpcMagic) {
+		return fmt.Errorf("rpc: bad handshake: expected %q", rpcMagic)
+	}
+	return nil
+}
+
+// ===== Server =====
+
+// RPCHandler answers a single decoded request. Nodes and the router each
+// provide one so they can share the same server.
+type RPCHandler interface {
+	ServeRPC(ctx context.Context, req *RPCRequest) *RPCResponse
+}
+
+type RPCServer struct {
+	addr        string
+	handler     RPCHandler
+	maxInflight int
+
+	mu     sync.Mutex
+	ln     net.Listener
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func NewRPCServer(handler RPCHandler, addr string) *RPCServer {
+	return &RPCServer{
+		addr:        addr,
+		handler:     handler,
+		maxInflight: rpcDefaultInflight,
+		conns:       make(map[net.Conn]struct{}),
+	}
+}
+
+// starts listening on s.addr and serves connections until Shutdown
+func (s *RPCServer) Start() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+func (s *RPCServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = ln.Close()
+		return ErrRPCClosed
+	}
+	s.ln = ln
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrRPCClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// stops accepting, closes open connections and waits for handlers to finish
+func (s *RPCServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	if s.ln != nil {
+		_ = s.ln.Close()
+	}
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *RPCServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	rw := bufio.NewReadWriter(bufio.NewReaderSize(conn, 64<<10), bufio.NewWriterSize(conn, 64<<10))
+	if err := rpcHandshake(conn, rw); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// responses are funneled through a single writer goroutine so frames
+	// never interleave on the socket.
+	out := make(chan []byte, s.maxInflight)
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for fr := range out {
+			// a peer that stops reading doesn't get to hold the writer forever
+			_ = conn.SetWriteDeadline(time.Now().Add(rpcWriteTimeout))
+			if _, err := rw.Write(fr); err != nil {
+				_ = conn.Close()
+				continue
+			}
+			// only flush once we've drained what's queued, so pipelined
+			// responses get batched into fewer syscalls.
+			if len(out) == 0 {
+				if err := rw.Flush(); err != nil {
+					_ = conn.Close()
+				}
+			}
+		}
+	}()
+
+	// the semaphore bounds in-flight requests on this connection
+	sem := make(chan struct{}, s.maxInflight)
+	var inflight sync.WaitGroup
+
+	for {
+		body, err := readRPCFrame(rw.Reader)
+		if err != nil {
+			break
+		}
+		req, err := decodeRPCRequest(body)
+		if err != nil {
+			break
+		}
+
+		sem <- struct{}{}
+		inflight.Add(1)
+		go func(req RPCRequest) {
+			defer func() {
+				<-sem
+				inflight.Done()
+			}()
+			resp := s.handler.ServeRPC(ctx, &req)
+			resp.ID = req.ID
+			out <- encodeRPCResponse(resp)
+		}(req)
+	}
+
+	cancel()
+	inflight.Wait()
+	close(out)
+	<-writerDone
+}
+
+// NodeRPCHandler serves the binary protocol for a single KV node.
+type NodeRPCHandler struct {
+	node *Node
+}
+
+func NewNodeRPCHandler(node *Node) *NodeRPCHandler {
+	return &NodeRPCHandler{node: node}
+}
+
+func (h *NodeRPCHandler) ServeRPC(ctx context.Context, req *RPCRequest) *RPCResponse {
+	ctx = ContextWithRequestID(ctx, req.RequestID)
+	ctx, span := h.node.tracer.Start(ContextWithTraceparent(ctx, req.Traceparent), "node.rpc "+req.Op.String(), SpanKindServer)
+	defer span.End()
+	ctx, op := h.node.inspect.Begin(ctx, "rpc", req.Op.String())
+	SetOpKey(ctx, string(req.Key))
+
+	resp := h.serveRPC(ctx, req)
+	op.Finish(resp.Status.String())
+	span.SetAttr("rpc.status", int(resp.Status))
+	if resp.Err != "" {
+		span.SetError(errors.New(resp.Err))
+	}
+	return resp
+}
+
+func (h *NodeRPCHandler) serveRPC(ctx context.Context, req *RPCRequest) *RPCResponse {
+	switch req.Op {
+	case OpPut, OpDelete:
+		// same input validation as the HTTP handlers
+		if req.ClientID == "" || req.Seq == 0 || len(req.Key) == 0 {
+			return &RPCResponse{Status: StatusBadRequest, Err: "missing client/seq/key"}
+		}
+		cmd := Command{
+			Instruct: CmdPut,
+			ClientID: req.ClientID,
+			Seq:      req.Seq,
+			Key:      req.Key,
+			Value:    req.Value,
+		}
+		if req.Op == OpDelete {
+			cmd.Instruct = CmdDelete
+			cmd.Value = nil
+		}
+		res, err := h.node.ExecContext(ctx, cmd)
+		if err != nil {
+			return execErrResponse(err)
+		}
+
+		return &RPCResponse{
+			Status:   StatusOK,
+			Success:  res.Success,
+			LogIndex: res.LogIndex,
+			Value:    res.PrevValue,
+		}
+
+	case OpGet:
+		if len(req.Key) == 0 {
+			return &RPCResponse{Status: StatusBadRequest, Err: "missing key"}
+		}
+		val, applied, err := h.node.Read(ctx, string(req.Key), ReadOptions{
+			Consistency: req.Consistency,
+			ClientID:    req.ClientID,
+			MinIndex:    req.MinIndex,
+		})
+		if err != nil {
+			if errors.Is(err, ErrChunkedValue) {
+				return &RPCResponse{Status: StatusConflict, Err: err.Error()}
+			}
+			if errors.Is(err, ErrReadTimeout) {
+				return &RPCResponse{Status: StatusUnavailable, Err: err.Error()}
+			}
+			if !errors.Is(err, errNotFound) {
+				return &RPCResponse{Status: StatusError, Err: err.Error()}
+			}
+			return &RPCResponse{Status: StatusNotFound, Err: err.Error()}
+		}
+		return &RPCResponse{Status: StatusOK, Success: true, Value: val, LogIndex: applied}
+
+	case OpHealth:
+		// a read-only node (or one short on disk) is up but can't take
+		// writes, Err says why
+		err := h.node.ReadOnly()
+		if err == nil {
+			err = h.node.DiskLow()
+		}
+		if err != nil {
+			return &RPCResponse{Status: StatusOK, LogIndex: h.node.LastIndex(), Err: err.Error()}
+		}
+		return &RPCResponse{Status: StatusOK, Success: true, LogIndex: h.node.LastIndex()}
+
+	case OpRegisterSession:
+		res, err := h.node.RegisterSessionContext(ctx, decodeSessionTTL(req.Value))
+		if err != nil {
+			return execErrResponse(err)
+		}
+		return &RPCResponse{Status: StatusOK, Success: true, LogIndex: res.LogIndex, Value: []byte(res.SessionID)}
+
+	case OpKeepAlive:
+		if req.ClientID == "" {
+			return &RPCResponse{Status: StatusBadRequest, Err: "missing session"}
+		}
+		res, err := h.node.KeepAliveContext(ctx, req.ClientID)
+		if err == nil && !res.Success {
+			err = ErrSessionExpired
+		}
+		if err != nil {
+			return execErrResponse(err)
+		}
+		return &RPCResponse{Status: StatusOK, Success: true, LogIndex: res.LogIndex, Value: []byte(res.SessionID)}
+
+	default:
+		return &RPCResponse{Status: StatusBadRequest, Err: fmt.Sprintf("unknown op %d", req.Op)}
+	}
+}
+
+// maps an Exec() error onto a response, the same way execErrStatus does for HTTP
+func execErrResponse(err error) *RPCResponse {
+	switch execErrStatus(err) {
+	case http.StatusBadRequest:
+		return &RPCResponse{Status: StatusBadRequest, Err: err.Error()}
+	case http.StatusGone:
+		return &RPCResponse{Status: StatusGone, Err: err.Error()}
+	case http.StatusConflict:
+		return &RPCResponse{Status: StatusConflict, Err: err.Error()}
+	case http.StatusServiceUnavailable:
+		return &RPCResponse{Status: StatusUnavailable, Err: err.Error()}
+	case http.StatusInsufficientStorage:
+		return &RPCResponse{Status: StatusDiskFull, Err: err.Error()}
+	default:
+		return &RPCResponse{Status: StatusError, Err: err.Error()}
+	}
+}
+
+// EncodeSessionTTL builds the Value of an OpRegisterSession request.
+func EncodeSessionTTL(ttl time.Duration) []byte {
+	return encodeSessionTTL(ttl)
+}
+
+// ===== Client =====
+
+// RPCClient keeps one persistent, multiplexed connection to a peer.
+// Any number of goroutines can call Do concurrently; their requests are
+// pipelined on the same socket and matched back up by request ID.
+// If the connection breaks, the next call dials a new one.
+type RPCClient struct {
+	addr        string
+	dialTimeout time.Duration
+	sem         chan struct{} // bounds our own in-flight requests
+
+	mu      sync.Mutex
+	conn    *rpcConn
+	nextID  uint64
+	closed  bool
+	dialing chan struct{}
+}
+
+type rpcConn struct {
+	c       net.Conn
+	rw      *bufio.ReadWriter
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint64]chan RPCResponse
+	err     error
+}
+
+func NewRPCClient(addr string) *RPCClient {
+	return &RPCClient{
+		addr:        addr,
+		dialTimeout: 2 * time.Second,
+		sem:         make(chan struct{}, rpcDefaultInflight),
+	}
+}
+
+func (c *RPCClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.conn != nil {
+		c.conn.fail(ErrRPCClosed)
+		c.conn = nil
+	}
+	return nil
+}
+
+// sends req and waits for its response, the context's deadline or
+// cancellation, whichever comes first.
+func (c *RPCClient) Do(ctx context.Context, req *RPCRequest) (*RPCResponse, error) {
+	// backpressure: wait for a free slot before putting more on the wire
+	select {
+	case c.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-c.sem }()
+
+	conn, id, err := c.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r := *req
+	r.ID = id
+	fr, err := encodeRPCRequest(&r)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan RPCResponse, 1)
+	if err := conn.register(id, ch); err != nil {
+		c.dropConn(conn)
+		return nil, err
+	}
+
+	if err := conn.write(ctx, fr); err != nil {
+		conn.fail(err)
+		c.dropConn(conn)
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			c.dropConn(conn)
+			return nil, conn.failure()
+		}
+		return &resp, nil
+	case <-ctx.Done():
+		conn.unregister(id)
+		return nil, ctx.Err()
+	}
+}
+
+func (c *RPCClient) getConn(ctx context.Context) (*rpcConn, uint64, error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return nil, 0, ErrRPCClosed
+		}
+		if c.conn != nil {
+			c.nextID++
+			conn, id := c.conn, c.nextID
+			c.mu.Unlock()
+			return conn, id, nil
+		}
+		// someone else is already dialing, wait for them
+		if c.dialing != nil {
+			wait := c.dialing
+			c.mu.Unlock()
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return nil, 0, ctx.Err()
+			}
+		}
+		c.dialing = make(chan struct{})
+		c.mu.Unlock()
+
+		conn, err := c.dial(ctx)
+
+		c.mu.Lock()
+		close(c.dialing)
+		c.dialing = nil
+		if err != nil {
+			c.mu.Unlock()
+			return nil, 0, err
+		}
+		c.conn = conn
+		c.mu.Unlock()
+	}
+}
+
+func (c *RPCClient) dial(ctx context.Context) (*rpcConn, error) {
+	d := net.Dialer{Timeout: c.dialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	rw := bufio.NewReadWriter(bufio.NewReaderSize(nc, 64<<10), bufio.NewWriterSize(nc, 64<<10))
+	if err := rpcHandshake(nc, rw); err != nil {
+		_ = nc.Close()
+		return nil, err
+	}
+	conn := &rpcConn{
+		c:       nc,
+		rw:      rw,
+		pending: make(map[uint64]chan RPCResponse),
+	}
+	go conn.readLoop()
+	return conn, nil
+}
+
+// forgets conn so the next call redials, unless it was already replaced
+func (c *RPCClient) dropConn(conn *rpcConn) {
+	c.mu.Lock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	c.mu.Unlock()
+}
+
+func (rc *rpcConn) register(id uint64, ch chan RPCResponse) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.err != nil {
+		return rc.err
+	}
+	rc.pending[id] = ch
+	return nil
+}
+
+func (rc *rpcConn) unregister(id uint64) {
+	rc.mu.Lock()
+	delete(rc.pending, id)
+	rc.mu.Unlock()
+}
+
+func (rc *rpcConn) failure() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.err
+}
+
+// a write stops at ctx's deadline or cancellation, the caller then fails the
+// connection since part of the frame may be on the wire
+func (rc *rpcConn) write(ctx context.Context, fr []byte) error {
+	rc.writeMu.Lock()
+	defer rc.writeMu.Unlock()
+	dl, _ := ctx.Deadline()
+	_ = rc.c.SetWriteDeadline(dl)
+	stop := context.AfterFunc(ctx, func() { _ = rc.c.SetWriteDeadline(time.Unix(1, 0)) })
+	defer stop()
+	if _, err := rc.rw.Write(fr); err != nil {
+		return err
+	}
+	return rc.rw.Flush()
+}
+
+// marks the connection dead and wakes up every waiting caller
+func (rc *rpcConn) fail(err error) {
+	rc.mu.Lock()
+	if rc.err == nil {
+		rc.err = err
+		for id, ch := range rc.pending {
+			close(ch)
+			delete(rc.pending, id)
+		}
+	}
+	rc.mu.Unlock()
+	_ = rc.c.Close()
+}
+
+func (rc *rpcConn) readLoop() {
+	for {
+		body, err := readRPCFrame(rc.rw.Reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = ErrRPCClosed
+			}
+			rc.fail(err)
+			return
+		}
+		resp, err := decodeRPCResponse(body)
+		if err != nil {
+			rc.fail(err)
+			return
+		}
+
+		rc.mu.Lock()
+		ch, ok := rc.pending[resp.ID]
+		delete(rc.pending, resp.ID)
+		rc.mu.Unlock()
+
+		// the caller may have given up already, in which case we just drop it
+		if ok {
+			ch <- resp
+		}
+	}
+}
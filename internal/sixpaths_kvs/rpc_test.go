@@ -0,0 +1,181 @@
+package sixpaths_kvs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRPCRequestRoundTrip(t *testing.T) {
+	in := RPCRequest{
+		ID:       42,
+		Op:       OpPut,
+		ClientID: "c1",
+		Seq:      7,
+		Key:      []byte("Alpha"),
+		Value:    []byte("Beta"),
+
+		Consistency: ReadLinearizable,
+		MinIndex:    99,
+		RequestID:   "req-1",
+		Traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	}
+	fr, err := encodeRPCRequest(&in)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	// strip the length prefix like readRPCFrame would
+	out, err := decodeRPCRequest(fr[4:])
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if out.ID != in.ID || out.Op != in.Op || out.ClientID != in.ClientID || out.Seq != in.Seq ||
+		!bytes.Equal(out.Key, in.Key) || !bytes.Equal(out.Value, in.Value) || out.Consistency != in.Consistency || out.MinIndex != in.MinIndex ||
+		out.RequestID != in.RequestID || out.Traceparent != in.Traceparent {
+		t.Fatalf("round trip mismatch: got %+v want %+v", out, in)
+	}
+
+	// frames without some or all of the optional trailing fields still decode
+	tpLen := 1 + len(in.Traceparent)
+	noTP, err := decodeRPCRequest(fr[4 : len(fr)-tpLen])
+	if err != nil || noTP.Traceparent != "" || noTP.RequestID != in.RequestID {
+		t.Fatalf("decoding frame without traceparent: %+v, %v", noTP, err)
+	}
+	idLen := tpLen + 1 + len(in.RequestID)
+	noID, err := decodeRPCRequest(fr[4 : len(fr)-idLen])
+	if err != nil || noID.RequestID != "" || noID.MinIndex != in.MinIndex {
+		t.Fatalf("decoding frame without request ID: %+v, %v", noID, err)
+	}
+	// peers from before read-your-writes tokens send the consistency alone
+	noMin, err := decodeRPCRequest(fr[4 : len(fr)-idLen-8])
+	if err != nil || noMin.Consistency != in.Consistency || noMin.MinIndex != 0 {
+		t.Fatalf("decoding frame without min index: %+v, %v", noMin, err)
+	}
+	old, err := decodeRPCRequest(fr[4 : len(fr)-idLen-9])
+	if err != nil || old.Consistency != ReadStale || !bytes.Equal(old.Value, in.Value) {
+		t.Fatalf("decoding frame without trailing fields: %+v, %v", old, err)
+	}
+
+	if _, err := decodeRPCRequest(fr[4 : len(fr)-tpLen-1]); err == nil {
+		t.Fatal("expected error decoding frame with a cut off request ID")
+	}
+	if _, err := decodeRPCRequest(fr[4 : len(fr)-idLen-10]); err == nil {
+		t.Fatal("expected error decoding truncated frame")
+	}
+}
+
+func startRPCNode(t *testing.T) (*Node, *RPCClient) {
+	t.Helper()
+
+	n, err := OpenNode(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := NewRPCServer(NewNodeRPCHandler(n), ln.Addr().String())
+	go func() { _ = srv.Serve(ln) }()
+
+	c := NewRPCClient(ln.Addr().String())
+	t.Cleanup(func() {
+		_ = c.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+		_ = n.Close()
+	})
+	return n, c
+}
+
+func TestRPCPutGetPipelined(t *testing.T) {
+	_, c := startRPCNode(t)
+	ctx := context.Background()
+
+	// many concurrent requests share the one connection
+	const writers = 32
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := c.Do(ctx, &RPCRequest{
+				Op:       OpPut,
+				ClientID: fmt.Sprintf("c%d", i),
+				Seq:      1,
+				Key:      []byte(fmt.Sprintf("k%d", i)),
+				Value:    []byte(fmt.Sprintf("v%d", i)),
+			})
+			if err != nil {
+				t.Errorf("put %d: %v", i, err)
+				return
+			}
+			if resp.Status != StatusOK || !resp.Success {
+				t.Errorf("put %d: status=%d err=%s", i, resp.Status, resp.Err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < writers; i++ {
+		resp, err := c.Do(ctx, &RPCRequest{Op: OpGet, Key: []byte(fmt.Sprintf("k%d", i))})
+		if err != nil {
+			t.Fatalf("get %d: %v", i, err)
+		}
+		if want := fmt.Sprintf("v%d", i); string(resp.Value) != want {
+			t.Fatalf("get %d: value=%q want %q", i, resp.Value, want)
+		}
+	}
+
+	resp, err := c.Do(ctx, &RPCRequest{Op: OpGet, Key: []byte("missing")})
+	if err != nil {
+		t.Fatalf("get missing: %v", err)
+	}
+	if resp.Status != StatusNotFound {
+		t.Fatalf("get missing: status=%d, want StatusNotFound", resp.Status)
+	}
+
+	resp, err = c.Do(ctx, &RPCRequest{Op: OpHealth})
+	if err != nil {
+		t.Fatalf("health: %v", err)
+	}
+	if resp.LogIndex != writers {
+		t.Fatalf("health lastIndex=%d, want %d", resp.LogIndex, writers)
+	}
+}
+
+func TestRPCFrameLimits(t *testing.T) {
+	// a length header alone can't make us allocate a huge buffer
+	var hdr bytes.Buffer
+	hdr.Write([]byte{0x40, 0, 0, 0}) // 1GB
+	if _, err := readRPCFrame(bufio.NewReader(&hdr)); err == nil {
+		t.Fatal("expected an oversized frame to be refused")
+	}
+	if _, err := encodeRPCRequest(&RPCRequest{Op: OpPut, Value: make([]byte, rpcMaxFrame)}); err == nil {
+		t.Fatal("expected an oversized request to be refused")
+	}
+
+	// a peer that never reads doesn't block the writer past the deadline
+	client, server := net.Pipe()
+	defer server.Close()
+	rc := &rpcConn{c: client, rw: bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client))}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- rc.write(ctx, []byte("stuck")) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("write to a peer that never reads succeeded")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("write ignored the context deadline")
+	}
+}
@@ -0,0 +1,100 @@
+package sixpaths_kvs
+
+import (
+	"context"
+	"strings"
+)
+
+// scan.go implements range reads over the keys of one node.
+// A scan walks the engine in key order from just after the After key, so a
+// page costs about the same wherever it is in the prefix, and never sees
+// half of a concurrent write. Each call returns at most Limit entries, plus
+// whether there are more.
+// Scans wait for the same consistency levels and minIndex tokens as reads.
+
+// used when a scan asks for no particular limit, and the most it may ask for
+const (
+	DefaultScanLimit = 100
+	MaxScanLimit     = 1000
+)
+
+type ScanOptions struct {
+	ReadOptions
+	Prefix string // only keys starting with Prefix
+	After  string // only keys after this one, for the next page
+	Limit  int    // at most this many entries, <= 0 means DefaultScanLimit
+}
+
+// ScanEntry is one key of a scan. Streamed values aren't returned inline,
+// only their size.
+type ScanEntry struct {
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+	Streamed bool   `json:"streamed,omitempty"`
+	Size     uint64 `json:"size"`
+}
+
+// Scan returns the next page of keys for opts, whether there are more, and
+// the applied index the scan saw (usable as a MinIndex token).
+func (n *Node) Scan(ctx context.Context, opts ScanOptions) ([]ScanEntry, bool, uint64, error) {
+	if err := n.waitForRead(ctx, opts.ReadOptions); err != nil {
+		return nil, false, 0, err
+	}
+	applied := n.store.LastApplied()
+	entries, more, err := n.store.Scan(opts.Prefix, opts.After, opts.Limit)
+	return entries, more, applied, err
+}
+
+// Scan returns up to limit user keys with the given prefix that sort after
+// after, and whether there are more.
+func (store *Store) Scan(prefix, after string, limit int) ([]ScanEntry, bool, error) {
+	if limit <= 0 {
+		limit = DefaultScanLimit
+	}
+	limit = min(limit, MaxScanLimit)
+
+	var out []ScanEntry
+	more := false
+	add := func(key, value []byte) bool {
+		// chunks, dedup entries and the like live under 0x00
+		if isInternalKey(key) || (after != "" && strings.Compare(string(key), after) <= 0) {
+			return true
+		}
+		if len(out) == limit {
+			more = true
+			return false
+		}
+		e := ScanEntry{Key: string(key), Size: uint64(len(value))}
+		if m, isM := parseManifest(value); isM {
+			e.Streamed = true
+			e.Size = m.Size
+		} else {
+			e.Value = string(value)
+		}
+		out = append(out, e)
+		return true
+	}
+
+	// the page starts right after after, and past the internal keys
+	if re, ok := store.engine.(RangeEngine); ok {
+		start := []byte{internalKeyPrefix + 1}
+		if after != "" && after+"\x00" > string(start) {
+			start = []byte(after + "\x00")
+		}
+		// one more than the page, to know if there are more
+		if err := re.IterateRange([]byte(prefix), start, limit+1, add); err != nil {
+			return nil, false, err
+		}
+		return out, more, nil
+	}
+
+	snap, err := store.engine.Snapshot()
+	if err != nil {
+		return nil, false, err
+	}
+	defer snap.Release()
+	if err := snap.Iterate([]byte(prefix), add); err != nil {
+		return nil, false, err
+	}
+	return out, more, nil
+}
@@ -0,0 +1,114 @@
+package sixpaths_kvs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestScanPagesInKeyOrder(t *testing.T) {
+	n, err := OpenNode(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	defer n.Close()
+	ctx := context.Background()
+
+	seq := uint64(0)
+	put := func(k, v string) {
+		seq++
+		if _, err := n.Exec(Command{Instruct: CmdPut, ClientID: "c1", Seq: seq, Key: []byte(k), Value: []byte(v)}); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+	}
+	for i := 4; i >= 0; i-- {
+		put(fmt.Sprintf("user:%d", i), fmt.Sprintf("v%d", i))
+	}
+	put("other", "x")
+	seq++
+	if _, err := n.PutStreamContext(ctx, "c1", seq, []byte("user:big"), strings.NewReader(strings.Repeat("z", 3*StreamChunkSize))); err != nil {
+		t.Fatalf("PutStream: %v", err)
+	}
+
+	// pages of 2, the chunks of the streamed value must not show up
+	var keys []string
+	opts := ScanOptions{Prefix: "user:", Limit: 2}
+	for page := 0; ; page++ {
+		entries, more, applied, err := n.Scan(ctx, opts)
+		if err != nil {
+			t.Fatalf("Scan: %v", err)
+		}
+		if applied != n.LastIndex() {
+			t.Fatalf("Scan applied = %d, want %d", applied, n.LastIndex())
+		}
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+			if e.Key == "user:big" && (!e.Streamed || e.Value != "" || e.Size != 3*StreamChunkSize) {
+				t.Fatalf("streamed entry = %+v", e)
+			}
+			if e.Key == "user:1" && e.Value != "v1" {
+				t.Fatalf("user:1 = %+v", e)
+			}
+		}
+		if !more {
+			break
+		}
+		if page > 5 {
+			t.Fatalf("scan never ended")
+		}
+		opts.After = entries[len(entries)-1].Key
+	}
+
+	want := "user:0,user:1,user:2,user:3,user:4,user:big"
+	if got := strings.Join(keys, ","); got != want {
+		t.Fatalf("scanned %s, want %s", got, want)
+	}
+}
+
+func TestScanRangeOnEveryEngine(t *testing.T) {
+	for _, engine := range []string{"map", "lsm"} {
+		t.Run(engine, func(t *testing.T) {
+			n, err := OpenNodeWithOptions(t.TempDir(), NodeOptions{Engine: engine})
+			if err != nil {
+				t.Fatalf("OpenNodeWithOptions: %v", err)
+			}
+			defer n.Close()
+
+			var want []string
+			for i := range 25 {
+				k := fmt.Sprintf("k%02d", i)
+				want = append(want, k)
+				if _, err := n.Exec(Command{Instruct: CmdPut, ClientID: "c1", Seq: uint64(i + 1), Key: []byte(k), Value: []byte("v")}); err != nil {
+					t.Fatalf("Exec: %v", err)
+				}
+			}
+
+			// no prefix: the dedup entries and stats under 0x00 stay out of it
+			var got []string
+			var after string
+			for {
+				entries, more, err := n.store.Scan("", after, 7)
+				if err != nil {
+					t.Fatalf("Scan: %v", err)
+				}
+				for _, e := range entries {
+					got = append(got, e.Key)
+				}
+				if !more {
+					break
+				}
+				after = entries[len(entries)-1].Key
+			}
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Fatalf("scanned %v, want %v", got, want)
+			}
+
+			// a page that ends on the last key has nothing more after it
+			entries, more, err := n.store.Scan("k", "k19", 5)
+			if err != nil || more || len(entries) != 5 || entries[0].Key != "k20" {
+				t.Fatalf("last page = %v, more %v, %v", entries, more, err)
+			}
+		})
+	}
+}
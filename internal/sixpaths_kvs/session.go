@@ -0,0 +1,322 @@
+package sixpaths_kvs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// session.go implements client sessions.
+// A client registers a session and gets back a session ID, which it then
+// uses as its ClientID. As long as it keeps the session alive (any command
+// or an explicit keepalive), its dedup entry is kept, once the session
+// expires the entry is garbage collected and late requests are rejected.
+//
+// Expiry is driven by the time stamped on each logged command (Command.Time)
+// and never by the wall clock at apply time, so replaying the WAL always
+// expires the same sessions at the same point in the log.
+//
+// Clients that never register a session keep their dedup entry forever,
+// like before.
+
+// session IDs look like "sess-<log index of the register command>-<token>",
+// the random token keeps a legacy client ID that happens to start with the
+// prefix from ever naming a real session
+const sessionIDPrefix = "sess-"
+
+// bytes of randomness in a session ID, the node draws them when it logs the
+// register command so replay hands out the same IDs
+const sessionTokenLen = 8
+
+// used when a register asks for no particular TTL
+const DefaultSessionTTL = 60 * time.Second
+
+// how much logged time passes between sweeps for expired sessions
+const sessionSweepInterval = int64(time.Second)
+
+// session entries are stored in durable engines under this prefix
+const sessionKeyPrefix = "\x00s/"
+
+var (
+	ErrSessionExpired   = errors.New("error: session expired or unknown, register a new one")
+	ErrReservedClientID = errors.New("error: client IDs starting with " + sessionIDPrefix + " are reserved for sessions")
+)
+
+type session struct {
+	lastActive int64 // logged time (unix nanos) of its last command
+	ttl        int64 // nanos
+}
+
+// true for client IDs that name a session rather than a legacy client
+func isSessionID(clientID string) bool {
+	return strings.HasPrefix(clientID, sessionIDPrefix)
+}
+
+// true for client IDs shaped like the ones we hand out, anything else that
+// has the session prefix is some other client squatting on it
+func wellFormedSessionID(clientID string) bool {
+	if !isSessionID(clientID) {
+		return false
+	}
+	idx, tok, ok := strings.Cut(clientID[len(sessionIDPrefix):], "-")
+	if !ok || idx == "" || len(tok) != 2*sessionTokenLen {
+		return false
+	}
+	if _, err := strconv.ParseUint(idx, 10, 64); err != nil {
+		return false
+	}
+	_, err := hex.DecodeString(tok)
+	return err == nil
+}
+
+func sessionKey(id string) []byte {
+	return []byte(sessionKeyPrefix + id)
+}
+
+// [i64 lastActive][i64 ttl]
+func encodeSession(s session) []byte {
+	out := binary.BigEndian.AppendUint64(nil, uint64(s.lastActive))
+	return binary.BigEndian.AppendUint64(out, uint64(s.ttl))
+}
+
+func decodeSession(b []byte) (session, bool) {
+	if len(b) != 16 {
+		return session{}, false
+	}
+	return session{
+		lastActive: int64(binary.BigEndian.Uint64(b[:8])),
+		ttl:        int64(binary.BigEndian.Uint64(b[8:])),
+	}, true
+}
+
+// the value of a register command is the TTL in milliseconds
+func encodeSessionTTL(ttl time.Duration) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(ttl.Milliseconds()))
+}
+
+// the value of a logged register command also carries the token,
+// [u64 ttl ms][token]
+func stampSessionToken(v []byte) []byte {
+	var tok [sessionTokenLen]byte
+	_, _ = rand.Read(tok[:])
+	return append(encodeSessionTTL(decodeSessionTTL(v)), tok[:]...)
+}
+
+// splits the value of a logged register command, anything but a TTL
+// followed by a token is corrupt
+func decodeSessionRegister(v []byte) (time.Duration, []byte, bool) {
+	if len(v) != 8+sessionTokenLen {
+		return 0, nil, false
+	}
+	return decodeSessionTTL(v[:8]), v[8:], true
+}
+
+// the ID a register command logged at logindex hands out
+func sessionIDFor(token []byte, logindex uint64) string {
+	return fmt.Sprintf("%s%d-%x", sessionIDPrefix, logindex, token)
+}
+
+func decodeSessionTTL(v []byte) time.Duration {
+	if len(v) != 8 {
+		return DefaultSessionTTL
+	}
+	ms := binary.BigEndian.Uint64(v)
+	if ms == 0 || ms > uint64(365*24*time.Hour/time.Millisecond) {
+		return DefaultSessionTTL
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// ===== Store side, all of these run with store.mu held =====
+
+// whether session id is still alive at logged time now
+func (store *Store) sessionAliveLocked(id string, now int64) bool {
+	s, ok := store.sessions[id]
+	return ok && now <= s.lastActive+s.ttl
+}
+
+// the session changes a single command makes, they only reach the store
+// once the command's batch has been applied (see commitSessionsLocked)
+type sessionChanges struct {
+	expired   []string
+	updates   map[string]session
+	nextSweep int64
+}
+
+// collects every session that expired by logged time now, together with its
+// dedup entry. b collects the matching deletes for a durable engine.
+func (store *Store) sweepSessionsLocked(now int64, b *Batch) *sessionChanges {
+	sc := &sessionChanges{nextSweep: store.nextSweep}
+	if now < store.nextSweep {
+		return sc
+	}
+	sc.nextSweep = now + sessionSweepInterval
+
+	for id, s := range store.sessions {
+		if now > s.lastActive+s.ttl {
+			sc.expired = append(sc.expired, id)
+			if store.durable {
+				b.Delete(sessionKey(id))
+				deleteDedup(b, id, store.dedupMap[id])
+			}
+		}
+	}
+	return sc
+}
+
+// queues a session update in sc and, for a durable engine, in b
+func (store *Store) touchSessionLocked(id string, s session, b *Batch, sc *sessionChanges) {
+	if sc.updates == nil {
+		sc.updates = make(map[string]session)
+	}
+	sc.updates[id] = s
+	if store.durable {
+		b.Put(sessionKey(id), encodeSession(s))
+	}
+}
+
+// refreshes the session behind a regular command, if the client is one.
+// returns false if the command comes from a dead session.
+func (store *Store) refreshSessionLocked(cmd Command, b *Batch, sc *sessionChanges) bool {
+	if !isSessionID(cmd.ClientID) {
+		return true
+	}
+	if !store.sessionAliveLocked(cmd.ClientID, cmd.Time) {
+		return false
+	}
+	s := store.sessions[cmd.ClientID]
+	s.lastActive = cmd.Time
+	store.touchSessionLocked(cmd.ClientID, s, b, sc)
+	return true
+}
+
+// applies a register or keepalive command to b and r
+func (store *Store) applySessionCmdLocked(cmd Command, logindex uint64, b *Batch, sc *sessionChanges, r *ApplyResult) error {
+	switch cmd.Instruct {
+	case CmdRegisterSession:
+		ttl, token, ok := decodeSessionRegister(cmd.Value)
+		if !ok {
+			return errors.New("error: corrupt session register command")
+		}
+		id := sessionIDFor(token, logindex)
+		s := session{lastActive: cmd.Time, ttl: int64(ttl)}
+		store.touchSessionLocked(id, s, b, sc)
+		r.SessionID = id
+		r.Success = true
+
+	case CmdKeepAlive:
+		if store.refreshSessionLocked(cmd, b, sc) {
+			r.SessionID = cmd.ClientID
+			r.Success = true
+		}
+	}
+	return nil
+}
+
+// makes the changes of an applied command visible
+func (store *Store) commitSessionsLocked(now int64, sc *sessionChanges) {
+	if now > store.clock {
+		store.clock = now
+	}
+	store.nextSweep = sc.nextSweep
+	for _, id := range sc.expired {
+		delete(store.sessions, id)
+		delete(store.dedupMap, id)
+	}
+	for id, s := range sc.updates {
+		store.sessions[id] = s
+	}
+}
+
+// reloads the sessions kept by a durable engine
+func (store *Store) loadSessions() error {
+	var serr error
+	err := store.engine.Iterate([]byte(sessionKeyPrefix), func(key, value []byte) bool {
+		s, ok := decodeSession(value)
+		if !ok {
+			serr = errors.New("error: corrupt session entry for " + string(key[len(sessionKeyPrefix):]))
+			return false
+		}
+		store.sessions[string(key[len(sessionKeyPrefix):])] = s
+		if s.lastActive > store.clock {
+			store.clock = s.lastActive
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// the logged time the next command should carry: the wall clock, but never
+// behind what has already been logged
+func (store *Store) nextTime() int64 {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	if now < store.clock {
+		now = store.clock
+	}
+	return now
+}
+
+// whether commands from clientID may be logged at time now
+func (store *Store) clientAllowed(clientID string, now int64) bool {
+	if !isSessionID(clientID) {
+		return true
+	}
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.sessionAliveLocked(clientID, now)
+}
+
+// number of session entries, expired ones count until they're swept
+func (store *Store) sessionCount() int {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return len(store.sessions)
+}
+
+// ===== Node side =====
+
+// RegisterSession logs a new session and returns its ID. ttl <= 0 means
+// DefaultSessionTTL.
+func (n *Node) RegisterSession(ttl time.Duration) (ApplyResult, error) {
+	return n.RegisterSessionContext(context.Background(), ttl)
+}
+
+// RegisterSessionContext is RegisterSession for a request, see ExecContext.
+func (n *Node) RegisterSessionContext(ctx context.Context, ttl time.Duration) (ApplyResult, error) {
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+	return n.ExecContext(ctx, Command{
+		Instruct: CmdRegisterSession,
+		Value:    encodeSessionTTL(ttl),
+	})
+}
+
+// KeepAlive refreshes a session, it fails with ErrSessionExpired if the
+// session is already gone.
+func (n *Node) KeepAlive(sessionID string) (ApplyResult, error) {
+	return n.KeepAliveContext(context.Background(), sessionID)
+}
+
+// KeepAliveContext is KeepAlive for a request, see ExecContext.
+func (n *Node) KeepAliveContext(ctx context.Context, sessionID string) (ApplyResult, error) {
+	if !isSessionID(sessionID) {
+		return ApplyResult{}, ErrSessionExpired
+	}
+	return n.ExecContext(ctx, Command{
+		Instruct: CmdKeepAlive,
+		ClientID: sessionID,
+	})
+}
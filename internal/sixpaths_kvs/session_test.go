@@ -0,0 +1,150 @@
+package sixpaths_kvs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplySessionExpiryIsDrivenByLoggedTime(t *testing.T) {
+	s, err := NewStore()
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+
+	sec := int64(time.Second)
+	apply := func(idx uint64, cmd Command) ApplyResult {
+		t.Helper()
+		r, err := s.Apply(cmd, idx)
+		if err != nil {
+			t.Fatalf("Apply %d: %v", idx, err)
+		}
+		return r
+	}
+
+	// a register without a token is corrupt, it can't hand out a guessable ID
+	if _, err := s.Apply(Command{Instruct: CmdRegisterSession, Value: encodeSessionTTL(2 * time.Second), Time: 10 * sec}, 1); err == nil {
+		t.Fatalf("register without a token was applied")
+	}
+
+	reg := apply(1, Command{Instruct: CmdRegisterSession, Value: stampSessionToken(encodeSessionTTL(2 * time.Second)), Time: 10 * sec})
+	if !reg.Success || !strings.HasPrefix(reg.SessionID, "sess-1-") || !wellFormedSessionID(reg.SessionID) {
+		t.Fatalf("register = %+v, want sess-1-<token>", reg)
+	}
+	id := reg.SessionID
+
+	// a write inside the TTL is applied and keeps the session alive
+	r := apply(2, Command{Instruct: CmdPut, ClientID: id, Seq: 1, Key: []byte("a"), Value: []byte("1"), Time: 11 * sec})
+	if !r.Success {
+		t.Fatalf("put from live session failed: %+v", r)
+	}
+	if _, ok := s.dedupMap[id]; !ok {
+		t.Fatalf("no dedup entry for sess-1")
+	}
+
+	// a legacy client's command moves logged time past the TTL, which sweeps the session
+	apply(3, Command{Instruct: CmdPut, ClientID: "legacy", Seq: 1, Key: []byte("b"), Value: []byte("2"), Time: 14 * sec})
+	if s.sessionCount() != 0 {
+		t.Fatalf("session not swept, %d left", s.sessionCount())
+	}
+	if _, ok := s.dedupMap[id]; ok {
+		t.Fatalf("dedup entry for sess-1 survived expiry")
+	}
+	if _, ok := s.dedupMap["legacy"]; !ok {
+		t.Fatalf("legacy client lost its dedup entry")
+	}
+
+	// a late retry from the expired session is not applied again
+	r = apply(4, Command{Instruct: CmdPut, ClientID: id, Seq: 1, Key: []byte("a"), Value: []byte("late"), Time: 15 * sec})
+	if r.Success {
+		t.Fatalf("write from expired session was applied")
+	}
+	if v, _ := s.Get("a"); string(v) != "1" {
+		t.Fatalf("a = %q, want 1", v)
+	}
+
+	r = apply(5, Command{Instruct: CmdKeepAlive, ClientID: id, Time: 15 * sec})
+	if r.Success {
+		t.Fatalf("keepalive revived an expired session")
+	}
+}
+
+func TestNodeRejectsExpiredSessionAcrossReplay(t *testing.T) {
+	dir := t.TempDir()
+	n, err := OpenNode(dir)
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+
+	short, err := n.RegisterSession(50 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("RegisterSession: %v", err)
+	}
+	long, err := n.RegisterSession(time.Hour)
+	if err != nil {
+		t.Fatalf("RegisterSession: %v", err)
+	}
+
+	put := func(client string, seq uint64, val string) (ApplyResult, error) {
+		return n.Exec(Command{Instruct: CmdPut, ClientID: client, Seq: seq, Key: []byte("k-" + client), Value: []byte(val)})
+	}
+	if _, err := put(short.SessionID, 1, "v1"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if _, err := put(long.SessionID, 1, "v1"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// the retry can't be recognized as a duplicate anymore, so it's refused
+	if _, err := put(short.SessionID, 1, "v1"); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("retry from expired session: err = %v, want ErrSessionExpired", err)
+	}
+	if _, err := n.KeepAlive(short.SessionID); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("keepalive of expired session: err = %v, want ErrSessionExpired", err)
+	}
+	if _, err := n.KeepAlive(long.SessionID); err != nil {
+		t.Fatalf("keepalive: %v", err)
+	}
+	// unknown sessions are refused as well
+	if _, err := put("sess-999-0123456789abcdef", 1, "v1"); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("unknown session: err = %v, want ErrSessionExpired", err)
+	}
+	// and so is a live session's index with someone else's token
+	forged := long.SessionID[:strings.LastIndex(long.SessionID, "-")+1] + "0000000000000000"
+	if _, err := put(forged, 1, "v1"); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("forged session: err = %v, want ErrSessionExpired", err)
+	}
+	// a legacy client that picked a session-looking ID can't pass for one
+	if _, err := put("sess-2", 1, "v1"); !errors.Is(err, ErrReservedClientID) {
+		t.Fatalf("legacy sess- client: err = %v, want ErrReservedClientID", err)
+	}
+
+	live := n.store.sessionCount()
+	if err := n.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// replay sees the same logged times, so it ends up with the same sessions
+	n, err = OpenNode(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer n.Close()
+
+	if got := n.store.sessionCount(); got != live {
+		t.Fatalf("after replay %d sessions, want %d", got, live)
+	}
+	if _, err := put(short.SessionID, 2, "v2"); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("expired session after replay: err = %v, want ErrSessionExpired", err)
+	}
+	res, err := put(long.SessionID, 1, "dup")
+	if err != nil {
+		t.Fatalf("retry on live session: %v", err)
+	}
+	if v, _ := n.Get("k-" + long.SessionID); string(v) != "v1" || !res.Success {
+		t.Fatalf("retry on live session was applied again, value %q", v)
+	}
+}
@@ -0,0 +1,293 @@
+package sixpaths_kvs
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// slowlog.go keeps track of what a node (or the router) is busy with.
+// Every request is registered with an Inspector while it runs, so
+// GET /admin/inflight lists what's in progress right now, and requests that
+// take longer than the threshold are kept in a ring buffer for
+// GET /admin/slow, together with where their time went: waiting for n.mu,
+// the dedup check, the WAL write and fsync, the store apply, waiting for a
+// read's index, or for the router the backend call.
+
+// used when a node or the router isn't given a threshold
+const DefaultSlowThreshold = 100 * time.Millisecond
+
+// how many slow requests we remember by default
+const defaultSlowLogLen = 256
+
+// the phases a request's time is broken down into
+const (
+	PhaseLockWait   = "lock_wait"
+	PhaseDedupCheck = "dedup_check"
+	PhaseWALWrite   = "wal_write"
+	PhaseWALFsync   = "wal_fsync"
+	PhaseApply      = "apply"
+	PhaseReadWait   = "read_wait"
+	PhaseBackend    = "backend"
+)
+
+// Inspector tracks in-flight requests and remembers the slow ones.
+type Inspector struct {
+	threshold time.Duration
+
+	mu       sync.Mutex
+	nextID   uint64
+	inflight map[uint64]*Op
+	slow     []SlowOp // ring buffer
+	next     int      // where the next slow op goes
+	full     bool
+}
+
+// NewInspector keeps the last capacity requests that took threshold or
+// longer, capacity <= 0 means 256.
+func NewInspector(threshold time.Duration, capacity int) *Inspector {
+	if capacity <= 0 {
+		capacity = defaultSlowLogLen
+	}
+	return &Inspector{
+		threshold: threshold,
+		inflight:  make(map[uint64]*Op),
+		slow:      make([]SlowOp, capacity),
+	}
+}
+
+// Threshold returns how long a request must take to be kept as slow.
+func (in *Inspector) Threshold() time.Duration {
+	return in.threshold
+}
+
+// Op is a request registered with an Inspector.
+type Op struct {
+	in    *Inspector
+	id    uint64
+	reqID string
+	kind  string // "http" or "rpc"
+	name  string // "POST /put", "put", ...
+	start time.Time
+
+	mu     sync.Mutex
+	key    string
+	phases map[string]time.Duration
+	stream bool // long-lived by design, never kept as slow
+}
+
+type opKey struct{}
+
+// Begin registers a request, the returned context carries the Op so the
+// code serving it can add to its phases. Finish must be called once it's done.
+func (in *Inspector) Begin(ctx context.Context, kind, name string) (context.Context, *Op) {
+	op := &Op{
+		in:    in,
+		reqID: RequestIDFromContext(ctx),
+		kind:  kind,
+		name:  name,
+		start: time.Now(),
+	}
+	in.mu.Lock()
+	in.nextID++
+	op.id = in.nextID
+	in.inflight[op.id] = op
+	in.mu.Unlock()
+	return context.WithValue(ctx, opKey{}, op), op
+}
+
+// Finish unregisters the request and keeps it if it was slow.
+func (op *Op) Finish(status string) {
+	dur := time.Since(op.start)
+	in := op.in
+
+	op.mu.Lock()
+	stream := op.stream
+	op.mu.Unlock()
+
+	in.mu.Lock()
+	delete(in.inflight, op.id)
+	if dur < in.threshold || stream {
+		in.mu.Unlock()
+		return
+	}
+	s := op.snapshot(dur)
+	s.Status = status
+	in.slow[in.next] = s
+	in.next = (in.next + 1) % len(in.slow)
+	if in.next == 0 {
+		in.full = true
+	}
+	in.mu.Unlock()
+
+	slog.Warn("slow_op", "request_id", s.RequestID, "op", s.Op, "key", s.Key, "dur_ms", s.DurMs, "status", status)
+}
+
+// SetOpKey records the key the request in ctx works on, once it's known.
+func SetOpKey(ctx context.Context, key string) {
+	if op, ok := ctx.Value(opKey{}).(*Op); ok {
+		op.mu.Lock()
+		op.key = key
+		op.mu.Unlock()
+	}
+}
+
+// SetOpStreaming marks the request in ctx as one that stays open on purpose,
+// like a watch, so it isn't reported as slow.
+func SetOpStreaming(ctx context.Context) {
+	if op, ok := ctx.Value(opKey{}).(*Op); ok {
+		op.mu.Lock()
+		op.stream = true
+		op.mu.Unlock()
+	}
+}
+
+// AddPhase adds d to a phase of the request in ctx, if there is one.
+func AddPhase(ctx context.Context, phase string, d time.Duration) {
+	if op, ok := ctx.Value(opKey{}).(*Op); ok {
+		op.mu.Lock()
+		if op.phases == nil {
+			op.phases = make(map[string]time.Duration)
+		}
+		op.phases[phase] += d
+		op.mu.Unlock()
+	}
+}
+
+// SlowOp is a finished request that took at least the threshold.
+type SlowOp struct {
+	RequestID string             `json:"requestId,omitempty"`
+	Kind      string             `json:"kind"`
+	Op        string             `json:"op"`
+	Key       string             `json:"key,omitempty"`
+	Start     time.Time          `json:"start"`
+	DurMs     float64            `json:"durMs"`
+	Status    string             `json:"status,omitempty"`
+	PhasesMs  map[string]float64 `json:"phasesMs,omitempty"`
+}
+
+// InflightOp is a request that's still running.
+type InflightOp struct {
+	RequestID string             `json:"requestId,omitempty"`
+	Kind      string             `json:"kind"`
+	Op        string             `json:"op"`
+	Key       string             `json:"key,omitempty"`
+	Start     time.Time          `json:"start"`
+	ElapsedMs float64            `json:"elapsedMs"`
+	PhasesMs  map[string]float64 `json:"phasesMs,omitempty"`
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (op *Op) snapshot(dur time.Duration) SlowOp {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	s := SlowOp{
+		RequestID: op.reqID,
+		Kind:      op.kind,
+		Op:        op.name,
+		Key:       op.key,
+		Start:     op.start,
+		DurMs:     ms(dur),
+	}
+	if len(op.phases) > 0 {
+		s.PhasesMs = make(map[string]float64, len(op.phases))
+		for p, d := range op.phases {
+			s.PhasesMs[p] = ms(d)
+		}
+	}
+	return s
+}
+
+// Slow returns the remembered slow requests, newest first.
+func (in *Inspector) Slow() []SlowOp {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	n := in.next
+	if in.full {
+		n = len(in.slow)
+	}
+	out := make([]SlowOp, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, in.slow[(in.next-i+len(in.slow))%len(in.slow)])
+	}
+	return out
+}
+
+// InFlight returns the requests running right now, oldest first.
+func (in *Inspector) InFlight() []InflightOp {
+	in.mu.Lock()
+	ops := make([]*Op, 0, len(in.inflight))
+	for _, op := range in.inflight {
+		ops = append(ops, op)
+	}
+	in.mu.Unlock()
+
+	now := time.Now()
+	out := make([]InflightOp, 0, len(ops))
+	for _, op := range ops {
+		s := op.snapshot(now.Sub(op.start))
+		out = append(out, InflightOp{
+			RequestID: s.RequestID,
+			Kind:      s.Kind,
+			Op:        s.Op,
+			Key:       s.Key,
+			Start:     s.Start,
+			ElapsedMs: s.DurMs,
+			PhasesMs:  s.PhasesMs,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Start.Before(out[j].Start) })
+	return out
+}
+
+// ServeSlow serves GET /admin/slow.
+func (in *Inspector) ServeSlow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"thresholdMs": ms(in.threshold),
+		"ops":         in.Slow(),
+	})
+}
+
+// ServeInFlight serves GET /admin/inflight.
+func (in *Inspector) ServeInFlight(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"ops": in.InFlight(),
+	})
+}
+
+// phase times one step of a request, as a child span and in the request's Op
+type phase struct {
+	ctx   context.Context
+	span  *Span
+	name  string
+	start time.Time
+}
+
+func startPhase(ctx context.Context, spanName, phaseName string) phase {
+	_, span := StartSpan(ctx, spanName, SpanKindInternal)
+	return phase{ctx: ctx, span: span, name: phaseName, start: time.Now()}
+}
+
+// ends the phase and returns how long it took
+func (p phase) end(err error) time.Duration {
+	d := time.Since(p.start)
+	p.span.SetError(err)
+	p.span.End()
+	AddPhase(p.ctx, p.name, d)
+	return d
+}
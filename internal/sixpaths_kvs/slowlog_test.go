@@ -0,0 +1,104 @@
+package sixpaths_kvs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInspectorRingKeepsNewest(t *testing.T) {
+	in := NewInspector(0, 2)
+	for _, name := range []string{"a", "b", "c"} {
+		_, op := in.Begin(t.Context(), "rpc", name)
+		op.Finish("ok")
+	}
+	got := in.Slow()
+	if len(got) != 2 || got[0].Op != "c" || got[1].Op != "b" {
+		t.Fatalf("Slow() = %+v, want c then b", got)
+	}
+
+	fast := NewInspector(time.Hour, 2)
+	_, op := fast.Begin(t.Context(), "rpc", "quick")
+	if len(fast.InFlight()) != 1 {
+		t.Fatal("op not listed as in flight")
+	}
+	op.Finish("ok")
+	if len(fast.Slow()) != 0 || len(fast.InFlight()) != 0 {
+		t.Fatal("a fast op was kept")
+	}
+}
+
+func TestNodeSlowAndInflightEndpoints(t *testing.T) {
+	n, err := OpenNodeWithOptions(t.TempDir(), NodeOptions{Inspector: NewInspector(0, 0)})
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	defer n.Close()
+	h := NewHTTPServer(n, "")
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(RequestIDHeader, "req-7")
+		w := httptest.NewRecorder()
+		h.srv.Handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// a read waiting for an index that never comes stays in flight
+	done := make(chan int)
+	go func() {
+		done <- serve(http.MethodGet, "/get?key=k&minIndex=99&timeoutMs=2000", "").Code
+	}()
+	var inflight struct{ Ops []InflightOp }
+	for deadline := time.Now().Add(time.Second); ; {
+		w := serve(http.MethodGet, "/admin/inflight", "")
+		_ = json.Unmarshal(w.Body.Bytes(), &inflight)
+		if len(inflight.Ops) >= 2 { // the read and this request
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("read never showed up in flight: %s", w.Body.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if op := inflight.Ops[0]; op.Op != "GET /get" || op.Key != "k" || op.RequestID != "req-7" {
+		t.Fatalf("oldest in-flight op = %+v", op)
+	}
+
+	if w := serve(http.MethodPost, "/put", `{"client":"c1","seq":1,"key":"k","value":"v"}`); w.Code != http.StatusOK {
+		t.Fatalf("put: %d %s", w.Code, w.Body.String())
+	}
+	// the put reached index 1, the read still waits for 99
+	n.store.mu.Lock()
+	n.store.lastlogi = 99
+	n.store.notifyAppliedLocked()
+	n.store.mu.Unlock()
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("read: %d", code)
+	}
+
+	var slow struct{ Ops []SlowOp }
+	w := serve(http.MethodGet, "/admin/slow", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &slow); err != nil {
+		t.Fatalf("bad /admin/slow body %q: %v", w.Body.String(), err)
+	}
+	found := map[string]SlowOp{}
+	for _, op := range slow.Ops {
+		found[op.Op] = op
+	}
+	put, read := found["POST /put"], found["GET /get"]
+	for _, p := range []string{PhaseLockWait, PhaseDedupCheck, PhaseWALWrite, PhaseWALFsync, PhaseApply} {
+		if _, ok := put.PhasesMs[p]; !ok {
+			t.Fatalf("put has no %s phase: %+v", p, put)
+		}
+	}
+	if put.Key != "k" || put.Status != "200" {
+		t.Fatalf("put = %+v", put)
+	}
+	if read.PhasesMs[PhaseReadWait] <= 0 {
+		t.Fatalf("read = %+v, want time in %s", read, PhaseReadWait)
+	}
+}
@@ -0,0 +1,430 @@
+package sixpaths_kvs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// sstable.go implements the immutable sorted tables of the LSM engine.
+// A table is written once, front to back, and never modified afterwards.
+// Its layout is:
+// file   = [data block]*[bloom filter][index][footer]
+// block  = [entry]*[u32 crc32]
+// entry  = [u8 kind][u16 keyLen][key bytes][u32 valLen][value bytes]
+// index  = one [u16 keyLen][last key in block][u64 offset][u32 length] per block
+// footer = [u64 indexOff][u32 indexLen][u64 bloomOff][u32 bloomLen][u64 entries][u64 magic]
+
+const (
+	kindPut    uint8 = 1
+	kindDelete uint8 = 2 // tombstone, hides older values of the key
+)
+
+const sstFooterLen = 40
+
+const sstMagic uint64 = 0x53504b5353543031 // "SPKSST01"
+
+var errSSTCorrupt = errors.New("sstable: corrupt")
+
+type sstIndexEntry struct {
+	lastKey []byte
+	offset  uint64
+	length  uint32
+}
+
+// ===== Writer =====
+
+type sstWriter struct {
+	fs    FS
+	f     File
+	path  string
+	bw    *bufio.Writer
+	off   uint64
+	block []byte
+
+	blockSize  int
+	bitsPerKey int
+
+	lastKey  []byte
+	firstKey []byte
+	index    []sstIndexEntry
+	hashes   []uint64
+	entries  uint64
+}
+
+func newSSTWriter(fsys FS, path string, blockSize, bitsPerKey int) (*sstWriter, error) {
+	f, err := fsys.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &sstWriter{
+		fs:         fsys,
+		f:          f,
+		path:       path,
+		bw:         bufio.NewWriterSize(f, 64<<10),
+		blockSize:  blockSize,
+		bitsPerKey: bitsPerKey,
+	}, nil
+}
+
+// adds an entry, keys have to come in strictly ascending order
+func (w *sstWriter) add(key []byte, kind uint8, value []byte) error {
+	if w.entries > 0 && bytes.Compare(key, w.lastKey) <= 0 {
+		return fmt.Errorf("sstable: key %q added out of order", key)
+	}
+	if w.entries == 0 {
+		w.firstKey = append([]byte(nil), key...)
+	}
+
+	w.block = append(w.block, kind)
+	w.block = binary.BigEndian.AppendUint16(w.block, uint16(len(key)))
+	w.block = append(w.block, key...)
+	w.block = binary.BigEndian.AppendUint32(w.block, uint32(len(value)))
+	w.block = append(w.block, value...)
+
+	w.lastKey = append(w.lastKey[:0], key...)
+	w.hashes = append(w.hashes, bloomHash(key))
+	w.entries++
+
+	if len(w.block) >= w.blockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// bytes written so far, used to decide when to cut a new table
+func (w *sstWriter) size() uint64 {
+	return w.off + uint64(len(w.block))
+}
+
+func (w *sstWriter) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	w.block = binary.BigEndian.AppendUint32(w.block, crc32.ChecksumIEEE(w.block))
+	if _, err := w.bw.Write(w.block); err != nil {
+		return err
+	}
+	w.index = append(w.index, sstIndexEntry{
+		lastKey: append([]byte(nil), w.lastKey...),
+		offset:  w.off,
+		length:  uint32(len(w.block)),
+	})
+	w.off += uint64(len(w.block))
+	w.block = w.block[:0]
+	return nil
+}
+
+// writes the bloom filter, index and footer, then fsyncs and closes the file
+func (w *sstWriter) finish() (int64, error) {
+	if err := w.flushBlock(); err != nil {
+		return 0, err
+	}
+
+	bloom := newBloomFilter(w.hashes, w.bitsPerKey).encode()
+	bloomOff := w.off
+	if _, err := w.bw.Write(bloom); err != nil {
+		return 0, err
+	}
+	w.off += uint64(len(bloom))
+
+	var idx []byte
+	for _, e := range w.index {
+		idx = binary.BigEndian.AppendUint16(idx, uint16(len(e.lastKey)))
+		idx = append(idx, e.lastKey...)
+		idx = binary.BigEndian.AppendUint64(idx, e.offset)
+		idx = binary.BigEndian.AppendUint32(idx, e.length)
+	}
+	idx = binary.BigEndian.AppendUint32(idx, crc32.ChecksumIEEE(idx))
+	indexOff := w.off
+	if _, err := w.bw.Write(idx); err != nil {
+		return 0, err
+	}
+	w.off += uint64(len(idx))
+
+	var footer []byte
+	footer = binary.BigEndian.AppendUint64(footer, indexOff)
+	footer = binary.BigEndian.AppendUint32(footer, uint32(len(idx)))
+	footer = binary.BigEndian.AppendUint64(footer, bloomOff)
+	footer = binary.BigEndian.AppendUint32(footer, uint32(len(bloom)))
+	footer = binary.BigEndian.AppendUint64(footer, w.entries)
+	footer = binary.BigEndian.AppendUint64(footer, sstMagic)
+	if _, err := w.bw.Write(footer); err != nil {
+		return 0, err
+	}
+	w.off += uint64(len(footer))
+
+	if err := w.bw.Flush(); err != nil {
+		return 0, err
+	}
+	if err := w.f.Sync(); err != nil {
+		return 0, err
+	}
+	if err := w.f.Close(); err != nil {
+		return 0, err
+	}
+	return int64(w.off), nil
+}
+
+// gives up on the table and removes whatever was written
+func (w *sstWriter) abort() {
+	_ = w.f.Close()
+	_ = w.fs.Remove(w.path)
+}
+
+// ===== Reader =====
+
+type sstable struct {
+	fs       FS
+	num      uint64
+	path     string
+	f        File
+	size     int64
+	entries  uint64
+	smallest []byte
+	largest  []byte
+	index    []sstIndexEntry
+	bloom    bloomFilter
+
+	// the engine's current set of levels holds one reference, snapshots
+	// hold the others. the file goes away once the last one is dropped.
+	refs     atomic.Int32
+	obsolete atomic.Bool
+}
+
+func openSSTable(fsys FS, path string, num uint64) (*sstable, error) {
+	f, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	t, err := loadSSTable(f, path, num)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	t.fs = fsys
+	return t, nil
+}
+
+func loadSSTable(f File, path string, num uint64) (*sstable, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < sstFooterLen {
+		return nil, fmt.Errorf("%w: %s is too short", errSSTCorrupt, path)
+	}
+
+	footer := make([]byte, sstFooterLen)
+	if _, err := f.ReadAt(footer, info.Size()-sstFooterLen); err != nil {
+		return nil, err
+	}
+	r := rpcReader{buf: footer}
+	indexOff, indexLen := r.u64(), r.u32()
+	bloomOff, bloomLen := r.u64(), r.u32()
+	entries, magic := r.u64(), r.u64()
+	if magic != sstMagic {
+		return nil, fmt.Errorf("%w: %s has a bad magic number", errSSTCorrupt, path)
+	}
+	if indexOff+uint64(indexLen) > uint64(info.Size()) || bloomOff+uint64(bloomLen) > uint64(info.Size()) || indexLen < 4 {
+		return nil, fmt.Errorf("%w: %s has a bad footer", errSSTCorrupt, path)
+	}
+
+	idx := make([]byte, indexLen)
+	if _, err := f.ReadAt(idx, int64(indexOff)); err != nil {
+		return nil, err
+	}
+	body, sum := idx[:len(idx)-4], binary.BigEndian.Uint32(idx[len(idx)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, fmt.Errorf("%w: %s has a bad index checksum", errSSTCorrupt, path)
+	}
+
+	t := &sstable{
+		num:     num,
+		path:    path,
+		f:       f,
+		size:    info.Size(),
+		entries: entries,
+	}
+
+	ir := rpcReader{buf: body}
+	for ir.off < len(body) && ir.err == nil {
+		var e sstIndexEntry
+		e.lastKey = ir.bytes(int(ir.u16()))
+		e.offset = ir.u64()
+		e.length = ir.u32()
+		t.index = append(t.index, e)
+	}
+	if ir.err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errSSTCorrupt, path, ir.err)
+	}
+
+	bloom := make([]byte, bloomLen)
+	if _, err := f.ReadAt(bloom, int64(bloomOff)); err != nil {
+		return nil, err
+	}
+	t.bloom = decodeBloomFilter(bloom)
+
+	// smallest key is the first key of the first block, largest the index's last
+	if len(t.index) > 0 {
+		first, err := t.readBlock(0)
+		if err != nil {
+			return nil, err
+		}
+		br := rpcReader{buf: first}
+		br.u8()
+		t.smallest = br.bytes(int(br.u16()))
+		t.largest = t.index[len(t.index)-1].lastKey
+	}
+
+	t.refs.Store(1)
+	return t, nil
+}
+
+// reads and checks the i-th data block, without its crc trailer
+func (t *sstable) readBlock(i int) ([]byte, error) {
+	e := t.index[i]
+	buf := make([]byte, e.length)
+	if _, err := t.f.ReadAt(buf, int64(e.offset)); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: %s block %d is truncated", errSSTCorrupt, t.path, i)
+		}
+		return nil, err
+	}
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("%w: %s block %d is too short", errSSTCorrupt, t.path, i)
+	}
+	body, sum := buf[:len(buf)-4], binary.BigEndian.Uint32(buf[len(buf)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, fmt.Errorf("%w: %s block %d has a bad checksum", errSSTCorrupt, t.path, i)
+	}
+	return body, nil
+}
+
+// looks key up in the table, found is false if the table doesn't mention it
+func (t *sstable) get(key []byte) (kind uint8, value []byte, found bool, err error) {
+	if len(t.index) == 0 || bytes.Compare(key, t.smallest) < 0 || bytes.Compare(key, t.largest) > 0 {
+		return 0, nil, false, nil
+	}
+	if !t.bloom.mayContain(key) {
+		return 0, nil, false, nil
+	}
+
+	// the first block whose last key is >= key is the only one that can hold it
+	i := sort.Search(len(t.index), func(i int) bool {
+		return bytes.Compare(t.index[i].lastKey, key) >= 0
+	})
+	if i == len(t.index) {
+		return 0, nil, false, nil
+	}
+
+	block, err := t.readBlock(i)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	r := rpcReader{buf: block}
+	for r.off < len(block) {
+		k := r.u8()
+		ek := r.take(int(r.u16()))
+		ev := r.take(int(r.u32()))
+		if r.err != nil {
+			return 0, nil, false, fmt.Errorf("%w: %s: %v", errSSTCorrupt, t.path, r.err)
+		}
+		switch bytes.Compare(ek, key) {
+		case 0:
+			return k, append([]byte(nil), ev...), true, nil
+		case 1:
+			return 0, nil, false, nil
+		}
+	}
+	return 0, nil, false, nil
+}
+
+func (t *sstable) ref() {
+	t.refs.Add(1)
+}
+
+// drops a reference, the last one closes the file (and removes it if the
+// table has been compacted away)
+func (t *sstable) unref() {
+	if t.refs.Add(-1) == 0 {
+		_ = t.f.Close()
+		if t.obsolete.Load() {
+			_ = t.fs.Remove(t.path)
+		}
+	}
+}
+
+// ===== Iterator =====
+
+// sstIter walks a table's entries in key order, one block at a time
+type sstIter struct {
+	t     *sstable
+	block int
+	buf   []byte
+	off   int
+
+	k, v  []byte
+	kd    uint8
+	ok    bool
+	error error
+}
+
+func (t *sstable) iter() *sstIter {
+	return &sstIter{t: t, block: -1}
+}
+
+func (it *sstIter) seek(key []byte) {
+	it.block = sort.Search(len(it.t.index), func(i int) bool {
+		return bytes.Compare(it.t.index[i].lastKey, key) >= 0
+	}) - 1
+	it.buf = nil
+	it.off = 0
+	it.next()
+	for it.ok && bytes.Compare(it.k, key) < 0 {
+		it.next()
+	}
+}
+
+func (it *sstIter) next() {
+	it.ok = false
+	if it.error != nil {
+		return
+	}
+	for it.off >= len(it.buf) {
+		it.block++
+		if it.block >= len(it.t.index) {
+			return
+		}
+		b, err := it.t.readBlock(it.block)
+		if err != nil {
+			it.error = err
+			return
+		}
+		it.buf, it.off = b, 0
+	}
+
+	r := rpcReader{buf: it.buf, off: it.off}
+	it.kd = r.u8()
+	it.k = r.take(int(r.u16()))
+	it.v = r.take(int(r.u32()))
+	if r.err != nil {
+		it.error = fmt.Errorf("%w: %s: %v", errSSTCorrupt, it.t.path, r.err)
+		return
+	}
+	it.off = r.off
+	it.ok = true
+}
+
+func (it *sstIter) valid() bool   { return it.ok }
+func (it *sstIter) key() []byte   { return it.k }
+func (it *sstIter) kind() uint8   { return it.kd }
+func (it *sstIter) value() []byte { return it.v }
+func (it *sstIter) err() error    { return it.error }
@@ -1,49 +1,205 @@
 package sixpaths_kvs
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"sync"
 )
 
 // store.go defines the KV store data struct
-// we get a map from string keys to byte values,
-// a Dedup map to make sure dupe requests from the same client arent
-// applied twice.
+// the keys and values themselves live in a StorageEngine (see engine.go),
+// on top of which we keep a Dedup map to make sure dupe requests from the
+// same client arent applied twice.
+// Reads of a single key go straight to the engine, which is safe for
+// concurrent use, so they never wait behind writers on our own lock.
 
 type Store struct {
-	kv       map[string][]byte
+	engine   StorageEngine
+	durable  bool // the engine persists data itself, so dedup state goes in it too
 	lastlogi uint64
-	mu       sync.Mutex
+	mu       sync.RWMutex     // guards lastlogi, dedupMap and the session state
 	dedupMap map[string]Dedup // map where key=clientID string, value=dedup
-}
 
-type Dedup struct {
-	seq    uint64
-	result ApplyResult
+	// closed and replaced every time a command is applied (see read.go)
+	appliedCh chan struct{}
+
+	// user keys and the bytes they take up, chunks of streamed values included
+	stats storeStats
+
+	// client sessions (see session.go), all times are logged times
+	sessions  map[string]session
+	clock     int64 // latest Command.Time applied
+	nextSweep int64 // logged time of the next sweep for expired sessions
 }
 
+var errNotFound = errors.New("error: No value at specificed key in map.")
+
+// NewStore returns a store backed by the default in-memory engine.
 func NewStore() (*Store, error) {
+	return NewStoreWithEngine(newMapEngine())
+}
+
+func NewStoreWithEngine(engine StorageEngine) (*Store, error) {
+	if engine == nil {
+		return nil, errors.New("error: NewStoreWithEngine() needs an engine")
+	}
+
+	_, durable := engine.(DurableEngine)
+
 	var st Store = Store{
-		kv:       make(map[string][]byte),
-		dedupMap: make(map[string]Dedup),
+		engine:    engine,
+		durable:   durable,
+		dedupMap:  make(map[string]Dedup),
+		sessions:  make(map[string]session),
+		appliedCh: make(chan struct{}),
+	}
+
+	// a durable engine may already hold data from before a restart,
+	// in which case we pick up where it left off
+	if durable {
+		if err := st.loadState(); err != nil {
+			return nil, err
+		}
 	}
 
 	return &st, nil
 }
 
+// reloads the last applied index, dedup entries and sessions from a durable engine
+func (store *Store) loadState() error {
+	store.lastlogi = store.engine.(DurableEngine).PersistedIndex()
+
+	var derr error
+	err := store.engine.Iterate([]byte(dedupKeyPrefix), func(key, value []byte) bool {
+		d, ok := decodeDedup(value)
+		if !ok {
+			derr = errors.New("error: corrupt dedup entry for " + string(key[len(dedupKeyPrefix):]))
+			return false
+		}
+		store.dedupMap[string(key[len(dedupKeyPrefix):])] = d
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if derr != nil {
+		return derr
+	}
+	// the results in each window, ascending by seq within a client
+	err = store.engine.Iterate([]byte(dedupEntryPrefix), func(key, value []byte) bool {
+		id, seq, ok := parseDedupEntryKey(key)
+		e, eok := decodeDedupResult(value)
+		if !ok || !eok || e.seq != seq {
+			derr = fmt.Errorf("error: corrupt dedup result %q", key)
+			return false
+		}
+		d := store.dedupMap[id]
+		d.window = append(d.window, e)
+		store.dedupMap[id] = d
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if derr != nil {
+		return derr
+	}
+	if err := store.loadStats(); err != nil {
+		return err
+	}
+	return store.loadSessions()
+}
+
+// the index of the last command applied to the store
+func (store *Store) LastApplied() uint64 {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.lastlogi
+}
+
 func (store *Store) Get(key string) ([]byte, error) {
 
-	// TODO: Consider a change from Lock/Unlock to a READ lock/unlock to maximize concurrency
-	store.mu.Lock()
-	defer store.mu.Unlock()
+	// no store lock needed: a single key is read atomically by the engine,
+	// and the engine already hands us a copy of the value
+	val, ok, err := store.engine.Get([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok || isInternalKey([]byte(key)) {
+		return nil, errNotFound
+	}
+	// streamed values can only be read back through a stream
+	if _, isM := parseManifest(val); isM {
+		return nil, ErrChunkedValue
+	}
+
+	return val, nil
+}
+
+// like Get, but also returns manifests and internal keys as stored.
+// the bool is false when nothing is stored at key.
+func (store *Store) getRaw(key string) ([]byte, bool, error) {
+	return store.engine.Get([]byte(key))
+}
+
+// ===== Stats =====
+
+type storeStats struct {
+	keys  int64
+	bytes int64
+}
+
+// durable engines keep the stats under this key, as [u64 keys][u64 bytes]
+var statsKey = []byte("\x00m/stats")
 
-	val, ok := store.kv[key]
+// returns the number of user keys and the bytes they take up
+func (store *Store) Stats() (keys, size int64) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.stats.keys, store.stats.bytes
+}
 
-	if !ok {
-		return nil, errors.New("error: No value at specificed key in map.")
+// adds the stats after a change of d to b, for a durable engine
+func (store *Store) addStatsLocked(d storeStats, b *Batch) {
+	if !store.durable || (d.keys == 0 && d.bytes == 0) {
+		return
 	}
-	//make a copy of val
-	valcopy := append([]byte{}, val...)
+	out := binary.BigEndian.AppendUint64(nil, uint64(store.stats.keys+d.keys))
+	out = binary.BigEndian.AppendUint64(out, uint64(store.stats.bytes+d.bytes))
+	b.Put(statsKey, out)
+}
 
-	return valcopy, nil
+// reloads the stats of a durable engine. engines written before we kept
+// stats are counted once.
+func (store *Store) loadStats() error {
+	v, ok, err := store.engine.Get(statsKey)
+	if err != nil {
+		return err
+	}
+	if ok && len(v) == 16 {
+		store.stats.keys = int64(binary.BigEndian.Uint64(v[:8]))
+		store.stats.bytes = int64(binary.BigEndian.Uint64(v[8:]))
+		return nil
+	}
+
+	return store.engine.Iterate(nil, func(key, value []byte) bool {
+		switch {
+		case !isInternalKey(key):
+			store.stats.keys++
+			store.stats.bytes += int64(len(key) + len(value))
+		case bytes.HasPrefix(key, []byte(chunkKeyPrefix)):
+			store.stats.bytes += int64(len(value))
+		}
+		return true
+	})
+}
+
+// closes the underlying engine
+func (store *Store) Close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.engine.Close()
 }
@@ -0,0 +1,149 @@
+package sixpaths_kvs
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Benchmarks for concurrent reads on the Store. Run them across core counts
+// to see read throughput scale, e.g.:
+//   go test ./internal/sixpaths_kvs -run '^$' -bench Store -cpu 1,2,4,8
+
+const benchKeys = 10000
+
+// a store with benchKeys keys in it, plus a writer that applies commands
+// one at a time the way Node.Exec does
+type benchStore struct {
+	s   *Store
+	mu  sync.Mutex // serializes writes like Node.mu
+	idx uint64
+	seq atomic.Uint64
+}
+
+func newBenchStore(b *testing.B) *benchStore {
+	b.Helper()
+	s, err := NewStore()
+	if err != nil {
+		b.Fatalf("NewStore: %v", err)
+	}
+	bs := &benchStore{s: s}
+	for i := 0; i < benchKeys; i++ {
+		bs.put(b, fmt.Sprintf("key%d", i), []byte("initial value"))
+	}
+	return bs
+}
+
+func (bs *benchStore) put(b *testing.B, key string, val []byte) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.idx++
+	_, err := bs.s.Apply(Command{
+		Instruct: CmdPut,
+		ClientID: "bench",
+		Seq:      bs.seq.Add(1),
+		Key:      []byte(key),
+		Value:    val,
+	}, bs.idx)
+	if err != nil {
+		b.Errorf("Apply: %v", err)
+	}
+}
+
+func BenchmarkStoreGetParallel(b *testing.B) {
+	bs := newBenchStore(b)
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			if _, err := bs.s.Get(fmt.Sprintf("key%d", r.Intn(benchKeys))); err != nil {
+				b.Errorf("Get: %v", err)
+			}
+		}
+	})
+}
+
+// 90% reads, 10% writes, the writes still go one at a time
+func BenchmarkStoreMixedParallel(b *testing.B) {
+	bs := newBenchStore(b)
+	val := []byte("updated value")
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			key := fmt.Sprintf("key%d", r.Intn(benchKeys))
+			if r.Intn(10) == 0 {
+				bs.put(b, key, val)
+				continue
+			}
+			if _, err := bs.s.Get(key); err != nil {
+				b.Errorf("Get: %v", err)
+			}
+		}
+	})
+}
+
+// reads while a single background writer keeps the store busy, which is
+// the case the old exclusive lock serialized completely
+func BenchmarkStoreGetUnderWriteLoad(b *testing.B) {
+	bs := newBenchStore(b)
+	val := []byte("updated value")
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			bs.put(b, fmt.Sprintf("key%d", i%benchKeys), val)
+		}
+	}()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			if _, err := bs.s.Get(fmt.Sprintf("key%d", r.Intn(benchKeys))); err != nil {
+				b.Errorf("Get: %v", err)
+			}
+		}
+	})
+
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+// pages through every key the way `kvctl scan -all` does, one op is the
+// whole walk. with a sorted index a page costs about the same wherever it
+// starts, so this grows linearly with benchKeys
+func BenchmarkStoreScanAllPaged(b *testing.B) {
+	bs := newBenchStore(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		seen, after := 0, ""
+		for {
+			page, more, err := bs.s.Scan("key", after, 100)
+			if err != nil {
+				b.Fatalf("Scan: %v", err)
+			}
+			seen += len(page)
+			if !more {
+				break
+			}
+			after = page[len(page)-1].Key
+		}
+		if seen != benchKeys {
+			b.Fatalf("scanned %d keys, want %d", seen, benchKeys)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package sixpaths_kvs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// stream.go lets clients upload and download values that are too large to
+// send as a single JSON body.
+// A streamed value is cut into chunks, each logged as its own CmdPutChunk
+// record under an internal key, and then committed by a CmdPutManifest
+// record stored at the user's key. Reads walk the manifest and fetch one
+// chunk at a time, so no one ever has to hold the whole value in memory.
+
+// size of each chunk record
+const StreamChunkSize = 256 << 10
+
+// keys starting with this byte are reserved for the store's own use
+const internalKeyPrefix = 0x00
+
+// every manifest value starts with this, regular values may not
+var manifestMagic = []byte("\x00SPK-MANIFEST\x00")
+
+var (
+	ErrChunkedValue  = errors.New("error: value is stored in chunks, read it with /stream")
+	ErrReservedKey   = errors.New("error: keys starting with 0x00 are reserved")
+	ErrReservedValue = errors.New("error: value starts with the reserved manifest prefix")
+	ErrValueChanged  = errors.New("error: value changed while it was being read")
+)
+
+// manifest describes where the chunks of a streamed value live.
+// chunks are keyed by the (client, seq) of the upload that wrote them,
+// which is unique, so a retried upload simply rewrites the same keys.
+type manifest struct {
+	ClientID string
+	Seq      uint64
+	Chunks   uint32
+	Size     uint64
+}
+
+func isInternalKey(key []byte) bool {
+	return len(key) > 0 && key[0] == internalKeyPrefix
+}
+
+// chunks of streamed values are stored under this prefix
+const chunkKeyPrefix = "\x00c/"
+
+func chunkKey(clientID string, seq uint64, i uint32) []byte {
+	return []byte(fmt.Sprintf(chunkKeyPrefix+"%s/%016x/%08x", clientID, seq, i))
+}
+
+// [magic][u8 clientIDlen][clientID bytes][u64 seq][u32 chunks][u64 size]
+func encodeManifest(m manifest) []byte {
+	out := append([]byte(nil), manifestMagic...)
+	out = append(out, uint8(len(m.ClientID)))
+	out = append(out, m.ClientID...)
+	out = binary.BigEndian.AppendUint64(out, m.Seq)
+	out = binary.BigEndian.AppendUint32(out, m.Chunks)
+	out = binary.BigEndian.AppendUint64(out, m.Size)
+	return out
+}
+
+// returns false if v isn't a manifest
+func parseManifest(v []byte) (manifest, bool) {
+	if !bytes.HasPrefix(v, manifestMagic) {
+		return manifest{}, false
+	}
+	r := rpcReader{buf: v, off: len(manifestMagic)}
+	var m manifest
+	m.ClientID = string(r.bytes(int(r.u8())))
+	m.Seq = r.u64()
+	m.Chunks = r.u32()
+	m.Size = r.u64()
+	if r.err != nil {
+		return manifest{}, false
+	}
+	return m, true
+}
+
+// adds a delete for every chunk belonging to m to the batch
+func dropChunks(b *Batch, m manifest) {
+	for i := uint32(0); i < m.Chunks; i++ {
+		b.Delete(chunkKey(m.ClientID, m.Seq, i))
+	}
+}
+
+// adds a delete for every chunk of m that is stored to the batch, and takes
+// their bytes off st. the caller holds store.mu.
+func (store *Store) dropUploadLocked(b *Batch, m manifest, st *storeStats) error {
+	for i := uint32(0); i < m.Chunks; i++ {
+		k := chunkKey(m.ClientID, m.Seq, i)
+		v, ok, err := store.engine.Get(k)
+		if err != nil {
+			return err
+		}
+		if ok {
+			b.Delete(k)
+			st.bytes -= int64(len(v))
+		}
+	}
+	return nil
+}
+
+// PutStream reads a value from r and stores it under key as a chunked value.
+// each chunk is executed (and fsynced) on its own, so other writes can
+// interleave with a long upload instead of waiting behind it. if the upload
+// fails before its manifest is in, the chunks it wrote are dropped again.
+func (n *Node) PutStream(clientID string, seq uint64, key []byte, r io.Reader) (ApplyResult, error) {
+	return n.PutStreamContext(context.Background(), clientID, seq, key, r)
+}
+
+// PutStreamContext is PutStream for a request, see ExecContext.
+func (n *Node) PutStreamContext(ctx context.Context, clientID string, seq uint64, key []byte, r io.Reader) (ApplyResult, error) {
+	if isInternalKey(key) {
+		return ApplyResult{}, ErrReservedKey
+	}
+
+	// a retry of an upload that already committed shouldn't redo all the work
+	switch res, st := n.store.lookupDedup(clientID, seq); st {
+	case dedupHit:
+		n.metrics.DedupHits.Inc()
+		return res, nil
+	case dedupGone:
+		return ApplyResult{}, ErrResultUnavailable
+	}
+
+	buf := make([]byte, StreamChunkSize)
+	m := manifest{ClientID: clientID, Seq: seq}
+
+	var res ApplyResult
+	err := n.putChunks(ctx, r, buf, &m)
+	if err == nil {
+		// the manifest commits the upload, until then readers see the old value
+		res, err = n.ExecContext(ctx, Command{
+			Instruct: CmdPutManifest,
+			ClientID: clientID,
+			Seq:      seq,
+			Key:      key,
+			Value:    encodeManifest(m),
+		})
+	}
+	if err != nil && m.Chunks > 0 {
+		// the client may be gone already, or its session expired, the
+		// cleanup still has to happen. the manifest says whose chunks they are
+		_, derr := n.ExecContext(context.WithoutCancel(ctx), Command{
+			Instruct: CmdDropChunks,
+			Value:    encodeManifest(m),
+		})
+		if derr != nil {
+			n.log.ErrorContext(ctx, "stream_cleanup_failed", "client", clientID, "seq", seq, "chunks", m.Chunks, "err", derr)
+		}
+	}
+	return res, err
+}
+
+// executes the chunks of r one by one, m counts what made it in
+func (n *Node) putChunks(ctx context.Context, r io.Reader, buf []byte, m *manifest) error {
+	for {
+		k, err := io.ReadFull(r, buf)
+		if k > 0 {
+			if m.Chunks == math.MaxUint32 {
+				return errors.New("error: streamed value has too many chunks")
+			}
+			_, xerr := n.ExecContext(ctx, Command{
+				Instruct: CmdPutChunk,
+				ClientID: m.ClientID,
+				Seq:      m.Seq,
+				Key:      chunkKey(m.ClientID, m.Seq, m.Chunks),
+				Value:    buf[:k],
+			})
+			if xerr != nil {
+				return xerr
+			}
+			m.Chunks++
+			m.Size += uint64(k)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetStream returns a reader over the value at key along with its size.
+// plain values are returned as-is, chunked values are read lazily.
+func (n *Node) GetStream(key string) (io.ReadCloser, int64, error) {
+	raw, ok, err := n.store.getRaw(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ok || isInternalKey([]byte(key)) {
+		return nil, 0, errNotFound
+	}
+
+	m, isM := parseManifest(raw)
+	if !isM {
+		return io.NopCloser(bytes.NewReader(raw)), int64(len(raw)), nil
+	}
+	return &chunkReader{store: n.store, m: m}, int64(m.Size), nil
+}
+
+// chunkReader fetches the chunks of a streamed value one at a time
+type chunkReader struct {
+	store *Store
+	m     manifest
+	next  uint32
+	cur   []byte
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.cur) == 0 {
+		if cr.next == cr.m.Chunks {
+			return 0, io.EOF
+		}
+		// if the value got overwritten or deleted its chunks are gone
+		v, ok, err := cr.store.getRaw(string(chunkKey(cr.m.ClientID, cr.m.Seq, cr.next)))
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, ErrValueChanged
+		}
+		cr.cur = v
+		cr.next++
+	}
+
+	k := copy(p, cr.cur)
+	cr.cur = cr.cur[k:]
+	return k, nil
+}
+
+func (cr *chunkReader) Close() error {
+	cr.cur = nil
+	return nil
+}
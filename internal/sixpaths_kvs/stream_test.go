@@ -0,0 +1,158 @@
+package sixpaths_kvs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestPutStreamRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	n, err := OpenNode(dir)
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+
+	// two and a half chunks worth of data
+	val := bytes.Repeat([]byte("0123456789"), StreamChunkSize/4)
+
+	res, err := n.PutStream("c1", 1, []byte("big"), bytes.NewReader(val))
+	if err != nil {
+		t.Fatalf("PutStream: %v", err)
+	}
+	if !res.Success {
+		t.Fatal("PutStream success = false")
+	}
+
+	if _, err := n.Get("big"); !errors.Is(err, ErrChunkedValue) {
+		t.Fatalf("Get on chunked value: err=%v, want ErrChunkedValue", err)
+	}
+
+	readAll := func(n *Node) []byte {
+		t.Helper()
+		rc, size, err := n.GetStream("big")
+		if err != nil {
+			t.Fatalf("GetStream: %v", err)
+		}
+		defer rc.Close()
+		got, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+		if int64(len(got)) != size {
+			t.Fatalf("read %d bytes, size said %d", len(got), size)
+		}
+		return got
+	}
+
+	if got := readAll(n); !bytes.Equal(got, val) {
+		t.Fatalf("streamed value mismatch: got %d bytes, want %d", len(got), len(val))
+	}
+
+	// the chunks come back after a restart as well
+	if err := n.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	n, err = OpenNode(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer n.Close()
+
+	if got := readAll(n); !bytes.Equal(got, val) {
+		t.Fatal("streamed value mismatch after replay")
+	}
+
+	// overwriting with a plain value drops the chunks
+	if _, err := n.Exec(Command{Instruct: CmdPut, ClientID: "c1", Seq: 2, Key: []byte("big"), Value: []byte("small")}); err != nil {
+		t.Fatalf("Exec put: %v", err)
+	}
+	if _, ok, _ := n.store.getRaw(string(chunkKey("c1", 1, 0))); ok {
+		t.Fatal("chunk still present after overwrite")
+	}
+	if got := readAll(n); string(got) != "small" {
+		t.Fatalf("GetStream on plain value = %q, want %q", got, "small")
+	}
+}
+
+func TestExecRejectsReservedKeys(t *testing.T) {
+	n, err := OpenNode(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	defer n.Close()
+
+	_, err = n.Exec(Command{Instruct: CmdPut, ClientID: "c1", Seq: 1, Key: []byte("\x00sneaky"), Value: []byte("v")})
+	if !errors.Is(err, ErrReservedKey) {
+		t.Fatalf("put on internal key: err=%v, want ErrReservedKey", err)
+	}
+
+	_, err = n.Exec(Command{Instruct: CmdPut, ClientID: "c1", Seq: 2, Key: []byte("k"), Value: encodeManifest(manifest{})})
+	if !errors.Is(err, ErrReservedValue) {
+		t.Fatalf("put of manifest-looking value: err=%v, want ErrReservedValue", err)
+	}
+}
+
+// hands out n bytes and then fails, like a client that goes away mid-upload
+type cutReader struct {
+	n int
+}
+
+func (r *cutReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, errors.New("connection reset")
+	}
+	k := min(len(p), r.n)
+	r.n -= k
+	return k, nil
+}
+
+func TestPutStreamDropsChunksOfAFailedUpload(t *testing.T) {
+	dir := t.TempDir()
+	n, err := OpenNode(dir)
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+
+	ctx := context.Background()
+	if _, err := n.PutStreamContext(ctx, "c1", 1, []byte("big"), &cutReader{n: 2*StreamChunkSize + 10}); err == nil {
+		t.Fatalf("PutStream of a cut off upload succeeded")
+	}
+	chunks := func(n *Node) int {
+		var c int
+		_ = n.store.engine.Iterate([]byte(chunkKeyPrefix), func(key, value []byte) bool {
+			c++
+			return true
+		})
+		return c
+	}
+	if c := chunks(n); c != 0 {
+		t.Fatalf("%d chunks left behind", c)
+	}
+	if keys, size := n.store.Stats(); keys != 0 || size != 0 {
+		t.Fatalf("stats after a failed upload = %d keys, %d bytes", keys, size)
+	}
+
+	// the same upload can be tried again, and replay drops the chunks too
+	val := bytes.Repeat([]byte("x"), StreamChunkSize+1)
+	if _, err := n.PutStreamContext(ctx, "c1", 1, []byte("big"), bytes.NewReader(val)); err != nil {
+		t.Fatalf("retried PutStream: %v", err)
+	}
+	keys, size := n.store.Stats()
+	if err := n.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	n, err = OpenNode(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer n.Close()
+	if c := chunks(n); c != 2 {
+		t.Fatalf("%d chunks after replay, want the retry's 2", c)
+	}
+	if k, sz := n.store.Stats(); k != keys || sz != size {
+		t.Fatalf("stats after replay = %d keys, %d bytes, want %d, %d", k, sz, keys, size)
+	}
+}
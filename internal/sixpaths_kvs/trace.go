@@ -0,0 +1,535 @@
+package sixpaths_kvs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trace.go implements lightweight distributed tracing.
+// A request gets a span on the router, one per rpc hop, one on the node and
+// child spans for the dedup check, the WAL encode/write/fsync and the store
+// apply, so a slow put shows where its time went. Spans cross processes in a
+// W3C traceparent (the HTTP header, or a field of the rpc frame) and are
+// exported in batches as OTLP JSON, to a file (one export request per line)
+// or to a collector's /v1/traces endpoint.
+//
+// A nil *Tracer and a nil *Span do nothing, so code can start spans
+// whether or not tracing is on.
+
+const TraceparentHeader = "traceparent"
+
+type SpanKind int
+
+// values from the OTLP spec
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// how many finished spans wait for export before we start dropping them
+const traceQueueLen = 4096
+
+// spans are exported once this many are queued, or every traceFlushEvery
+const (
+	traceBatchLen   = 256
+	traceFlushEvery = time.Second
+)
+
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+func (sc spanContext) valid() bool {
+	return sc.traceID != [16]byte{} && sc.spanID != [8]byte{}
+}
+
+// "00-<trace id>-<span id>-<flags>"
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-" + flags
+}
+
+func parseTraceparent(s string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	// version 00 has exactly four fields, later ones may add more
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	sc.sampled = flags&1 == 1
+	return sc, sc.valid()
+}
+
+type spanKey struct{}
+type remoteParentKey struct{}
+
+// ContextWithTraceparent returns a copy of ctx whose next span continues the
+// trace in traceparent. Invalid values are ignored.
+func ContextWithTraceparent(ctx context.Context, traceparent string) context.Context {
+	sc, ok := parseTraceparent(traceparent)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteParentKey{}, sc)
+}
+
+// TraceparentFromContext returns the traceparent to send along with an
+// outgoing request made under ctx, or "".
+func TraceparentFromContext(ctx context.Context) string {
+	if s := SpanFromContext(ctx); s != nil {
+		return s.sc.traceparent()
+	}
+	if sc, ok := ctx.Value(remoteParentKey{}).(spanContext); ok {
+		return sc.traceparent()
+	}
+	return ""
+}
+
+// SpanFromContext returns the span running in ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// StartSpan starts a child of the span running in ctx. Without one there is
+// no trace to add to and it returns ctx and a nil span.
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.start(ctx, parent.sc, true, name, kind)
+}
+
+// ===== Span =====
+
+type Span struct {
+	tracer   *Tracer
+	sc       spanContext
+	parentID [8]byte // zero for a root span
+	name     string
+	kind     SpanKind
+	start    time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs []otlpAttr
+	err   string
+	ended bool
+}
+
+// SetAttr records an attribute, v should be a string, bool or integer.
+func (s *Span) SetAttr(key string, v any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, otlpAttr{Key: key, Value: otlpValueOf(v)})
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End finishes the span and queues it for export, later calls do nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.sc.sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+// ===== Tracer =====
+
+// Tracer hands out spans and exports the finished ones in the background.
+type Tracer struct {
+	service string
+	exp     SpanExporter
+
+	mu      sync.Mutex
+	queue   []*Span
+	closed  bool
+	dropped uint64
+
+	kick chan struct{}
+	done chan struct{}
+}
+
+// SpanExporter delivers one OTLP JSON export request.
+type SpanExporter interface {
+	Export(payload []byte) error
+	Close() error
+}
+
+// NewTracer returns a tracer whose spans are exported through exp, tagged
+// with service as service.name.
+func NewTracer(service string, exp SpanExporter) *Tracer {
+	t := &Tracer{
+		service: service,
+		exp:     exp,
+		kick:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go t.loop()
+	return t
+}
+
+// OpenTracer builds a tracer for the -trace-file / -trace-endpoint flags,
+// it returns nil (tracing off) if both are empty.
+func OpenTracer(service, file, endpoint string) (*Tracer, error) {
+	var exps multiExporter
+	if file != "" {
+		fe, err := NewFileSpanExporter(file)
+		if err != nil {
+			return nil, err
+		}
+		exps = append(exps, fe)
+	}
+	if endpoint != "" {
+		exps = append(exps, NewHTTPSpanExporter(endpoint))
+	}
+	switch len(exps) {
+	case 0:
+		return nil, nil
+	case 1:
+		return NewTracer(service, exps[0]), nil
+	}
+	return NewTracer(service, exps), nil
+}
+
+// Start starts a span under the one running in ctx. Without one it continues
+// the remote trace from ContextWithTraceparent, or else starts a new trace.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		return t.start(ctx, parent.sc, true, name, kind)
+	}
+	if sc, ok := ctx.Value(remoteParentKey{}).(spanContext); ok {
+		return t.start(ctx, sc, true, name, kind)
+	}
+	return t.start(ctx, spanContext{}, false, name, kind)
+}
+
+func (t *Tracer) start(ctx context.Context, parent spanContext, hasParent bool, name string, kind SpanKind) (context.Context, *Span) {
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if hasParent {
+		s.sc.traceID = parent.traceID
+		s.sc.sampled = parent.sampled
+		s.parentID = parent.spanID
+	} else {
+		_, _ = rand.Read(s.sc.traceID[:])
+		s.sc.sampled = true
+	}
+	_, _ = rand.Read(s.sc.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	t.mu.Lock()
+	if t.closed || len(t.queue) >= traceQueueLen {
+		t.dropped++
+		t.mu.Unlock()
+		return
+	}
+	t.queue = append(t.queue, s)
+	// still under mu, so Close can't have closed kick yet
+	if len(t.queue) >= traceBatchLen {
+		select {
+		case t.kick <- struct{}{}:
+		default:
+		}
+	}
+	t.mu.Unlock()
+}
+
+func (t *Tracer) loop() {
+	defer close(t.done)
+	tick := time.NewTicker(traceFlushEvery)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+		case _, ok := <-t.kick:
+			if !ok {
+				t.flush()
+				return
+			}
+		}
+		t.flush()
+	}
+}
+
+// exports everything queued so far
+func (t *Tracer) flush() {
+	t.mu.Lock()
+	batch := t.queue
+	t.queue = nil
+	dropped := t.dropped
+	t.dropped = 0
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		slog.Warn("trace spans dropped, export queue full", "spans", dropped)
+	}
+	for len(batch) > 0 {
+		n := min(len(batch), traceBatchLen)
+		payload, err := encodeOTLP(t.service, batch[:n])
+		if err == nil {
+			err = t.exp.Export(payload)
+		}
+		if err != nil {
+			slog.Warn("trace export failed", "spans", n, "err", err)
+		}
+		batch = batch[n:]
+	}
+}
+
+// Close exports the spans still queued and closes the exporter.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	t.mu.Unlock()
+
+	close(t.kick)
+	<-t.done
+	return t.exp.Close()
+}
+
+// ===== OTLP JSON =====
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"` // int64s are strings in OTLP JSON
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func otlpValueOf(v any) otlpValue {
+	var s string
+	switch x := v.(type) {
+	case string:
+		return otlpValue{StringValue: &x}
+	case bool:
+		return otlpValue{BoolValue: &x}
+	case int:
+		s = strconv.FormatInt(int64(x), 10)
+	case int64:
+		s = strconv.FormatInt(x, 10)
+	case uint64:
+		s = strconv.FormatUint(x, 10)
+	case uint32:
+		s = strconv.FormatUint(uint64(x), 10)
+	default:
+		str := fmt.Sprint(v)
+		return otlpValue{StringValue: &str}
+	}
+	return otlpValue{IntValue: &s}
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 is error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string      `json:"traceId"`
+	SpanID       string      `json:"spanId"`
+	ParentSpanID string      `json:"parentSpanId,omitempty"`
+	Name         string      `json:"name"`
+	Kind         SpanKind    `json:"kind"`
+	Start        string      `json:"startTimeUnixNano"`
+	End          string      `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr  `json:"attributes,omitempty"`
+	Status       *otlpStatus `json:"status,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// builds an ExportTraceServiceRequest in OTLP's JSON encoding
+func encodeOTLP(service string, spans []*Span) ([]byte, error) {
+	var ss otlpScopeSpans
+	ss.Scope.Name = "sixpaths_kv"
+	ss.Spans = make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID:    hex.EncodeToString(s.sc.traceID[:]),
+			SpanID:     hex.EncodeToString(s.sc.spanID[:]),
+			Name:       s.name,
+			Kind:       s.kind,
+			Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+			End:        strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes: s.attrs,
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != "" {
+			o.Status = &otlpStatus{Code: 2, Message: s.err}
+		}
+		s.mu.Unlock()
+		ss.Spans = append(ss.Spans, o)
+	}
+
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = []otlpAttr{{Key: "service.name", Value: otlpValueOf(service)}}
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	return json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{rs}})
+}
+
+// ===== Exporters =====
+
+// FileSpanExporter appends each export request to a file as one JSON line.
+type FileSpanExporter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func NewFileSpanExporter(path string) (*FileSpanExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSpanExporter{f: f}, nil
+}
+
+func (e *FileSpanExporter) Export(payload []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.f.Write(append(payload, '\n'))
+	return err
+}
+
+func (e *FileSpanExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.f.Close()
+}
+
+// HTTPSpanExporter posts each export request to an OTLP/HTTP collector,
+// e.g. "http://127.0.0.1:4318/v1/traces".
+type HTTPSpanExporter struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPSpanExporter(url string) *HTTPSpanExporter {
+	return &HTTPSpanExporter{url: url, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (e *HTTPSpanExporter) Export(payload []byte) error {
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("error: collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (e *HTTPSpanExporter) Close() error {
+	return nil
+}
+
+// sends every export to all of its exporters
+type multiExporter []SpanExporter
+
+func (m multiExporter) Export(payload []byte) error {
+	var errs []error
+	for _, e := range m {
+		errs = append(errs, e.Export(payload))
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiExporter) Close() error {
+	var errs []error
+	for _, e := range m {
+		errs = append(errs, e.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,135 @@
+package sixpaths_kvs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type memExporter struct {
+	mu       sync.Mutex
+	payloads [][]byte
+}
+
+func (e *memExporter) Export(p []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.payloads = append(e.payloads, append([]byte(nil), p...))
+	return nil
+}
+
+func (e *memExporter) Close() error { return nil }
+
+func (e *memExporter) spans(t *testing.T) []otlpSpan {
+	t.Helper()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var out []otlpSpan
+	for _, p := range e.payloads {
+		var req otlpRequest
+		if err := json.Unmarshal(p, &req); err != nil {
+			t.Fatalf("bad OTLP payload: %v", err)
+		}
+		for _, rs := range req.ResourceSpans {
+			if v := rs.Resource.Attributes[0].Value.StringValue; v == nil || *v != "test-node" {
+				t.Fatalf("resource attributes = %+v", rs.Resource.Attributes)
+			}
+			for _, ss := range rs.ScopeSpans {
+				out = append(out, ss.Spans...)
+			}
+		}
+	}
+	return out
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := parseTraceparent(tp)
+	if !ok || !sc.sampled || sc.traceparent() != tp {
+		t.Fatalf("parse(%q) = %+v, %v", tp, sc, ok)
+	}
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bx-01",
+	} {
+		if _, ok := parseTraceparent(bad); ok {
+			t.Fatalf("parse(%q) should fail", bad)
+		}
+	}
+}
+
+// a put continues the caller's trace and breaks down into the node's steps
+func TestNodeSpansForPut(t *testing.T) {
+	exp := &memExporter{}
+	tr := NewTracer("test-node", exp)
+	n, err := OpenNodeWithOptions(t.TempDir(), NodeOptions{Tracer: tr})
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	defer n.Close()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodPost, "/put", strings.NewReader(`{"client":"c1","seq":1,"key":"k","value":"v"}`))
+	req.Header.Set(TraceparentHeader, "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	NewHTTPServer(n, "").srv.Handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	byName := map[string]otlpSpan{}
+	for _, s := range exp.spans(t) {
+		if s.TraceID != traceID {
+			t.Fatalf("span %s is in trace %s", s.Name, s.TraceID)
+		}
+		byName[s.Name] = s
+	}
+	parents := map[string]string{
+		"node.http POST /put": "node.http POST /put", // checked below
+		"node.exec":           "node.http POST /put",
+		"node.lock_wait":      "node.exec",
+		"node.dedup_check":    "node.exec",
+		"wal.encode":          "node.exec",
+		"wal.write":           "node.exec",
+		"wal.fsync":           "node.exec",
+		"store.apply":         "node.exec",
+	}
+	for name, parent := range parents {
+		s, ok := byName[name]
+		if !ok {
+			t.Fatalf("no %s span, got %v", name, byName)
+		}
+		want := byName[parent].SpanID
+		if name == parent {
+			want = "00f067aa0ba902b7"
+		}
+		if s.ParentSpanID != want {
+			t.Fatalf("%s has parent %s, want %s (%s)", name, s.ParentSpanID, want, parent)
+		}
+	}
+	if byName["node.http POST /put"].Kind != SpanKindServer {
+		t.Fatalf("server span kind = %d", byName["node.http POST /put"].Kind)
+	}
+}
+
+func TestNilTracerIsNoop(t *testing.T) {
+	var tr *Tracer
+	ctx, span := tr.Start(t.Context(), "x", SpanKindInternal)
+	span.SetAttr("k", 1)
+	span.End()
+	if SpanFromContext(ctx) != nil || TraceparentFromContext(ctx) != "" {
+		t.Fatal("nil tracer started a span")
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
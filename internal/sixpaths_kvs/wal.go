@@ -3,16 +3,17 @@ package sixpaths_kvs
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
-	"log"
+	"log/slog"
 	"math"
 	"os"
 	"path/filepath"
-	"time"
+	"sync/atomic"
 )
 
 // wal.go implements a write-ahead log for data durability
@@ -25,41 +26,74 @@ import (
 // of this file's logic.
 
 type WAL struct {
-	f      *os.File
+	fs     FS
+	f      File
 	path   string
 	offset int64
 	bw     *bufio.Writer
 	hdrLen int
+	v1     bool // records without a time field, only while upgrading
+
+	// where the last good frame starts, 0 if the log has none
+	lastFrame int64
+	// why an append failed, the log takes no more until Recover
+	failed error
+
+	// for metrics, readable without the node lock
+	size    atomic.Int64 // mirrors offset
+	records atomic.Int64 // records currently in the log
+	fsync   *Histogram   // fsync latency in seconds, nil if nobody is watching
+
+	log *slog.Logger
 }
 
-var walHeader = []byte("WALv1-BE\x00")
+var walHeader = []byte("WALv2-BE\x00")
+
+// logs written before records carried a timestamp, we upgrade them on open
+var walHeaderV1 = []byte("WALv1-BE\x00")
 
 type Record struct {
 	LogIndex uint64
 	Cmd      Command
 }
 
-var errCorrupt = errors.New("wal: corrupt")
+// returned by appends once the log couldn't be written or synced, see
+// WAL.Recover. What was written after the last good frame is unknown then:
+// the page cache may hold bytes the disk never got, or a frame cut short.
+var ErrWALFailed = errors.New("error: a write to the WAL failed")
+
+var (
+	errCorrupt  = errors.New("wal: corrupt")
+	errFrameLen = fmt.Errorf("%w: bad frame length", errCorrupt)
+	errBadCRC   = fmt.Errorf("%w: crc mismatch", errCorrupt)
+)
 
 func isCorrupt(err error) bool {
 	return errors.Is(err, errCorrupt)
 }
 
 func NewWAL(path string) (*WAL, error) {
+	return NewWALWithFS(OSFS, path)
+}
+
+// NewWALWithFS is NewWAL on fsys.
+func NewWALWithFS(fsys FS, path string) (*WAL, error) {
 	//This function creates a new WAL using the path provided
 
 	// we create the skeleton of the WAL we're going to return
 	var newWAL *WAL = new(WAL)
+	newWAL.log = slog.Default()
+	newWAL.fs = fsys
 
 	dir := filepath.Dir(path)
-	err := os.MkdirAll(dir, 0o755)
+	err := fsys.MkdirAll(dir, 0o755)
 	// checks whether directory specified by path exists.
 	if err != nil {
 		return nil, err
 	}
 
 	// if the file doesn't exist, we create one.
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	f, err := fsys.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
 
 	if err != nil {
 		return nil, err
@@ -87,8 +121,14 @@ func NewWAL(path string) (*WAL, error) {
 		if err != nil {
 			return nil, err
 		}
+		// the file itself has to survive a crash too, not just what's in it
+		err = fsys.SyncDir(dir)
+		if err != nil {
+			return nil, err
+		}
 		// Update the offset for our new file.
 		newWAL.offset = int64(offset)
+		newWAL.size.Store(newWAL.offset)
 
 	} else {
 		_, err = f.Seek(0, io.SeekStart)
@@ -102,11 +142,19 @@ func NewWAL(path string) (*WAL, error) {
 			return nil, err
 		}
 
-		if !bytes.Equal(hdr, walHeader) {
+		// an old v1 log is rewritten in the current format first
+		if bytes.Equal(hdr, walHeaderV1) {
+			f, info, err = upgradeWALv1(fsys, f, path)
+			if err != nil {
+				return nil, fmt.Errorf("error: upgrading v1 WAL: %w", err)
+			}
+			bw.Reset(f)
+		} else if !bytes.Equal(hdr, walHeader) {
 			return nil, fmt.Errorf("bad WAL header: expected %q", walHeader)
 		}
 		// placeholder, offset = curr file size
 		newWAL.offset = info.Size()
+		newWAL.size.Store(newWAL.offset)
 
 		// put cursor at the end to facilitate appends
 		_, err = f.Seek(0, io.SeekEnd)
@@ -126,6 +174,11 @@ func NewWAL(path string) (*WAL, error) {
 
 func (w *WAL) Close() error {
 
+	// whatever is still buffered after a failure must not go out
+	if w.failed != nil {
+		return w.f.Close()
+	}
+
 	err := w.bw.Flush()
 	if err != nil {
 		return err
@@ -152,8 +205,8 @@ func Encode(rec *Record) ([]byte, error) {
 
 	// First, we validate the record entries.
 
-	if rec.Cmd.Instruct != CmdPut && rec.Cmd.Instruct != CmdDelete {
-		return nil, errors.New("invalid Command, neither Put nor Delete")
+	if !validType(rec.Cmd.Instruct) {
+		return nil, errors.New("invalid Command, unknown command type")
 	}
 
 	// clientID must fit in u8.
@@ -173,6 +226,9 @@ func Encode(rec *Record) ([]byte, error) {
 	// encode the LogIndex to bytes and append it to our enc []byte
 	enc = binary.BigEndian.AppendUint64(enc, rec.LogIndex)
 
+	// we append the time the command was logged at
+	enc = binary.BigEndian.AppendUint64(enc, uint64(rec.Cmd.Time))
+
 	// we do not need to encode since it's only 1 byte
 	// endianness doesn't matter for 1 byte
 	// We append the instruction
@@ -228,49 +284,78 @@ func Encode(rec *Record) ([]byte, error) {
 
 	// Now the record encoded into our WAL as bytes is in the following format:
 	// frame = [u32 framelen][u32 crc32][enc]
-	// [enc] = [u64 logIndex][u8 cmdType][u8 clientIDlen][clientID bytes][u64 seq]
+	// [enc] = [u64 logIndex][i64 time][u8 cmdType][u8 clientIDlen][clientID bytes][u64 seq]
 	// cont. [u16 keyLen][key bytes][u32 valLen][value bytes]
+	// (v1 logs had no time field)
 
 	return frame, nil
 
 }
 
 func (wal *WAL) Append(rec *Record) error {
+	return wal.AppendContext(context.Background(), rec)
+}
+
+// AppendContext is Append on behalf of a request, see ExecContext.
+func (wal *WAL) AppendContext(ctx context.Context, rec *Record) error {
 	// checks record integrity
 	// calls encode to get the frame
 	// Flushes, Syncs, and updates the offset
 
+	if wal.failed != nil {
+		return fmt.Errorf("%w, the log needs recovering: %w", ErrWALFailed, wal.failed)
+	}
+
+	enc := startPhase(ctx, "wal.encode", PhaseWALWrite)
 	fr, err := Encode(rec)
+	enc.end(err)
 	if err != nil {
 		return err
 	}
 
 	// We attempt to append the frame at the offset
 	// to our WAL file. If successful, we will get the incr
+	write := startPhase(ctx, "wal.write", PhaseWALWrite)
+	write.span.SetAttr("bytes", len(fr))
 	_, err = wal.bw.Write(fr)
-	if err != nil {
-		return err
+	if err == nil {
+		err = wal.bw.Flush()
 	}
-
-	err = wal.bw.Flush()
+	write.end(err)
 	if err != nil {
-		return err
+		wal.failed = err
+		return fmt.Errorf("%w: %w", ErrWALFailed, err)
 	}
 
-	start := time.Now()
+	sync := startPhase(ctx, "wal.fsync", PhaseWALFsync)
 	err = wal.f.Sync()
+	fsyncDur := sync.end(err)
 	if err != nil {
-		return err
+		// a failed fsync may have dropped dirty pages the kernel then marks
+		// clean, retrying it could succeed without the data being on disk
+		wal.failed = err
+		return fmt.Errorf("%w: %w", ErrWALFailed, err)
 	}
-	log.Printf("wal_append bytes=%d fsync_ms=%d", len(fr), time.Since(start).Milliseconds())
+	if wal.fsync != nil {
+		wal.fsync.Observe(fsyncDur.Seconds())
+	}
+	wal.log.DebugContext(ctx, "wal_append", "index", rec.LogIndex, "bytes", len(fr), "fsync_ms", fsyncDur.Milliseconds())
 
 	// if successful write, we update our offset
+	wal.lastFrame = wal.offset
 	wal.offset += int64(len(fr))
+	wal.size.Store(wal.offset)
+	wal.records.Add(1)
 
 	return nil
 }
 
 func Decode(payload []byte) (Record, error) {
+	return decodeRecord(payload, true)
+}
+
+// decodes a record payload, v1 payloads (withTime=false) have no time field
+func decodeRecord(payload []byte, withTime bool) (Record, error) {
 
 	newrec := Record{}
 	newcom := Command{}
@@ -296,6 +381,16 @@ func Decode(payload []byte) (Record, error) {
 	newrec.LogIndex = binary.BigEndian.Uint64(paycopy[off : off+8])
 	off += 8
 
+	// then the time it was logged at
+	if withTime {
+		err = need(8)
+		if err != nil {
+			return Record{}, err
+		}
+		newcom.Time = int64(binary.BigEndian.Uint64(paycopy[off : off+8]))
+		off += 8
+	}
+
 	// then we extract the cmdType
 	err = need(1)
 	if err != nil {
@@ -303,7 +398,7 @@ func Decode(payload []byte) (Record, error) {
 	}
 
 	if !validType(CommandType(paycopy[off])) {
-		return Record{}, fmt.Errorf("wrong Commandtype, expected 1 or 2 but got: %d", CommandType(paycopy[off]))
+		return Record{}, fmt.Errorf("wrong Commandtype, expected %d to %d but got: %d", CmdPut, lastCommandType, CommandType(paycopy[off]))
 	}
 	newcom.Instruct = CommandType(paycopy[off])
 	off += 1
@@ -400,10 +495,10 @@ func (w *WAL) readFrameAt(offset int64) ([]byte, int, error) {
 	frameLen := binary.BigEndian.Uint32(hdr[:])
 	// we make some frameLen checks to see if the data seems legit
 	if frameLen < 4 {
-		return nil, 0, fmt.Errorf("%w: bad framelen = %d", errCorrupt, frameLen)
+		return nil, 0, fmt.Errorf("%w = %d", errFrameLen, frameLen)
 	}
 	if uint32(math.Pow(2, 30)) < frameLen {
-		return nil, 0, fmt.Errorf("%w: frameLen overflows", errCorrupt)
+		return nil, 0, fmt.Errorf("%w = %d, overflows", errFrameLen, frameLen)
 	}
 
 	// we create a byteslice to store the frame body
@@ -434,7 +529,7 @@ func (w *WAL) readFrameAt(offset int64) ([]byte, int, error) {
 	// if the crc we get and the one we parsed are not equal,
 	// we know our data has been corrupted.
 	if got != crcCheck {
-		return nil, 0, errCorrupt
+		return nil, 0, errBadCRC
 	}
 
 	//otherwise, everything looks good and we return our payload
@@ -454,6 +549,9 @@ func (w *WAL) ReplayAll() (recs []Record, lastIndex uint64, err error) {
 	var out []Record
 
 	var repairNeeded bool = true
+	// what was wrong with the first bad frame
+	var badKind string
+	var badErr error
 
 	// this loop reads frames and decodes them until it reaches an error
 	for {
@@ -469,6 +567,7 @@ func (w *WAL) ReplayAll() (recs []Record, lastIndex uint64, err error) {
 			if rerr != io.EOF && rerr != io.ErrUnexpectedEOF && !isCorrupt(rerr) {
 				return out, lastIndex, rerr
 			}
+			badKind, badErr = frameProblemKind(rerr), rerr
 			break
 		}
 
@@ -477,6 +576,7 @@ func (w *WAL) ReplayAll() (recs []Record, lastIndex uint64, err error) {
 		// if the decoding fails, we break
 		if derr != nil {
 			repairNeeded = true
+			badKind, badErr = WALProblemDecode, derr
 			break
 		}
 
@@ -485,12 +585,30 @@ func (w *WAL) ReplayAll() (recs []Record, lastIndex uint64, err error) {
 		out = append(out, currRec)
 		// we update the lastidx
 		lastIndex = currRec.LogIndex
+		w.lastFrame = off
 		// since our decode was successful, we
 		off = off + int64(n)
 		lastGood = off
 	}
 
 	if repairNeeded {
+		// a bad frame with good frames after it isn't a torn write: cutting
+		// the log here would throw away committed records, so we leave the
+		// file as it is and let the caller decide
+		cerr, err := w.checkMidLogDamage(lastGood, lastIndex, badKind, badErr)
+		if err != nil {
+			return out, lastIndex, err
+		}
+		if cerr != nil {
+			w.size.Store(cerr.Size)
+			w.records.Store(int64(len(out)))
+			return out, lastIndex, cerr
+		}
+		if info, serr := w.f.Stat(); serr == nil {
+			w.log.Warn("wal_torn_tail", "offset", lastGood, "bytes_dropped", info.Size()-lastGood,
+				"last_index", lastIndex, "problem", badKind)
+		}
+
 		// we truncate to the lastGood and we reset the writer state.
 		err = w.f.Truncate(lastGood)
 		if err != nil {
@@ -508,6 +626,8 @@ func (w *WAL) ReplayAll() (recs []Record, lastIndex uint64, err error) {
 
 		// our WAL's offset is set to the last good offset
 		w.offset = lastGood
+		w.size.Store(lastGood)
+		w.records.Store(int64(len(out)))
 		w.bw.Reset(w.f)
 		return out, lastIndex, nil
 	}
@@ -519,7 +639,283 @@ func (w *WAL) ReplayAll() (recs []Record, lastIndex uint64, err error) {
 	}
 
 	w.offset = lastGood
+	w.size.Store(lastGood)
+	w.records.Store(int64(len(out)))
 	w.bw.Reset(w.f)
 	return out, lastIndex, nil
 
 }
+
+// Failed returns why the log stopped taking appends, nil if it hasn't.
+func (w *WAL) Failed() error {
+	return w.failed
+}
+
+// Recover checks the log again after a failed append and, if it's sound,
+// lets it take appends again. lastIndex is the index of the last record
+// that was acknowledged. Through a fresh handle, the last good frame has to
+// read back whole, end where we think the log ends and hold lastIndex;
+// anything after it, the append that failed, is cut off, and the file has to
+// sync. The failed append is gone then, it was never acknowledged.
+func (w *WAL) Recover(lastIndex uint64) error {
+	if w.failed == nil {
+		return nil
+	}
+	f, err := w.fs.OpenFile(w.path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		_ = f.Close()
+		return err
+	}
+
+	check := &WAL{f: f, hdrLen: w.hdrLen}
+	hdr := make([]byte, len(walHeader))
+	if _, err := f.ReadAt(hdr, 0); err != nil || !bytes.Equal(hdr, walHeader) {
+		return fail(fmt.Errorf("error: the WAL header doesn't read back: %v", err))
+	}
+	if w.lastFrame > 0 {
+		enc, n, err := check.readFrameAt(w.lastFrame)
+		if err != nil {
+			return fail(fmt.Errorf("error: the last good frame at %d doesn't read back: %w", w.lastFrame, err))
+		}
+		if w.lastFrame+int64(n) != w.offset {
+			return fail(fmt.Errorf("error: the last good frame at %d ends at %d, want %d", w.lastFrame, w.lastFrame+int64(n), w.offset))
+		}
+		rec, err := Decode(enc)
+		if err != nil {
+			return fail(err)
+		}
+		if rec.LogIndex != lastIndex {
+			return fail(fmt.Errorf("error: the last good frame holds index %d, want %d", rec.LogIndex, lastIndex))
+		}
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return fail(err)
+	}
+	if err := f.Truncate(w.offset); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	// a trim that failed after its rename left the name unsynced
+	if err := w.fs.SyncDir(filepath.Dir(w.path)); err != nil {
+		return fail(err)
+	}
+	if _, err := f.Seek(w.offset, io.SeekStart); err != nil {
+		return fail(err)
+	}
+
+	w.log.Warn("wal_recovered", "last_index", lastIndex, "offset", w.offset,
+		"bytes_dropped", info.Size()-w.offset, "failure", w.failed)
+	_ = w.f.Close()
+	w.f = f
+	w.bw.Reset(f)
+	w.failed = nil
+	return nil
+}
+
+// Size returns the size of the log file in bytes.
+func (w *WAL) Size() int64 {
+	return w.size.Load()
+}
+
+// Records returns how many records the log holds, as of the last replay
+// plus everything appended since.
+func (w *WAL) Records() int64 {
+	return w.records.Load()
+}
+
+// TrimThrough drops every record with a LogIndex <= index from the log,
+// once a durable storage engine has persisted them and no longer needs
+// the WAL to recover them.
+// The records we keep are copied into a fresh file that then atomically
+// replaces the old one.
+func (w *WAL) TrimThrough(index uint64) error {
+	if w.failed != nil {
+		return fmt.Errorf("%w, the log needs recovering: %w", ErrWALFailed, w.failed)
+	}
+	err := w.bw.Flush()
+	if err != nil {
+		// like a failed append, we can't tell what reached the file
+		w.failed = err
+		return fmt.Errorf("%w: %w", ErrWALFailed, err)
+	}
+
+	tmpPath := w.path + ".trim"
+	tmp, err := w.fs.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	// on failure we throw the half-written copy away and keep the old log
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = w.fs.Remove(tmpPath)
+		}
+	}()
+
+	tbw := bufio.NewWriterSize(tmp, 64<<10)
+	if _, err = tbw.Write(walHeader); err != nil {
+		return err
+	}
+
+	// we walk the frames the same way ReplayAll does, and copy the ones we keep
+	// written is where the next kept frame lands in the new file
+	var kept, lastFrame int64
+	written := int64(len(walHeader))
+	off := int64(w.hdrLen)
+	for off < w.offset {
+		enc, n, rerr := w.readFrameAt(off)
+		if rerr != nil {
+			err = fmt.Errorf("error: TrimThrough() failed reading frame at %d: %w", off, rerr)
+			return err
+		}
+		if len(enc) < 8 {
+			err = fmt.Errorf("%w: frame at %d has no log index", errCorrupt, off)
+			return err
+		}
+		if binary.BigEndian.Uint64(enc[:8]) > index {
+			lastFrame = written
+			written += int64(n)
+			kept++
+			frame := make([]byte, n)
+			if _, err = w.f.ReadAt(frame, off); err != nil {
+				return err
+			}
+			if _, err = tbw.Write(frame); err != nil {
+				return err
+			}
+		}
+		off += int64(n)
+	}
+
+	if err = tbw.Flush(); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = w.fs.Rename(tmpPath, w.path); err != nil {
+		return err
+	}
+
+	// the renamed file is our log now, whatever fails below. the old handle
+	// points at a file that's no longer in the directory
+	_ = w.f.Close()
+	w.f = tmp
+	w.offset = written
+	w.lastFrame = lastFrame
+	w.size.Store(written)
+	w.records.Store(kept)
+	w.bw.Reset(tmp)
+
+	if _, serr := tmp.Seek(written, io.SeekStart); serr != nil {
+		w.failed = serr
+		return fmt.Errorf("%w: %w", ErrWALFailed, serr)
+	}
+	// until the rename is durable a crash can bring the old log back, and
+	// with it lose whatever we append to the new one
+	if serr := w.fs.SyncDir(filepath.Dir(w.path)); serr != nil {
+		w.failed = serr
+		return fmt.Errorf("%w: %w", ErrWALFailed, serr)
+	}
+
+	return nil
+}
+
+// upgradeWALv1 rewrites a v1 log in the current format. v1 records have no
+// time, so they come out with Time 0, which sessions treat as "long ago".
+// like TrimThrough, we write a fresh file and rename it over the old one.
+func upgradeWALv1(fsys FS, f File, path string) (File, os.FileInfo, error) {
+	old := &WAL{fs: fsys, f: f, path: path, hdrLen: len(walHeaderV1), v1: true}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmpPath := path + ".upgrade"
+	tmp, err := fsys.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	fail := func(err error) (File, os.FileInfo, error) {
+		_ = tmp.Close()
+		_ = fsys.Remove(tmpPath)
+		return nil, nil, err
+	}
+
+	tbw := bufio.NewWriterSize(tmp, 64<<10)
+	if _, err := tbw.Write(walHeader); err != nil {
+		return fail(err)
+	}
+
+	// a torn last frame is dropped, the same as ReplayAll would. damage with
+	// good frames after it leaves the v1 log as it is, the rewrite would lose
+	// every record past it
+	off := int64(old.hdrLen)
+	var lastIndex uint64
+	for off < info.Size() {
+		enc, n, rerr := old.readFrameAt(off)
+		kind := frameProblemKind(rerr)
+		var rec Record
+		if rerr == nil {
+			rec, rerr = decodeRecord(enc, false)
+			kind = WALProblemDecode
+		}
+		if rerr != nil {
+			if kind == "" {
+				return fail(rerr)
+			}
+			cerr, err := old.checkMidLogDamage(off, lastIndex, kind, rerr)
+			if err != nil {
+				return fail(err)
+			}
+			if cerr != nil {
+				return fail(cerr)
+			}
+			slog.Warn("wal_torn_tail", "path", path, "offset", off, "bytes_dropped", info.Size()-off,
+				"last_index", lastIndex, "problem", kind)
+			break
+		}
+		lastIndex = rec.LogIndex
+		fr, eerr := Encode(&rec)
+		if eerr != nil {
+			return fail(eerr)
+		}
+		if _, err := tbw.Write(fr); err != nil {
+			return fail(err)
+		}
+		off += int64(n)
+	}
+
+	if err := tbw.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := fsys.Rename(tmpPath, path); err != nil {
+		return fail(err)
+	}
+	if err := fsys.SyncDir(filepath.Dir(path)); err != nil {
+		return fail(err)
+	}
+	_ = f.Close()
+
+	if _, err := tmp.Seek(0, io.SeekEnd); err != nil {
+		_ = tmp.Close()
+		return nil, nil, err
+	}
+	ninfo, err := tmp.Stat()
+	if err != nil {
+		_ = tmp.Close()
+		return nil, nil, err
+	}
+	slog.Info("wal_upgrade", "path", path, "from", "v1", "to", "v2", "bytes", ninfo.Size())
+	return tmp, ninfo, nil
+}
@@ -0,0 +1,102 @@
+package sixpaths_kvs
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplayStillCutsTornTail(t *testing.T) {
+	path, offs := writeTestWAL(t, 3)
+	dir := filepath.Dir(path)
+	data, _ := os.ReadFile(path)
+	_ = os.WriteFile(path, data[:len(data)-3], 0o644)
+
+	n, err := OpenNode(dir)
+	if err != nil {
+		t.Fatalf("OpenNode after a torn write: %v", err)
+	}
+	defer n.Close()
+	if n.ReadOnly() != nil {
+		t.Fatalf("node is read-only after a torn write: %v", n.ReadOnly())
+	}
+	if info, _ := os.Stat(path); info.Size() != offs[2] {
+		t.Fatalf("log is %d bytes, want it cut to %d", info.Size(), offs[2])
+	}
+}
+
+func TestReplayRefusesMidLogCorruption(t *testing.T) {
+	path, offs := writeTestWAL(t, 5)
+	dir := filepath.Dir(path)
+
+	// a flipped byte in the third record's value
+	data, _ := os.ReadFile(path)
+	data[offs[3]-1] ^= 0xff
+	_ = os.WriteFile(path, data, 0o644)
+
+	_, err := OpenNode(dir)
+	var cerr *WALCorruptionError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("OpenNode = %v, want a WALCorruptionError", err)
+	}
+	if cerr.Kind != WALProblemCRC || cerr.Offset != offs[2] || cerr.FirstDamaged != 3 || cerr.LastDamaged != 3 ||
+		cerr.ResumeOffset != offs[3] || cerr.ResumeIndex != 4 || cerr.LastIndex != 5 {
+		t.Fatalf("corruption = %+v", cerr)
+	}
+
+	// nothing is cut off, and a copy of the log is kept aside
+	if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+		t.Fatalf("log is %d bytes, want it left at %d", info.Size(), len(data))
+	}
+	if q, err := os.ReadFile(cerr.Quarantine); err != nil || len(q) != len(data) {
+		t.Fatalf("quarantine copy %q: %d bytes, %v", cerr.Quarantine, len(q), err)
+	}
+
+	// a second try finds the same damage and reuses the copy
+	_, err = OpenNode(dir)
+	var again *WALCorruptionError
+	if !errors.As(err, &again) || again.Quarantine != cerr.Quarantine {
+		t.Fatalf("second OpenNode = %v", err)
+	}
+}
+
+func TestReadOnlyOnCorruptWAL(t *testing.T) {
+	path, offs := writeTestWAL(t, 5)
+	dir := filepath.Dir(path)
+	data, _ := os.ReadFile(path)
+	data[offs[3]-1] ^= 0xff
+	_ = os.WriteFile(path, data, 0o644)
+
+	n, err := OpenNodeWithOptions(dir, NodeOptions{ReadOnlyOnCorruptWAL: true})
+	if err != nil {
+		t.Fatalf("OpenNodeWithOptions: %v", err)
+	}
+	defer n.Close()
+
+	if v, err := n.Get("k"); err != nil || string(v) != "value" {
+		t.Fatalf("Get(k) = %q, %v", v, err)
+	}
+	_, err = n.Exec(Command{Instruct: CmdPut, ClientID: "c1", Seq: 6, Key: []byte("k6"), Value: []byte("value")})
+	if !errors.Is(err, ErrReadOnly) || !errors.Is(n.ReadOnly(), ErrReadOnly) {
+		t.Fatalf("Exec on a read-only node = %v", err)
+	}
+	if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+		t.Fatalf("read-only node changed the log")
+	}
+
+	h := NewHTTPServer(n, "")
+	w := httptest.NewRecorder()
+	h.srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if !strings.Contains(w.Body.String(), `"read_only"`) {
+		t.Fatalf("/health = %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	h.srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/put", strings.NewReader(`{"client":"c1","seq":6,"key":"k6","value":"v"}`)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("/put on a read-only node = %d %s", w.Code, w.Body.String())
+	}
+}
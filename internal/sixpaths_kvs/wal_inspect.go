@@ -0,0 +1,332 @@
+package sixpaths_kvs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// wal_inspect.go looks for damage in a log.
+// ScanWAL is for offline tools like cmd/waltool: it opens the file read-only
+// and never changes it, it reports every good frame and then where the first
+// problem is and what kind it is. TruncateWALAt is the explicit repair, and
+// it keeps a backup of the file.
+// ReplayAll only cuts a bad frame off by itself when it's a torn tail, with
+// nothing good after it; checkMidLogDamage tells the two cases apart.
+
+// the kinds of problem ScanWAL reports
+const (
+	WALProblemTorn     = "torn"      // the file ends partway through a frame
+	WALProblemFrameLen = "frame_len" // a frame length that can't be right
+	WALProblemCRC      = "crc"       // the frame's checksum doesn't match its contents
+	WALProblemDecode   = "decode"    // the checksum matches but the record doesn't decode
+	WALProblemIndexGap = "index_gap" // a record's index doesn't follow the one before it
+)
+
+// WALFrame is one good frame of a log.
+type WALFrame struct {
+	Offset int64 // where the frame starts in the file
+	Size   int   // bytes it takes on disk, length prefix included
+	Record Record
+}
+
+// WALProblem is the first bad frame of a log.
+type WALProblem struct {
+	Offset    int64  // where the bad frame starts
+	Kind      string // one of the WALProblem* kinds
+	PrevIndex uint64 // index of the last good record, 0 if there is none
+	Err       error
+}
+
+func (p *WALProblem) Error() string {
+	return fmt.Sprintf("wal: %s at offset %d (after index %d): %v", p.Kind, p.Offset, p.PrevIndex, p.Err)
+}
+
+// WALScan sums up a log read by ScanWAL.
+type WALScan struct {
+	Version    int // 1 for logs from before records had a time, 2 otherwise
+	Size       int64
+	Records    int
+	FirstIndex uint64
+	LastIndex  uint64
+	GoodEnd    int64       // offset right after the last good frame
+	Problem    *WALProblem // nil if the whole file is good
+}
+
+// ScanWAL reads the log at path without modifying it and calls fn with
+// every good frame in order, stopping at the first problem or when fn
+// returns an error. The error is only non-nil if the file couldn't be read
+// as a log at all, or fn failed; problems with frames are in the result.
+func ScanWAL(path string, fn func(WALFrame) error) (*WALScan, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := make([]byte, len(walHeader))
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		return nil, fmt.Errorf("error: %s is not a WAL, it's too short for a header", path)
+	}
+	scan := &WALScan{Size: info.Size(), GoodEnd: int64(len(hdr))}
+	switch {
+	case bytes.Equal(hdr, walHeader):
+		scan.Version = 2
+	case bytes.Equal(hdr, walHeaderV1):
+		scan.Version = 1
+	default:
+		return nil, fmt.Errorf("error: %s is not a WAL, bad header %q", path, hdr)
+	}
+
+	w := &WAL{f: f, path: path, hdrLen: len(hdr)}
+	off := int64(len(hdr))
+	for off < scan.Size {
+		problem := func(kind string, err error) {
+			scan.Problem = &WALProblem{Offset: off, Kind: kind, PrevIndex: scan.LastIndex, Err: err}
+		}
+
+		enc, n, rerr := w.readFrameAt(off)
+		switch kind := frameProblemKind(rerr); {
+		case rerr == nil:
+		case kind == WALProblemTorn:
+			problem(kind, fmt.Errorf("%d bytes left, not a whole frame", scan.Size-off))
+		case kind != "":
+			problem(kind, rerr)
+		default:
+			return scan, rerr
+		}
+		if scan.Problem != nil {
+			break
+		}
+
+		rec, derr := decodeRecord(enc, scan.Version == 2)
+		if derr != nil {
+			problem(WALProblemDecode, derr)
+			break
+		}
+		// every logged command takes the next index, trimming only drops a prefix
+		if scan.Records > 0 && rec.LogIndex != scan.LastIndex+1 {
+			problem(WALProblemIndexGap, fmt.Errorf("index %d follows %d", rec.LogIndex, scan.LastIndex))
+			break
+		}
+
+		if fn != nil {
+			if err := fn(WALFrame{Offset: off, Size: n, Record: rec}); err != nil {
+				return scan, err
+			}
+		}
+		if scan.Records == 0 {
+			scan.FirstIndex = rec.LogIndex
+		}
+		scan.Records++
+		scan.LastIndex = rec.LogIndex
+		off += int64(n)
+		scan.GoodEnd = off
+	}
+	return scan, nil
+}
+
+// the kind of problem a readFrameAt error is, "" if it's not a problem with the frame
+func frameProblemKind(err error) string {
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return WALProblemTorn
+	case errors.Is(err, errFrameLen):
+		return WALProblemFrameLen
+	case errors.Is(err, errBadCRC):
+		return WALProblemCRC
+	}
+	return ""
+}
+
+// WALCorruptionError is returned by ReplayAll when a bad frame is followed
+// by good ones, so it can't be a write torn by a crash. Records
+// FirstDamaged..LastDamaged are lost (or were never in the log), and the
+// intact records ResumeIndex..LastIndex after them can't be replayed past
+// the gap. ReplayAll leaves the file untouched in this case.
+type WALCorruptionError struct {
+	Path         string
+	Offset       int64  // where the damage starts
+	Kind         string // what's wrong with the first bad frame, one of the WALProblem* kinds
+	Size         int64
+	FirstDamaged uint64
+	LastDamaged  uint64
+	ResumeOffset int64 // the first good frame after the damage
+	ResumeIndex  uint64
+	LastIndex    uint64 // the last good record we could find after the damage
+	Err          error
+
+	Quarantine string // where OpenNode copied the damaged log, if it did
+}
+
+func (e *WALCorruptionError) Error() string {
+	damaged := fmt.Sprintf("records %d..%d are damaged", e.FirstDamaged, e.LastDamaged)
+	if e.LastDamaged < e.FirstDamaged {
+		damaged = "no whole record is damaged"
+	}
+	msg := fmt.Sprintf("error: WAL %s is corrupt in the middle, %s at offset %d (%v): %s, "+
+		"and records %d..%d after them are intact but can't be replayed past the gap",
+		e.Path, e.Kind, e.Offset, e.Err, damaged, e.ResumeIndex, e.LastIndex)
+	if e.Quarantine != "" {
+		msg += ", a copy of the log is in " + e.Quarantine
+	}
+	return msg
+}
+
+func (e *WALCorruptionError) Unwrap() error {
+	return e.Err
+}
+
+// decides whether the bad frame at off is a torn tail or mid-log damage by
+// looking for a good frame anywhere after it. the one it finds has to carry
+// a later index than lastIndex, so a stray match in the damaged bytes is
+// about as likely as a crc32 collision. returns nil for a torn tail.
+func (w *WAL) checkMidLogDamage(off int64, lastIndex uint64, kind string, cause error) (*WALCorruptionError, error) {
+	info, err := w.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size-off <= 4 {
+		return nil, nil
+	}
+	// replay already holds every record in memory, so the tail can be too
+	tail := make([]byte, size-off)
+	if _, err := w.f.ReadAt(tail, off); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// the smallest frame: length, crc, index, time, type, client len, seq, key len, value len
+	minFrame, typeOff := 4+4+8+8+1+1+8+2+4, 24
+	if w.v1 {
+		// v1 records have no time
+		minFrame, typeOff = minFrame-8, typeOff-8
+	}
+	for pos := 1; pos+minFrame <= len(tail); pos++ {
+		frameLen := int(binary.BigEndian.Uint32(tail[pos:]))
+		if frameLen < minFrame-4 || pos+4+frameLen > len(tail) {
+			continue
+		}
+		idx := binary.BigEndian.Uint64(tail[pos+8:])
+		if idx <= lastIndex || idx > lastIndex+uint64(len(tail)) {
+			continue
+		}
+		if !validType(CommandType(tail[pos+typeOff])) {
+			continue
+		}
+		enc := tail[pos+8 : pos+4+frameLen]
+		if crc32.ChecksumIEEE(enc) != binary.BigEndian.Uint32(tail[pos+4:]) {
+			continue
+		}
+		rec, derr := decodeRecord(enc, !w.v1)
+		if derr != nil {
+			continue
+		}
+
+		cerr := &WALCorruptionError{
+			Path:         w.path,
+			Offset:       off,
+			Kind:         kind,
+			Size:         size,
+			FirstDamaged: lastIndex + 1,
+			LastDamaged:  rec.LogIndex - 1,
+			ResumeOffset: off + int64(pos),
+			ResumeIndex:  rec.LogIndex,
+			LastIndex:    rec.LogIndex,
+			Err:          cause,
+		}
+		// we follow the good frames from there to report how much is intact
+		next := cerr.ResumeOffset + int64(4+frameLen)
+		for {
+			enc, n, rerr := w.readFrameAt(next)
+			if rerr != nil {
+				break
+			}
+			r, derr := decodeRecord(enc, !w.v1)
+			if derr != nil {
+				break
+			}
+			cerr.LastIndex = r.LogIndex
+			next += int64(n)
+		}
+		return cerr, nil
+	}
+	return nil, nil
+}
+
+// TruncateWALAt cuts the log at path down to its first offset bytes, which
+// must be the start of one of its good frames or the end of the last one.
+// The whole file is copied to a backup first, its path is returned.
+// The log must not be open in a running node.
+func TruncateWALAt(path string, offset int64) (string, error) {
+	boundary := false
+	scan, err := ScanWAL(path, func(fr WALFrame) error {
+		if fr.Offset == offset {
+			boundary = true
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if offset == scan.GoodEnd {
+		boundary = true
+	}
+	if !boundary {
+		return "", fmt.Errorf("error: offset %d is not the start of a good frame (good frames end at %d)", offset, scan.GoodEnd)
+	}
+
+	backup := fmt.Sprintf("%s.bak-%s", path, time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := copyFileSync(OSFS, path, backup); err != nil {
+		return "", fmt.Errorf("error: backing up %s: %w", path, err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return backup, err
+	}
+	defer f.Close()
+	if err := f.Truncate(offset); err != nil {
+		return backup, err
+	}
+	if err := f.Sync(); err != nil {
+		return backup, err
+	}
+	return backup, nil
+}
+
+// copies src to a new file dst and syncs it, dst must not exist yet
+func copyFileSync(fsys FS, src, dst string) error {
+	in, err := fsys.OpenFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := fsys.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return fsys.SyncDir(filepath.Dir(dst))
+}
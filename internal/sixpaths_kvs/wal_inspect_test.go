@@ -0,0 +1,107 @@
+package sixpaths_kvs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writes a log with records 1..n and returns its path and frame offsets
+func writeTestWAL(t *testing.T, n int) (string, []int64) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "wal")
+	w, err := NewWAL(path)
+	if err != nil {
+		t.Fatalf("NewWAL: %v", err)
+	}
+	var offs []int64
+	for i := 1; i <= n; i++ {
+		offs = append(offs, w.offset)
+		rec := Record{LogIndex: uint64(i), Cmd: Command{Instruct: CmdPut, ClientID: "c1", Seq: uint64(i), Key: []byte("k"), Value: []byte("value")}}
+		if err := w.Append(&rec); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return path, offs
+}
+
+func TestScanWALReportsFirstProblem(t *testing.T) {
+	path, offs := writeTestWAL(t, 5)
+
+	scan, err := ScanWAL(path, nil)
+	if err != nil {
+		t.Fatalf("ScanWAL: %v", err)
+	}
+	if scan.Problem != nil || scan.Records != 5 || scan.FirstIndex != 1 || scan.LastIndex != 5 || scan.GoodEnd != scan.Size {
+		t.Fatalf("clean scan = %+v", scan)
+	}
+
+	// a flipped byte in the third record's value
+	data, _ := os.ReadFile(path)
+	data[offs[3]-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	var seen []uint64
+	scan, err = ScanWAL(path, func(fr WALFrame) error {
+		seen = append(seen, fr.Record.LogIndex)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ScanWAL: %v", err)
+	}
+	p := scan.Problem
+	if p == nil || p.Kind != WALProblemCRC || p.Offset != offs[2] || p.PrevIndex != 2 || len(seen) != 2 {
+		t.Fatalf("problem = %+v, seen %v", p, seen)
+	}
+	// verifying must leave the file alone
+	if after, _ := os.ReadFile(path); !bytes.Equal(after, data) {
+		t.Fatalf("ScanWAL modified the log")
+	}
+}
+
+func TestScanWALTornTailAndIndexGap(t *testing.T) {
+	path, offs := writeTestWAL(t, 3)
+	data, _ := os.ReadFile(path)
+
+	torn := filepath.Join(t.TempDir(), "torn")
+	_ = os.WriteFile(torn, data[:len(data)-3], 0o644)
+	scan, err := ScanWAL(torn, nil)
+	if err != nil || scan.Problem == nil || scan.Problem.Kind != WALProblemTorn || scan.Problem.Offset != offs[2] {
+		t.Fatalf("torn scan = %+v, %v", scan, err)
+	}
+
+	// the second record dropped out of the middle
+	gap := filepath.Join(t.TempDir(), "gap")
+	_ = os.WriteFile(gap, append(append([]byte{}, data[:offs[1]]...), data[offs[2]:]...), 0o644)
+	scan, err = ScanWAL(gap, nil)
+	if err != nil || scan.Problem == nil || scan.Problem.Kind != WALProblemIndexGap || scan.Problem.PrevIndex != 1 {
+		t.Fatalf("gap scan = %+v, %v", scan, err)
+	}
+}
+
+func TestTruncateWALAtKeepsBackup(t *testing.T) {
+	path, offs := writeTestWAL(t, 4)
+	orig, _ := os.ReadFile(path)
+
+	if _, err := TruncateWALAt(path, offs[2]+1); err == nil {
+		t.Fatalf("TruncateWALAt accepted an offset inside a frame")
+	}
+
+	backup, err := TruncateWALAt(path, offs[2])
+	if err != nil {
+		t.Fatalf("TruncateWALAt: %v", err)
+	}
+	if b, _ := os.ReadFile(backup); !bytes.Equal(b, orig) {
+		t.Fatalf("backup doesn't match the original log")
+	}
+	scan, err := ScanWAL(path, nil)
+	if err != nil || scan.Problem != nil || scan.LastIndex != 2 || scan.Size != offs[2] {
+		t.Fatalf("scan after truncate = %+v, %v", scan, err)
+	}
+}
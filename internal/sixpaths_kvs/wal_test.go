@@ -1,7 +1,113 @@
 package sixpaths_kvs
 
-import "testing"
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
 
 func EncodeDecodeEquiv(t *testing.T) {
 
 }
+
+// builds a frame the way v1 logs wrote it, without the time field
+func encodeV1(t *testing.T, rec Record) []byte {
+	t.Helper()
+	fr, err := Encode(&rec)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	enc := append(append([]byte{}, fr[8:16]...), fr[24:]...)
+
+	out := binary.BigEndian.AppendUint32(nil, uint32(4+len(enc)))
+	out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(enc))
+	return append(out, enc...)
+}
+
+func TestNewWALUpgradesV1Log(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+
+	recs := []Record{
+		{LogIndex: 1, Cmd: Command{Instruct: CmdPut, ClientID: "c1", Seq: 1, Key: []byte("a"), Value: []byte("1")}},
+		{LogIndex: 2, Cmd: Command{Instruct: CmdDelete, ClientID: "c1", Seq: 2, Key: []byte("a")}},
+	}
+	file := append([]byte{}, walHeaderV1...)
+	for _, rec := range recs {
+		file = append(file, encodeV1(t, rec)...)
+	}
+	if err := os.WriteFile(path, file, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	w, err := NewWAL(path)
+	if err != nil {
+		t.Fatalf("NewWAL: %v", err)
+	}
+	defer w.Close()
+
+	got, last, err := w.ReplayAll()
+	if err != nil {
+		t.Fatalf("ReplayAll: %v", err)
+	}
+	if last != 2 || len(got) != 2 {
+		t.Fatalf("replayed %d records up to %d, want 2 up to 2", len(got), last)
+	}
+	if got[0].Cmd.ClientID != "c1" || string(got[0].Cmd.Value) != "1" || got[1].Cmd.Instruct != CmdDelete {
+		t.Fatalf("records changed in the upgrade: %+v", got)
+	}
+
+	// new records go on in the current format
+	if err := w.Append(&Record{LogIndex: 3, Cmd: Command{Instruct: CmdPut, ClientID: "c1", Seq: 3, Key: []byte("b"), Time: 42}}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	got, _, err = w.ReplayAll()
+	if err != nil || len(got) != 3 || got[2].Cmd.Time != 42 {
+		t.Fatalf("after append: %d records, err %v", len(got), err)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !bytes.HasPrefix(raw, walHeader) {
+		t.Fatalf("header not upgraded: %q", raw[:len(walHeader)])
+	}
+}
+
+func TestNewWALKeepsCorruptV1Log(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+
+	file := append([]byte{}, walHeaderV1...)
+	var offs []int
+	for i := 1; i <= 4; i++ {
+		offs = append(offs, len(file))
+		file = append(file, encodeV1(t, Record{LogIndex: uint64(i), Cmd: Command{Instruct: CmdPut, ClientID: "c1", Seq: uint64(i), Key: []byte("k"), Value: []byte("v")}})...)
+	}
+	// a flipped byte in the second record's value
+	file[offs[2]-1] ^= 0xff
+	if err := os.WriteFile(path, file, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	_, err := NewWAL(path)
+	var cerr *WALCorruptionError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("NewWAL = %v, want a WALCorruptionError", err)
+	}
+	if cerr.FirstDamaged != 2 || cerr.ResumeIndex != 3 || cerr.LastIndex != 4 {
+		t.Fatalf("corruption = %+v", cerr)
+	}
+
+	// the v1 log is left as it was, no half-done upgrade beside it
+	raw, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(raw, file) {
+		t.Fatalf("v1 log changed: %v", err)
+	}
+	if _, err := os.Stat(path + ".upgrade"); !os.IsNotExist(err) {
+		t.Fatalf("upgrade file left behind: %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package sixpaths_kvs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// watch.go lets clients follow the changes made to a node's keys.
+// After a put, delete or streamed put is applied, Exec hands an event to
+// every watcher whose prefix matches. Watchers get events in log order,
+// starting with the first write applied after they subscribed; there is no
+// history to replay. A watcher that can't keep up is cut off (its channel
+// is closed and Err reports it) rather than slowing down writes.
+
+// how many events a watcher may fall behind before it's cut off
+const watchBuffer = 1024
+
+var ErrWatchLagging = errors.New("error: watcher fell too far behind and was dropped")
+
+// WatchEvent is one applied change.
+type WatchEvent struct {
+	Node     string `json:"node,omitempty"` // ID of the node that applied it
+	Index    uint64 `json:"index"`
+	Type     string `json:"type"` // "put" or "delete"
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+	Streamed bool   `json:"streamed,omitempty"` // the value was streamed, only its size is sent
+	Size     uint64 `json:"size,omitempty"`
+}
+
+// Watcher receives the events for one prefix, see Node.Watch.
+type Watcher struct {
+	prefix string
+	ch     chan WatchEvent
+	hub    *watchHub
+
+	err error // set before ch is closed
+}
+
+// Events returns the channel the events arrive on, it's closed when the
+// watcher is cancelled or dropped.
+func (w *Watcher) Events() <-chan WatchEvent {
+	return w.ch
+}
+
+// Err returns why the events channel was closed, nil if the watcher was cancelled.
+func (w *Watcher) Err() error {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+	return w.err
+}
+
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*Watcher]struct{}
+}
+
+// Watch subscribes to the changes of keys starting with prefix. The watcher
+// lives until ctx is done.
+func (n *Node) Watch(ctx context.Context, prefix string) *Watcher {
+	h := &n.watch
+	w := &Watcher{prefix: prefix, ch: make(chan WatchEvent, watchBuffer), hub: h}
+
+	h.mu.Lock()
+	if h.watchers == nil {
+		h.watchers = make(map[*Watcher]struct{})
+	}
+	h.watchers[w] = struct{}{}
+	h.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		h.drop(w, nil)
+	}()
+	return w
+}
+
+// removes w, closing its channel, if it's still subscribed
+func (h *watchHub) drop(w *Watcher, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dropLocked(w, err)
+}
+
+func (h *watchHub) dropLocked(w *Watcher, err error) {
+	if _, ok := h.watchers[w]; !ok {
+		return
+	}
+	delete(h.watchers, w)
+	w.err = err
+	close(w.ch)
+}
+
+// hands the change a command made to the watchers, called by Exec with n.mu held
+// so events go out in log order
+func (n *Node) publish(cmd Command, res ApplyResult) {
+	h := &n.watch
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.watchers) == 0 {
+		return
+	}
+
+	ev := WatchEvent{Node: n.id, Index: res.LogIndex, Key: string(cmd.Key)}
+	switch cmd.Instruct {
+	case CmdPut:
+		ev.Type = "put"
+		ev.Value = string(cmd.Value)
+	case CmdPutManifest:
+		ev.Type = "put"
+		ev.Streamed = true
+		if m, ok := parseManifest(cmd.Value); ok {
+			ev.Size = m.Size
+		}
+	case CmdDelete:
+		// even if there was nothing to delete, watchers see every delete logged
+		ev.Type = "delete"
+	default:
+		return
+	}
+
+	for w := range h.watchers {
+		if !strings.HasPrefix(ev.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.ch <- ev:
+		default:
+			h.dropLocked(w, ErrWatchLagging)
+		}
+	}
+}
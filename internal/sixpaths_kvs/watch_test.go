@@ -0,0 +1,78 @@
+package sixpaths_kvs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWatchSeesChangesUnderPrefix(t *testing.T) {
+	n, err := OpenNode(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := n.Watch(ctx, "user:")
+
+	cmds := []Command{
+		{Instruct: CmdPut, ClientID: "c1", Seq: 1, Key: []byte("user:1"), Value: []byte("alice")},
+		{Instruct: CmdPut, ClientID: "c1", Seq: 2, Key: []byte("other"), Value: []byte("x")},
+		{Instruct: CmdDelete, ClientID: "c1", Seq: 3, Key: []byte("user:1")},
+		// a retry is answered from dedup, nothing new happens
+		{Instruct: CmdPut, ClientID: "c1", Seq: 1, Key: []byte("user:1"), Value: []byte("alice")},
+	}
+	for _, cmd := range cmds {
+		if _, err := n.Exec(cmd); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+	}
+
+	want := []WatchEvent{
+		{Index: 1, Type: "put", Key: "user:1", Value: "alice"},
+		{Index: 3, Type: "delete", Key: "user:1"},
+	}
+	for _, ev := range want {
+		select {
+		case got := <-w.Events():
+			if got != ev {
+				t.Fatalf("event = %+v, want %+v", got, ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event, want %+v", ev)
+		}
+	}
+
+	cancel()
+	for range w.Events() {
+		t.Fatalf("unexpected event")
+	}
+	if w.Err() != nil {
+		t.Fatalf("Err after cancel = %v", w.Err())
+	}
+}
+
+func TestWatchDropsLaggingWatcher(t *testing.T) {
+	n, err := OpenNode(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenNode: %v", err)
+	}
+	defer n.Close()
+
+	w := n.Watch(t.Context(), "")
+	for i := uint64(1); i <= watchBuffer+1; i++ {
+		if _, err := n.Exec(Command{Instruct: CmdPut, ClientID: "c1", Seq: i, Key: []byte("k"), Value: []byte("v")}); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+	}
+
+	got := 0
+	for range w.Events() {
+		got++
+	}
+	if got != watchBuffer || !errors.Is(w.Err(), ErrWatchLagging) {
+		t.Fatalf("got %d events and err %v, want %d and ErrWatchLagging", got, w.Err(), watchBuffer)
+	}
+}